@@ -14,8 +14,6 @@
 
 package raft
 
-import "time"
-
 type candidate struct {
 	*Raft
 	respCh      chan rpcResponse
@@ -44,9 +42,9 @@ func (c *candidate) startElection() {
 		println(c, "startElection")
 	}
 	d := c.rtime.duration(c.hbTimeout)
-	deadline := time.Now().Add(d)
+	deadline := c.clock.Now().Add(d)
 	c.timer.reset(d)
-	c.logger.Info("started election for term", c.term)
+	c.logger.Info("started election", "term", c.term)
 	if tracer.electionStarted != nil {
 		tracer.electionStarted(c.Raft)
 	}
@@ -78,7 +76,7 @@ func (c *candidate) onVoteResult(resp rpcResponse) {
 		println(c, resp)
 	}
 	if resp.err != nil {
-		c.logger.Warn("requestVote node", resp.from, ": "+trimPrefix(resp.err))
+		c.logger.Warn("requestVote failed", "term", c.term, "node", resp.from, "err", trimPrefix(resp.err))
 		return
 	}
 
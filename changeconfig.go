@@ -93,7 +93,7 @@ func (l *leader) beginFinishedRounds() {
 	for id, repl := range l.repls {
 		r := repl.status.round
 		if r != nil && r.finished() {
-			r.begin(l.lastLogIndex)
+			r.begin(l.clock.Now(), l.lastLogIndex)
 			if trace {
 				println(l, id, "started:", r)
 			}
@@ -158,7 +158,7 @@ func (l *leader) checkConfigAction(t *task, config Config, status *replicationSt
 	} else if status.round == nil {
 		// start first round
 		status.round = new(round)
-		status.round.begin(l.lastLogIndex)
+		status.round.begin(l.clock.Now(), l.lastLogIndex)
 		if trace {
 			println(l, status.id, "started:", status.round)
 		}
@@ -168,11 +168,11 @@ func (l *leader) checkConfigAction(t *task, config Config, status *replicationSt
 	if status.round != nil {
 		r := status.round
 		if !r.finished() && status.matchIndex >= r.LastIndex {
-			r.finish()
+			r.finish(l.clock.Now())
 			if trace {
 				println(l, status.id, "finished:", r)
 			}
-			l.logger.Info("nonVoter", status.id, "completed round", r.Ordinal, "in", r.Duration(), ", its lastIndex:", r.LastIndex)
+			l.logger.Info("nonvoter completed round", "node", status.id, "round", r.Ordinal, "duration", r.Duration(), "lastIndex", r.LastIndex)
 			if tracer.roundCompleted != nil {
 				tracer.roundCompleted(l.Raft, status.id, *r)
 			}
@@ -182,7 +182,7 @@ func (l *leader) checkConfigAction(t *task, config Config, status *replicationSt
 		}
 		hasNewEntries := l.lastLogIndex > status.matchIndex
 		if hasNewEntries && r.Duration() > l.promoteThreshold {
-			r.begin(l.lastLogIndex)
+			r.begin(l.clock.Now(), l.lastLogIndex)
 			if trace {
 				println(l, status.id, "started:", r)
 			}
@@ -200,24 +200,24 @@ func (l *leader) checkConfigAction(t *task, config Config, status *replicationSt
 	// perform configAction
 	switch action {
 	case Promote:
-		l.logger.Info("promoting nonvoter ", n.ID, ", after", status.round.Ordinal, "round(s)")
+		l.logger.Info("promoting nonvoter", "node", n.ID, "rounds", status.round.Ordinal)
 		config = config.clone()
 		n.Voter, n.Action = true, None
 		config.Nodes[n.ID] = n
 	case Remove:
 		if status.matchIndex >= l.configs.Latest.Index {
-			l.logger.Info("removing nonvoter", n.ID)
+			l.logger.Info("removing nonvoter", "node", n.ID)
 			config = config.clone()
 			delete(config.Nodes, n.ID)
 		} else {
 			return
 		}
 	case ForceRemove:
-		l.logger.Info("force removing node", n.ID)
+		l.logger.Info("force removing node", "node", n.ID)
 		config = config.clone()
 		delete(config.Nodes, n.ID)
 	case Demote:
-		l.logger.Info("demoting voter", n.ID)
+		l.logger.Info("demoting voter", "node", n.ID)
 		config = config.clone()
 		n.Voter = false
 		if n.Action == Demote {
@@ -255,10 +255,10 @@ type round struct {
 	LastIndex uint64
 }
 
-func (r *round) begin(lastIndex uint64) {
-	r.Ordinal, r.Start, r.LastIndex = r.Ordinal+1, time.Now(), lastIndex
+func (r *round) begin(now time.Time, lastIndex uint64) {
+	r.Ordinal, r.Start, r.LastIndex = r.Ordinal+1, now, lastIndex
 }
-func (r *round) finish()                { r.End = time.Now() }
+func (r *round) finish(now time.Time)   { r.End = now }
 func (r *round) finished() bool         { return !r.End.IsZero() }
 func (r round) Duration() time.Duration { return r.End.Sub(r.Start) }
 
@@ -16,54 +16,351 @@ package raft
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"math"
 	"net"
 	"strconv"
+	"sync"
 	"time"
 )
 
+const (
+	minRetryBackoff = 50 * time.Millisecond
+	maxRetryBackoff = time.Second
+	maxRedirects    = 5
+)
+
+var errNoLeader = temporaryError("raft: no leader")
+
 // Client is an RPC client used for performing admin tasks,
-// such as membership change, transfer leadership etc.
+// such as membership change, transfer leadership etc, and
+// for submitting FSM updates and reads from another process.
+//
+// Client is created with one or more seed addresses, and it learns
+// addresses of other nodes from the config reported by them. Tasks
+// which only leader can perform, such as ChangeConfig, are sent to
+// the current leader. Other tasks are sent to the first reachable
+// seed.
+//
+// The tasks failed with NotLeaderError, or any TemporaryError other
+// than TimeoutError, are retried with backoff until RetryTimeout. A
+// task whose request is sent, but response is not received because
+// of network failure, is retried only if it is idempotent.
+//
+// If the context is done before the task is completed, ContextError
+// is returned. ContextError.Unknown tells whether the request was sent
+// to any node.
 type Client struct {
-	addr string
+	// RetryTimeout is the maximum duration for which a task
+	// is retried. If zero, the task is not retried, except
+	// for redirecting to leader.
+	RetryTimeout time.Duration
+
 	dial dialFn
+
+	mu     sync.Mutex
+	addrs  []string // seeds, followed by learned addresses
+	leader string   // address of leader, empty if not known
 }
 
-// NewClient creates new client for given raft server.
-func NewClient(addr string) *Client {
-	return &Client{addr, net.DialTimeout}
+// NewClient creates new client for given raft servers.
+func NewClient(addrs ...string) *Client {
+	c := &Client{
+		RetryTimeout: 10 * time.Second,
+		dial:         net.DialTimeout,
+	}
+	for _, addr := range addrs {
+		c.addAddr(addr)
+	}
+	return c
+}
+
+// Addrs returns the addresses known to the client.
+func (c *Client) Addrs() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.addrs...)
+}
+
+func (c *Client) addAddr(addr string) {
+	if addr == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, a := range c.addrs {
+		if a == addr {
+			return
+		}
+	}
+	c.addrs = append(c.addrs, addr)
+}
+
+func (c *Client) learn(info Info) {
+	for _, n := range info.Configs.Latest.Nodes {
+		c.addAddr(n.Addr)
+	}
+}
+
+func (c *Client) getLeader() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.leader
+}
+
+func (c *Client) setLeader(addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.leader = addr
+}
+
+// unsetLeader forgets the leader, if it is still addr.
+func (c *Client) unsetLeader(addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.leader == addr {
+		c.leader = ""
+	}
 }
 
-func (c *Client) getConn() (*conn, error) {
-	netConn, err := c.dial("tcp", c.addr, 5*time.Second)
+// getConn dials addr. The deadline of ctx, if any, is applied
+// to dialing and to the returned connection.
+func (c *Client) getConn(ctx context.Context, addr string) (*conn, error) {
+	timeout := 5 * time.Second
+	deadline, ok := ctx.Deadline()
+	if ok {
+		if d := time.Until(deadline); d < timeout {
+			timeout = d
+		}
+	}
+	conn, err := dial(c.dial, addr, timeout)
 	if err != nil {
 		return nil, err
 	}
-	return &conn{
-		rwc:  netConn,
-		bufr: bufio.NewReader(netConn),
-		bufw: bufio.NewWriter(netConn),
-	}, nil
+	if ok {
+		if err = conn.rwc.SetDeadline(deadline); err != nil {
+			_ = conn.rwc.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
 }
 
-// GetInfo return Info containing raft current state.
-func (c *Client) GetInfo() (Info, error) {
-	conn, err := c.getConn()
+// clientTask describes how to perform a task on remote node.
+type clientTask struct {
+	typ    taskType
+	leader bool // only leader can perform
+	resend bool // idempotent, can be resent on network failure
+
+	// encodes request, excluding task type. can be nil.
+	req func(w *bufio.Writer) error
+
+	// decodes result, after successful response. if nil,
+	// decodeTaskResult is used.
+	resp func(r *bufio.Reader) (interface{}, error)
+}
+
+// netError wraps the error occurred in communicating
+// with remote node. sent tells whether the request
+// was sent when the error occurred.
+type netError struct {
+	error
+	sent bool
+}
+
+// tryTask performs t on node at addr once.
+func (c *Client) tryTask(ctx context.Context, addr string, t clientTask) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, netError{err, false}
+	}
+	conn, err := c.getConn(ctx, addr)
 	if err != nil {
-		return Info{}, err
+		return nil, netError{err, false}
 	}
 	defer conn.rwc.Close()
+	if ctx.Done() != nil {
+		// unblock pending i/o on cancel
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-ctx.Done():
+				_ = conn.rwc.Close()
+			case <-stop:
+			}
+		}()
+	}
 
-	if err = conn.bufw.WriteByte(byte(taskInfo)); err != nil {
-		return Info{}, err
+	if err = conn.bufw.WriteByte(byte(t.typ)); err != nil {
+		return nil, netError{err, false}
+	}
+	if t.req != nil {
+		if err = t.req(conn.bufw); err != nil {
+			return nil, netError{err, false}
+		}
 	}
 	if err = conn.bufw.Flush(); err != nil {
-		return Info{}, err
+		return nil, netError{err, true}
+	}
+	// conn is used for single task. closing write side makes
+	// server close conn after response, so that the fields
+	// which older server does not send are read as EOF
+	if cw, ok := conn.rwc.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+	}
+	taskErr, err := decodeTaskErr(conn.bufr)
+	if err != nil {
+		return nil, netError{err, true}
+	}
+	if taskErr != nil {
+		return nil, taskErr
+	}
+	var result interface{}
+	if t.resp != nil {
+		result, err = t.resp(conn.bufr)
+	} else {
+		result, err = decodeTaskResult(t.typ, conn.bufr)
 	}
-	result, err := decodeTaskResp(taskInfo, conn.bufr)
+	if err != nil {
+		return nil, netError{err, true}
+	}
+	if info, ok := result.(Info); ok {
+		c.learn(info)
+	}
+	return result, nil
+}
+
+// tryAddrs performs t on the first reachable node. Seeds
+// are tried first, followed by the learned addresses.
+func (c *Client) tryAddrs(ctx context.Context, t clientTask) (interface{}, error) {
+	err := error(netError{errors.New("raft: no address"), false})
+	for _, addr := range c.Addrs() {
+		var result interface{}
+		result, err = c.tryTask(ctx, addr, t)
+		if e, ok := err.(netError); ok && !e.sent {
+			continue
+		}
+		return result, err
+	}
+	return nil, err
+}
+
+// findLeader returns the address of the leader. If cluster is
+// not bootstrapped, it returns the address of a node which is
+// not bootstrapped, so that ChangeConfig bootstraps it.
+func (c *Client) findLeader(ctx context.Context) (string, error) {
+	if addr := c.getLeader(); addr != "" {
+		return addr, nil
+	}
+	err := error(netError{errors.New("raft: no address"), false})
+	reachable, bootstrap := false, ""
+	for _, addr := range c.Addrs() {
+		var result interface{}
+		if result, err = c.tryTask(ctx, addr, clientTask{typ: taskInfo}); err != nil {
+			continue
+		}
+		reachable = true
+		info := result.(Info)
+		if info.State == Leader {
+			c.setLeader(addr)
+			return addr, nil
+		}
+		if info.Leader != 0 {
+			if n, ok := info.Configs.Latest.Nodes[info.Leader]; ok && n.Addr != "" {
+				c.setLeader(n.Addr)
+				return n.Addr, nil
+			}
+		}
+		if bootstrap == "" && !info.Configs.IsBootstrapped() {
+			bootstrap = addr
+		}
+	}
+	if bootstrap != "" {
+		return bootstrap, nil
+	}
+	if reachable {
+		return "", errNoLeader
+	}
+	return "", err
+}
+
+// execute performs t, with redirects and retries.
+func (c *Client) execute(ctx context.Context, t clientTask) (interface{}, error) {
+	deadline := time.Now().Add(c.RetryTimeout)
+	backoff, redirects := minRetryBackoff, 0
+	hint := ""    // leader address from NotLeaderError
+	sent := false // whether request is sent, but response not received
+	for {
+		var result interface{}
+		var err error
+		addr := hint
+		if t.leader {
+			if addr == "" {
+				addr, err = c.findLeader(ctx)
+			}
+			if err == nil {
+				result, err = c.tryTask(ctx, addr, t)
+			}
+		} else {
+			result, err = c.tryAddrs(ctx, t)
+		}
+		hint = ""
+
+		switch e := err.(type) {
+		case nil:
+			return result, nil
+		case NotLeaderError:
+			c.unsetLeader(addr)
+			if e.Lost && !t.resend {
+				// task might have been committed by new leader
+				return nil, err
+			}
+			if e.Leader.Addr != "" && redirects < maxRedirects {
+				redirects++
+				c.addAddr(e.Leader.Addr)
+				hint = e.Leader.Addr
+				continue
+			}
+		case netError:
+			c.unsetLeader(addr)
+			sent = sent || e.sent
+			if ctx.Err() != nil {
+				return nil, ContextError{Err: ctx.Err(), Unknown: sent}
+			}
+			if e.sent && !t.resend {
+				return nil, e.error
+			}
+			err = e.error
+		case TimeoutError:
+			// task is performed, but did not complete in time
+			return nil, err
+		case TemporaryError:
+		default:
+			return nil, err
+		}
+
+		if time.Now().Add(backoff).After(deadline) {
+			return nil, err
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ContextError{Err: ctx.Err(), Unknown: sent}
+		case <-timer.C:
+		}
+		if backoff *= 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+// GetInfo return Info containing raft current state.
+func (c *Client) GetInfo(ctx context.Context) (Info, error) {
+	result, err := c.execute(ctx, clientTask{typ: taskInfo, resend: true})
 	if err != nil {
 		return Info{}, err
 	}
@@ -78,43 +375,31 @@ func (c *Client) GetInfo() (Info, error) {
 // So it is guaranteed that submitted config change is completed
 // in spite of leader change.
 //
+// If the cluster is not bootstrapped yet, the config is sent
+// to a seed node which is not bootstrapped, to bootstrap it.
+//
 // use WaitForStableConfig, in order to wait for the changes
 // submitted for completion.
-func (c *Client) ChangeConfig(config Config) error {
-	conn, err := c.getConn()
-	if err != nil {
-		return err
-	}
-	defer conn.rwc.Close()
-
-	if err = conn.bufw.WriteByte(byte(taskChangeConfig)); err != nil {
-		return err
-	}
-	_ = config.encode().encode(conn.bufw)
-	if err = conn.bufw.Flush(); err != nil {
-		return err
-	}
-	_, err = decodeTaskResp(taskChangeConfig, conn.bufr)
+func (c *Client) ChangeConfig(ctx context.Context, config Config) error {
+	_, err := c.execute(ctx, clientTask{
+		typ:    taskChangeConfig,
+		leader: true,
+		req: func(w *bufio.Writer) error {
+			return config.encode().encode(w)
+		},
+	})
 	return err
 }
 
 // WaitForStableConfig blocks the caller until all config changes are
 // completed. if there are no config changes left, this method returns
 // immediately.
-func (c *Client) WaitForStableConfig() (Config, error) {
-	conn, err := c.getConn()
-	if err != nil {
-		return Config{}, err
-	}
-	defer conn.rwc.Close()
-
-	if err = conn.bufw.WriteByte(byte(taskWaitForStableConfig)); err != nil {
-		return Config{}, err
-	}
-	if err = conn.bufw.Flush(); err != nil {
-		return Config{}, err
-	}
-	result, err := decodeTaskResp(taskWaitForStableConfig, conn.bufr)
+func (c *Client) WaitForStableConfig(ctx context.Context) (Config, error) {
+	result, err := c.execute(ctx, clientTask{
+		typ:    taskWaitForStableConfig,
+		leader: true,
+		resend: true,
+	})
 	if err != nil {
 		return Config{}, err
 	}
@@ -128,23 +413,13 @@ func (c *Client) WaitForStableConfig() (Config, error) {
 // ErrSnapshotThreshold: the threshold is not satisfied.
 // ErrNoUpdates: there are no edits since last snapshot.
 // InProgressError: if there is already another TakeSnapshot task is in progress.
-func (c *Client) TakeSnapshot(threshold uint64) (snapIndex uint64, err error) {
-	conn, err := c.getConn()
-	if err != nil {
-		return 0, err
-	}
-	defer conn.rwc.Close()
-
-	if err = conn.bufw.WriteByte(byte(taskTakeSnapshot)); err != nil {
-		return 0, err
-	}
-	if err = writeUint64(conn.bufw, threshold); err != nil {
-		return 0, err
-	}
-	if err = conn.bufw.Flush(); err != nil {
-		return 0, err
-	}
-	result, err := decodeTaskResp(taskTakeSnapshot, conn.bufr)
+func (c *Client) TakeSnapshot(ctx context.Context, threshold uint64) (snapIndex uint64, err error) {
+	result, err := c.execute(ctx, clientTask{
+		typ: taskTakeSnapshot,
+		req: func(w *bufio.Writer) error {
+			return writeUint64(w, threshold)
+		},
+	})
 	if err != nil {
 		return 0, err
 	}
@@ -163,27 +438,157 @@ func (c *Client) TakeSnapshot(threshold uint64) (snapIndex uint64, err error) {
 // ErrTransferTargetNonvoter: the target node is non-voter.
 // ErrTransferInvalidTarget: the target node does not exist.
 // ErrQuorumUnreachable: quorum of voters is unreachable resulting loss of leadership.
-func (c *Client) TransferLeadership(target uint64, timeout time.Duration) error {
-	conn, err := c.getConn()
+func (c *Client) TransferLeadership(ctx context.Context, target uint64, timeout time.Duration) error {
+	_, err := c.execute(ctx, clientTask{
+		typ:    taskTransferLdr,
+		leader: true,
+		req: func(w *bufio.Writer) error {
+			if err := writeUint64(w, target); err != nil {
+				return err
+			}
+			return writeUint64(w, uint64(timeout))
+		},
+	})
+	if err == nil {
+		c.setLeader("")
+	}
+	return err
+}
+
+// DownloadSnapshot writes the latest snapshot of the node into w, along
+// with its metadata and checksum. The checksum is verified before
+// returning. The data written can be used with RestoreSnapshot
+// to initialize storage of a new node. This does not take a new snapshot,
+// use TakeSnapshot before this to include recent updates.
+//
+// ErrNoSnapshot: the node has not taken any snapshot yet.
+func (c *Client) DownloadSnapshot(ctx context.Context, w io.Writer) (SnapshotInfo, error) {
+	result, err := c.execute(ctx, clientTask{
+		typ: taskDownloadSnapshot,
+		resp: func(r *bufio.Reader) (interface{}, error) {
+			meta, err := readSnapshotHeader(r)
+			if err != nil {
+				return nil, err
+			}
+			if err = writeSnapshotHeader(w, meta); err != nil {
+				return nil, err
+			}
+			sum, err := readSnapshotData(r, w, meta.size)
+			if err != nil {
+				return nil, err
+			}
+			if _, err = w.Write(sum); err != nil {
+				return nil, err
+			}
+			return meta, nil
+		},
+	})
 	if err != nil {
-		return err
+		return SnapshotInfo{}, err
 	}
-	defer conn.rwc.Close()
+	meta := result.(snapshotMeta)
+	return SnapshotInfo{Index: meta.index, Term: meta.term, Config: meta.config, Size: meta.size}, nil
+}
 
-	if err = conn.bufw.WriteByte(byte(taskTransferLdr)); err != nil {
-		return err
+// Update submits cmd to the leader, to be applied to FSM.
+// It returns the value returned by FSM.Update, encoded by the
+// Options.Codec of the leader.
+//
+// Update is not resent, if the connection fails after the
+// request is sent, because cmd might have been applied.
+//
+// ErrResultNotEncoded: cmd is applied, but its result could not be encoded.
+func (c *Client) Update(ctx context.Context, cmd []byte) ([]byte, error) {
+	result, err := c.execute(ctx, clientTask{
+		typ:    taskUpdateFSM,
+		leader: true,
+		req: func(w *bufio.Writer) error {
+			return writeBytes(w, cmd)
+		},
+	})
+	if err != nil {
+		return nil, err
 	}
-	if err = writeUint64(conn.bufw, target); err != nil {
-		return err
+	return result.([]byte), nil
+}
+
+// Read submits query to the leader for linearizable read of FSM.
+// The query is decoded by the Options.Codec of the leader, before
+// passing it to FSM.Read. It returns the value returned by FSM.Read,
+// encoded by the same codec.
+func (c *Client) Read(ctx context.Context, query []byte) ([]byte, error) {
+	result, err := c.execute(ctx, clientTask{
+		typ:    taskReadFSM,
+		leader: true,
+		resend: true,
+		req: func(w *bufio.Writer) error {
+			return writeBytes(w, query)
+		},
+	})
+	if err != nil {
+		return nil, err
 	}
-	if err = writeUint64(conn.bufw, uint64(timeout)); err != nil {
-		return err
+	return result.([]byte), nil
+}
+
+// Barrier blocks until all preceding updates submitted to the leader
+// are applied to its FSM.
+func (c *Client) Barrier(ctx context.Context) error {
+	_, err := c.execute(ctx, clientTask{
+		typ:    taskBarrierFSM,
+		leader: true,
+		resend: true,
+	})
+	return err
+}
+
+// OpenSession opens a new client session on the leader, that expires
+// if no update is applied within timeout. It returns the session id,
+// to be used with UpdateSession.
+func (c *Client) OpenSession(ctx context.Context, timeout time.Duration) (uint64, error) {
+	result, err := c.execute(ctx, clientTask{
+		typ:    taskOpenSession,
+		leader: true,
+		req: func(w *bufio.Writer) error {
+			return writeUint64(w, uint64(timeout))
+		},
+	})
+	if err != nil {
+		return 0, err
 	}
-	if err = conn.bufw.Flush(); err != nil {
-		return err
+	return result.(uint64), nil
+}
+
+// UpdateSession submits cmd to the leader, to be applied to FSM at most
+// once for given session id and seq. It returns the value returned by
+// FSM.Update, encoded by the Options.Codec of the leader.
+//
+// Unlike Update, it is resent if the connection fails after the request
+// is sent. If it fails with error, the update may or may not have been
+// applied; calling UpdateSession again with same seq returns the result
+// of the update, applying it if not already applied.
+//
+// ErrSessionExpired: the session is not open, or it is expired.
+// ErrDuplicateRequest: the seq is older than the last applied seq.
+func (c *Client) UpdateSession(ctx context.Context, id, seq uint64, cmd []byte) ([]byte, error) {
+	result, err := c.execute(ctx, clientTask{
+		typ:    taskUpdateSession,
+		leader: true,
+		resend: true,
+		req: func(w *bufio.Writer) error {
+			if err := writeUint64(w, id); err != nil {
+				return err
+			}
+			if err := writeUint64(w, seq); err != nil {
+				return err
+			}
+			return writeBytes(w, cmd)
+		},
+	})
+	if err != nil {
+		return nil, err
 	}
-	_, err = decodeTaskResp(taskTransferLdr, conn.bufr)
-	return err
+	return result.([]byte), nil
 }
 
 // ------------------------------------------------------------------------
@@ -196,50 +601,64 @@ const (
 	taskWaitForStableConfig
 	taskTakeSnapshot
 	taskTransferLdr
+	taskDownloadSnapshot
+	taskUpdateFSM
+	taskReadFSM
+	taskBarrierFSM
+	taskOpenSession
+	taskUpdateSession
 )
 
 func (t taskType) isValid() bool {
 	switch t {
-	case taskInfo, taskChangeConfig, taskWaitForStableConfig, taskTakeSnapshot, taskTransferLdr:
+	case taskInfo, taskChangeConfig, taskWaitForStableConfig, taskTakeSnapshot, taskTransferLdr, taskDownloadSnapshot:
+		return true
+	case taskUpdateFSM, taskReadFSM, taskBarrierFSM, taskOpenSession, taskUpdateSession:
 		return true
 	}
 	return false
 }
 
-func decodeTaskResp(typ taskType, r io.Reader) (interface{}, error) {
+// decodeTaskErr decodes the error reported by the task.
+// err is non-nil, if it failed to decode.
+func decodeTaskErr(r io.Reader) (taskErr error, err error) {
 	errType, err := readString(r)
-	if err != nil {
+	if err != nil || errType == "" {
 		return nil, err
 	}
-	if errType != "" {
+	switch errType {
+	case "raft.NotLeaderError":
+		node := Node{}
+		if err := node.decode(r); err != nil {
+			return nil, err
+		}
+		lost, err := readBool(r)
+		if err != nil {
+			return nil, err
+		}
+		return NotLeaderError{node, lost}, nil
+	default:
+		s, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
 		switch errType {
-		case "raft.NotLeaderError":
-			node := Node{}
-			if err := node.decode(r); err != nil {
-				return nil, err
-			}
-			lost, err := readBool(r)
-			if err != nil {
-				return nil, err
-			}
-			return nil, NotLeaderError{node, lost}
+		case "raft.plainError":
+			return plainError(s), nil
+		case "raft.temporaryError":
+			return temporaryError(s), nil
+		case "raft.InProgressError":
+			return InProgressError(s), nil
+		case "raft.TimeoutError":
+			return TimeoutError(s), nil
 		default:
-			s, err := readString(r)
-			if err != nil {
-				return nil, err
-			}
-			switch errType {
-			case "raft.plainError":
-				return nil, plainError(s)
-			case "raft.temporaryError":
-				return nil, temporaryError(s)
-			case "raft.InProgressError":
-				return nil, InProgressError(s)
-			default:
-				return nil, errors.New(s)
-			}
+			return errors.New(s), nil
 		}
 	}
+}
+
+func decodeTaskResult(typ taskType, r io.Reader) (interface{}, error) {
+	var err error
 	switch typ {
 	case taskInfo:
 		info := Info{}
@@ -255,10 +674,14 @@ func decodeTaskResp(typ taskType, r io.Reader) (interface{}, error) {
 			return nil, err
 		}
 		return config, nil
-	case taskChangeConfig, taskTransferLdr:
+	case taskChangeConfig, taskTransferLdr, taskBarrierFSM:
 		return nil, nil
-	case taskTakeSnapshot:
+	case taskTakeSnapshot, taskOpenSession:
 		return readUint64(r)
+	case taskDownloadSnapshot:
+		return readSnapshotHeader(r)
+	case taskUpdateFSM, taskReadFSM, taskUpdateSession:
+		return readBytes(r)
 	}
 	return nil, errors.New("invalidTaskType")
 }
@@ -274,6 +697,10 @@ func encodeTaskResp(t Task, w io.Writer) error {
 				return err
 			}
 			return writeBool(w, err.Lost)
+		case InProgressError:
+			return writeString(w, string(err))
+		case TimeoutError:
+			return writeString(w, string(err))
 		default:
 			return writeString(w, err.Error())
 		}
@@ -286,6 +713,8 @@ func encodeTaskResp(t Task, w io.Writer) error {
 		return nil
 	case uint64:
 		return writeUint64(w, r)
+	case []byte:
+		return writeBytes(w, r)
 	case Config:
 		return r.encode().encode(w)
 	case Info:
@@ -299,6 +728,24 @@ func (s State) MarshalJSON() ([]byte, error) {
 	return []byte(strconv.Quote(s.String())), nil
 }
 
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (s *State) UnmarshalJSON(data []byte) error {
+	if len(data) < 2 || data[0] != '"' {
+		return errors.New("state must be json string")
+	}
+	str, err := strconv.Unquote(string(data))
+	if err != nil {
+		return err
+	}
+	for _, st := range []State{Follower, Candidate, Leader} {
+		if st.String() == str {
+			*s = st
+			return nil
+		}
+	}
+	return fmt.Errorf("%q is not a valid state", str)
+}
+
 // MarshalJSON implements the json.Marshaler interface.
 func (a Action) MarshalJSON() ([]byte, error) {
 	return []byte(strconv.Quote(a.String())), nil
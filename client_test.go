@@ -15,8 +15,18 @@
 package raft
 
 import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"reflect"
+	"strconv"
 	"testing"
+	"time"
+
+	"github.com/santhosh-tekuri/raft/vfs"
 )
 
 func TestClient_GetInfo(t *testing.T) {
@@ -29,7 +39,7 @@ func TestClient_GetInfo(t *testing.T) {
 		want := c.info(r)
 		client := NewClient(c.id2Addr(r.nid))
 		client.dial = r.dialFn
-		got, err := client.GetInfo()
+		got, err := client.GetInfo(context.Background())
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -50,7 +60,7 @@ func TestClient_TakeSnapshot(t *testing.T) {
 
 	client := NewClient(c.id2Addr(ldr.nid))
 	client.dial = ldr.dialFn
-	snapIndex, err := client.TakeSnapshot(0)
+	snapIndex, err := client.TakeSnapshot(context.Background(), 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -61,7 +71,7 @@ func TestClient_TakeSnapshot(t *testing.T) {
 		t.Fatalf("info.snapshotIndex=%d", info.SnapshotIndex)
 	}
 
-	if _, err := client.TakeSnapshot(0); err != ErrNoUpdates {
+	if _, err := client.TakeSnapshot(context.Background(), 0); err != ErrNoUpdates {
 		t.Fatalf("got %v, want %v", err, ErrNoUpdates)
 	}
 }
@@ -72,13 +82,13 @@ func TestClient_TransferLeadership(t *testing.T) {
 
 	client := NewClient(c.id2Addr(ldr.nid))
 	client.dial = ldr.dialFn
-	if err := client.TransferLeadership(7, c.longTimeout); err != ErrTransferInvalidTarget {
+	if err := client.TransferLeadership(context.Background(), 7, c.longTimeout); err != ErrTransferInvalidTarget {
 		t.Fatalf("got %v, want %v", err, ErrTransferInvalidTarget)
 	}
-	if err := client.TransferLeadership(ldr.nid, c.longTimeout); err != ErrTransferSelf {
+	if err := client.TransferLeadership(context.Background(), ldr.nid, c.longTimeout); err != ErrTransferSelf {
 		t.Fatalf("got %v, want %v", err, ErrTransferSelf)
 	}
-	if err := client.TransferLeadership(flrs[0].nid, c.longTimeout); err != nil {
+	if err := client.TransferLeadership(context.Background(), flrs[0].nid, c.longTimeout); err != nil {
 		t.Fatal(err)
 	}
 	newLdr := c.waitForLeader()
@@ -86,3 +96,225 @@ func TestClient_TransferLeadership(t *testing.T) {
 		t.Fatalf("newLdr=%d, want %d", newLdr.nid, flrs[0].nid)
 	}
 }
+
+func TestClient_DownloadSnapshot(t *testing.T) {
+	c, ldr, _ := launchCluster(t, 1)
+	defer c.shutdown()
+
+	client := NewClient(c.id2Addr(ldr.nid))
+	client.dial = ldr.dialFn
+	buf := new(bytes.Buffer)
+	if _, err := client.DownloadSnapshot(context.Background(), buf); err != ErrNoSnapshot {
+		t.Fatalf("got %v, want %v", err, ErrNoSnapshot)
+	}
+
+	c.sendUpdates(ldr, 1, 10)
+	c.waitFSMLen(10)
+	c.takeSnapshot(ldr, 0, nil)
+	info, err := client.DownloadSnapshot(context.Background(), buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapIndex := c.info(ldr).SnapshotIndex; info.Index != snapIndex {
+		t.Fatalf("snapIndex=%d, want %d", info.Index, snapIndex)
+	}
+	snap := buf.Bytes()
+
+	// corrupted snapshot must not be restored
+	corrupt := append([]byte(nil), snap...)
+	corrupt[len(corrupt)-md5.Size-1]++
+	dir, err := ioutil.TempDir(tempDir, "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = RestoreSnapshot(c.opt, dir, c.id, 1, Config{}, bytes.NewReader(corrupt)); err == nil {
+		t.Fatal("restore of corrupted snapshot must fail")
+	}
+
+	// restore into in-memory filesystem
+	mem := vfs.NewMem(1)
+	if err = mem.MkdirAll("/storage", 0700); err != nil {
+		t.Fatal(err)
+	}
+	opt := c.opt
+	opt.FS = mem
+	if _, err = RestoreSnapshot(opt, "/storage", c.id, 1, Config{}, bytes.NewReader(snap)); err != nil {
+		t.Fatal(err)
+	}
+	if matches, _ := mem.Glob("/storage/*.id"); len(matches) != 1 {
+		t.Fatalf("identity files: got %v", matches)
+	}
+
+	// restore in new cluster with 3 nodes
+	c2 := newCluster(t)
+	defer c2.shutdown()
+	config := Config{Nodes: make(map[uint64]Node)}
+	for id := uint64(1); id <= 3; id++ {
+		if err := config.AddVoter(id, c2.id2Addr(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for id := uint64(1); id <= 3; id++ {
+		dir, err := ioutil.TempDir(tempDir, "storage")
+		if err != nil {
+			t.Fatal(err)
+		}
+		restored, err := RestoreSnapshot(c2.opt, dir, c2.id, id, config, bytes.NewReader(snap))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if restored.Index != info.Index || len(restored.Nodes) != 3 {
+			t.Fatalf("restored config: %v", restored)
+		}
+		if _, err = RestoreSnapshot(c2.opt, dir, c2.id, id, config, bytes.NewReader(snap)); err == nil {
+			t.Fatal("restore into non-empty storage must fail")
+		}
+		c2.launchStorage(id, dir)
+	}
+	ldr2 := c2.waitForHealthy()
+	c2.waitFSMLen(10)
+	c2.sendUpdates(ldr2, 11, 20)
+	c2.waitFSMLen(20)
+	if got := c2.info(ldr2).CID; got != c2.id {
+		t.Fatalf("cid=%d, want %d", got, c2.id)
+	}
+}
+
+func TestClient_LeaderDiscovery(t *testing.T) {
+	c, ldr, flrs := launchCluster(t, 3)
+	defer c.shutdown()
+
+	// first seed is unreachable, second seed is follower
+	client := NewClient(c.id2Addr(9), c.id2Addr(flrs[0].nid))
+	client.dial = flrs[0].dialFn
+	if err := client.TransferLeadership(context.Background(), flrs[1].nid, c.longTimeout); err != nil {
+		t.Fatal(err)
+	}
+	if newLdr := c.waitForLeader(); newLdr != flrs[1] {
+		t.Fatalf("newLdr=%d, want %d", newLdr.nid, flrs[1].nid)
+	}
+	for _, r := range c.rr {
+		found := false
+		for _, addr := range client.Addrs() {
+			found = found || addr == c.id2Addr(r.nid)
+		}
+		if !found {
+			t.Fatalf("addrs=%v, does not contain M%d", client.Addrs(), r.nid)
+		}
+	}
+
+	// leader is lost, must retry until new leader is elected
+	c.shutdown(flrs[1])
+	config, err := client.WaitForStableConfig(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Nodes) != 3 {
+		t.Fatalf("config.nodes=%v", config.Nodes)
+	}
+	if newLdr := c.waitForLeader(ldr, flrs[0]); newLdr == flrs[1] {
+		t.Fatalf("newLdr=%d", newLdr.nid)
+	}
+
+	// all seeds are down, must use learned address
+	c.shutdown(flrs[0])
+	info, err := client.GetInfo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.NID != ldr.nid {
+		t.Fatalf("info.nid=%d, want %d", info.NID, ldr.nid)
+	}
+}
+
+type fsmMockCodec struct{}
+
+func (fsmMockCodec) DecodeRead(query []byte) (interface{}, error) {
+	if string(query) == "last" {
+		return "last", nil
+	}
+	return strconv.Atoi(string(query))
+}
+
+func (fsmMockCodec) EncodeResult(v interface{}) ([]byte, error) {
+	if v.(fsmReply).msg == "noencode" {
+		return nil, errors.New("cannot encode")
+	}
+	return []byte(fmt.Sprintf("%s:%d", v.(fsmReply).msg, v.(fsmReply).index)), nil
+}
+
+func TestClient_FSMTasks(t *testing.T) {
+	c := newCluster(t)
+	c.opt.Codec = fsmMockCodec{}
+	ldr, flrs := c.ensureLaunch(3)
+	defer c.shutdown()
+
+	// submitted to follower, must be redirected to leader
+	client := NewClient(c.id2Addr(flrs[0].nid))
+	client.dial = flrs[0].dialFn
+	if _, err := client.Read(context.Background(), []byte("last")); err == nil || err.Error() != errNoCommands.Error() {
+		t.Fatalf("got %v, want %v", err, errNoCommands)
+	}
+	for i := 1; i <= 10; i++ {
+		result, err := client.Update(context.Background(), []byte(fmt.Sprintf("update:%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("update:%d:%d", i, i); string(result) != want {
+			t.Fatalf("result=%q, want %q", result, want)
+		}
+	}
+	if err := client.Barrier(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := fsm(ldr).len(); got != 10 {
+		t.Fatalf("fsm.len=%d, want %d", got, 10)
+	}
+	result, err := client.Read(context.Background(), []byte("3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "update:4:3"; string(result) != want {
+		t.Fatalf("result=%q, want %q", result, want)
+	}
+	if _, err := client.Read(context.Background(), []byte("x")); err == nil {
+		t.Fatal("error expected for invalid query")
+	}
+
+	// result not encoded, but update is applied
+	if _, err := client.Update(context.Background(), []byte("noencode")); err != ErrResultNotEncoded {
+		t.Fatalf("got %v, want %v", err, ErrResultNotEncoded)
+	}
+	if got := fsm(ldr).len(); got != 11 {
+		t.Fatalf("fsm.len=%d, want %d", got, 11)
+	}
+}
+
+func TestClient_Context(t *testing.T) {
+	c, ldr, _ := launchCluster(t, 1)
+	defer c.shutdown()
+
+	client := NewClient(c.id2Addr(ldr.nid))
+	client.dial = ldr.dialFn
+
+	// request is not sent
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := client.Update(ctx, []byte("test")); err != (ContextError{Err: context.Canceled}) {
+		t.Fatalf("got %v, want %v", err, ContextError{Err: context.Canceled})
+	}
+	c.waitBarrier(ldr, c.longTimeout)
+	if fsm(ldr).len() != 0 {
+		t.Fatal("update must not be applied")
+	}
+
+	// unreachable seed, retried until deadline
+	client = NewClient(c.id2Addr(9))
+	client.dial = ldr.dialFn
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err := client.GetInfo(ctx)
+	if err, ok := err.(ContextError); !ok || err.Err != context.DeadlineExceeded || err.Unknown {
+		t.Fatalf("got %#v, want ContextError", err)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import "time"
+
+// Clock provides current time and timers to raft. All timeouts,
+// deadlines and timestamps used by raft are derived from Clock.
+//
+// The default is system clock. A simulated clock, such as the one
+// in package sim, can be used to run raft in virtual time.
+// Implementations must be safe for concurrent use.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// NewTimer creates a new Timer, that sends the current
+	// time on its channel after at least duration d.
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is the interface of time.Timer, returned by Clock.
+type Timer interface {
+	// C returns the channel on which the time is delivered.
+	// It must return the same channel, for the lifetime of Timer.
+	C() <-chan time.Time
+
+	// Stop prevents the Timer from firing. It returns false
+	// if the timer has already expired or been stopped.
+	Stop() bool
+
+	// Reset changes the timer to expire after duration d.
+	// It returns true if the timer had been active.
+	Reset(d time.Duration) bool
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+type systemTimer struct {
+	*time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
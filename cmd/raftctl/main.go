@@ -16,10 +16,12 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -28,12 +30,24 @@ import (
 )
 
 func main() {
+	// commands that do not talk to RAFT_ADDR
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "watch":
+			watch(os.Args[2:])
+			return
+		case "storage":
+			storage(os.Args[2:])
+			return
+		}
+	}
 	addr, ok := os.LookupEnv("RAFT_ADDR")
 	if !ok {
 		errln("RAFT_ADDR environment variable not set")
 		os.Exit(1)
 	}
-	exec(raft.NewClient(addr), os.Args[1:])
+	// RAFT_ADDR can be comma separated list of addresses
+	exec(raft.NewClient(strings.Split(addr, ",")...), os.Args[1:])
 }
 
 func exec(c *raft.Client, args []string) {
@@ -44,8 +58,10 @@ func exec(c *raft.Client, args []string) {
 		errln("  info       get information")
 		errln("  leader     get leader details")
 		errln("  config     configuration related tasks")
-		errln("  snapshot   take snapshot")
+		errln("  snapshot   take or download snapshot")
 		errln("  transfer   transfer leadership")
+		errln("  watch      watch changes in cluster status")
+		errln("  storage    inspect storage of stopped node")
 	}
 	if len(args) == 0 {
 		printUsage()
@@ -71,7 +87,7 @@ func exec(c *raft.Client, args []string) {
 }
 
 func info(c *raft.Client) {
-	info, err := c.GetInfo()
+	info, err := c.GetInfo(context.Background())
 	if err != nil {
 		errln(err.Error())
 		os.Exit(1)
@@ -92,7 +108,7 @@ func info(c *raft.Client) {
 }
 
 func leader(c *raft.Client) {
-	info, err := c.GetInfo()
+	info, err := c.GetInfo(context.Background())
 	if err != nil {
 		errln(err.Error())
 		os.Exit(1)
@@ -172,7 +188,7 @@ func config(c *raft.Client, args []string) {
 }
 
 func getConfig(c *raft.Client) {
-	info, err := c.GetInfo()
+	info, err := c.GetInfo(context.Background())
 	if err != nil {
 		errln(err.Error())
 		os.Exit(1)
@@ -214,7 +230,7 @@ func setConfig(c *raft.Client, args []string) {
 		config.Nodes[id] = n
 	}
 
-	if err = c.ChangeConfig(config); err != nil {
+	if err = c.ChangeConfig(context.Background(), config); err != nil {
 		errln(err.Error())
 		os.Exit(1)
 	}
@@ -237,7 +253,7 @@ func applyConfig(c *raft.Client, args []string) {
 		errln("clear-action    nid=2,action=none")
 		os.Exit(1)
 	}
-	info, err := c.GetInfo()
+	info, err := c.GetInfo(context.Background())
 	if err != nil {
 		errln(err.Error())
 		os.Exit(1)
@@ -321,14 +337,14 @@ func applyConfig(c *raft.Client, args []string) {
 		}
 		config.Nodes[uint64(nid)] = n
 	}
-	if err = c.ChangeConfig(config); err != nil {
+	if err = c.ChangeConfig(context.Background(), config); err != nil {
 		errln(err.Error())
 		os.Exit(1)
 	}
 }
 
 func waitConfig(c *raft.Client) {
-	config, err := c.WaitForStableConfig()
+	config, err := c.WaitForStableConfig(context.Background())
 	if err != nil {
 		errln(err.Error())
 		os.Exit(1)
@@ -365,7 +381,7 @@ func addNode(c *raft.Client, args []string) {
 		}
 		promote = true
 	}
-	info, err := c.GetInfo()
+	info, err := c.GetInfo(context.Background())
 	if err != nil {
 		errln(err.Error())
 		os.Exit(1)
@@ -386,7 +402,7 @@ func addNode(c *raft.Client, args []string) {
 		errln(err.Error())
 		os.Exit(1)
 	}
-	if err = c.ChangeConfig(config); err != nil {
+	if err = c.ChangeConfig(context.Background(), config); err != nil {
 		errln(err.Error())
 		os.Exit(1)
 	}
@@ -402,7 +418,7 @@ func configAction(c *raft.Client, action raft.Action, args []string) {
 		errln(err.Error())
 		os.Exit(1)
 	}
-	info, err := c.GetInfo()
+	info, err := c.GetInfo(context.Background())
 	if err != nil {
 		errln(err.Error())
 		os.Exit(1)
@@ -412,7 +428,7 @@ func configAction(c *raft.Client, action raft.Action, args []string) {
 		errln(err.Error())
 		os.Exit(1)
 	}
-	if err = c.ChangeConfig(config); err != nil {
+	if err = c.ChangeConfig(context.Background(), config); err != nil {
 		errln(err.Error())
 		os.Exit(1)
 	}
@@ -423,7 +439,7 @@ func changeAddr(c *raft.Client, args []string) {
 		errln("usage: raftctl config addr <nid>=<addr> ...")
 		os.Exit(1)
 	}
-	info, err := c.GetInfo()
+	info, err := c.GetInfo(context.Background())
 	if err != nil {
 		errln(err.Error())
 		os.Exit(1)
@@ -446,7 +462,7 @@ func changeAddr(c *raft.Client, args []string) {
 			os.Exit(1)
 		}
 	}
-	if err = c.ChangeConfig(config); err != nil {
+	if err = c.ChangeConfig(context.Background(), config); err != nil {
 		errln(err.Error())
 		os.Exit(1)
 	}
@@ -457,7 +473,7 @@ func changeData(c *raft.Client, args []string) {
 		errln("usage: raftctl config data <nid>=<data> ...")
 		os.Exit(1)
 	}
-	info, err := c.GetInfo()
+	info, err := c.GetInfo(context.Background())
 	if err != nil {
 		errln(err.Error())
 		os.Exit(1)
@@ -480,15 +496,20 @@ func changeData(c *raft.Client, args []string) {
 			os.Exit(1)
 		}
 	}
-	if err = c.ChangeConfig(config); err != nil {
+	if err = c.ChangeConfig(context.Background(), config); err != nil {
 		errln(err.Error())
 		os.Exit(1)
 	}
 }
 
 func snapshot(c *raft.Client, args []string) {
+	if len(args) == 2 && args[0] == "download" {
+		downloadSnapshot(c, args[1])
+		return
+	}
 	if len(args) != 1 {
 		errln("usage: raftctl snapshot <threshold>")
+		errln("       raftctl snapshot download <file>")
 		os.Exit(1)
 	}
 	i, err := strconv.ParseInt(args[0], 10, 64)
@@ -496,7 +517,7 @@ func snapshot(c *raft.Client, args []string) {
 		errln(err.Error())
 		os.Exit(1)
 	}
-	snapIndex, err := c.TakeSnapshot(uint64(i))
+	snapIndex, err := c.TakeSnapshot(context.Background(), uint64(i))
 	if err != nil {
 		errln(err.Error())
 		os.Exit(1)
@@ -504,6 +525,32 @@ func snapshot(c *raft.Client, args []string) {
 	fmt.Println("snapshot index:", snapIndex)
 }
 
+func downloadSnapshot(c *raft.Client, file string) {
+	f, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".*.tmp")
+	if err != nil {
+		errln(err.Error())
+		os.Exit(1)
+	}
+	info, err := c.DownloadSnapshot(context.Background(), f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), file)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		errln(err.Error())
+		os.Exit(1)
+	}
+	fmt.Println("snapshot index:", info.Index)
+	fmt.Println("snapshot term:", info.Term)
+	fmt.Println("snapshot size:", info.Size)
+}
+
 func transfer(c *raft.Client, args []string) {
 	if len(args) != 2 {
 		errln("usage: raftctl transfer <target> <timeout>")
@@ -519,7 +566,7 @@ func transfer(c *raft.Client, args []string) {
 		errln(err.Error())
 		os.Exit(1)
 	}
-	err = c.TransferLeadership(uint64(nid), d)
+	err = c.TransferLeadership(context.Background(), uint64(nid), d)
 	if err != nil {
 		errln(err.Error())
 		os.Exit(1)
@@ -0,0 +1,355 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/santhosh-tekuri/raft"
+)
+
+func storage(args []string) {
+	flags := flag.NewFlagSet("storage", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	keysFile := flags.String("keys", "", "")
+	printUsage := func() {
+		errln("usage: raftctl storage [-keys keys-file] <command> <storage-dir> [options]")
+		errln()
+		errln("works on storage directory of a node which is not running.")
+		errln("storage directory is never modified, except by recover and restore.")
+		errln()
+		errln("options:")
+		errln("  -keys keys-file  json file with encryption keys of storage, as")
+		errln(`                   {"current": 2, "keys": {"1": "<base64>", "2": "<base64>"}}`)
+		errln()
+		errln("list of commands:")
+		errln("  identity    prints identity and term")
+		errln("  segments    lists log segments")
+		errln("  entries     dumps log entries")
+		errln("  snapshots   lists snapshots")
+		errln("  verify      verifies consistency")
+		errln("  recover     forcibly replaces config, when quorum is lost")
+		errln("  restore     initializes fresh storage from snapshot file")
+	}
+	if err := flags.Parse(args); err != nil {
+		if err != flag.ErrHelp {
+			errln(err.Error())
+		}
+		printUsage()
+		os.Exit(1)
+	}
+	args = flags.Args()
+	if len(args) < 2 {
+		printUsage()
+		os.Exit(1)
+	}
+	opt := raft.DefaultOptions()
+	opt.Logger = nil
+	if *keysFile != "" {
+		keys, err := readKeys(*keysFile)
+		if err != nil {
+			errln(err.Error())
+			os.Exit(1)
+		}
+		opt.Keys = keys
+	}
+	cmd, dir, args := args[0], args[1], args[2:]
+	switch cmd {
+	case "identity":
+		storageIdentity(opt, dir)
+	case "segments":
+		storageSegments(opt, dir)
+	case "entries":
+		storageEntries(opt, dir, args)
+	case "snapshots":
+		storageSnapshots(opt, dir)
+	case "verify":
+		storageVerify(opt, dir)
+	case "recover":
+		storageRecover(opt, dir, args)
+	case "restore":
+		storageRestore(opt, dir, args)
+	default:
+		errln("unknown storage command:", cmd)
+		printUsage()
+		os.Exit(1)
+	}
+}
+
+// keyFile is KeyProvider, whose keys are read from json file.
+type keyFile struct {
+	Current uint32            `json:"current"`
+	Keys    map[uint32][]byte `json:"keys"`
+}
+
+func readKeys(file string) (*keyFile, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	k := &keyFile{}
+	if err = json.Unmarshal(b, k); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return k, nil
+}
+
+func (k *keyFile) CurrentKey() (uint32, []byte, error) {
+	key, err := k.Key(k.Current)
+	return k.Current, key, err
+}
+
+func (k *keyFile) Key(id uint32) ([]byte, error) {
+	key, ok := k.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("key %d not found in keys file", id)
+	}
+	return key, nil
+}
+
+func readStorage(opt raft.Options, dir string) raft.StorageInfo {
+	info, err := raft.ReadStorage(opt, dir)
+	if err != nil {
+		errln(err.Error())
+		os.Exit(1)
+	}
+	if info.Locked {
+		errln("warning: storage is locked, node might be running")
+	}
+	return info
+}
+
+func storageIdentity(opt raft.Options, dir string) {
+	info := readStorage(opt, dir)
+	printJSON(struct {
+		CID      uint64 `json:"cid"`
+		NID      uint64 `json:"nid"`
+		Term     uint64 `json:"term"`
+		VotedFor uint64 `json:"votedFor"`
+	}{info.CID, info.NID, info.Term, info.VotedFor})
+}
+
+func storageSegments(opt raft.Options, dir string) {
+	info := readStorage(opt, dir)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "FILE\tFIRST\tLAST\tCOUNT\tUSED\tSIZE\t")
+	for _, s := range info.Segments {
+		file := filepath.Base(s.File)
+		if s.Dangling {
+			_, _ = fmt.Fprintf(w, "%s (dangling)\t-\t-\t-\t-\t-\t\n", file)
+			continue
+		}
+		first := "-"
+		if s.Count > 0 {
+			first = strconv.FormatUint(s.PrevIndex+1, 10)
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\t\n", file, first, s.LastIndex(), s.Count, s.DataSize, s.FileSize)
+	}
+	_ = w.Flush()
+}
+
+func storageEntries(opt raft.Options, dir string, args []string) {
+	if len(args) > 2 {
+		errln("usage: raftctl storage entries <storage-dir> [<from> [<to>]]")
+		os.Exit(1)
+	}
+	from, to := uint64(0), ^uint64(0)
+	if len(args) > 0 {
+		i, err := strconv.ParseUint(args[0], 10, 64)
+		if err != nil {
+			errln(err.Error())
+			os.Exit(1)
+		}
+		from = i
+	}
+	if len(args) > 1 {
+		i, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			errln(err.Error())
+			os.Exit(1)
+		}
+		to = i
+	}
+	readStorage(opt, dir)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "INDEX\tTERM\tTYPE\tSIZE\tCONFIG\t")
+	err := raft.ReadEntries(opt, dir, func(e raft.Entry) error {
+		if e.Index < from || e.Index > to {
+			return nil
+		}
+		config := ""
+		if e.Config != nil {
+			b, err := json.Marshal(e.Config.Nodes)
+			if err != nil {
+				return err
+			}
+			config = string(b)
+		}
+		_, _ = fmt.Fprintf(w, "%d\t%d\t%s\t%d\t%s\t\n", e.Index, e.Term, e.Type, e.Size, config)
+		return nil
+	})
+	_ = w.Flush()
+	if err != nil {
+		errln(err.Error())
+		os.Exit(1)
+	}
+}
+
+func storageSnapshots(opt raft.Options, dir string) {
+	info := readStorage(opt, dir)
+	if info.Snapshots == nil {
+		info.Snapshots = []raft.SnapshotInfo{}
+	}
+	printJSON(info.Snapshots)
+}
+
+func storageVerify(opt raft.Options, dir string) {
+	problems, err := raft.VerifyStorage(opt, dir)
+	if err != nil {
+		errln(err.Error())
+		os.Exit(1)
+	}
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+	fmt.Println("ok")
+}
+
+func storageRecover(opt raft.Options, dir string, args []string) {
+	force := len(args) > 0 && args[0] == "-force"
+	if force {
+		args = args[1:]
+	}
+	if len(args) != 3 {
+		errln("usage: raftctl storage recover <storage-dir> [-force] <config-file> <term> <reason>")
+		errln()
+		errln("forcibly replaces the config of a stopped node. use this only when")
+		errln("quorum of voters is permanently lost. run it only on the surviving")
+		errln("node with most up-to-date log. term must be greater than the term and")
+		errln("last entry's term of every surviving node. wipe the storage of other")
+		errln("surviving nodes, retaining identity, before starting them.")
+		os.Exit(1)
+	}
+	b, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		errln(err.Error())
+		os.Exit(1)
+	}
+	config := raft.Config{}
+	if err = json.Unmarshal(b, &config); err != nil {
+		errln(err.Error())
+		os.Exit(1)
+	}
+	term, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		errln(err.Error())
+		os.Exit(1)
+	}
+	reason := args[2]
+
+	errln("WARNING: this bypasses raft safety guarantees.")
+	errln("  - entries committed only on the lost voters are lost forever")
+	errln("  - if lost voters come back with their old storage, the cluster")
+	errln("    may have two leaders and committed entries may be lost")
+	errln("  - lost voters must be wiped, before they join the cluster again")
+	errln("  - other surviving nodes must be wiped, before they are started")
+	if !force {
+		errln()
+		_, _ = fmt.Fprint(os.Stderr, "type 'recover' to continue: ")
+		var answer string
+		_, _ = fmt.Scanln(&answer)
+		if answer != "recover" {
+			errln("aborted")
+			os.Exit(1)
+		}
+	}
+
+	config, err = raft.RecoverConfig(opt, dir, config, term, reason)
+	if err != nil {
+		errln(err.Error())
+		os.Exit(1)
+	}
+	errln("config recovered. audit record appended to", filepath.Join(dir, "recovery.log"))
+	printJSON(config)
+}
+
+func storageRestore(opt raft.Options, dir string, args []string) {
+	if len(args) != 3 && len(args) != 4 {
+		errln("usage: raftctl storage restore <storage-dir> <snapshot-file> <cid> <nid> [<config-file>]")
+		errln()
+		errln("snapshot-file is the file saved by 'raftctl snapshot download'.")
+		errln("if config-file is not given, config from snapshot is used.")
+		errln("restore same snapshot with same config on each node of new cluster.")
+		os.Exit(1)
+	}
+	cid, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		errln(err.Error())
+		os.Exit(1)
+	}
+	nid, err := strconv.ParseUint(args[2], 10, 64)
+	if err != nil {
+		errln(err.Error())
+		os.Exit(1)
+	}
+	config := raft.Config{}
+	if len(args) == 4 {
+		b, err := ioutil.ReadFile(args[3])
+		if err != nil {
+			errln(err.Error())
+			os.Exit(1)
+		}
+		if err = json.Unmarshal(b, &config); err != nil {
+			errln(err.Error())
+			os.Exit(1)
+		}
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		errln(err.Error())
+		os.Exit(1)
+	}
+	defer f.Close()
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		errln(err.Error())
+		os.Exit(1)
+	}
+	config, err = raft.RestoreSnapshot(opt, dir, cid, nid, config, bufio.NewReader(f))
+	if err != nil {
+		errln(err.Error())
+		os.Exit(1)
+	}
+	printJSON(config)
+}
+
+func printJSON(v interface{}) {
+	b, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		errln(err.Error())
+		os.Exit(1)
+	}
+	fmt.Println(string(b))
+}
@@ -0,0 +1,248 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/santhosh-tekuri/raft"
+)
+
+func watch(args []string) {
+	flags := flag.NewFlagSet("watch", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	interval := flags.Duration("i", time.Second, "")
+	table := flags.Bool("t", false, "")
+	printUsage := func() {
+		errln("usage: raftctl watch [-i interval] [-t] [<addr>...]")
+		errln()
+		errln("polls given nodes and prints changes in their state.")
+		errln("if no address is given, RAFT_ADDR is used.")
+		errln()
+		errln("options:")
+		errln("  -i interval  polling interval (default 1s)")
+		errln("  -t           print replication table instead of changes")
+	}
+	if err := flags.Parse(args); err != nil {
+		if err != flag.ErrHelp {
+			errln(err.Error())
+		}
+		printUsage()
+		os.Exit(1)
+	}
+	if *interval <= 0 {
+		errln("interval must be positive")
+		os.Exit(1)
+	}
+	addrs := flags.Args()
+	if len(addrs) == 0 {
+		addr, ok := os.LookupEnv("RAFT_ADDR")
+		if !ok {
+			errln("RAFT_ADDR environment variable not set")
+			os.Exit(1)
+		}
+		addrs = strings.Split(addr, ",")
+	}
+
+	nodes := make([]*watchNode, len(addrs))
+	for i, addr := range addrs {
+		c := raft.NewClient(addr)
+		c.RetryTimeout = 0 // poll again, instead of retry
+		nodes[i] = &watchNode{addr: addr, c: c}
+	}
+	for {
+		var wg sync.WaitGroup
+		for _, n := range nodes {
+			wg.Add(1)
+			go func(n *watchNode) {
+				defer wg.Done()
+				n.poll()
+			}(n)
+		}
+		wg.Wait()
+		now := time.Now()
+		if *table {
+			printTable(now, nodes)
+		} else {
+			for _, n := range nodes {
+				for _, change := range n.changes() {
+					fmt.Printf("%s %s %s\n", now.Format("15:04:05.000"), n.addr, change)
+				}
+			}
+		}
+		time.Sleep(*interval)
+	}
+}
+
+type watchNode struct {
+	addr string
+	c    *raft.Client
+
+	prev, cur       *raft.Info
+	prevErr, curErr error
+	polled          bool
+}
+
+func (n *watchNode) poll() {
+	n.prev, n.prevErr = n.cur, n.curErr
+	info, err := n.c.GetInfo(context.Background())
+	if err != nil {
+		n.cur, n.curErr = nil, err
+	} else {
+		n.cur, n.curErr = &info, nil
+	}
+}
+
+// changes returns the differences between last two polls.
+// on first poll, all tracked fields are reported.
+func (n *watchNode) changes() []string {
+	first := !n.polled
+	n.polled = true
+	if n.curErr != nil {
+		if first || n.prevErr == nil || n.prevErr.Error() != n.curErr.Error() {
+			return []string{"error: " + n.curErr.Error()}
+		}
+		return nil
+	}
+	prev, cur := n.prev, n.cur
+	if prev == nil {
+		// first poll or recovered from error
+		var flrs []string
+		for _, id := range sortedFollowers(cur) {
+			flrs = append(flrs, fmt.Sprintf("[%s]", formatRepl(id, cur.Followers[id], cur.LastLogIndex)))
+		}
+		s := fmt.Sprintf("nid=%d term=%d state=%s leader=%d committed=%d applied=%d",
+			cur.NID, cur.Term, cur.State, cur.Leader, cur.Committed, cur.LastApplied)
+		if len(flrs) > 0 {
+			s += " followers=" + strings.Join(flrs, " ")
+		}
+		return []string{s}
+	}
+
+	var changes []string
+	changed := func(field string, from, to interface{}) {
+		changes = append(changes, fmt.Sprintf("%s: %v -> %v", field, from, to))
+	}
+	if prev.Term != cur.Term {
+		changed("term", prev.Term, cur.Term)
+	}
+	if prev.State != cur.State {
+		changed("state", prev.State, cur.State)
+	}
+	if prev.Leader != cur.Leader {
+		changed("leader", prev.Leader, cur.Leader)
+	}
+	if prev.Committed != cur.Committed {
+		changed("committed", prev.Committed, cur.Committed)
+	}
+	if prev.LastApplied != cur.LastApplied {
+		changed("applied", prev.LastApplied, cur.LastApplied)
+	}
+	for _, id := range sortedFollowers(cur) {
+		repl := cur.Followers[id]
+		prevRepl, ok := prev.Followers[id]
+		if !ok {
+			changes = append(changes, fmt.Sprintf("follower %s", formatRepl(id, repl, cur.LastLogIndex)))
+			continue
+		}
+		if prevRepl.MatchIndex != repl.MatchIndex {
+			changed(fmt.Sprintf("follower %d matchIndex", id), prevRepl.MatchIndex, repl.MatchIndex)
+		}
+		switch {
+		case prevRepl.Unreachable == nil && repl.Unreachable != nil:
+			changes = append(changes, fmt.Sprintf("follower %d unreachable: %s", id, repl.ErrMessage))
+		case prevRepl.Unreachable != nil && repl.Unreachable == nil:
+			changes = append(changes, fmt.Sprintf("follower %d reachable", id))
+		}
+	}
+	for _, id := range sortedFollowers(prev) {
+		if _, ok := cur.Followers[id]; !ok {
+			changes = append(changes, fmt.Sprintf("follower %d removed", id))
+		}
+	}
+	return changes
+}
+
+func printTable(now time.Time, nodes []*watchNode) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, now.Format("15:04:05.000"))
+	_, _ = fmt.Fprintln(w, "ADDR\tNID\tSTATE\tTERM\tLEADER\tLAST\tCOMMITTED\tAPPLIED\t")
+	var ldr *raft.Info
+	var errs []string
+	for _, n := range nodes {
+		if n.curErr != nil {
+			_, _ = fmt.Fprintf(w, "%s\t-\terror\t-\t-\t-\t-\t-\t\n", n.addr)
+			errs = append(errs, fmt.Sprintf("%s: %v", n.addr, n.curErr))
+			continue
+		}
+		info := n.cur
+		_, _ = fmt.Fprintf(w, "%s\t%d\t%s\t%d\t%d\t%d\t%d\t%d\t\n",
+			n.addr, info.NID, info.State, info.Term, info.Leader, info.LastLogIndex, info.Committed, info.LastApplied)
+		if info.State == raft.Leader && (ldr == nil || info.Term > ldr.Term) {
+			ldr = info
+		}
+	}
+	_ = w.Flush()
+	for _, err := range errs {
+		fmt.Println(err)
+	}
+	if ldr != nil && len(ldr.Followers) > 0 {
+		_, _ = fmt.Fprintln(w)
+		_, _ = fmt.Fprintln(w, "FOLLOWER\tMATCH\tLAG\tUNREACHABLE\t")
+		for _, id := range sortedFollowers(ldr) {
+			repl := ldr.Followers[id]
+			unreachable := "-"
+			if repl.Unreachable != nil {
+				unreachable = fmt.Sprintf("%s ago", now.Sub(*repl.Unreachable).Truncate(time.Second))
+			}
+			_, _ = fmt.Fprintf(w, "%d\t%d\t%d\t%s\t\n", id, repl.MatchIndex, lag(ldr.LastLogIndex, repl.MatchIndex), unreachable)
+		}
+	}
+	_, _ = fmt.Fprintln(w)
+	_ = w.Flush()
+}
+
+func sortedFollowers(info *raft.Info) []uint64 {
+	var ids []uint64
+	for id := range info.Followers {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func formatRepl(id uint64, repl raft.Replication, lastLogIndex uint64) string {
+	s := fmt.Sprintf("%d matchIndex=%d lag=%d", id, repl.MatchIndex, lag(lastLogIndex, repl.MatchIndex))
+	if repl.Unreachable != nil {
+		s += " unreachable"
+	}
+	return s
+}
+
+func lag(lastLogIndex, matchIndex uint64) uint64 {
+	if matchIndex >= lastLogIndex {
+		return 0
+	}
+	return lastLogIndex - matchIndex
+}
@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sort"
 	"strconv"
 )
 
@@ -221,6 +222,17 @@ func (c Config) nodeForAddr(addr string) (Node, bool) {
 	return Node{}, false
 }
 
+// ids returns ids of nodes in decreasing order. Use it instead of
+// ranging over Nodes, where order matters for seeded replay.
+func (c Config) ids() []uint64 {
+	ids := make([]uint64, 0, len(c.Nodes))
+	for id := range c.Nodes {
+		ids = append(ids, id)
+	}
+	sort.Sort(decrUint64Slice(ids))
+	return ids
+}
+
 func (c Config) isVoter(id uint64) bool {
 	n, ok := c.Nodes[id]
 	return ok && n.Voter
@@ -348,24 +360,31 @@ func (c Config) encode() *entry {
 }
 
 func (c *Config) decode(e *entry) error {
+	_, err := c.decodeTrailing(e)
+	return err
+}
+
+// decodeTrailing is same as decode, but also returns
+// the bytes in e.data, that follow the config.
+func (c *Config) decodeTrailing(e *entry) ([]byte, error) {
 	if e.typ != entryConfig {
-		return fmt.Errorf("raft: expected entryConfig in Config.decode")
+		return nil, fmt.Errorf("raft: expected entryConfig in Config.decode")
 	}
 	c.Index, c.Term = e.index, e.term
 	r := bytes.NewBuffer(e.data)
 	size, err := readUint32(r)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	c.Nodes = make(map[uint64]Node)
 	for ; size > 0; size-- {
 		n := Node{}
 		if err := n.decode(r); err != nil {
-			return err
+			return nil, err
 		}
 		c.Nodes[n.ID] = n
 	}
-	return nil
+	return r.Bytes(), nil
 }
 
 func (c Config) validate() error {
@@ -483,8 +502,11 @@ func (l *leader) setCommitIndex(index uint64) {
 		println(l, "log.Commit", index)
 	}
 	l.storage.commitLog(index)
+	if tracer.logCommitted != nil {
+		tracer.logCommitted(l.Raft)
+	}
 	if l.commitIndex < l.startIndex && index >= l.startIndex {
-		l.logger.Info("ready for commit")
+		l.logger.Info("ready for commit", "term", l.term, "index", index)
 		if tracer.commitReady != nil {
 			tracer.commitReady(l.Raft)
 		}
@@ -495,7 +517,7 @@ func (l *leader) setCommitIndex(index uint64) {
 			if trace {
 				println(l, "stableConfig")
 			}
-			l.logger.Info("config is stable")
+			l.logger.Info("config is stable", "config", l.configs.Latest)
 			for _, t := range l.waitStable {
 				t.reply(l.configs.Latest)
 			}
@@ -547,8 +569,8 @@ func (l *leader) changeConfig(config Config) {
 	}
 
 	// add new repls
-	for id, n := range config.Nodes {
-		if id != l.nid {
+	for _, id := range config.ids() {
+		if n := config.Nodes[id]; id != l.nid {
 			if repl, ok := l.repls[id]; !ok {
 				l.addReplication(n)
 			} else {
@@ -570,9 +592,9 @@ func (r *Raft) changeConfig(config Config) {
 	r.configs.Committed = r.configs.Latest
 	r.setLatest(config)
 	if r.configs.Latest.Index == 1 {
-		r.logger.Info("bootstrapped with", r.configs.Latest)
+		r.logger.Info("bootstrapped", "config", r.configs.Latest)
 	} else {
-		r.logger.Info("changed to", r.configs.Latest)
+		r.logger.Info("config changed", "term", r.term, "config", r.configs.Latest)
 	}
 	if tracer.configChanged != nil {
 		tracer.configChanged(r)
@@ -587,7 +609,7 @@ func (r *Raft) commitConfig() {
 		r.setLeader(0) // for faster election
 	}
 	r.configs.Committed = r.configs.Latest
-	r.logger.Info("committed", r.configs.Latest)
+	r.logger.Info("config committed", "config", r.configs.Latest)
 	if tracer.configCommitted != nil {
 		tracer.configCommitted(r)
 	}
@@ -598,7 +620,7 @@ func (r *Raft) revertConfig() {
 		println(r, "revertConfig", r.configs.Committed)
 	}
 	r.setLatest(r.configs.Committed)
-	r.logger.Info("reverted to", r.configs.Latest)
+	r.logger.Info("config reverted", "config", r.configs.Latest)
 	if tracer.configReverted != nil {
 		tracer.configReverted(r)
 	}
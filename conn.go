@@ -93,7 +93,7 @@ func (r *resolver) lookupID(id uint64, timeout time.Duration) string {
 			return addr
 		}
 		err = opError(err, "Resolver.LookupID(%d)", id)
-		r.logger.Warn(trimPrefix(err))
+		r.logger.Warn("resolver failed", "node", id, "err", trimPrefix(err))
 		r.alerts.Error(err)
 	}
 
@@ -111,6 +111,7 @@ type connPool struct {
 	nid      uint64
 	resolver *resolver
 	dialFn   dialFn
+	clock    Clock
 	max      int
 
 	mu    sync.Mutex
@@ -131,8 +132,8 @@ func (pool *connPool) getConn(deadline time.Time) (*conn, error) {
 	}
 
 	// dial ---------
-	addr := pool.resolver.lookupID(pool.nid, deadline.Sub(time.Now()))
-	c, err := dial(pool.dialFn, addr, deadline.Sub(time.Now()))
+	addr := pool.resolver.lookupID(pool.nid, deadline.Sub(pool.clock.Now()))
+	c, err := dial(pool.dialFn, addr, deadline.Sub(pool.clock.Now()))
 	if err != nil {
 		return nil, err
 	}
@@ -197,6 +198,7 @@ func (r *Raft) getConnPool(nid uint64) *connPool {
 			nid:      nid,
 			resolver: r.resolver,
 			dialFn:   r.dialFn,
+			clock:    r.clock,
 			max:      1,
 		}
 		r.connPools[nid] = pool
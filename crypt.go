@@ -0,0 +1,197 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Encrypted snapshot is stored as random nonce followed by chunks.
+// Each chunk holds chunkSize bytes of data, except last chunk which
+// may be shorter. There is always at least one chunk. Each chunk is
+// sealed with nonce xor'ed with chunk number, and its additional data
+// tells whether it is the last chunk, to detect truncation.
+
+const chunkSize = 64 * 1024
+
+var errDecrypt = errors.New("raft: snapshot decryption failed")
+
+// sealedSize returns the size of encrypted snapshot
+// with given data size.
+func sealedSize(size int64) int64 {
+	const nonceSize, tagSize = 12, 16 // of gcm
+	chunks := (size + chunkSize - 1) / chunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return nonceSize + size + chunks*tagSize
+}
+
+func chunkNonce(nonce []byte, base []byte, chunk uint64) []byte {
+	copy(nonce, base)
+	i := len(nonce) - 8
+	binary.BigEndian.PutUint64(nonce[i:], binary.BigEndian.Uint64(nonce[i:])^chunk)
+	return nonce
+}
+
+func chunkAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// sealWriter -----------------------------------------------------
+
+type sealWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	base  []byte
+	nonce []byte
+	chunk uint64
+	buf   []byte
+	out   []byte
+	n     int64 // number of data bytes written
+}
+
+func newSealWriter(w io.Writer, aead cipher.AEAD) (*sealWriter, error) {
+	base := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, base); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(base); err != nil {
+		return nil, err
+	}
+	return &sealWriter{
+		w:     w,
+		aead:  aead,
+		base:  base,
+		nonce: make([]byte, len(base)),
+		buf:   make([]byte, 0, chunkSize),
+	}, nil
+}
+
+func (w *sealWriter) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		// full chunk is sealed, only when more data follows.
+		// so that Close can seal it as last chunk
+		if len(w.buf) == chunkSize {
+			if err := w.seal(false); err != nil {
+				return n - len(b), err
+			}
+		}
+		m := copy(w.buf[len(w.buf):chunkSize], b)
+		w.buf = w.buf[:len(w.buf)+m]
+		b = b[m:]
+		w.n += int64(m)
+	}
+	return n, nil
+}
+
+func (w *sealWriter) seal(last bool) error {
+	nonce := chunkNonce(w.nonce, w.base, w.chunk)
+	w.out = w.aead.Seal(w.out[:0], nonce, w.buf, chunkAD(last))
+	if _, err := w.w.Write(w.out); err != nil {
+		return err
+	}
+	w.chunk++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// Close seals the last chunk. It does not close the
+// underlying writer.
+func (w *sealWriter) Close() error {
+	return w.seal(true)
+}
+
+// openReader -----------------------------------------------------
+
+type openReader struct {
+	r     io.Reader
+	aead  cipher.AEAD
+	base  []byte
+	nonce []byte
+	chunk uint64
+	size  int64 // number of data bytes yet to be read from r
+	in    []byte
+	buf   []byte
+	off   int
+}
+
+func newOpenReader(r io.Reader, aead cipher.AEAD, size int64) (*openReader, error) {
+	base := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(r, base); err != nil {
+		return nil, err
+	}
+	return &openReader{
+		r:     r,
+		aead:  aead,
+		base:  base,
+		nonce: make([]byte, len(base)),
+		size:  size,
+		in:    make([]byte, chunkSize+aead.Overhead()),
+	}, nil
+}
+
+func (r *openReader) Read(b []byte) (int, error) {
+	if r.off == len(r.buf) {
+		if r.size < 0 {
+			return 0, io.EOF
+		}
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+		if len(r.buf) == 0 {
+			return 0, io.EOF
+		}
+	}
+	n := copy(b, r.buf[r.off:])
+	r.off += n
+	return n, nil
+}
+
+// open reads and decrypts next chunk. After last chunk,
+// size is set to -1.
+func (r *openReader) open() error {
+	n := int64(chunkSize)
+	last := r.size <= chunkSize
+	if last {
+		n = r.size
+	}
+	in := r.in[:n+int64(r.aead.Overhead())]
+	if _, err := io.ReadFull(r.r, in); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	nonce := chunkNonce(r.nonce, r.base, r.chunk)
+	buf, err := r.aead.Open(r.buf[:0], nonce, in, chunkAD(last))
+	if err != nil {
+		return errDecrypt
+	}
+	r.buf, r.off = buf, 0
+	r.chunk++
+	if r.size -= n; last {
+		r.size = -1
+	}
+	return nil
+}
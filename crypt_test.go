@@ -0,0 +1,255 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/santhosh-tekuri/raft/log"
+)
+
+func TestSealWriter(t *testing.T) {
+	keys := &keysMock{keys: map[uint32][]byte{1: bytes.Repeat([]byte{1}, 32)}}
+	aead, err := log.AEAD(keys, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3 * chunkSize} {
+		t.Run(fmt.Sprintf("size=%d", size), func(t *testing.T) {
+			data := make([]byte, size)
+			rand.Read(data)
+			buf := new(bytes.Buffer)
+			w, err := newSealWriter(buf, aead)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for b := data; len(b) > 0; { // write in odd sized pieces
+				n := 1000
+				if n > len(b) {
+					n = len(b)
+				}
+				if _, err = w.Write(b[:n]); err != nil {
+					t.Fatal(err)
+				}
+				b = b[n:]
+			}
+			if err = w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if w.n != int64(size) {
+				t.Fatalf("n=%d, want %d", w.n, size)
+			}
+			if got, want := int64(buf.Len()), sealedSize(int64(size)); got != want {
+				t.Fatalf("sealedSize=%d, want %d", got, want)
+			}
+
+			sealed := buf.Bytes()
+			r, err := newOpenReader(bytes.NewReader(sealed), aead, int64(size))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatal("decrypted data does not match")
+			}
+
+			// tampered
+			tampered := append([]byte(nil), sealed...)
+			tampered[len(tampered)/2] ^= 1
+			if r, err = newOpenReader(bytes.NewReader(tampered), aead, int64(size)); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = ioutil.ReadAll(r); err != errDecrypt {
+				t.Fatalf("tampered: got %v, want %v", err, errDecrypt)
+			}
+
+			// truncated at chunk boundary
+			if size > chunkSize {
+				chunk := chunkSize + aead.Overhead()
+				truncated := sealed[:aead.NonceSize()+chunk]
+				if r, err = newOpenReader(bytes.NewReader(truncated), aead, chunkSize); err != nil {
+					t.Fatal(err)
+				}
+				if _, err = ioutil.ReadAll(r); err != errDecrypt {
+					t.Fatalf("truncated: got %v, want %v", err, errDecrypt)
+				}
+			}
+		})
+	}
+}
+
+func TestRaft_encryption(t *testing.T) {
+	keys := &keysMock{keys: map[uint32][]byte{1: bytes.Repeat([]byte{1}, 16)}, current: 1}
+	opt := DefaultOptions()
+	opt.Logger = nil
+	opt.LogSegmentSize = 1024
+	opt.SnapshotsRetain = 2
+	opt.Keys = keys
+	execute := func(r *Raft, task Task) interface{} {
+		t.Helper()
+		result, err := r.Execute(context.Background(), task)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	update := func(r *Raft, from, to int) {
+		t.Helper()
+		for i := from; i <= to; i++ {
+			execute(r, UpdateFSM([]byte(fmt.Sprintf("update:%d", i))))
+		}
+	}
+
+	r := launchNode(t, opt, &fsmMock{id: identity{1, 1}}, "")
+	storageDir := filepath.Dir(r.snaps.dir)
+	update(r, 1, 20)
+	execute(r, TakeSnapshot(0))
+
+	// rotate key
+	keys.rotate(2, bytes.Repeat([]byte{2}, 32))
+	update(r, 21, 40)
+	execute(r, TakeSnapshot(0))
+	update(r, 41, 60)
+	_ = r.Shutdown(context.Background())
+
+	// no plaintext must be found in storage
+	err := filepath.Walk(storageDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if bytes.Contains(b, []byte("update:")) {
+			t.Errorf("%s has plaintext", path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := ReadStorage(opt, storageDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Snapshots) != 2 || info.Snapshots[0].KeyID != 2 || info.Snapshots[1].KeyID != 1 {
+		t.Fatalf("snapshots=%+v, want keyIDs 2 1", info.Snapshots)
+	}
+	if seg := info.Segments[len(info.Segments)-1]; seg.KeyID != 2 {
+		t.Fatalf("last segment keyID=%d, want 2", seg.KeyID)
+	}
+	if problems, err := VerifyStorage(opt, storageDir); err != nil {
+		t.Fatal(err)
+	} else if len(problems) != 0 {
+		t.Fatalf("problems: %v", problems)
+	}
+	var updates []string
+	err = ReadEntries(opt, storageDir, func(e Entry) error {
+		if e.Type == "update" {
+			updates = append(updates, string(e.Data))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) == 0 || updates[len(updates)-1] != "update:60" {
+		t.Fatalf("updates=%q, want last %q", updates, "update:60")
+	}
+
+	// without keys, encrypted entries cannot be read
+	noKeys := opt
+	noKeys.Keys = nil
+	if problems, err := VerifyStorage(noKeys, storageDir); err != nil {
+		t.Fatal(err)
+	} else if len(problems) == 0 {
+		t.Fatal("VerifyStorage must report that encrypted entries cannot be read")
+	}
+	if err = ReadEntries(noKeys, storageDir, func(Entry) error { return nil }); err == nil {
+		t.Fatal("ReadEntries must fail without keys")
+	}
+
+	// without keys, storage cannot be opened
+	if _, err := New(noKeys, &fsmMock{id: identity{1, 1}}, storageDir); err == nil {
+		t.Fatal("New must fail without keys")
+	}
+
+	// restore from encrypted snapshot and replay encrypted entries
+	fsm := &fsmMock{id: identity{1, 1}}
+	r = launchNode(t, opt, fsm, storageDir)
+	defer func() { _ = r.Shutdown(context.Background()) }()
+	execute(r, BarrierFSM())
+	if got := fsm.len(); got != 60 {
+		t.Fatalf("fsm.len=%d, want %d", got, 60)
+	}
+	if got := fsm.lastCommand(); got != "update:60" {
+		t.Fatalf("lastCommand=%q, want %q", got, "update:60")
+	}
+
+	// exported snapshot is plaintext
+	buf := new(bytes.Buffer)
+	snap, err := r.snaps.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.release()
+	if err = snap.export(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte("update:40")) {
+		t.Fatal("exported snapshot must be plaintext")
+	}
+}
+
+// keysMock ---------------------------------------------
+
+type keysMock struct {
+	mu      sync.Mutex
+	keys    map[uint32][]byte
+	current uint32
+}
+
+func (k *keysMock) rotate(id uint32, key []byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[id], k.current = key, id
+}
+
+func (k *keysMock) CurrentKey() (uint32, []byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.current, k.keys[k.current], nil
+}
+
+func (k *keysMock) Key(id uint32) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if key, ok := k.keys[id]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("key %d not found", id)
+}
@@ -69,8 +69,34 @@ var (
 	// ErrTransferTargetNonvoter indicates that TransferLeadership task failed because the target node is non-voter.
 	ErrTransferTargetNonvoter = plainError("raft.transferLeadership: target is nonvoter")
 
+	// ErrNoSnapshot indicates that Client.DownloadSnapshot failed because the node
+	// has not taken any snapshot yet.
+	ErrNoSnapshot = plainError("raft: no snapshot taken yet")
+
 	// ErrTransferInvalidTarget indicates that TransferLeadership task failed because the target node does not exist.
 	ErrTransferInvalidTarget = plainError("raft.transferLeadership: no such target found")
+
+	// ErrBusy is returned by FSMTask, if there are too many pending FSMTasks and
+	// Options.FailWhenBusy is true. User can retry the task after some time.
+	ErrBusy = temporaryError("raft: too many pending entries")
+
+	// ErrDiskFull is returned by FSMTask, if free space in storage is below
+	// Options.MinFreeBytes. User can retry the task after some time, when
+	// log compaction has freed some space.
+	ErrDiskFull = temporaryError("raft: disk is almost full")
+
+	// ErrSessionExpired is returned by UpdateSession task, if the session is
+	// not open or it is expired. User must open a new session.
+	ErrSessionExpired = plainError("raft: session expired")
+
+	// ErrDuplicateRequest is returned by UpdateSession task, if the update is
+	// already applied, but its result is not available.
+	ErrDuplicateRequest = plainError("raft: duplicate request, result not available")
+
+	// ErrResultNotEncoded is returned by Client.Update and Client.UpdateSession,
+	// if the update is applied, but Options.Codec failed to encode its result.
+	// User must not resend the update, unless it is idempotent.
+	ErrResultNotEncoded = plainError("raft: update applied, but its result could not be encoded")
 )
 
 var (
@@ -159,6 +185,31 @@ func (e TimeoutError) Error() string {
 // later.
 func (e TimeoutError) Temporary() {}
 
+// ContextError is returned by Raft.Execute and Client, when the
+// context is done before the task is completed.
+type ContextError struct {
+	// Err is the error reported by context, i.e.
+	// context.Canceled or context.DeadlineExceeded.
+	Err error
+
+	// Unknown is false, if the task is guaranteed not to be performed,
+	// for example the entry is dropped before it is appended to log.
+	// If true, the task may or may not be performed.
+	Unknown bool
+}
+
+func (e ContextError) Error() string {
+	if e.Unknown {
+		return fmt.Sprintf("raft: %v, outcome unknown", e.Err)
+	}
+	return fmt.Sprintf("raft: %v, task not performed", e.Err)
+}
+
+// Unwrap returns the error reported by context.
+func (e ContextError) Unwrap() error {
+	return e.Err
+}
+
 // -----------------------------------------------------------
 
 // OpError is the error type usually returned when an error
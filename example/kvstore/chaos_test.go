@@ -0,0 +1,208 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/santhosh-tekuri/raft"
+	"github.com/santhosh-tekuri/raft/rafttest"
+	"github.com/santhosh-tekuri/raft/sim"
+	"github.com/santhosh-tekuri/raft/vfs"
+)
+
+var seedFlag = flag.Int64("seed", 0, "run chaos test with given seed")
+
+// TestChaos runs concurrent clients doing get/set/delete through handler,
+// while injecting partitions, leader crashes and restarts. The recorded
+// history must be linearizable. Nodes run on vfs.Mem, so that a crashed
+// leader loses the data it has not synced, see rafttest.Cluster.Crash.
+func TestChaos(t *testing.T) {
+	seeds := []int64{1, 2, 3}
+	if *seedFlag != 0 {
+		seeds = []int64{*seedFlag}
+	}
+	for _, seed := range seeds {
+		t.Run(fmt.Sprintf("seed=%d", seed), func(t *testing.T) {
+			testChaos(t, seed)
+		})
+	}
+}
+
+func testChaos(t *testing.T, seed int64) {
+	c := rafttest.Launch(t, rafttest.Config{
+		Size:   3,
+		NewFSM: func(id uint64) raft.FSM { return newKVStore() },
+		Options: func(id uint64, opt *raft.Options) {
+			// vfs.Mem copies whole segment on each sync
+			opt.LogSegmentSize = 64 * 1024
+		},
+		FS:   func(id uint64) vfs.FS { return vfs.NewMem(seed*10 + int64(id)) },
+		Seed: seed,
+	})
+	defer c.Shutdown()
+	h := &history{clock: c.Clock}
+	var mu sync.RWMutex // guards Node.Raft, which changes on crash/restart
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(client int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed*10 + int64(client)))
+			nodes := c.Nodes()
+			n := nodes[rnd.Intn(len(nodes))]
+			for seq := 1; ; seq++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				mu.RLock()
+				r := n.Raft
+				mu.RUnlock()
+				key := fmt.Sprintf("k%d", rnd.Intn(3))
+				var in kvInput
+				switch x := rnd.Intn(10); {
+				case x < 5:
+					in = kvInput{opGet, key, ""}
+				case x < 9:
+					in = kvInput{opSet, key, fmt.Sprintf("c%d-%d", client, seq)}
+				default:
+					in = kvInput{opDel, key, ""}
+				}
+				if !h.do(r, client, in) {
+					// back off, as clock does not move while we spin
+					n = nodes[rnd.Intn(len(nodes))]
+					c.Sleep(10 * time.Millisecond)
+				}
+			}
+		}(i)
+	}
+
+	// nemesis
+	rnd := rand.New(rand.NewSource(seed))
+	for round := 0; round < 6; round++ {
+		ldr := c.Leader()
+		switch rnd.Intn(3) {
+		case 0:
+			// isolate a random node, which may be leader
+			nodes := c.Nodes()
+			c.Partition([]*rafttest.Node{nodes[rnd.Intn(len(nodes))]})
+			c.Sleep(time.Second)
+			c.Heal()
+		case 1:
+			mu.Lock()
+			c.Crash(ldr)
+			mu.Unlock()
+			c.Sleep(time.Second)
+			mu.Lock()
+			c.Restart(ldr)
+			mu.Unlock()
+		default:
+			nodes := c.Nodes()
+			mu.Lock()
+			c.Restart(nodes[rnd.Intn(len(nodes))])
+			mu.Unlock()
+		}
+		c.Sleep(500 * time.Millisecond)
+	}
+	close(stop)
+	wg.Wait()
+
+	ops := h.operations()
+	if ok, violation := checkHistory(kvModel, ops); !ok {
+		t.Fatalf("seed %d: history of %d operations is not linearizable, minimal violation:%s",
+			seed, len(ops), formatHistory(kvModel, violation))
+	}
+}
+
+// history --------------------------------------------------
+
+type history struct {
+	time  int64      // logical clock, to order call and return events
+	clock *sim.Clock // virtual clock of cluster, for request timeouts
+	mu    sync.Mutex
+	ops   []operation
+}
+
+func (h *history) now() int64 {
+	return atomic.AddInt64(&h.time, 1)
+}
+
+// do performs the operation using handler of r, and records it.
+// The outcome of failed set/delete is unknown, unless handler says that
+// it is not applied, by redirecting to leader or with 503. Failed get,
+// or request not applied has no effect and is not recorded. Returns
+// false on failure.
+func (h *history) do(r *raft.Raft, client int, in kvInput) bool {
+	op := operation{client: client, input: in, call: h.now()}
+	var code int
+	var body string
+	if r != nil { // nil if crashed
+		method := map[kvOp]string{opGet: http.MethodGet, opSet: http.MethodPost, opDel: http.MethodDelete}[in.op]
+		code, body = serve(h.clock, r, method, in.key, in.val)
+	}
+	op.ret = h.now()
+	switch {
+	case in.op == opGet && code == http.StatusOK:
+		op.output = body
+	case in.op != opGet && code == http.StatusNoContent:
+	case in.op == opGet, code == 0, code == http.StatusPermanentRedirect, code == http.StatusServiceUnavailable:
+		return false
+	default:
+		op.ret = pending
+	}
+	h.mu.Lock()
+	h.ops = append(h.ops, op)
+	h.mu.Unlock()
+	return op.ret != pending
+}
+
+func (h *history) operations() []operation {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]operation(nil), h.ops...)
+}
+
+// serve sends request to handler of r, waiting at most
+// a minute of virtual time.
+func serve(clock *sim.Clock, r *raft.Raft, method, key, val string) (code int, body string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	timer := clock.NewTimer(time.Minute)
+	defer timer.Stop()
+	go func() {
+		select {
+		case <-timer.C():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	req := httptest.NewRequest(method, "/"+key, strings.NewReader(val)).WithContext(ctx)
+	w := httptest.NewRecorder()
+	handler{r}.ServeHTTP(w, req)
+	return w.Code, w.Body.String()
+}
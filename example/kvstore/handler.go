@@ -40,7 +40,7 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		if _, ok := r.URL.Query()["dirty"]; ok {
 			task = raft.DirtyReadFSM(get{key})
 		}
-		res, err := h.execute(task)
+		res, err := h.r.Execute(r.Context(), task)
 		if err != nil {
 			h.replyErr(w, r, err)
 		} else {
@@ -54,14 +54,14 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		_, err = h.execute(raft.UpdateFSM(encodeCmd(set{key, string(b)})))
+		_, err = h.r.Execute(r.Context(), raft.UpdateFSM(encodeCmd(set{key, string(b)})))
 		if err != nil {
 			h.replyErr(w, r, err)
 		} else {
 			w.WriteHeader(http.StatusNoContent)
 		}
 	case http.MethodDelete:
-		_, err := h.execute(raft.UpdateFSM(encodeCmd(del{key})))
+		_, err := h.r.Execute(r.Context(), raft.UpdateFSM(encodeCmd(del{key})))
 		if err != nil {
 			h.replyErr(w, r, err)
 		} else {
@@ -73,22 +73,19 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h handler) replyErr(w http.ResponseWriter, r *http.Request, err error) {
-	if err, ok := err.(raft.NotLeaderError); ok && err.Leader.ID != 0 {
-		url := fmt.Sprintf("http://%s%s", err.Leader.Data, r.URL.Path)
-		http.Redirect(w, r, url, http.StatusPermanentRedirect)
-		return
+	// if leadership is lost, the request might have been applied.
+	// so redirect only when it is not applied, because client
+	// resends the request on redirect
+	status := http.StatusInternalServerError
+	if err, ok := err.(raft.NotLeaderError); ok && !err.Lost {
+		if err.Leader.ID != 0 {
+			url := fmt.Sprintf("http://%s%s", err.Leader.Data, r.URL.Path)
+			http.Redirect(w, r, url, http.StatusPermanentRedirect)
+			return
+		}
+		status = http.StatusServiceUnavailable
 	}
 	w.Header().Set("Content-Type", "text/plain")
-	w.WriteHeader(http.StatusInternalServerError)
+	w.WriteHeader(status)
 	w.Write([]byte(err.Error()))
 }
-
-func (h handler) execute(t raft.FSMTask) (interface{}, error) {
-	select {
-	case <-h.r.Closed():
-		return nil, raft.ErrServerClosed
-	case h.r.FSMTasks() <- t:
-	}
-	<-t.Done()
-	return t.Result(), t.Err()
-}
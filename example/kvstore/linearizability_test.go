@@ -0,0 +1,402 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// This file implements a linearizability checker in the style of
+// Porcupine/Knossos: the Wing & Gong search with the memoization
+// described by Lowe, applied to each key independently.
+
+// pending is the return time of operation, whose outcome is unknown.
+// Such operation may take effect at any time after its call, or never.
+const pending = math.MaxInt64
+
+// operation is a client operation recorded in history.
+type operation struct {
+	client int
+	input  interface{}
+	output interface{} // ignored, if ret is pending
+	call   int64       // logical time of invocation
+	ret    int64       // logical time of response
+}
+
+// model is the sequential specification of the system.
+type model struct {
+	// partition splits history into independent histories,
+	// which are checked separately.
+	partition func(history []operation) [][]operation
+
+	init func() interface{}
+
+	// step tells whether the operation is valid in given state,
+	// and returns the new state.
+	step func(state interface{}, op operation) (bool, interface{})
+
+	equal func(s1, s2 interface{}) bool
+
+	// removable tells whether dropping op from non-linearizable
+	// history, guarantees that it is still non-linearizable if
+	// the remaining history is non-linearizable. used only to
+	// minimize the violation reported.
+	removable func(op operation, history []operation) bool
+
+	describe func(op operation) string
+}
+
+// checkHistory tells whether history is linearizable. If not, it
+// returns a minimal subhistory which is not linearizable.
+func checkHistory(m model, history []operation) (ok bool, violation []operation) {
+	for _, ops := range m.partition(history) {
+		ops = dropPending(m, ops)
+		if !linearizable(m, ops) {
+			return false, minimize(m, ops)
+		}
+	}
+	return true, nil
+}
+
+// dropPending drops the removable operations whose outcome is unknown,
+// by assuming that they never took effect. Otherwise, the search has to
+// try them at each step, which is exponential in their number.
+func dropPending(m model, ops []operation) []operation {
+	var kept []operation
+	for _, op := range ops {
+		if op.ret != pending || !m.removable(op, ops) {
+			kept = append(kept, op)
+		}
+	}
+	return kept
+}
+
+// minimize drops operations from non-linearizable ops, until
+// dropping any other removable operation makes it linearizable.
+func minimize(m model, ops []operation) []operation {
+	for changed := true; changed; {
+		changed = false
+		for i := len(ops) - 1; i >= 0; i-- {
+			if !m.removable(ops[i], ops) {
+				continue
+			}
+			reduced := append(append([]operation(nil), ops[:i]...), ops[i+1:]...)
+			if !linearizable(m, reduced) {
+				ops, changed = reduced, true
+			}
+		}
+	}
+	return ops
+}
+
+func formatHistory(m model, ops []operation) string {
+	var b strings.Builder
+	for _, op := range ops {
+		ret := "?"
+		if op.ret != pending {
+			ret = fmt.Sprint(op.ret)
+		}
+		fmt.Fprintf(&b, "\n\tclient %d [%d, %s]: %s", op.client, op.call, ret, m.describe(op))
+	}
+	return b.String()
+}
+
+// linearizable --------------------------------------------------
+
+// event is call or return of an operation, in a doubly linked list.
+type event struct {
+	op         int
+	ret        bool
+	time       int64
+	match      *event // return event of call
+	prev, next *event
+}
+
+// lift removes the call event e and its return event from list.
+func (e *event) lift() {
+	e.prev.next, e.next.prev = e.next, e.prev
+	r := e.match
+	r.prev.next = r.next
+	if r.next != nil {
+		r.next.prev = r.prev
+	}
+}
+
+// unlift undoes lift.
+func (e *event) unlift() {
+	r := e.match
+	r.prev.next = r
+	if r.next != nil {
+		r.next.prev = r
+	}
+	e.prev.next, e.next.prev = e, e
+}
+
+type bitset []uint64
+
+func (b bitset) set(i int)   { b[i/64] |= 1 << uint(i%64) }
+func (b bitset) clear(i int) { b[i/64] &^= 1 << uint(i%64) }
+
+func (b bitset) key() string {
+	buf := make([]byte, 8*len(b))
+	for i, w := range b {
+		binary.LittleEndian.PutUint64(buf[8*i:], w)
+	}
+	return string(buf)
+}
+
+// linearizable tries to find a linearization of ops, by
+// searching the order in which operations take effect.
+func linearizable(m model, ops []operation) bool {
+	events := make([]*event, 0, 2*len(ops))
+	for i, op := range ops {
+		call, ret := &event{op: i, time: op.call}, &event{op: i, ret: true, time: op.ret}
+		call.match = ret
+		events = append(events, call, ret)
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].time != events[j].time {
+			return events[i].time < events[j].time
+		}
+		return !events[i].ret && events[j].ret // calls first, to be lenient
+	})
+	head := &event{}
+	prev := head
+	for _, e := range events {
+		prev.next, e.prev = e, prev
+		prev = e
+	}
+
+	type frame struct {
+		e     *event
+		state interface{}
+	}
+	var stack []frame
+	linearized := make(bitset, (len(ops)+63)/64)
+	cache := make(map[string][]interface{}) // map[linearized][]state
+	seen := func(state interface{}) bool {
+		k := linearized.key()
+		for _, s := range cache[k] {
+			if m.equal(s, state) {
+				return true
+			}
+		}
+		cache[k] = append(cache[k], state)
+		return false
+	}
+
+	state := m.init()
+	e := head.next
+	for head.next != nil {
+		if !e.ret {
+			if ok, newState := m.step(state, ops[e.op]); ok {
+				linearized.set(e.op)
+				if !seen(newState) {
+					stack = append(stack, frame{e, state})
+					state = newState
+					e.lift()
+					e = head.next
+					continue
+				}
+				linearized.clear(e.op)
+			}
+			e = e.next
+			continue
+		}
+		// an operation returned without taking effect: backtrack
+		if len(stack) == 0 {
+			return false
+		}
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		state = top.state
+		linearized.clear(top.e.op)
+		top.e.unlift()
+		e = top.e.next
+	}
+	return true
+}
+
+// kvModel --------------------------------------------------
+
+type kvOp byte
+
+const (
+	opGet kvOp = iota
+	opSet
+	opDel
+)
+
+type kvInput struct {
+	op       kvOp
+	key, val string
+}
+
+// kvModel is the model of kvstore, where each key is a register whose
+// initial value is empty. Values written by set must be unique, so that
+// the writes can be dropped safely while minimizing violation.
+var kvModel = model{
+	partition: func(history []operation) [][]operation {
+		m := make(map[string][]operation)
+		var keys []string
+		for _, op := range history {
+			key := op.input.(kvInput).key
+			if _, ok := m[key]; !ok {
+				keys = append(keys, key)
+			}
+			m[key] = append(m[key], op)
+		}
+		sort.Strings(keys)
+		var parts [][]operation
+		for _, key := range keys {
+			parts = append(parts, m[key])
+		}
+		return parts
+	},
+	init: func() interface{} { return "" },
+	step: func(state interface{}, op operation) (bool, interface{}) {
+		in := op.input.(kvInput)
+		switch in.op {
+		case opSet:
+			return true, in.val
+		case opDel:
+			return true, ""
+		default:
+			return op.output.(string) == state.(string), state
+		}
+	},
+	equal: func(s1, s2 interface{}) bool { return s1 == s2 },
+	removable: func(op operation, history []operation) bool {
+		// dropping a read only removes constraints. a write can be
+		// dropped, if no read could have observed the value it wrote:
+		// in any linearization of history, no read follows the write
+		// before next write, so removing it leaves linearization valid.
+		in := op.input.(kvInput)
+		if in.op == opGet {
+			return true
+		}
+		for _, o := range history {
+			if o.input.(kvInput).op == opGet && o.output.(string) == in.val && o.ret > op.call {
+				return false
+			}
+		}
+		return true
+	},
+	describe: func(op operation) string {
+		in := op.input.(kvInput)
+		switch in.op {
+		case opSet:
+			return fmt.Sprintf("set(%s, %q)", in.key, in.val)
+		case opDel:
+			return fmt.Sprintf("del(%s)", in.key)
+		default:
+			return fmt.Sprintf("get(%s) -> %q", in.key, op.output)
+		}
+	},
+}
+
+// tests --------------------------------------------------
+
+func TestLinearizable(t *testing.T) {
+	get := func(client int, key, val string, call, ret int64) operation {
+		return operation{client, kvInput{opGet, key, ""}, val, call, ret}
+	}
+	set := func(client int, key, val string, call, ret int64) operation {
+		return operation{client, kvInput{opSet, key, val}, nil, call, ret}
+	}
+	del := func(client int, key string, call, ret int64) operation {
+		return operation{client, kvInput{opDel, key, ""}, nil, call, ret}
+	}
+	tests := []struct {
+		name      string
+		history   []operation
+		ok        bool
+		violation []operation
+	}{
+		{
+			name:    "sequential",
+			history: []operation{set(1, "k", "a", 1, 2), get(2, "k", "a", 3, 4), del(1, "k", 5, 6), get(2, "k", "", 7, 8)},
+			ok:      true,
+		},
+		{
+			name:    "concurrent",
+			history: []operation{set(1, "k", "a", 1, 5), get(2, "k", "a", 2, 3), get(3, "k", "", 4, 6)},
+			ok:      false,
+			// a read cannot go back in time
+			violation: []operation{set(1, "k", "a", 1, 5), get(2, "k", "a", 2, 3), get(3, "k", "", 4, 6)},
+		},
+		{
+			name:    "concurrentReorder",
+			history: []operation{set(1, "k", "a", 1, 5), get(3, "k", "", 2, 4), get(2, "k", "a", 3, 6)},
+			ok:      true,
+		},
+		{
+			name:    "stale",
+			history: []operation{set(1, "k", "a", 1, 2), get(3, "x", "", 1, 3), set(2, "k", "b", 3, 4), get(1, "k", "b", 4, 6), get(2, "k", "a", 7, 8)},
+			ok:      false,
+			violation: []operation{
+				set(1, "k", "a", 1, 2), set(2, "k", "b", 3, 4), get(2, "k", "a", 7, 8),
+			},
+		},
+		{
+			name:    "pendingApplied",
+			history: []operation{set(1, "k", "a", 1, pending), get(2, "k", "", 2, 3), get(2, "k", "a", 4, 5)},
+			ok:      true,
+		},
+		{
+			name:    "pendingNeverApplied",
+			history: []operation{set(1, "k", "a", 1, pending), get(2, "k", "", 2, 3), get(2, "k", "", 4, 5)},
+			ok:      true,
+		},
+		{
+			name:    "pendingAppliedTwice",
+			history: []operation{set(1, "k", "a", 1, pending), set(2, "k", "b", 2, 3), get(2, "k", "a", 4, 5), get(2, "k", "b", 6, 7)},
+			ok:      false,
+			violation: []operation{
+				set(1, "k", "a", 1, pending), set(2, "k", "b", 2, 3), get(2, "k", "a", 4, 5), get(2, "k", "b", 6, 7),
+			},
+		},
+		{
+			name:    "readUnwritten",
+			history: []operation{set(1, "k", "a", 1, 2), get(2, "k", "b", 3, 4)},
+			ok:      false,
+			// set is dropped, since nobody read its value
+			violation: []operation{get(2, "k", "b", 3, 4)},
+		},
+		{
+			name:    "readBeforeDelete",
+			history: []operation{set(1, "k", "a", 1, 2), get(2, "k", "", 3, 4), del(1, "k", 5, 6), get(2, "k", "", 7, 8)},
+			ok:      false,
+			// del is dropped, since it is called after the read returned
+			violation: []operation{set(1, "k", "a", 1, 2), get(2, "k", "", 3, 4)},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ok, violation := checkHistory(kvModel, test.history)
+			if ok != test.ok {
+				t.Fatalf("ok=%v, want %v", ok, test.ok)
+			}
+			if !ok && formatHistory(kvModel, violation) != formatHistory(kvModel, test.violation) {
+				t.Fatalf("violation:%s\nwant:%s", formatHistory(kvModel, violation), formatHistory(kvModel, test.violation))
+			}
+		})
+	}
+}
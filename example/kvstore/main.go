@@ -42,6 +42,12 @@
 //   $ curl -v localhost:8001/k1
 //   $ curl -v -L localhost:8002/k1
 //   $ curl -v 'localhost:8002/k1?dirty'
+//
+// chaos_test.go checks that reads and writes through the http handler
+// are linearizable, while injecting partitions, graceful shutdowns and
+// restarts. to rerun with a failing seed:
+//   $ go test -run Chaos -seed 7
+// this does not replay the same run, but makes the failure likely to recur.
 package main
 
 import (
@@ -17,14 +17,40 @@ package raft
 type follower struct {
 	*Raft
 	electionAborted bool
+
+	// holds running relays to nonvoters, key is nid
+	relays map[uint64]*relay
+
+	// relays stopped, which might not have finished yet
+	stopped []*relay
+
+	// log compaction deferred, until stopped relays finish
+	deferredLTE uint64
+
+	// to receive updates from relays
+	relayUpdateCh chan replUpdate
+
+	// nonvoters whose relay failed, and term in which it failed
+	relayFailed map[uint64]uint64
+
+	// commitIndex notified to relays
+	relayIndex uint64
+	removeLTE  uint64
 }
 
 func (f *follower) init() {
 	f.timer.reset(f.rtime.duration(f.hbTimeout))
 	f.electionAborted = false
+	f.relays = make(map[uint64]*relay)
+	f.relayFailed = make(map[uint64]uint64)
+	f.relayUpdateCh = make(chan replUpdate, 1024)
+	f.removeLTE = f.log.PrevIndex()
 }
 
-func (f *follower) release() {}
+func (f *follower) release() {
+	f.stopRelays()
+	f.relayUpdateCh = nil
+}
 
 func (f *follower) resetTimer() {
 	if yes, _ := f.canStartElection(); yes {
@@ -43,7 +69,7 @@ func (f *follower) onTimeout() {
 		if trace {
 			println(f, "electionAborted", reason)
 		}
-		f.logger.Info(reason+",", "aborting election")
+		f.logger.Info("aborting election", "term", f.term, "reason", reason)
 		if tracer.electionAborted != nil {
 			tracer.electionAborted(f.Raft, reason)
 		}
@@ -17,7 +17,10 @@ package raft
 import (
 	"bufio"
 	"bytes"
+	"fmt"
 	"io"
+	"sync/atomic"
+	"time"
 
 	"github.com/santhosh-tekuri/raft/log"
 )
@@ -50,6 +53,62 @@ type FSM interface {
 	Restore(io.Reader) error
 }
 
+// FSMEntry is the update entry applied to FSM.
+type FSMEntry struct {
+	Index uint64 // log index of the entry
+	Term  uint64 // term in which the entry is created
+	Cmd   []byte
+}
+
+// EntryFSM is an optional interface, that can be implemented by FSM
+// to know the index and term of the entry being applied. The index can
+// be used to make external side effects idempotent, to record applied
+// progress, or as fencing token.
+type EntryFSM interface {
+	FSM
+
+	// UpdateEntry applies given entry to state machine. The value
+	// returned will be made available as result of UpdateFSM task.
+	//
+	// FSM.Update is not called, if FSM implements EntryFSM.
+	UpdateEntry(e FSMEntry) interface{}
+}
+
+// BatchFSM is an optional interface, that can be implemented by FSM
+// to apply multiple entries together. This is useful for FSMs, backed
+// by embedded database, to apply the entries in single transaction.
+type BatchFSM interface {
+	FSM
+
+	// UpdateBatch applies given entries to state machine, in order.
+	// It must return one result per entry. The results will be made
+	// available as result of corresponding UpdateFSM tasks.
+	//
+	// FSM.Update and EntryFSM.UpdateEntry are not called, if FSM
+	// implements BatchFSM.
+	UpdateBatch(entries []FSMEntry) []interface{}
+}
+
+// PersistentFSM is an optional interface, that can be implemented by FSM
+// whose state is durable, such as FSM backed by embedded database. Such FSM
+// should also implement EntryFSM or BatchFSM, to record the index of last
+// applied entry along with its state.
+type PersistentFSM interface {
+	FSM
+
+	// LastApplied returns the index of last entry, that is durably applied
+	// to FSM. On startup, raft skips restoring from snapshot and replays only
+	// the entries after this index, if this index is not behind the latest
+	// snapshot. Otherwise FSM is restored from latest snapshot.
+	LastApplied() (uint64, error)
+
+	// RestoreFile is called instead of FSM.Restore, with the path to
+	// snapshot file. The file is owned by raft, and it may be removed
+	// after this call returns. If the snapshot is encrypted, FSM.Restore
+	// is called instead.
+	RestoreFile(path string) error
+}
+
 // FSMState captures the current state of FSM.
 // It is returned by an FSM in response to a Snapshot.
 // It must be safe to invoke FSMState methods with concurrent
@@ -63,13 +122,49 @@ type FSMState interface {
 	Release()
 }
 
+// Codec is used to carry FSM commands and results over the Client
+// protocol, which deals only with bytes.
+//
+// The methods in Codec can be called concurrently.
+type Codec interface {
+	// DecodeRead decodes the query submitted with Client.Read,
+	// into the command that is passed to FSM.Read.
+	DecodeRead(query []byte) (interface{}, error)
+
+	// EncodeResult encodes the value returned by FSM.Update or
+	// FSM.Read, which is sent back to the Client.
+	EncodeResult(v interface{}) ([]byte, error)
+}
+
+// bytesCodec is the default Codec. It passes the query to FSM.Read
+// as is, and accepts only nil, []byte or string as results.
+type bytesCodec struct{}
+
+func (bytesCodec) DecodeRead(query []byte) (interface{}, error) {
+	return query, nil
+}
+
+func (bytesCodec) EncodeResult(v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	}
+	return nil, fmt.Errorf("raft: cannot encode result of type %T, use Options.Codec", v)
+}
+
 type stateMachine struct {
 	FSM
-	id    uint64
-	index uint64
-	term  uint64
-	ch    chan interface{}
-	snaps *snapshots
+	id       uint64
+	index    uint64
+	term     uint64
+	applied  uint64 // index, published atomically for Raft.info
+	ch       chan interface{}
+	snaps    *snapshots
+	sessions *sessions
 }
 
 func (fsm *stateMachine) runLoop() {
@@ -103,6 +198,55 @@ func (fsm *stateMachine) runLoop() {
 }
 
 func (fsm *stateMachine) onApply(t fsmApply) {
+	bfsm, _ := fsm.FSM.(BatchFSM)
+	var updates []FSMEntry
+	var pending []pendingUpdate
+	flush := func() {
+		if len(updates) == 0 {
+			return
+		}
+		results := bfsm.UpdateBatch(updates)
+		if len(results) != len(updates) {
+			err := fmt.Errorf("got %d results for %d entries", len(results), len(updates))
+			panic(opError(err, "BatchFSM.UpdateBatch"))
+		}
+		for i, p := range pending {
+			fsm.reply(p, results[i])
+		}
+		updates, pending = updates[:0], pending[:0]
+	}
+
+	// apply applies log entry e, and replies to ne if not nil
+	apply := func(e *entry, ne *newEntry) {
+		var resp interface{}
+		switch e.typ {
+		case entryUpdate, entryUpdateSession:
+			var p *pendingUpdate
+			var fe FSMEntry
+			if p, fe, resp = fsm.checkUpdate(e, ne, flush); p == nil {
+				break
+			}
+			if bfsm != nil {
+				// replied on flush
+				updates = append(updates, fe)
+				pending = append(pending, *p)
+				return
+			}
+			fsm.reply(*p, fsm.update(fe))
+			return
+		case entryOpenSession:
+			resp = fsm.sessions.open(e)
+		default:
+			flush() // reads and barriers must see preceding updates
+			if e.typ == entryRead || e.typ == entryDirtyRead {
+				resp = fsm.Read(ne.cmd)
+			}
+		}
+		if ne != nil {
+			ne.reply(resp)
+		}
+	}
+
 	// process all entries before t.neHead from log
 	commitIndex := t.log.LastIndex()
 	front := commitIndex + 1
@@ -122,10 +266,8 @@ func (fsm *stateMachine) onApply(t fsmApply) {
 		if trace {
 			println(fsm, "apply", e.typ, e.index)
 		}
-		if e.typ == entryUpdate {
-			fsm.Update(e.data)
-		}
-		fsm.index, fsm.term = e.index, e.term
+		apply(e, nil)
+		fsm.setIndex(e.index, e.term)
 	}
 
 	// process all entries from t.neHead if any
@@ -134,20 +276,64 @@ func (fsm *stateMachine) onApply(t fsmApply) {
 		if trace {
 			println(fsm, "apply", ne.typ, ne.index)
 		}
-		var resp interface{}
-		if ne.typ == entryRead || ne.typ == entryDirtyRead {
-			resp = fsm.Read(ne.cmd)
-		} else if ne.typ == entryUpdate {
-			resp = fsm.Update(ne.data)
-		}
 		if ne.isLogEntry() {
-			fsm.index, fsm.term = ne.index, ne.term
+			fsm.setIndex(ne.index, ne.term)
 		}
-		ne.reply(resp)
+		apply(ne.entry, ne)
 	}
+	flush()
 	assert(fsm.index == commitIndex)
 }
 
+// pendingUpdate is an update that is being applied to FSM.
+type pendingUpdate struct {
+	ne   *newEntry // nil for entries from log
+	sess *session  // nil for entryUpdate
+}
+
+// checkUpdate returns the update to be applied for entryUpdate or
+// entryUpdateSession. If the update must not be applied, it returns
+// nil along with the response to be sent.
+func (fsm *stateMachine) checkUpdate(e *entry, ne *newEntry, flush func()) (*pendingUpdate, FSMEntry, interface{}) {
+	p, fe := &pendingUpdate{ne: ne}, FSMEntry{e.index, e.term, e.data}
+	if e.typ == entryUpdate {
+		return p, fe, nil
+	}
+	sess, seq := fsm.sessions.lookup(e)
+	switch {
+	case sess == nil:
+		return nil, fe, ErrSessionExpired
+	case seq == sess.seq && seq > 0:
+		if sess.pending {
+			flush() // original update is in batch
+		}
+		return nil, fe, sess.result
+	case seq < sess.seq || seq == 0:
+		return nil, fe, ErrDuplicateRequest
+	}
+	sess.seq, sess.result, sess.pending = seq, nil, true
+	p.sess, fe.Cmd = sess, e.data[sessionHeaderLen:]
+	return p, fe, nil
+}
+
+// reply records the result of update in its session if any,
+// and replies to its newEntry if any.
+func (fsm *stateMachine) reply(p pendingUpdate, result interface{}) {
+	if p.sess != nil {
+		result = fsm.sessions.record(p.sess, result)
+	}
+	if p.ne != nil {
+		p.ne.reply(result)
+	}
+}
+
+func (fsm *stateMachine) update(e FSMEntry) interface{} {
+	if efsm, ok := fsm.FSM.(EntryFSM); ok {
+		return efsm.UpdateEntry(e)
+	}
+	return fsm.Update(e.Cmd)
+}
+
 func (fsm *stateMachine) onSnapReq(t fsmSnapReq) {
 	if fsm.index == fsm.snaps.index {
 		t.reply(ErrNoUpdates)
@@ -166,9 +352,10 @@ func (fsm *stateMachine) onSnapReq(t fsmSnapReq) {
 		return
 	}
 	t.reply(fsmSnapResp{
-		index: fsm.index,
-		term:  fsm.term,
-		state: state,
+		index:    fsm.index,
+		term:     fsm.term,
+		state:    state,
+		sessions: fsm.sessions.bytes(),
 	})
 }
 
@@ -178,13 +365,25 @@ func (fsm *stateMachine) onRestoreReq() error {
 		return opError(err, "snapshots.open")
 	}
 	defer snap.release()
-	if err = fsm.Restore(bufio.NewReader(snap.file)); err != nil {
+	if pfsm, ok := fsm.FSM.(PersistentFSM); ok && snap.meta.keyID == 0 {
+		if err = pfsm.RestoreFile(snap.file.Name()); err != nil {
+			return opError(err, "PersistentFSM.RestoreFile")
+		}
+	} else if err = fsm.Restore(bufio.NewReader(snap.r)); err != nil {
 		return opError(err, "FSM.Restore")
 	}
-	fsm.index, fsm.term = snap.meta.index, snap.meta.term
+	if err = fsm.sessions.restore(snap.meta.sessions); err != nil {
+		return opError(err, "sessions.restore")
+	}
+	fsm.setIndex(snap.meta.index, snap.meta.term)
 	return nil
 }
 
+func (fsm *stateMachine) setIndex(index, term uint64) {
+	fsm.index, fsm.term = index, term
+	atomic.StoreUint64(&fsm.applied, index)
+}
+
 type fsmApply struct {
 	neHead *newEntry
 	log    *log.Log
@@ -199,12 +398,76 @@ type lastApplied struct {
 }
 
 func (r *Raft) lastApplied() uint64 {
+	// fsm does not process tasks until restore is finished,
+	// which may take long. so use the index it published
+	if r.restoring {
+		return atomic.LoadUint64(&r.fsm.applied)
+	}
 	t := lastApplied{newTask()}
 	r.fsm.ch <- t
 	<-t.done
 	return t.result.(uint64)
 }
 
+// persistentApplied returns the index and term of last entry applied to
+// PersistentFSM. ok is false, if fsm is not persistent, or if it must be
+// restored from snapshot. Must be called before fsm.runLoop is started.
+func (r *Raft) persistentApplied() (index, term uint64, ok bool, err error) {
+	pfsm, isPersistent := r.fsm.FSM.(PersistentFSM)
+	if !isPersistent {
+		return 0, 0, false, nil
+	}
+	if index, err = pfsm.LastApplied(); err != nil {
+		return 0, 0, false, opError(err, "PersistentFSM.LastApplied")
+	}
+	switch {
+	case index > r.lastLogIndex:
+		err = fmt.Errorf("last applied %d is beyond last log index %d", index, r.lastLogIndex)
+		return 0, 0, false, opError(err, "PersistentFSM.LastApplied")
+	case index == r.snaps.index:
+		return index, r.snaps.term, true, nil
+	case index > r.snaps.index && r.log.Contains(index):
+		if term, err = r.storage.getEntryTerm(index); err != nil {
+			return 0, 0, false, err
+		}
+		return index, term, true, nil
+	}
+	return 0, 0, false, nil
+}
+
+// restoreSessions restores sessions from latest snapshot, and replays
+// session entries from log upto index. Results of the replayed updates
+// are not available, because they are not applied to FSM. Must be
+// called before fsm.runLoop is started.
+func (fsm *stateMachine) restoreSessions(l *log.Log, index uint64) error {
+	meta, err := fsm.snaps.meta()
+	if err != nil {
+		return opError(err, "snapshots.meta")
+	}
+	if err = fsm.sessions.restore(meta.sessions); err != nil {
+		return opError(err, "sessions.restore")
+	}
+	for i := meta.index + 1; i <= index; i++ {
+		b, err := l.Get(i)
+		if err != nil {
+			return opError(err, "Log.Get(%d)", i)
+		}
+		e := &entry{}
+		if err := e.decode(bytes.NewReader(b)); err != nil {
+			return opError(err, "Log.Get(%d).decode", i)
+		}
+		switch e.typ {
+		case entryOpenSession:
+			fsm.sessions.open(e)
+		case entryUpdateSession:
+			if sess, seq := fsm.sessions.lookup(e); sess != nil && seq > sess.seq {
+				sess.seq, sess.result = seq, ErrDuplicateRequest
+			}
+		}
+	}
+	return nil
+}
+
 // raft(onRestart/onInstallSnapReq) -> fsmLoop
 type fsmRestoreReq struct {
 	err chan error
@@ -218,6 +481,10 @@ func (r *Raft) onTakeSnapshot(t takeSnapshot) {
 		t.reply(InProgressError("takeSnapshot"))
 		return
 	}
+	if r.restoring {
+		t.reply(InProgressError("restoreFSM"))
+		return
+	}
 	r.snapTakenCh = make(chan snapTaken, 1)
 	go func(index uint64, config Config) { // tracked by r.snapTakenCh
 		meta, err := doTakeSnapshot(r.fsm, index, config)
@@ -244,11 +511,11 @@ func doTakeSnapshot(fsm *stateMachine, index uint64, config Config) (snapshotMet
 	defer resp.state.Release()
 
 	// write snapshot to storage
-	sink, err := fsm.snaps.new(resp.index, resp.term, config)
+	sink, err := fsm.snaps.new(resp.index, resp.term, config, resp.sessions)
 	if err != nil {
 		return snapshotMeta{}, opError(err, "snapshots.new")
 	}
-	bufw := bufio.NewWriter(sink.file)
+	bufw := bufio.NewWriter(sink.w)
 	err = resp.state.Persist(bufw)
 	if err == nil {
 		err = bufw.Flush()
@@ -268,26 +535,37 @@ func (r *Raft) onSnapshotTaken(t snapTaken) {
 
 	if t.err != nil {
 		if err, ok := t.err.(OpError); ok {
-			r.logger.Warn(trimPrefix(err))
+			r.logger.Error("snapshot failed", "err", trimPrefix(err))
 			r.alerts.Error(err)
 		}
 		t.req.reply(t.err)
 		return
 	}
+	r.freeAt = time.Time{} // snapshot used space, measure again
 
 	if r.storage.log.Contains(t.meta.index) {
 		// find compact index
 		// nowCompact: min of all matchIndex
 		// canCompact: min of online matchIndex
-		nowCompact, canCompact := t.meta.index, t.meta.index
+		// both are limited to retain trailing logs
+		limit := r.compactLimit(t.meta.index)
+		nowCompact, canCompact := limit, limit
+		var repls []*replication
 		if r.state == Leader {
 			for _, repl := range r.ldr.repls {
-				if repl.status.matchIndex < nowCompact {
-					nowCompact = repl.status.matchIndex
-				}
-				if repl.status.noContact.IsZero() && repl.status.matchIndex < canCompact {
-					canCompact = repl.status.matchIndex
-				}
+				repls = append(repls, repl)
+			}
+		} else if r.state == Follower {
+			for _, rl := range r.flr.relays {
+				repls = append(repls, rl.replication)
+			}
+		}
+		for _, repl := range repls {
+			if repl.status.matchIndex < nowCompact {
+				nowCompact = repl.status.matchIndex
+			}
+			if repl.status.noContact.IsZero() && repl.status.matchIndex < canCompact {
+				canCompact = repl.status.matchIndex
 			}
 		}
 		if trace {
@@ -302,13 +580,56 @@ func (r *Raft) onSnapshotTaken(t snapTaken) {
 		}
 		if canCompact > nowCompact {
 			// notify repls with new logView
-			r.ldr.removeLTE = canCompact
-			r.ldr.notifyFlr(false)
+			if r.state == Leader {
+				r.ldr.removeLTE = canCompact
+				r.ldr.notifyFlr(false)
+			} else {
+				r.flr.removeLTE = canCompact
+				r.flr.notifyRelays()
+			}
 		}
 	}
 	t.req.reply(t.meta.index)
 }
 
+// compactLimit returns the index upto which log can be compacted
+// after snapshot at index, such that trailingLogs entries and
+// trailingBytes bytes of entries before index are retained.
+func (r *Raft) compactLimit(index uint64) uint64 {
+	if index <= r.trailingLogs {
+		return 0
+	}
+	limit := r.log.CanLTE(index - r.trailingLogs)
+	if r.trailingBytes > 0 {
+		size := r.log.DataSize(index)
+		for limit > r.log.PrevIndex() && size-r.log.DataSize(limit) < r.trailingBytes {
+			limit = r.log.CanLTE(limit - 1)
+		}
+	}
+	return limit
+}
+
+// checkSnapshotTriggers takes snapshot without waiting for snapTimer,
+// if log has grown beyond snapBytes since recent snapshot, or if free
+// space in storage is low. It is called whenever commitIndex advances.
+func (r *Raft) checkSnapshotTriggers() {
+	if r.snapTakenCh != nil || r.restoring || r.commitIndex <= r.snaps.index || r.commitIndex < r.snaps.index+r.snapThreshold {
+		return
+	}
+	reason := ""
+	if r.snapBytes > 0 && r.logBytes() >= r.snapBytes {
+		reason = "log size"
+	} else if r.snapFreeBytes > 0 || r.minFreeBytes > 0 {
+		if free := r.freeBytes(); free < r.snapFreeBytes || free < r.minFreeBytes {
+			reason = "low disk space"
+		}
+	}
+	if reason != "" {
+		r.logger.Info("taking snapshot", "reason", reason)
+		r.onTakeSnapshot(takeSnapshot{threshold: r.snapThreshold})
+	}
+}
+
 // takeSnapshot() -> fsmLoop
 type fsmSnapReq struct {
 	*task
@@ -317,9 +638,10 @@ type fsmSnapReq struct {
 
 // takeSnapshot() <- fsmLoop
 type fsmSnapResp struct {
-	index uint64
-	term  uint64
-	state FSMState
+	index    uint64
+	term     uint64
+	state    FSMState
+	sessions []byte
 }
 
 // snapLoop -> raft (after snapshot taken)
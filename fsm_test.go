@@ -15,7 +15,13 @@
 package raft
 
 import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestFSM_takeSnap_emptyLog(t *testing.T) {
@@ -93,3 +99,253 @@ func TestFSM_takeSnap_restartSendUpdates(t *testing.T) {
 	c.sendUpdates(r, 1, 3)
 	c.waitFSMLen(fsmLen+3, r)
 }
+
+type batchFSMMock struct {
+	*fsmMock
+	batches [][]uint64 // indexes of entries in each batch
+}
+
+func (fsm *batchFSMMock) Update(cmd []byte) interface{} {
+	panic("Update must not be called on BatchFSM")
+}
+
+func (fsm *batchFSMMock) UpdateBatch(entries []FSMEntry) []interface{} {
+	var indexes []uint64
+	var results []interface{}
+	for _, e := range entries {
+		indexes = append(indexes, e.Index)
+		results = append(results, fsm.fsmMock.Update(e.Cmd))
+	}
+	fsm.batches = append(fsm.batches, indexes)
+	return results
+}
+
+func TestFSM_trailingBytes(t *testing.T) {
+	opt := DefaultOptions()
+	opt.Logger = nil
+	opt.LogSegmentSize = 1024
+	opt.TrailingBytes = 2048
+	r := launchNode(t, opt, &fsmMock{id: identity{1, 1}}, "")
+	defer func() { _ = r.Shutdown(context.Background()) }()
+	for i := 1; i <= 200; i++ {
+		if _, err := r.Execute(context.Background(), UpdateFSM([]byte(fmt.Sprintf("update:%d", i)))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snapIndex, err := r.Execute(context.Background(), TakeSnapshot(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = r.inspect(func(r *Raft) {
+		prevIndex := r.log.PrevIndex()
+		if prevIndex == 0 {
+			t.Fatal("log is not compacted")
+		}
+		if size := r.log.DataSize(snapIndex.(uint64)) - r.log.DataSize(prevIndex); size < opt.TrailingBytes {
+			t.Fatalf("retained %d bytes, want >=%d", size, opt.TrailingBytes)
+		}
+	})
+}
+
+func TestFSM_snapshotBytes(t *testing.T) {
+	opt := DefaultOptions()
+	opt.Logger = nil
+	opt.LogSegmentSize = 1024
+	opt.SnapshotInterval = 0
+	opt.SnapshotThreshold = 1
+	opt.SnapshotBytes = 4096
+	r := launchNode(t, opt, &fsmMock{id: identity{1, 1}}, "")
+	defer func() { _ = r.Shutdown(context.Background()) }()
+	for i := 1; i <= 200; i++ {
+		if _, err := r.Execute(context.Background(), UpdateFSM([]byte(fmt.Sprintf("update:%d", i)))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !waitForCondition(func() bool {
+		var logBytes int64
+		_ = r.inspect(func(r *Raft) {
+			if r.snapTakenCh == nil {
+				logBytes = r.logBytes()
+			} else {
+				logBytes = opt.SnapshotBytes
+			}
+		})
+		return logBytes < opt.SnapshotBytes
+	}, 10*time.Millisecond, 5*time.Second) {
+		t.Fatal("log size since snapshot must be less than SnapshotBytes")
+	}
+	if index, _ := r.snaps.latest(); index == 0 {
+		t.Fatal("snapshot must be taken")
+	}
+}
+
+func TestFSM_updateBatch(t *testing.T) {
+	opt := DefaultOptions()
+	opt.Logger = nil
+	fsm := &batchFSMMock{fsmMock: &fsmMock{id: identity{1, 1}}}
+	r := launchNode(t, opt, fsm, "")
+	defer func() { _ = r.Shutdown(context.Background()) }()
+
+	// block raft loop, so that all tasks are applied in single round
+	started, block := make(chan struct{}), make(chan struct{})
+	go func() {
+		_ = r.inspect(func(*Raft) {
+			close(started)
+			<-block
+		})
+	}()
+	<-started
+	var tasks []FSMTask
+	for i := 1; i <= 5; i++ {
+		if i == 4 {
+			t := ReadFSM("last")
+			r.FSMTasks() <- t
+			tasks = append(tasks, t)
+		}
+		t := UpdateFSM([]byte(fmt.Sprintf("update:%d", i)))
+		r.FSMTasks() <- t
+		tasks = append(tasks, t)
+	}
+	close(block)
+
+	want := []fsmReply{{"update:1", 1}, {"update:2", 2}, {"update:3", 3}, {"update:3", 2}, {"update:4", 4}, {"update:5", 5}}
+	for i, task := range tasks {
+		<-task.Done()
+		if task.Err() != nil {
+			t.Fatal(task.Err())
+		}
+		if got := task.Result(); got != want[i] {
+			t.Fatalf("tasks[%d].result=%v, want %v", i, got, want[i])
+		}
+	}
+	// read splits the batch
+	if got, want := fmt.Sprint(fsm.batches), "[[3 4 5] [6 7]]"; got != want {
+		t.Fatalf("batches=%s, want %s", got, want)
+	}
+}
+
+type entryFSMMock struct {
+	*fsmMock
+	entries []FSMEntry
+}
+
+func (fsm *entryFSMMock) Update(cmd []byte) interface{} {
+	panic("Update must not be called on EntryFSM")
+}
+
+func (fsm *entryFSMMock) UpdateEntry(e FSMEntry) interface{} {
+	fsm.entries = append(fsm.entries, FSMEntry{Index: e.Index, Term: e.Term})
+	return fsm.fsmMock.Update(e.Cmd)
+}
+
+func TestFSM_updateEntry(t *testing.T) {
+	opt := DefaultOptions()
+	opt.Logger = nil
+	fsm := &entryFSMMock{fsmMock: &fsmMock{id: identity{1, 1}}}
+	r := launchNode(t, opt, fsm, "")
+	defer func() { _ = r.Shutdown(context.Background()) }()
+
+	for i := 1; i <= 3; i++ {
+		if _, err := r.Execute(context.Background(), UpdateFSM([]byte("update"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	info, err := r.Execute(context.Background(), GetInfo())
+	if err != nil {
+		t.Fatal(err)
+	}
+	term := info.(Info).Term
+	want := []FSMEntry{{Index: 3, Term: term}, {Index: 4, Term: term}, {Index: 5, Term: term}}
+	if !reflect.DeepEqual(fsm.entries, want) {
+		t.Fatalf("entries=%v, want %v", fsm.entries, want)
+	}
+}
+
+type persistentFSMMock struct {
+	*fsmMock
+	lastApplied uint64
+	updates     int
+	restores    int
+}
+
+func (fsm *persistentFSMMock) Update(cmd []byte) interface{} {
+	panic("Update must not be called on EntryFSM")
+}
+
+func (fsm *persistentFSMMock) UpdateEntry(e FSMEntry) interface{} {
+	fsm.lastApplied = e.Index
+	fsm.updates++
+	return fsm.fsmMock.Update(e.Cmd)
+}
+
+func (fsm *persistentFSMMock) LastApplied() (uint64, error) {
+	return fsm.lastApplied, nil
+}
+
+func (fsm *persistentFSMMock) RestoreFile(path string) error {
+	fsm.restores++
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return fsm.fsmMock.Restore(f)
+}
+
+func TestFSM_persistent(t *testing.T) {
+	opt := DefaultOptions()
+	opt.Logger = nil
+	opt.SnapshotInterval = 0
+	execute := func(r *Raft, task Task) interface{} {
+		t.Helper()
+		result, err := r.Execute(context.Background(), task)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	update := func(r *Raft, from, to int) {
+		t.Helper()
+		for i := from; i <= to; i++ {
+			execute(r, UpdateFSM([]byte(fmt.Sprintf("update:%d", i))))
+		}
+	}
+
+	fsm := &persistentFSMMock{fsmMock: &fsmMock{id: identity{1, 1}}}
+	r := launchNode(t, opt, fsm, "")
+	storageDir := filepath.Dir(r.snaps.dir)
+	update(r, 1, 10)
+	if snapIndex := execute(r, TakeSnapshot(0)); snapIndex != uint64(12) {
+		t.Fatalf("snapIndex=%v, want %d", snapIndex, 12)
+	}
+	update(r, 11, 15)
+	_ = r.Shutdown(context.Background())
+
+	// fsm is up to date, must not be restored, and entries must not be replayed
+	fsm.updates = 0
+	r = launchNode(t, opt, fsm, storageDir)
+	update(r, 16, 16)
+	execute(r, BarrierFSM())
+	if fsm.restores != 0 || fsm.updates != 1 {
+		t.Fatalf("restores=%d updates=%d, want 0 1", fsm.restores, fsm.updates)
+	}
+	if got := fsm.len(); got != 16 {
+		t.Fatalf("fsm.len=%d, want %d", got, 16)
+	}
+	_ = r.Shutdown(context.Background())
+
+	// fsm lost its state, must be restored from snapshot, and remaining entries replayed
+	fsm = &persistentFSMMock{fsmMock: &fsmMock{id: identity{1, 1}}}
+	r = launchNode(t, opt, fsm, storageDir)
+	defer func() { _ = r.Shutdown(context.Background()) }()
+	execute(r, BarrierFSM())
+	if fsm.restores != 1 || fsm.updates != 6 {
+		t.Fatalf("restores=%d updates=%d, want 1 6", fsm.restores, fsm.updates)
+	}
+	if got := fsm.len(); got != 16 {
+		t.Fatalf("fsm.len=%d, want %d", got, 16)
+	}
+	if got := fsm.lastCommand(); got != "update:16" {
+		t.Fatalf("lastCommand=%q, want %q", got, "update:16")
+	}
+}
@@ -0,0 +1,284 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package httpadmin provides http.Handler which exposes raft admin tasks
+// as JSON endpoints. It mirrors the tasks supported by raft.Client.
+//
+//   method  path                 task                          response
+//   ------------------------------------------------------------------------------
+//   GET     /info                GetInfo                       raft.Info
+//   GET     /config              GetInfo                       raft.Configs
+//   POST    /config              ChangeConfig(body)            204
+//   POST    /config/wait         WaitForStableConfig           raft.Config
+//   POST    /snapshot?threshold  TakeSnapshot(threshold)       {"index": snapIndex}
+//   POST    /transfer?target&timeout
+//                                TransferLeadership            204
+//   GET     /live                liveness probe                200 or 503
+//   GET     /ready               readiness probe               200 or 503
+//
+// The body of POST /config is the JSON encoding of raft.Config, as returned
+// by GET /config. The node ids are taken from keys of Config.Nodes.
+//
+// Errors are reported as JSON object {"type": "...", "error": "..."}. For
+// raft.NotLeaderError, the leader details are included as "leader" field
+// and status code is 421 (Misdirected Request). Temporary errors use
+// status code 503 (Service Unavailable).
+//
+// The node is live, as long as it is not shutdown. The node is ready, if
+// it knows the leader and if it is leader, it is ready to commit. Pass
+// query parameter "leader" to /ready, to require that the node is leader.
+package httpadmin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/santhosh-tekuri/raft"
+)
+
+// NewHandler returns http.Handler that serves admin tasks of given raft node.
+func NewHandler(r *raft.Raft) http.Handler {
+	return handler{r}
+}
+
+type handler struct {
+	r *raft.Raft
+}
+
+func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	switch {
+	case path == "/info" && r.Method == http.MethodGet:
+		h.getInfo(w, r)
+	case path == "/config" && r.Method == http.MethodGet:
+		h.getConfig(w, r)
+	case path == "/config" && r.Method == http.MethodPost:
+		h.changeConfig(w, r)
+	case path == "/config/wait" && r.Method == http.MethodPost:
+		h.waitForStableConfig(w, r)
+	case path == "/snapshot" && r.Method == http.MethodPost:
+		h.takeSnapshot(w, r)
+	case path == "/transfer" && r.Method == http.MethodPost:
+		h.transferLeadership(w, r)
+	case path == "/live" && r.Method == http.MethodGet:
+		h.live(w, r)
+	case path == "/ready" && r.Method == http.MethodGet:
+		h.ready(w, r)
+	case isKnownPath(path):
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func isKnownPath(path string) bool {
+	switch path {
+	case "/info", "/config", "/config/wait", "/snapshot", "/transfer", "/live", "/ready":
+		return true
+	}
+	return false
+}
+
+func (h handler) getInfo(w http.ResponseWriter, r *http.Request) {
+	result, err := h.r.Execute(r.Context(), raft.GetInfo())
+	if err != nil {
+		replyErr(w, err)
+		return
+	}
+	replyJSON(w, http.StatusOK, result)
+}
+
+func (h handler) getConfig(w http.ResponseWriter, r *http.Request) {
+	result, err := h.r.Execute(r.Context(), raft.GetInfo())
+	if err != nil {
+		replyErr(w, err)
+		return
+	}
+	replyJSON(w, http.StatusOK, result.(raft.Info).Configs)
+}
+
+func (h handler) changeConfig(w http.ResponseWriter, r *http.Request) {
+	config := raft.Config{}
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+		replyBadRequest(w, err)
+		return
+	}
+	if config.Nodes == nil {
+		config.Nodes = make(map[uint64]raft.Node)
+	}
+	// fix node.ID
+	for id, n := range config.Nodes {
+		n.ID = id
+		config.Nodes[id] = n
+	}
+	if _, err := h.r.Execute(r.Context(), raft.ChangeConfig(config)); err != nil {
+		replyErr(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h handler) waitForStableConfig(w http.ResponseWriter, r *http.Request) {
+	result, err := h.r.Execute(r.Context(), raft.WaitForStableConfig())
+	if err != nil {
+		replyErr(w, err)
+		return
+	}
+	replyJSON(w, http.StatusOK, result)
+}
+
+func (h handler) takeSnapshot(w http.ResponseWriter, r *http.Request) {
+	var threshold uint64
+	if s := r.URL.Query().Get("threshold"); s != "" {
+		i, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			replyBadRequest(w, fmt.Errorf("invalid threshold: %v", err))
+			return
+		}
+		threshold = i
+	}
+	result, err := h.r.Execute(r.Context(), raft.TakeSnapshot(threshold))
+	if err != nil {
+		replyErr(w, err)
+		return
+	}
+	replyJSON(w, http.StatusOK, struct {
+		Index uint64 `json:"index"`
+	}{result.(uint64)})
+}
+
+func (h handler) transferLeadership(w http.ResponseWriter, r *http.Request) {
+	var target uint64
+	if s := r.URL.Query().Get("target"); s != "" {
+		i, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			replyBadRequest(w, fmt.Errorf("invalid target: %v", err))
+			return
+		}
+		target = i
+	}
+	var timeout time.Duration
+	if s := r.URL.Query().Get("timeout"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			replyBadRequest(w, fmt.Errorf("invalid timeout: %v", err))
+			return
+		}
+		timeout = d
+	}
+	if _, err := h.r.Execute(r.Context(), raft.TransferLeadership(target, timeout)); err != nil {
+		replyErr(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h handler) live(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-h.r.Closed():
+		replyErr(w, raft.ErrServerClosed)
+	default:
+		replyJSON(w, http.StatusOK, struct {
+			Live bool `json:"live"`
+		}{true})
+	}
+}
+
+func (h handler) ready(w http.ResponseWriter, r *http.Request) {
+	result, err := h.r.Execute(r.Context(), raft.GetInfo())
+	if err != nil {
+		replyErr(w, err)
+		return
+	}
+	info := result.(raft.Info)
+	_, leaderOnly := r.URL.Query()["leader"]
+	var reason string
+	switch {
+	case info.Leader == 0:
+		reason = "no known leader"
+	case leaderOnly && info.State != raft.Leader:
+		reason = "not leader"
+	case info.State == raft.Leader && !info.CommitReady:
+		reason = "leader not ready to commit"
+	}
+	resp := struct {
+		Ready  bool       `json:"ready"`
+		Reason string     `json:"reason,omitempty"`
+		State  raft.State `json:"state"`
+		Leader uint64     `json:"leader,omitempty"`
+	}{reason == "", reason, info.State, info.Leader}
+	if reason != "" {
+		replyJSON(w, http.StatusServiceUnavailable, resp)
+		return
+	}
+	replyJSON(w, http.StatusOK, resp)
+}
+
+// reply -------------------------------------------------------
+
+type errorBody struct {
+	Type   string      `json:"type"`
+	Error  string      `json:"error"`
+	Leader *leaderBody `json:"leader,omitempty"`
+}
+
+type leaderBody struct {
+	ID   uint64 `json:"id"`
+	Addr string `json:"addr"`
+	Data string `json:"data,omitempty"`
+}
+
+func replyErr(w http.ResponseWriter, err error) {
+	body := errorBody{Type: fmt.Sprintf("%T", err), Error: err.Error()}
+	status := http.StatusInternalServerError
+	switch e := err.(type) {
+	case raft.NotLeaderError:
+		status = http.StatusMisdirectedRequest
+		if e.Leader.ID != 0 {
+			body.Leader = &leaderBody{e.Leader.ID, e.Leader.Addr, e.Leader.Data}
+		}
+	case raft.TemporaryError:
+		status = http.StatusServiceUnavailable
+	default:
+		switch err {
+		case raft.ErrServerClosed:
+			status = http.StatusServiceUnavailable
+		case raft.ErrStaleConfig:
+			status = http.StatusConflict
+		case raft.ErrSnapshotThreshold, raft.ErrNoUpdates:
+			status = http.StatusPreconditionFailed
+		case raft.ErrTransferInvalidTarget, raft.ErrTransferSelf, raft.ErrTransferTargetNonvoter, raft.ErrTransferNoVoter:
+			status = http.StatusBadRequest
+		}
+	case raft.ContextError:
+		status = http.StatusGatewayTimeout
+	}
+	replyJSON(w, status, body)
+}
+
+func replyBadRequest(w http.ResponseWriter, err error) {
+	replyJSON(w, http.StatusBadRequest, errorBody{Type: "badRequest", Error: err.Error()})
+}
+
+func replyJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(v)
+}
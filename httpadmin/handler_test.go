@@ -0,0 +1,211 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpadmin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/santhosh-tekuri/raft"
+)
+
+func TestHandler(t *testing.T) {
+	r, addr, dir := launch(t)
+	defer func() {
+		_ = r.Shutdown(context.Background())
+		_ = os.RemoveAll(dir)
+	}()
+	s := httptest.NewServer(NewHandler(r))
+	defer s.Close()
+
+	// not bootstrapped yet
+	if got := do(t, s, http.MethodGet, "/live", nil, nil); got != http.StatusOK {
+		t.Fatalf("live: got %d, want %d", got, http.StatusOK)
+	}
+	if got := do(t, s, http.MethodGet, "/ready", nil, nil); got != http.StatusServiceUnavailable {
+		t.Fatalf("ready: got %d, want %d", got, http.StatusServiceUnavailable)
+	}
+
+	// bootstrap
+	configs := raft.Configs{}
+	if got := do(t, s, http.MethodGet, "/config", nil, &configs); got != http.StatusOK {
+		t.Fatalf("getConfig: got %d, want %d", got, http.StatusOK)
+	}
+	config := configs.Latest
+	if err := config.AddVoter(r.NID(), addr); err != nil {
+		t.Fatal(err)
+	}
+	body, _ := json.Marshal(config)
+	if got := do(t, s, http.MethodPost, "/config", body, nil); got != http.StatusNoContent {
+		t.Fatalf("changeConfig: got %d, want %d", got, http.StatusNoContent)
+	}
+	if got := do(t, s, http.MethodPost, "/config", body, nil); got != http.StatusConflict {
+		t.Fatalf("changeConfig: got %d, want %d", got, http.StatusConflict)
+	}
+
+	// wait for ready
+	ready := false
+	for i := 0; i < 50 && !ready; i++ {
+		ready = do(t, s, http.MethodGet, "/ready?leader", nil, nil) == http.StatusOK
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !ready {
+		t.Fatal("node is not ready")
+	}
+
+	info := raft.Info{}
+	if got := do(t, s, http.MethodGet, "/info", nil, &info); got != http.StatusOK {
+		t.Fatalf("info: got %d, want %d", got, http.StatusOK)
+	}
+	if info.State != raft.Leader || !info.CommitReady {
+		t.Fatalf("info: state=%v commitReady=%v", info.State, info.CommitReady)
+	}
+
+	stable := raft.Config{}
+	if got := do(t, s, http.MethodPost, "/config/wait", nil, &stable); got != http.StatusOK {
+		t.Fatalf("waitForStableConfig: got %d, want %d", got, http.StatusOK)
+	}
+	if _, ok := stable.Nodes[r.NID()]; !ok {
+		t.Fatalf("waitForStableConfig: got %v", stable)
+	}
+
+	// snapshot
+	snap := struct{ Index uint64 }{}
+	if got := do(t, s, http.MethodPost, "/snapshot", nil, &snap); got != http.StatusOK {
+		t.Fatalf("takeSnapshot: got %d, want %d", got, http.StatusOK)
+	}
+	if snap.Index != 2 {
+		t.Fatalf("takeSnapshot: index=%d, want 2", snap.Index)
+	}
+	errBody := struct{ Error string }{}
+	if got := do(t, s, http.MethodPost, "/snapshot", nil, &errBody); got != http.StatusPreconditionFailed {
+		t.Fatalf("takeSnapshot: got %d, want %d", got, http.StatusPreconditionFailed)
+	}
+	if errBody.Error != raft.ErrNoUpdates.Error() {
+		t.Fatalf("takeSnapshot: got %q, want %q", errBody.Error, raft.ErrNoUpdates)
+	}
+
+	// transfer
+	if got := do(t, s, http.MethodPost, "/transfer?timeout=1s", nil, nil); got != http.StatusBadRequest {
+		t.Fatalf("transfer: got %d, want %d", got, http.StatusBadRequest)
+	}
+	if got := do(t, s, http.MethodPost, "/transfer?timeout=xyz", nil, nil); got != http.StatusBadRequest {
+		t.Fatalf("transfer: got %d, want %d", got, http.StatusBadRequest)
+	}
+
+	// misc
+	if got := do(t, s, http.MethodDelete, "/info", nil, nil); got != http.StatusMethodNotAllowed {
+		t.Fatalf("got %d, want %d", got, http.StatusMethodNotAllowed)
+	}
+	if got := do(t, s, http.MethodGet, "/xyz", nil, nil); got != http.StatusNotFound {
+		t.Fatalf("got %d, want %d", got, http.StatusNotFound)
+	}
+}
+
+// helpers -------------------------------------------------------------------
+
+func launch(t *testing.T) (r *raft.Raft, addr, dir string) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "httpadmin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = raft.SetIdentity(dir, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	opt := raft.DefaultOptions()
+	opt.Logger = nil
+	opt.HeartbeatTimeout = 200 * time.Millisecond
+	r, err = raft.New(opt, new(fsmMock), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = r.Serve(lr)
+	}()
+	return r, lr.Addr().String(), dir
+}
+
+func do(t *testing.T, s *httptest.Server, method, path string, body []byte, v interface{}) int {
+	t.Helper()
+	req, err := http.NewRequest(method, s.URL+path, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+			t.Fatalf("%s %s: Content-Type=%q", method, path, ct)
+		}
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+type fsmMock struct {
+	cmds []string
+}
+
+func (fsm *fsmMock) Update(cmd []byte) interface{} {
+	fsm.cmds = append(fsm.cmds, string(cmd))
+	return nil
+}
+
+func (fsm *fsmMock) Read(cmd interface{}) interface{} {
+	return fmt.Errorf("unknown cmd %v", cmd)
+}
+
+func (fsm *fsmMock) Snapshot() (raft.FSMState, error) {
+	return fsmState(strings.Join(fsm.cmds, "\n")), nil
+}
+
+func (fsm *fsmMock) Restore(r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	fsm.cmds = strings.Split(string(b), "\n")
+	return nil
+}
+
+type fsmState string
+
+func (s fsmState) Persist(w io.Writer) error {
+	_, err := io.WriteString(w, string(s))
+	return err
+}
+
+func (s fsmState) Release() {}
@@ -56,9 +56,9 @@ func (l *leader) init() {
 	l.removeLTE = l.log.PrevIndex()
 
 	// start replication routine for each follower
-	for id, n := range l.configs.Latest.Nodes {
+	for _, id := range l.configs.Latest.ids() {
 		if id != l.nid {
-			l.addReplication(n)
+			l.addReplication(l.configs.Latest.Nodes[id])
 		}
 	}
 	l.checkConfigActions(nil, l.configs.Latest)
@@ -116,8 +116,13 @@ func (l *leader) release() {
 func (l *leader) storeEntry(ne *newEntry) {
 	assert(ne != nil)
 	lastIndex, configIndex := l.lastLogIndex, l.configs.Latest.Index
+	diskFull := l.checkDiskFull()
 	for ne != nil {
-		if l.transfer.inProgress() {
+		if !ne.accept() {
+			ne.release() // dropped, skip it
+		} else if diskFull && ne.isUpdate() {
+			ne.reply(ErrDiskFull)
+		} else if l.transfer.inProgress() {
 			ne.reply(InProgressError("transferLeadership"))
 		} else if !l.node.Voter {
 			if _, ok := l.configs.Latest.Nodes[l.nid]; ok {
@@ -127,6 +132,9 @@ func (l *leader) storeEntry(ne *newEntry) {
 			}
 		} else {
 			ne.entry.index, ne.entry.term = l.lastLogIndex+1, l.term
+			if ne.isSession() {
+				ne.stampTime(l.clock.Now())
+			}
 			if l.neTail != nil {
 				l.neTail.next, l.neTail = ne, ne
 			} else {
@@ -163,19 +171,44 @@ func (l *leader) storeEntry(ne *newEntry) {
 	}
 }
 
+// checkDiskFull tells whether free space in storage is below
+// minFreeBytes. When so, it also tries to take snapshot, so that
+// log can be compacted.
+func (l *leader) checkDiskFull() bool {
+	if l.minFreeBytes == 0 {
+		return false
+	}
+	free := l.freeBytes()
+	if diskFull := free < l.minFreeBytes; diskFull != l.diskFull {
+		l.diskFull = diskFull
+		if diskFull {
+			l.logger.Warn("refusing updates, disk is almost full", "free", free)
+		} else {
+			l.logger.Info("accepting updates, disk has free space", "free", free)
+		}
+	}
+	if l.diskFull {
+		l.checkSnapshotTriggers()
+	}
+	return l.diskFull
+}
+
 func (l *leader) addReplication(n Node) {
 	assert(n.ID != l.nid) // no replication for leader
 	repl := &replication{
 		node:           n,
-		rtime:          newRandTime(),
+		rtime:          l.rtime.fork(),
 		status:         replicationStatus{id: n.ID, node: n, removeLTE: l.removeLTE},
+		delegateSnaps:  l.delegateSnaps,
+		chainNonvoters: l.chainNonvoters,
 		ldrStartIndex:  l.startIndex,
 		ldrLastIndex:   l.lastLogIndex,
 		matchIndex:     0,
 		nextIndex:      l.lastLogIndex + 1,
 		connPool:       l.getConnPool(n.ID),
 		hbTimeout:      l.hbTimeout,
-		timer:          newSafeTimer(),
+		timer:          newSafeTimer(l.clock),
+		clock:          l.clock,
 		bandwidth:      l.bandwidth,
 		log:            l.storage.log.ViewAt(l.removeLTE, l.lastLogIndex),
 		snaps:          l.storage.snaps,
@@ -228,15 +261,19 @@ func (l *leader) checkReplUpdates(u replUpdate) {
 				noContactUpdated = true
 				status.noContact, status.err = u.time, u.err
 				if u.time.IsZero() {
-					l.logger.Info("node", status.id, "is reachable now")
+					l.logger.Info("node is reachable now", "node", status.id)
 					l.alerts.Reachable(status.id)
 				} else {
-					l.logger.Warn("node", status.id, "is unreachable, reason:", u.err)
+					l.logger.Warn("node is unreachable", "node", status.id, "err", u.err)
 					l.alerts.Unreachable(status.id, u.err)
 				}
 				if tracer.unreachable != nil {
 					tracer.unreachable(l.Raft, status.id, u.time, u.err)
 				}
+			case snapHelper:
+				u.ch <- l.snapHelper(status.id)
+			case relayHelper:
+				u.ch <- l.relayHelper(status.id, u.failed)
 			case newTerm:
 				// if response contains term T > currentTerm:
 				// set currentTerm = T, convert to follower
@@ -290,7 +327,7 @@ func (l *leader) checkQuorum(wait time.Duration) {
 			if trace {
 				println(l, "quorumReachable")
 			}
-			l.logger.Info("quorum is reachable now")
+			l.logger.Info("quorum is reachable now", "term", l.term)
 			l.alerts.QuorumUnreachable()
 			if tracer.quorumUnreachable != nil {
 				tracer.quorumUnreachable(l.Raft, time.Time{})
@@ -301,9 +338,9 @@ func (l *leader) checkQuorum(wait time.Duration) {
 	}
 
 	if l.quorumWait == 0 || !l.timer.active {
-		l.logger.Info("quorum is unreachable")
+		l.logger.Warn("quorum is unreachable", "term", l.term)
 		if tracer.quorumUnreachable != nil {
-			tracer.quorumUnreachable(l.Raft, time.Now())
+			tracer.quorumUnreachable(l.Raft, l.clock.Now())
 		}
 	}
 	if wait == 0 {
@@ -354,12 +391,16 @@ func (l *leader) onMajorityCommit() {
 		l.setCommitIndex(majorityMatchIndex)
 		l.applyCommitted()
 		l.notifyFlr(false) // we updated commit index
+		l.checkSnapshotTriggers()
 	}
 }
 
 // if commitIndex > lastApplied: increment lastApplied, apply
 // log[lastApplied] to state machine
 func (l *leader) applyCommitted() {
+	if l.restoring {
+		return
+	}
 	// add all entries <=commitIndex & add only non-log entries at commitIndex+1
 	var prev, ne *newEntry = nil, l.neHead
 	for ne != nil {
@@ -408,6 +449,96 @@ func (l *leader) notifyFlr(includeConfig bool) {
 	}
 }
 
+// snapHelper returns connPool of the follower, to which sending snapshot
+// to target can be delegated. Such follower must be reachable and must
+// have all committed entries. Follower in the same failure domain as
+// the target is preferred. It returns nil, if there is no such follower.
+func (l *leader) snapHelper(target uint64) *connPool {
+	targetDomain := l.domain(target)
+	var helper *replicationStatus
+	sameDomain := false
+	for id, repl := range l.repls {
+		status := &repl.status
+		if id == target || !status.noContact.IsZero() || status.matchIndex < l.commitIndex {
+			continue
+		}
+		same := l.domain(id) == targetDomain
+		switch {
+		case helper == nil, same && !sameDomain:
+		case same == sameDomain && status.matchIndex > helper.matchIndex:
+		case same == sameDomain && status.matchIndex == helper.matchIndex && id < helper.id:
+		default:
+			continue
+		}
+		helper, sameDomain = status, same
+	}
+	if helper == nil {
+		return nil
+	}
+	if trace {
+		println(l, "snapHelper for", target, "is", helper.id)
+	}
+	return l.getConnPool(helper.id)
+}
+
+// relayHelper returns connPool of the voter follower, through which
+// entries can be relayed to nonvoter target. Such follower must be
+// reachable. Follower in the same failure domain as the target is
+// preferred, then the one relaying to fewer nonvoters. Followers which
+// failed to relay are skipped. It returns nil, if there is no such
+// follower, so that leader replicates by itself.
+func (l *leader) relayHelper(target, failed uint64) *connPool {
+	status := &l.repls[target].status
+	if failed != 0 {
+		if status.relaySkip == nil {
+			status.relaySkip = make(map[uint64]bool)
+		}
+		status.relaySkip[failed] = true
+	}
+	relaying := make(map[uint64]int)
+	for id, repl := range l.repls {
+		if id != target && !repl.status.node.Voter && repl.status.relayedBy != 0 {
+			relaying[repl.status.relayedBy]++
+		}
+	}
+	targetDomain := l.domain(target)
+	var helper *replicationStatus
+	sameDomain := false
+	for id, repl := range l.repls {
+		s := &repl.status
+		if id == target || !s.node.Voter || !s.noContact.IsZero() || status.relaySkip[id] {
+			continue
+		}
+		same := l.domain(id) == targetDomain
+		switch {
+		case helper == nil, same && !sameDomain:
+		case same == sameDomain && relaying[id] < relaying[helper.id]:
+		case same == sameDomain && relaying[id] == relaying[helper.id] && id < helper.id:
+		default:
+			continue
+		}
+		helper, sameDomain = s, same
+	}
+	if helper == nil {
+		// try all followers again, if direct replication fails
+		status.relayedBy, status.relaySkip = 0, nil
+		return nil
+	}
+	if trace {
+		println(l, "relayHelper for", target, "is", helper.id)
+	}
+	status.relayedBy = helper.id
+	return l.getConnPool(helper.id)
+}
+
+// domain returns failure domain of the node with given id.
+func (l *leader) domain(id uint64) string {
+	if l.failureDomain == nil {
+		return ""
+	}
+	return l.failureDomain(l.configs.Latest.Nodes[id])
+}
+
 func (l *leader) checkLogCompact() {
 	for _, repl := range l.repls {
 		if repl.status.removeLTE < l.removeLTE {
@@ -0,0 +1,104 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// KeyProvider provides the keys used to encrypt data. The keys
+// of all data that is retained, must be available.
+type KeyProvider interface {
+	// CurrentKey returns the key used to encrypt new data, along
+	// with its id. The id must not be zero. The key must be 16, 24
+	// or 32 bytes long to select AES-128, AES-192 or AES-256.
+	CurrentKey() (id uint32, key []byte, err error)
+
+	// Key returns the key with given id, which is used to
+	// decrypt existing data.
+	Key(id uint32) ([]byte, error)
+}
+
+// sealOverhead is the number of bytes added to each entry,
+// when it is encrypted: nonce followed by gcm tag.
+const sealOverhead = 12 + 16
+
+var errDecrypt = errors.New("decryption failed")
+
+// CurrentAEAD returns AES-GCM cipher with the current key
+// of keys, along with the key id.
+func CurrentAEAD(keys KeyProvider) (uint32, cipher.AEAD, error) {
+	id, key, err := keys.CurrentKey()
+	if err != nil {
+		return 0, nil, err
+	}
+	if id == 0 {
+		return 0, nil, errors.New("key id is zero")
+	}
+	aead, err := newAEAD(key)
+	return id, aead, err
+}
+
+// AEAD returns AES-GCM cipher with the key of given id.
+func AEAD(keys KeyProvider, id uint32) (cipher.AEAD, error) {
+	if keys == nil {
+		return nil, fmt.Errorf("encrypted with key %d, but no KeyProvider", id)
+	}
+	key, err := keys.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	return newAEAD(key)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts b, using index as additional data, so that
+// an entry cannot be moved to another index.
+func seal(aead cipher.AEAD, index uint64, b []byte) ([]byte, error) {
+	buf := make([]byte, aead.NonceSize(), aead.NonceSize()+len(b)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+		return nil, err
+	}
+	var ad [8]byte
+	byteOrder.PutUint64(ad[:], index)
+	return aead.Seal(buf, buf, b, ad[:]), nil
+}
+
+// open decrypts b sealed at index, and appends it to dst.
+func open(aead cipher.AEAD, dst []byte, index uint64, b []byte) ([]byte, error) {
+	if len(b) < aead.NonceSize() {
+		return nil, errDecrypt
+	}
+	var ad [8]byte
+	byteOrder.PutUint64(ad[:], index)
+	nonce, b := b[:aead.NonceSize()], b[aead.NonceSize():]
+	dst, err := aead.Open(dst, nonce, b, ad[:])
+	if err != nil {
+		return nil, errDecrypt
+	}
+	return dst, nil
+}
@@ -45,7 +45,8 @@
 // multiple entries from mmapped segment files easier.
 //
 // Last 8 bytes in file is the header. Header tells number of entries in the segment file.
-// It is encoded as binary.LittleEndian.
+// It is encoded as binary.LittleEndian. The upper 32 bits of header tell the id of key
+// used to encrypt the entries, which is zero if the entries are not encrypted.
 //
 // Before header are the offsets of each entry in reverse order. Each offset is 8 bytes encoded
 // as binary.LittleEndian. If segment file has n entries, there will be n+1 offsets.
@@ -73,6 +74,13 @@
 // Some times the last segment may still has the new entries and offsets, but header will not reflect the new entries.
 // The header is updated only on commit.
 //
+// Encryption
+//
+// If Options.Keys is set, each entry is encrypted using AES-GCM with the current key
+// of the segment, with its index as additional data. The key of a segment is chosen
+// when it is opened without any entries, and it does not change after that. So
+// rotating the key affects only the new segments.
+//
 // Removing Entries
 //
 // RemoveGTE(i) removes all entries >=i. GTE stands for Greater Than Equals. After call to RemoveGTE(i), Log.LastIndex
@@ -0,0 +1,144 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/santhosh-tekuri/raft/vfs"
+)
+
+// SegmentInfo describes a segment file on disk.
+type SegmentInfo struct {
+	File      string `json:"file"`
+	PrevIndex uint64 `json:"prevIndex"`
+	Count     uint64 `json:"count"`           // number of entries as per header
+	FileSize  int64  `json:"fileSize"`        // size of segment file
+	DataSize  int64  `json:"dataSize"`        // bytes used by entries
+	KeyID     uint32 `json:"keyID,omitempty"` // id of encryption key
+
+	// Dangling is true, if the segment does not follow the previous
+	// segment. Such segments are removed by Open, and are not read.
+	Dangling bool `json:"dangling,omitempty"`
+}
+
+// LastIndex returns index of last entry in the segment.
+func (s SegmentInfo) LastIndex() uint64 {
+	return s.PrevIndex + s.Count
+}
+
+// Segments returns information of all segment files in dir,
+// sorted by PrevIndex.
+//
+// Unlike Open, it never modifies dir. Dangling segments are
+// included in the result, marked as such, in place of removing
+// them. It is meant for inspecting log of a stopped node.
+func Segments(fs vfs.FS, dir string) ([]SegmentInfo, error) {
+	offs, err := segments(fs, dir)
+	if err != nil {
+		return nil, err
+	}
+	var infos []SegmentInfo
+	var last SegmentInfo // last segment, that is not dangling
+	for i, off := range offs {
+		info := SegmentInfo{File: segmentFile(dir, off), PrevIndex: off}
+		if i > 0 && (last.Count == 0 || off != last.LastIndex()) {
+			info.Dangling = true
+			infos = append(infos, info)
+			continue
+		}
+		err := readSegment(fs, info.File, func(s *segment) error {
+			info.Count = uint64(s.n)
+			info.FileSize = int64(len(s.data))
+			info.DataSize = int64(s.size)
+			info.KeyID = s.keyID
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+		last = info
+	}
+	return infos, nil
+}
+
+// ReadSegment calls fn for each entry in given segment file.
+// The []byte passed to fn is valid only during the call.
+//
+// The segment file is mapped read-only, and its header and
+// offsets are validated before calling fn. keys is required
+// only if the segment is encrypted.
+func ReadSegment(fs vfs.FS, info SegmentInfo, keys KeyProvider, fn func(index uint64, b []byte) error) error {
+	return readSegment(fs, info.File, func(s *segment) error {
+		s.prevIndex = info.PrevIndex
+		if s.n > 0 && s.keyID != 0 {
+			aead, err := AEAD(keys, s.keyID)
+			if err != nil {
+				return fmt.Errorf("log: %s: %v", info.File, err)
+			}
+			s.aead = aead
+		}
+		for i := uint64(1); i <= uint64(s.n); i++ {
+			b, err := s.get(s.prevIndex+i, 1)
+			if err != nil {
+				return err
+			}
+			if err := fn(s.prevIndex+i, b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func readSegment(fs vfs.FS, file string, fn func(s *segment) error) error {
+	f, err := fs.Map(file, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s := &segment{file: f, data: f.Data()}
+	if err := s.validate(); err != nil {
+		return fmt.Errorf("log: %s: %v", file, err)
+	}
+	return fn(s)
+}
+
+// validate checks that header and offsets are consistent,
+// and sets s.n, s.size and s.keyID.
+func (s *segment) validate() error {
+	if len(s.data) < 3*8 {
+		return fmt.Errorf("file size %d is too small", len(s.data))
+	}
+	n, keyID := s.header()
+	if n < 0 || s.at(n+1) < 0 {
+		return fmt.Errorf("invalid entry count %d", n)
+	}
+	prev := 0
+	for i := 1; i <= n+1; i++ {
+		off := s.offset(i)
+		if off < prev || off > s.at(n+1) {
+			return fmt.Errorf("invalid offset %d for entry %d", off, i)
+		}
+		prev = off
+	}
+	if s.offset(1) != 0 {
+		return fmt.Errorf("first entry offset is %d, want 0", s.offset(1))
+	}
+	s.n, s.size, s.keyID = n, s.offset(n+1), keyID
+	return nil
+}
@@ -18,6 +18,8 @@ import (
 	"errors"
 	"fmt"
 	"os"
+
+	"github.com/santhosh-tekuri/raft/vfs"
 )
 
 // ErrNotFound is returned by Get, GetN if the entry index is <=PrevIndex.
@@ -31,6 +33,14 @@ var ErrExceedsSegmentSize = errors.New("log: entry exceeds segment size")
 type Options struct {
 	FileMode    os.FileMode
 	SegmentSize int
+
+	// FS is the filesystem used. Defaults to vfs.OS.
+	FS vfs.FS
+
+	// Keys, if not nil, is used to encrypt entries. Each segment
+	// records the id of key used, so that keys can be rotated.
+	// Existing segments are not reencrypted.
+	Keys KeyProvider
 }
 
 func (o Options) validate() error {
@@ -51,6 +61,7 @@ type Log struct {
 	first *segment
 	last  *segment
 	index []uint64 // for view: index[0] is prevIndex, index[1] is lastIndex
+	size  int64    // sum of segment sizes, not maintained in view
 }
 
 // Open opens log from given directory. if dir does not exist it is created
@@ -59,7 +70,10 @@ func Open(dir string, dirMode os.FileMode, opt Options) (*Log, error) {
 	if err := opt.validate(); err != nil {
 		return nil, err
 	}
-	if err := os.MkdirAll(dir, dirMode); err != nil {
+	if opt.FS == nil {
+		opt.FS = vfs.OS
+	}
+	if err := opt.FS.MkdirAll(dir, dirMode); err != nil {
 		return nil, err
 	}
 	first, last, err := openSegments(dir, opt)
@@ -71,12 +85,16 @@ func Open(dir string, dirMode os.FileMode, opt Options) (*Log, error) {
 		return nil, err
 	}
 
-	return &Log{
+	l := &Log{
 		dir:   dir,
 		opt:   opt,
 		first: first,
 		last:  last,
-	}, nil
+	}
+	for s := first; s != nil; s = s.next {
+		l.size += int64(s.size)
+	}
+	return l, nil
 }
 
 // ViewAt create a view with bounds [prevIndex, lastIndex]. View is
@@ -133,6 +151,44 @@ func (l *Log) Count() uint64 {
 	return l.LastIndex() - l.PrevIndex()
 }
 
+// DataSize returns the number of bytes used by the entries
+// in segments, upto index i. If i is >LastIndex it panics.
+//
+// It only visits the segments following i, so it is cheap
+// when i is close to LastIndex.
+func (l *Log) DataSize(i uint64) int64 {
+	if i > l.LastIndex() {
+		panic(fmt.Sprintf("log: %d>lastIndex(%d)", i, l.LastIndex()))
+	}
+	if l.index == nil {
+		if i <= l.PrevIndex() {
+			return 0
+		}
+		size := l.size
+		for s := l.last; i < s.lastIndex(); s = s.prev {
+			if i > s.prevIndex {
+				return size - int64(s.size-s.offset(int(i-s.prevIndex)+1))
+			}
+			size -= int64(s.size)
+		}
+		return size
+	}
+
+	// view does not track size
+	var size int64
+	for s := l.first; s != nil && i > s.prevIndex; s = s.next {
+		if i >= s.lastIndex() {
+			size += int64(s.size)
+		} else {
+			size += int64(s.offset(int(i-s.prevIndex) + 1))
+		}
+		if s == l.last {
+			break
+		}
+	}
+	return size
+}
+
 func (l *Log) segment(i uint64) *segment {
 	if i > l.LastIndex() {
 		panic(fmt.Sprintf("log: %d>lastIndex(%d)", i, l.LastIndex()))
@@ -163,7 +219,8 @@ func (l *Log) Contains(i uint64) bool {
 // The returned []byte is mmapped data. It can be used as long as
 // Close, RemoveLTE, RemoveGTE is not called. Any of these three calls
 // might invalidate the data returned and further use of it will
-// cause errors.
+// cause errors. If the segment is encrypted, decrypted copy
+// is returned instead.
 //
 // if index is >LastIndex it panics. If index <PrevIndex, it returns
 // ErrNotFound.
@@ -172,7 +229,7 @@ func (l *Log) Get(i uint64) ([]byte, error) {
 	if s == nil {
 		return nil, ErrNotFound
 	}
-	return s.get(i, 1), nil
+	return s.get(i, 1)
 }
 
 // GetN returns n entries from i. that is entries i, i+1,...,i+n-1.
@@ -180,7 +237,7 @@ func (l *Log) Get(i uint64) ([]byte, error) {
 // segment file. The returned data can be used as long as Close,
 // RemoveLTE, RemoveGTE is not called. Any of these three calls
 // might invalidate the data returned and further use of it will
-// cause errors.
+// cause errors. For encrypted segments, decrypted copy is returned.
 //
 // if index is >LastIndex it panics. If index <PrevIndex, it returns
 // ErrNotFound.
@@ -194,19 +251,20 @@ func (l *Log) GetN(i uint64, n uint64) ([][]byte, error) {
 	}
 	var buffs [][]byte
 	for n > 0 {
-		if s == l.last {
-			buffs = append(buffs, s.get(i, n))
-			break
-		} else {
-			sn := s.lastIndex() - (i - 1)
-			if sn > n {
+		sn := n
+		if s != l.last {
+			if sn = s.lastIndex() - (i - 1); sn > n {
 				sn = n
 			}
-			buffs = append(buffs, s.get(i, sn))
-			i += sn
-			n -= sn
-			s = s.next
 		}
+		b, err := s.get(i, sn)
+		if err != nil {
+			return nil, err
+		}
+		buffs = append(buffs, b)
+		i += sn
+		n -= sn
+		s = s.next
 	}
 	return buffs, nil
 }
@@ -214,12 +272,16 @@ func (l *Log) GetN(i uint64, n uint64) ([][]byte, error) {
 // Append appends an entry to log. the param []byte
 // is opaque to Log and is not interpreted.
 func (l *Log) Append(b []byte) error {
-	if l.last.available() < len(b) {
+	if l.last.available() < l.last.sizeOf(len(b)) {
 		if l.last.n == 0 {
 			return ErrExceedsSegmentSize
 		}
-		if len(b) > l.opt.SegmentSize-3*8 {
-			l.opt.SegmentSize = len(b) + 3*8
+		size := len(b)
+		if l.opt.Keys != nil {
+			size += sealOverhead
+		}
+		if size > l.opt.SegmentSize-3*8 {
+			l.opt.SegmentSize = size + 3*8
 		}
 		if err := l.Commit(); err != nil {
 			return err
@@ -230,9 +292,12 @@ func (l *Log) Append(b []byte) error {
 		}
 		connect(l.last, s)
 		l.last = s
+		l.size += int64(s.size)
 	}
-	l.last.append(b)
-	return nil
+	size := l.last.size
+	err := l.last.append(b)
+	l.size += int64(l.last.size - size)
+	return err
 }
 
 // CanLTE tells which entries will be removed if RemoveLTE(i)
@@ -267,6 +332,7 @@ func (l *Log) RemoveLTE(i uint64) error {
 			s := l.first
 			l.first = l.first.next
 			disconnect(l.first.prev, l.first)
+			l.size -= int64(s.size)
 			if err := s.closeAndRemove(); err != nil {
 				return err
 			}
@@ -286,7 +352,7 @@ func (l *Log) RemoveGTE(i uint64) error {
 	for {
 		if i <= l.last.prevIndex+1 {
 			if l.last == l.first && i == l.last.prevIndex+1 {
-				return l.last.removeGTE(l.last.prevIndex + 1) // clear all entries
+				return l.removeGTE(l.last.prevIndex + 1) // clear all entries
 			}
 
 			// remove l.last
@@ -295,6 +361,7 @@ func (l *Log) RemoveGTE(i uint64) error {
 			if l.last != nil {
 				disconnect(l.last, l.last.next)
 			}
+			l.size -= int64(s.size)
 			if err := s.closeAndRemove(); err != nil {
 				return err
 			}
@@ -307,14 +374,14 @@ func (l *Log) RemoveGTE(i uint64) error {
 				if err != nil {
 					return err
 				}
-				l.first, l.last = s, s
+				l.first, l.last, l.size = s, s, int64(s.size)
 				break
 			}
 		} else if i > l.last.prevIndex {
 			if i > l.last.lastIndex() {
 				i = l.last.lastIndex() + 1
 			}
-			return l.last.removeGTE(i)
+			return l.removeGTE(i)
 		} else {
 			break
 		}
@@ -322,6 +389,14 @@ func (l *Log) RemoveGTE(i uint64) error {
 	return nil
 }
 
+// removeGTE removes entries >=i from last segment.
+func (l *Log) removeGTE(i uint64) error {
+	size := l.last.size
+	err := l.last.removeGTE(i)
+	l.size -= int64(size - l.last.size)
+	return err
+}
+
 // Reset clears all entries and resets to given lastIndex
 func (l *Log) Reset(lastIndex uint64) error {
 	// remove all segments
@@ -336,7 +411,7 @@ func (l *Log) Reset(lastIndex uint64) error {
 	if err != nil {
 		return err
 	}
-	l.first, l.last = s, s
+	l.first, l.last, l.size = s, s, int64(s.size)
 	return nil
 }
 
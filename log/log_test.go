@@ -23,6 +23,8 @@ import (
 	"os"
 	"reflect"
 	"testing"
+
+	"github.com/santhosh-tekuri/raft/vfs"
 )
 
 func TestOpen(t *testing.T) {
@@ -160,6 +162,65 @@ func TestLog_GetN(t *testing.T) {
 	})
 }
 
+func TestLog_DataSize(t *testing.T) {
+	l := newLog(t, 1024)
+	for numSegments(l) != 3 {
+		appendEntry(t, l)
+	}
+	var want int64
+	for i := uint64(1); i <= l.LastIndex(); i++ {
+		want += int64(len(msg(i)))
+		if got := l.DataSize(i); got != want {
+			t.Fatalf("DataSize(%d)=%d, want %d", i, got, want)
+		}
+	}
+	if err := l.RemoveLTE(l.first.lastIndex()); err != nil {
+		t.Fatal(err)
+	}
+	if got := l.DataSize(l.PrevIndex()); got != 0 {
+		t.Fatalf("DataSize(prevIndex)=%d, want 0", got)
+	}
+	checkPanic(t, func() {
+		_ = l.DataSize(l.LastIndex() + 1)
+	})
+
+	// tracked size must match size computed by view
+	checkSizes := func(op string) {
+		t.Helper()
+		v := l.View()
+		for i := l.PrevIndex(); i <= l.LastIndex(); i++ {
+			if got, want := l.DataSize(i), v.DataSize(i); got != want {
+				t.Fatalf("after %s: DataSize(%d)=%d, want %d", op, i, got, want)
+			}
+		}
+	}
+	for numSegments(l) != 4 {
+		appendEntry(t, l)
+	}
+	checkSizes("append")
+	if err := l.RemoveGTE(l.last.prevIndex + 2); err != nil {
+		t.Fatal(err)
+	}
+	checkSizes("RemoveGTE(last)")
+	if err := l.RemoveGTE(l.first.next.prevIndex); err != nil {
+		t.Fatal(err)
+	}
+	checkSizes("RemoveGTE(segments)")
+	appendEntry(t, l)
+	checkSizes("append")
+	if err := l.Reset(100); err != nil {
+		t.Fatal(err)
+	}
+	checkSizes("Reset")
+	if got := l.DataSize(l.LastIndex()); got != 0 {
+		t.Fatalf("after Reset: DataSize(lastIndex)=%d, want 0", got)
+	}
+	appendEntry(t, l)
+	checkSizes("append")
+	l = reopen(t, l)
+	checkSizes("reopen")
+}
+
 func TestLog_ViewAt(t *testing.T) {
 	l := newLog(t, 1024)
 
@@ -467,6 +528,169 @@ func TestLog_RemoveLTE_RemoveGTE(t *testing.T) {
 	removeGTE(0, []uint64{0}, 0)
 }
 
+func TestSegments(t *testing.T) {
+	l := newLog(t, 1024)
+	for numSegments(l) != 3 {
+		appendEntry(t, l)
+	}
+	if err := l.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.RemoveLTE(l.first.lastIndex()); err != nil {
+		t.Fatal(err)
+	}
+
+	infos, err := Segments(vfs.OS, l.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertInt(t, "numSegments", len(infos), numSegments(l))
+	i := 0
+	for s := l.first; s != nil; s = s.next {
+		assertUint64(t, "prevIndex", infos[i].PrevIndex, s.prevIndex)
+		assertUint64(t, "lastIndex", infos[i].LastIndex(), s.lastIndex())
+		assertInt(t, "dataSize", int(infos[i].DataSize), s.size)
+		i++
+	}
+
+	want := l.PrevIndex() + 1
+	for _, info := range infos {
+		err := ReadSegment(vfs.OS, info, nil, func(index uint64, b []byte) error {
+			assertUint64(t, "index", index, want)
+			if !bytes.Equal(b, msg(index)) {
+				t.Fatalf("entry %d: got %q, want %q", index, b, msg(index))
+			}
+			want++
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertUint64(t, "lastIndex", want-1, l.LastIndex())
+
+	// corrupt header of last segment
+	f, err := os.OpenFile(infos[len(infos)-1].File, os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x0f}, infos[len(infos)-1].FileSize-8); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+	if _, err = Segments(vfs.OS, l.dir); err == nil {
+		t.Fatal("error expected for corrupted segment")
+	}
+}
+
+func TestOpen_danglingSegments(t *testing.T) {
+	l := newLog(t, 1024)
+	for numSegments(l) != 2 {
+		appendEntry(t, l)
+	}
+	if err := l.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	segs := getSegments(l)
+
+	// segments not connected to last segment, must be removed on open
+	dangling := []string{
+		segmentFile(l.dir, l.LastIndex()+10),
+		segmentFile(l.dir, l.LastIndex()+20),
+	}
+	for _, f := range dangling {
+		if err := ioutil.WriteFile(f, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Segments must mark them dangling, without reading them
+	infos, err := Segments(vfs.OS, l.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertInt(t, "numSegments", len(infos), len(segs)+len(dangling))
+	for i, info := range infos {
+		if want := i >= len(segs); info.Dangling != want {
+			t.Fatalf("%s: dangling got %v, want %v", info.File, info.Dangling, want)
+		}
+	}
+
+	l = reopen(t, l)
+	for _, f := range dangling {
+		if _, err := os.Stat(f); !os.IsNotExist(err) {
+			t.Fatalf("dangling segment %s not removed: %v", f, err)
+		}
+	}
+	if got := getSegments(l); !reflect.DeepEqual(got, segs) {
+		t.Fatalf("segments=%v, want %v", got, segs)
+	}
+	checkGet(t, l)
+}
+
+func TestLog_encryption(t *testing.T) {
+	keys := &keysMock{keys: map[uint32][]byte{1: bytes.Repeat([]byte{1}, 16)}, current: 1}
+	dir, err := ioutil.TempDir(tempDir, "log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := Open(dir, 0700, Options{FileMode: 0600, SegmentSize: 1024, Keys: keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for numSegments(l) != 2 {
+		appendEntry(t, l)
+	}
+
+	// rotate key, new segments must use new key
+	keys.keys[2], keys.current = bytes.Repeat([]byte{2}, 32), 2
+	for numSegments(l) != 4 {
+		appendEntry(t, l)
+	}
+	l = reopen(t, l)
+	checkGet(t, l)
+	checkGetN(t, l, 1, l.LastIndex(), msgs(1, l.LastIndex()))
+
+	infos, err := Segments(vfs.OS, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keyIDs []uint32
+	for _, info := range infos {
+		keyIDs = append(keyIDs, info.KeyID)
+		b, err := ioutil.ReadFile(info.File)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(b, []byte("odd[")) || bytes.Contains(b, []byte("even[")) {
+			t.Fatalf("%s has plaintext", info.File)
+		}
+	}
+	if want := []uint32{1, 1, 2, 2}; !reflect.DeepEqual(keyIDs, want) {
+		t.Fatalf("keyIDs=%v, want %v", keyIDs, want)
+	}
+	if err = ReadSegment(vfs.OS, infos[0], nil, func(uint64, []byte) error { return nil }); err == nil {
+		t.Fatal("ReadSegment must fail without keys")
+	}
+	err = ReadSegment(vfs.OS, infos[0], keys, func(index uint64, b []byte) error {
+		if !bytes.Equal(b, msg(index)) {
+			t.Fatalf("entry %d: got %q, want %q", index, b, msg(index))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// without keys, encrypted log cannot be opened
+	if err = l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Open(dir, 0700, Options{FileMode: 0600, SegmentSize: 1024}); err == nil {
+		t.Fatal("Open must fail without keys")
+	}
+}
+
 var tempDir string
 
 func TestMain(M *testing.M) {
@@ -488,7 +712,7 @@ func newLog(tb testing.TB, size int) *Log {
 	if err != nil {
 		tb.Fatal(err)
 	}
-	l, err := Open(dir, 0700, Options{0600, size})
+	l, err := Open(dir, 0700, Options{FileMode: 0600, SegmentSize: size})
 	if err != nil {
 		tb.Fatal(err)
 	}
@@ -627,3 +851,19 @@ func getSegments(l *Log) []uint64 {
 	}
 	return segs
 }
+
+type keysMock struct {
+	keys    map[uint32][]byte
+	current uint32
+}
+
+func (k *keysMock) CurrentKey() (uint32, []byte, error) {
+	return k.current, k.keys[k.current], nil
+}
+
+func (k *keysMock) Key(id uint32) ([]byte, error) {
+	if key, ok := k.keys[id]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("key %d not found", id)
+}
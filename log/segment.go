@@ -15,10 +15,13 @@
 package log
 
 import (
+	"crypto/cipher"
 	"encoding/binary"
+	"fmt"
 	"os"
+	"path/filepath"
 
-	"github.com/santhosh-tekuri/raft/mmap"
+	"github.com/santhosh-tekuri/raft/vfs"
 )
 
 var byteOrder = binary.LittleEndian
@@ -28,76 +31,138 @@ type segment struct {
 	prev      *segment
 	next      *segment
 
-	file   *mmap.File // index file
-	n      int        // number of entries
-	size   int        // log size
-	synced int        // number of entries synced, will be -1 on GTE
+	fs     vfs.FS
+	file   vfs.MappedFile
+	data   []byte // mapped data of file
+	n      int    // number of entries
+	size   int    // log size
+	synced int    // number of entries synced, will be -1 on GTE
+
+	keyID uint32      // id of key used to encrypt entries, 0 if not encrypted
+	aead  cipher.AEAD // nil if not encrypted
 }
 
 func openSegment(dir string, prevIndex uint64, opt Options) (*segment, error) {
 	f := segmentFile(dir, prevIndex)
-	if exists, err := fileExists(f); err != nil {
+	if exists, err := fileExists(opt.FS, f); err != nil {
 		return nil, err
 	} else if !exists {
-		if err = createSegment(f, opt); err != nil {
+		if err = createSegment(dir, f, opt); err != nil {
 			return nil, err
 		}
 	}
-	file, err := mmap.OpenFile(f, os.O_RDWR, opt.FileMode)
+	file, err := opt.FS.Map(f, os.O_RDWR, opt.FileMode)
 	if err != nil {
 		return nil, err
 	}
 	s := &segment{
 		prevIndex: prevIndex,
+		fs:        opt.FS,
 		file:      file,
+		data:      file.Data(),
 	}
-	s.n = s.offset(0)
+	s.n, s.keyID = s.header()
 	s.synced = s.n
 	s.size = s.offset(s.n + 1)
+	if s.n == 0 {
+		// no entries yet, use current key
+		s.keyID = 0
+		if opt.Keys != nil {
+			s.keyID, s.aead, err = CurrentAEAD(opt.Keys)
+		}
+	} else if s.keyID != 0 {
+		s.aead, err = AEAD(opt.Keys, s.keyID)
+	}
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("log: %s: %v", f, err)
+	}
 	return s, nil
 }
 
 func (s *segment) at(i int) int {
-	return len(s.file.Data) - i*8 - 8
+	return len(s.data) - i*8 - 8
 }
 
 func (s *segment) offset(i int) int {
-	return int(byteOrder.Uint64(s.file.Data[s.at(i):]))
+	return int(byteOrder.Uint64(s.data[s.at(i):]))
 }
 
 func (s *segment) setOffset(off int, i int) {
-	byteOrder.PutUint64(s.file.Data[s.at(i):], uint64(off))
+	byteOrder.PutUint64(s.data[s.at(i):], uint64(off))
+}
+
+// header returns number of entries and key id. The key id is
+// stored in upper 32 bits, so that segments written before
+// encryption was introduced have key id 0.
+func (s *segment) header() (n int, keyID uint32) {
+	h := byteOrder.Uint64(s.data[s.at(0):])
+	return int(uint32(h)), uint32(h >> 32)
+}
+
+func (s *segment) setHeader() {
+	byteOrder.PutUint64(s.data[s.at(0):], uint64(s.keyID)<<32|uint64(s.n))
 }
 
 func (s *segment) lastIndex() uint64 {
 	return s.prevIndex + uint64(s.n)
 }
 
-func (s *segment) get(i uint64, n uint64) []byte {
-	if i > s.prevIndex {
-		i := int(i - s.prevIndex)
-		from, to := s.offset(i), s.offset(i+int(n))
-		return s.file.Data[from:to]
+// get returns n entries from i. If segment is encrypted, the
+// entries are decrypted into new buffer, otherwise mapped data
+// is returned.
+func (s *segment) get(i uint64, n uint64) ([]byte, error) {
+	if i <= s.prevIndex {
+		panic("i<=prevIndex")
+	}
+	j := int(i - s.prevIndex)
+	if s.aead == nil {
+		from, to := s.offset(j), s.offset(j+int(n))
+		return s.data[from:to], nil
 	}
-	panic("i<=prevIndex")
+	var buf []byte
+	for k := 0; k < int(n); k++ {
+		from, to := s.offset(j+k), s.offset(j+k+1)
+		b, err := open(s.aead, buf, i+uint64(k), s.data[from:to])
+		if err != nil {
+			return nil, fmt.Errorf("log: entry %d: %v", i+uint64(k), err)
+		}
+		buf = b
+	}
+	return buf, nil
 }
 
 func (s *segment) available() int {
 	return s.at(s.n+2) - s.size
 }
 
-func (s *segment) append(b []byte) {
-	copy(s.file.Data[s.size:], b)
+// sizeOf returns the number of bytes needed to store entry of size n.
+func (s *segment) sizeOf(n int) int {
+	if s.aead != nil {
+		n += sealOverhead
+	}
+	return n
+}
+
+func (s *segment) append(b []byte) error {
+	if s.aead != nil {
+		var err error
+		if b, err = seal(s.aead, s.lastIndex()+1, b); err != nil {
+			return err
+		}
+	}
+	copy(s.data[s.size:], b)
 	size := s.size + len(b)
 	s.setOffset(size, s.n+2)
 	s.n, s.size = s.n+1, size
+	return nil
 }
 
 func (s *segment) removeGTE(i uint64) error {
 	n := int(i - s.prevIndex - 1)
 	if n < s.n {
-		s.setOffset(n, 0)
 		s.n, s.size, s.synced = n, s.offset(n+1), -1
+		s.setHeader()
 	}
 	return s.sync()
 }
@@ -111,7 +176,7 @@ func (s *segment) sync() error {
 		if err := s.file.Sync(); err != nil {
 			return err
 		}
-		s.setOffset(s.n, 0)
+		s.setHeader()
 		if err := s.file.Sync(); err != nil {
 			return err
 		}
@@ -128,8 +193,13 @@ func (s *segment) close() error {
 	return err
 }
 
+// remove deletes the segment file, and syncs the dir. Otherwise
+// the removed entries might reappear after crash.
 func (s *segment) remove() error {
-	return os.Remove(s.file.Name())
+	if err := s.fs.Remove(s.file.Name()); err != nil {
+		return err
+	}
+	return s.fs.SyncDir(filepath.Dir(s.file.Name()))
 }
 
 func (s *segment) closeAndRemove() error {
@@ -21,10 +21,12 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+
+	"github.com/santhosh-tekuri/raft/vfs"
 )
 
-func fileExists(name string) (bool, error) {
-	info, err := os.Stat(name)
+func fileExists(fs vfs.FS, name string) (bool, error) {
+	info, err := fs.Stat(name)
 	if os.IsNotExist(err) {
 		return false, nil
 	} else if err != nil {
@@ -36,8 +38,10 @@ func fileExists(name string) (bool, error) {
 	return true, nil
 }
 
-func createSegment(name string, opt Options) (err error) {
-	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, opt.FileMode)
+// createSegment creates segment file, and syncs the dir
+// so that the file survives crash.
+func createSegment(dir, name string, opt Options) (err error) {
+	f, err := opt.FS.OpenFile(name, os.O_RDWR|os.O_CREATE, opt.FileMode)
 	if err != nil {
 		return
 	}
@@ -46,7 +50,7 @@ func createSegment(name string, opt Options) (err error) {
 			err = e
 		}
 		if err != nil {
-			if e := os.Remove(name); err == nil {
+			if e := opt.FS.Remove(name); err == nil {
 				err = e
 			}
 		}
@@ -58,7 +62,10 @@ func createSegment(name string, opt Options) (err error) {
 	if _, err = f.WriteAt(make([]byte, 16), size-16); err != nil {
 		return
 	}
-	err = f.Sync()
+	if err = f.Sync(); err != nil {
+		return
+	}
+	err = opt.FS.SyncDir(dir)
 	return
 }
 
@@ -66,8 +73,8 @@ func segmentFile(dir string, prevIndex uint64) string {
 	return filepath.Join(dir, fmt.Sprintf("%d.log", prevIndex))
 }
 
-func segments(dir string) ([]uint64, error) {
-	matches, err := filepath.Glob(filepath.Join(dir, "*.log"))
+func segments(fs vfs.FS, dir string) ([]uint64, error) {
+	matches, err := fs.Glob(filepath.Join(dir, "*.log"))
 	if err != nil {
 		return nil, err
 	}
@@ -88,7 +95,7 @@ func segments(dir string) ([]uint64, error) {
 }
 
 func openSegments(dir string, opt Options) (first, last *segment, err error) {
-	offs, err := segments(dir)
+	offs, err := segments(opt.FS, dir)
 	if err != nil {
 		return
 	}
@@ -112,7 +119,7 @@ func openSegments(dir string, opt Options) (first, last *segment, err error) {
 			last = s
 		} else {
 			// dangling segment: remove it
-			if err = os.Remove(segmentFile(dir, off)); err == nil {
+			if err = opt.FS.Remove(segmentFile(dir, off)); err != nil {
 				return
 			}
 		}
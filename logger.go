@@ -0,0 +1,253 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log message.
+type Level int8
+
+// Supported log levels, from least to most severe.
+const (
+	LevelDebug Level = iota - 1
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return fmt.Sprintf("Level(%d)", int8(l))
+}
+
+// Logger is the interface to be implemented for
+// consuming structured, leveled logs.
+//
+// Each method takes a constant message followed by
+// alternating keys and values. Keys are always strings.
+// For example:
+//
+//     logger.Info("changing state", "nid", 1, "term", 5, "from", "follower", "to", "candidate")
+//
+// Raft always attaches "nid" field to every message.
+// Fields such as "term", "leader" are attached where relevant.
+type Logger interface {
+	// Debug consumes debug message, which is useful only
+	// for troubleshooting.
+	Debug(msg string, keyvals ...interface{})
+
+	// Info consumes information message.
+	Info(msg string, keyvals ...interface{})
+
+	// Warn consumes warning message. Raft is able to continue
+	// but this might need attention.
+	Warn(msg string, keyvals ...interface{})
+
+	// Error consumes error message. Raft is shutting down or
+	// unable to perform some operation.
+	Error(msg string, keyvals ...interface{})
+}
+
+// PrintLogger is the two-method logger interface supported by
+// earlier versions. Use FromPrintLogger to use it as Logger.
+type PrintLogger interface {
+	// Info consumes information message.
+	Info(v ...interface{})
+
+	// Warn consumes warning message.
+	Warn(v ...interface{})
+}
+
+// FromPrintLogger adapts given PrintLogger to Logger.
+//
+// Debug messages are discarded. Info messages are sent to
+// PrintLogger.Info. Warn and Error messages are sent to
+// PrintLogger.Warn. Fields are printed as key=value after
+// the message.
+func FromPrintLogger(l PrintLogger) Logger {
+	return printLogger{l}
+}
+
+type printLogger struct {
+	l PrintLogger
+}
+
+func (printLogger) Debug(msg string, keyvals ...interface{}) {}
+
+func (p printLogger) Info(msg string, keyvals ...interface{}) {
+	p.l.Info(formatText(msg, keyvals))
+}
+
+func (p printLogger) Warn(msg string, keyvals ...interface{}) {
+	p.l.Warn(formatText(msg, keyvals))
+}
+
+func (p printLogger) Error(msg string, keyvals ...interface{}) {
+	p.l.Warn(formatText(msg, keyvals))
+}
+
+// NewTextLogger returns Logger which writes messages with
+// level >= given level to w in human readable form:
+//
+//     [INFO] raft: changing state nid=1 term=5 from=follower to=candidate
+func NewTextLogger(w io.Writer, level Level) Logger {
+	return &writerLogger{w: w, level: level, format: func(level Level, msg string, keyvals []interface{}) []byte {
+		return []byte(fmt.Sprintf("[%s] raft: %s\n", strings.ToUpper(level.String()), formatText(msg, keyvals)))
+	}}
+}
+
+// NewJSONLogger returns Logger which writes messages with
+// level >= given level to w, one json object per line:
+//
+//     {"time":"2019-03-01T10:00:00Z","level":"info","msg":"changing state","nid":1,"term":5}
+//
+// Values that implement error or fmt.Stringer are written
+// as json strings.
+func NewJSONLogger(w io.Writer, level Level) Logger {
+	return &writerLogger{w: w, level: level, format: formatJSON}
+}
+
+type writerLogger struct {
+	mu     sync.Mutex
+	w      io.Writer
+	level  Level
+	format func(level Level, msg string, keyvals []interface{}) []byte
+}
+
+func (l *writerLogger) log(level Level, msg string, keyvals []interface{}) {
+	if level < l.level {
+		return
+	}
+	b := l.format(level, msg, keyvals)
+	l.mu.Lock()
+	_, _ = l.w.Write(b)
+	l.mu.Unlock()
+}
+
+func (l *writerLogger) Debug(msg string, keyvals ...interface{}) { l.log(LevelDebug, msg, keyvals) }
+func (l *writerLogger) Info(msg string, keyvals ...interface{})  { l.log(LevelInfo, msg, keyvals) }
+func (l *writerLogger) Warn(msg string, keyvals ...interface{})  { l.log(LevelWarn, msg, keyvals) }
+func (l *writerLogger) Error(msg string, keyvals ...interface{}) { l.log(LevelError, msg, keyvals) }
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, keyvals ...interface{}) {}
+func (nopLogger) Info(msg string, keyvals ...interface{})  {}
+func (nopLogger) Warn(msg string, keyvals ...interface{})  {}
+func (nopLogger) Error(msg string, keyvals ...interface{}) {}
+
+// fieldLogger prefixes fields to every message
+type fieldLogger struct {
+	l      Logger
+	fields []interface{}
+}
+
+func withFields(l Logger, keyvals ...interface{}) Logger {
+	if fl, ok := l.(fieldLogger); ok {
+		return fieldLogger{fl.l, append(append([]interface{}(nil), fl.fields...), keyvals...)}
+	}
+	return fieldLogger{l, keyvals}
+}
+
+func (l fieldLogger) kv(keyvals []interface{}) []interface{} {
+	return append(append(make([]interface{}, 0, len(l.fields)+len(keyvals)), l.fields...), keyvals...)
+}
+
+func (l fieldLogger) Debug(msg string, keyvals ...interface{}) { l.l.Debug(msg, l.kv(keyvals)...) }
+func (l fieldLogger) Info(msg string, keyvals ...interface{})  { l.l.Info(msg, l.kv(keyvals)...) }
+func (l fieldLogger) Warn(msg string, keyvals ...interface{})  { l.l.Warn(msg, l.kv(keyvals)...) }
+func (l fieldLogger) Error(msg string, keyvals ...interface{}) { l.l.Error(msg, l.kv(keyvals)...) }
+
+// formatting ---------------------------------------------------------
+
+func formatText(msg string, keyvals []interface{}) string {
+	buf := new(bytes.Buffer)
+	buf.WriteString(msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		buf.WriteByte(' ')
+		buf.WriteString(logKey(keyvals, i))
+		buf.WriteByte('=')
+		s := fmt.Sprint(logValue(keyvals, i))
+		if strings.ContainsAny(s, " \t\n\"=") {
+			s = fmt.Sprintf("%q", s)
+		}
+		buf.WriteString(s)
+	}
+	return buf.String()
+}
+
+func formatJSON(level Level, msg string, keyvals []interface{}) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString(`{"time":`)
+	writeJSON(buf, time.Now().UTC().Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeJSON(buf, level.String())
+	buf.WriteString(`,"msg":`)
+	writeJSON(buf, msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		buf.WriteByte(',')
+		writeJSON(buf, logKey(keyvals, i))
+		buf.WriteByte(':')
+		switch v := logValue(keyvals, i).(type) {
+		case error:
+			writeJSON(buf, v.Error())
+		case fmt.Stringer:
+			writeJSON(buf, v.String())
+		default:
+			writeJSON(buf, v)
+		}
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(b)
+}
+
+func logKey(keyvals []interface{}, i int) string {
+	if s, ok := keyvals[i].(string); ok {
+		return s
+	}
+	return fmt.Sprint(keyvals[i])
+}
+
+func logValue(keyvals []interface{}, i int) interface{} {
+	if i+1 < len(keyvals) {
+		return keyvals[i+1]
+	}
+	return "MISSING"
+}
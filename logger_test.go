@@ -0,0 +1,80 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestLogger_text(t *testing.T) {
+	buf := new(bytes.Buffer)
+	l := withFields(NewTextLogger(buf, LevelInfo), "nid", 1)
+	l.Debug("not logged", "term", 2)
+	l.Info("changing state", "term", 5, "from", Follower, "to", State(Candidate))
+	l.Warn("node is unreachable", "node", 2, "err", errors.New("dial failed"))
+	want := "[INFO] raft: changing state nid=1 term=5 from=follower to=candidate\n" +
+		"[WARN] raft: node is unreachable nid=1 node=2 err=\"dial failed\"\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestLogger_json(t *testing.T) {
+	buf := new(bytes.Buffer)
+	l := withFields(NewJSONLogger(buf, LevelWarn), "nid", 1)
+	l.Info("not logged")
+	l.Error("shutting down", "reason", errors.New("disk full"), "state", State(Leader))
+	m := make(map[string]interface{})
+	if err := json.Unmarshal(buf.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]interface{}{
+		"level":  "error",
+		"msg":    "shutting down",
+		"nid":    float64(1),
+		"reason": "disk full",
+		"state":  "leader",
+	} {
+		if m[k] != v {
+			t.Errorf("%s: got %v, want %v", k, m[k], v)
+		}
+	}
+}
+
+type printLoggerMock struct {
+	info, warn []string
+}
+
+func (l *printLoggerMock) Info(v ...interface{}) { l.info = append(l.info, fmt.Sprint(v...)) }
+func (l *printLoggerMock) Warn(v ...interface{}) { l.warn = append(l.warn, fmt.Sprint(v...)) }
+
+func TestFromPrintLogger(t *testing.T) {
+	pl := new(printLoggerMock)
+	l := FromPrintLogger(pl)
+	l.Debug("dropped")
+	l.Info("started election", "term", 3)
+	l.Warn("quorum is unreachable")
+	l.Error("shutting down", "reason", "disk full")
+	if len(pl.info) != 1 || pl.info[0] != "started election term=3" {
+		t.Fatalf("info: got %q", pl.info)
+	}
+	if len(pl.warn) != 2 || pl.warn[1] != `shutting down reason="disk full"` {
+		t.Fatalf("warn: got %q", pl.warn)
+	}
+}
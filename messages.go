@@ -16,6 +16,7 @@ package raft
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -30,8 +31,32 @@ const (
 	entryDirtyRead
 	entryNop
 	entryConfig
+	entryOpenSession
+	entryUpdateSession
 )
 
+func (t entryType) String() string {
+	switch t {
+	case entryBarrier:
+		return "barrier"
+	case entryUpdate:
+		return "update"
+	case entryRead:
+		return "read"
+	case entryDirtyRead:
+		return "dirtyRead"
+	case entryNop:
+		return "nop"
+	case entryConfig:
+		return "config"
+	case entryOpenSession:
+		return "openSession"
+	case entryUpdateSession:
+		return "updateSession"
+	}
+	return fmt.Sprintf("entryType(%d)", uint8(t))
+}
+
 type entry struct {
 	index uint64
 	term  uint64
@@ -48,6 +73,16 @@ func (e *entry) isLogEntry() bool {
 	}
 }
 
+// isUpdate tells whether the entry updates fsm.
+func (e *entry) isUpdate() bool {
+	switch e.typ {
+	case entryUpdate, entryOpenSession, entryUpdateSession:
+		return true
+	default:
+		return false
+	}
+}
+
 func (e *entry) decode(r io.Reader) error {
 	var err error
 
@@ -102,11 +137,13 @@ const (
 	rpcAppendEntries
 	rpcInstallSnap
 	rpcTimeoutNow
+	rpcSendSnap
+	rpcRelay
 )
 
 func (t rpcType) isValid() bool {
 	switch t {
-	case rpcIdentity, rpcVote, rpcAppendEntries, rpcInstallSnap, rpcTimeoutNow:
+	case rpcIdentity, rpcVote, rpcAppendEntries, rpcInstallSnap, rpcTimeoutNow, rpcSendSnap, rpcRelay:
 		return true
 	}
 	return false
@@ -132,6 +169,10 @@ func (t rpcType) createReq() request {
 		return &installSnapReq{}
 	case rpcTimeoutNow:
 		return &timeoutNowReq{}
+	case rpcSendSnap:
+		return &sendSnapReq{}
+	case rpcRelay:
+		return &relayReq{}
 	}
 	panic(fmt.Errorf("raft.createReq(%d)", t))
 }
@@ -149,6 +190,10 @@ func (t rpcType) createResp(r *Raft, result rpcResult, err error) response {
 		return &installSnapResp{resp}
 	case rpcTimeoutNow:
 		return &timeoutNowResp{resp}
+	case rpcSendSnap:
+		return &sendSnapResp{resp: resp}
+	case rpcRelay:
+		return &relayResp{resp: resp}
 	}
 	panic(fmt.Errorf("raft.createResp(%d)", t))
 }
@@ -167,6 +212,8 @@ const (
 	nonVoter
 	readErr
 	unexpectedErr
+	staleSnapshot
+	cannotRelay
 )
 
 type message interface {
@@ -433,12 +480,20 @@ func (resp *appendResp) encode(w io.Writer) error {
 
 // ------------------------------------------------------
 
+// installSnapReq is followed by snapshot data of given size.
+//
+// The sessions are appended to data of lastConfig entry, only if not
+// empty. Older nodes ignore them, as Config.decode ignores trailing
+// bytes. Thus layout of the request is same as before sessions were
+// introduced, and older nodes can install snapshot during rolling
+// upgrade, though they lose the sessions.
 type installSnapReq struct {
 	req
 	lastIndex  uint64 // last index in the snapshot
 	lastTerm   uint64 // term of lastIndex
 	lastConfig Config // last config in the snapshot
 	size       int64  // size of the snapshot
+	sessions   []byte // client sessions in the snapshot
 }
 
 func (req *installSnapReq) rpcType() rpcType { return rpcInstallSnap }
@@ -459,9 +514,15 @@ func (req *installSnapReq) decode(r io.Reader) error {
 	if err = e.decode(r); err != nil {
 		return err
 	}
-	if err = req.lastConfig.decode(e); err != nil {
+	trailing, err := req.lastConfig.decodeTrailing(e)
+	if err != nil {
 		return err
 	}
+	if len(trailing) > 0 {
+		if req.sessions, err = readBytes(bytes.NewReader(trailing)); err != nil {
+			return err
+		}
+	}
 
 	size, err := readUint64(r)
 	if err != nil {
@@ -482,6 +543,13 @@ func (req *installSnapReq) encode(w io.Writer) error {
 		return err
 	}
 	e := req.lastConfig.encode()
+	if len(req.sessions) > 0 {
+		b := bytes.NewBuffer(e.data)
+		if err := writeBytes(b, req.sessions); err != nil {
+			return err
+		}
+		e.data = b.Bytes()
+	}
 	if err := e.encode(w); err != nil {
 		return err
 	}
@@ -507,3 +575,127 @@ func (req *timeoutNowReq) rpcType() rpcType { return rpcTimeoutNow }
 type timeoutNowResp struct {
 	resp
 }
+
+// ------------------------------------------------------
+
+// sendSnapReq asks a follower to send its snapshot to target,
+// on behalf of leader. The follower replies with sendSnapResp,
+// and after sending snapshot, with installSnapResp of target.
+type sendSnapReq struct {
+	req             // term and id of leader
+	target   uint64 // node to which snapshot is sent
+	minIndex uint64 // snapshots before this index are not useful
+}
+
+func (req *sendSnapReq) rpcType() rpcType { return rpcSendSnap }
+
+func (req *sendSnapReq) decode(r io.Reader) error {
+	var err error
+	if err = req.req.decode(r); err != nil {
+		return err
+	}
+	if req.target, err = readUint64(r); err != nil {
+		return err
+	}
+	req.minIndex, err = readUint64(r)
+	return err
+}
+
+func (req *sendSnapReq) encode(w io.Writer) error {
+	if err := req.req.encode(w); err != nil {
+		return err
+	}
+	if err := writeUint64(w, req.target); err != nil {
+		return err
+	}
+	return writeUint64(w, req.minIndex)
+}
+
+// ------------------------------------------------------
+
+type sendSnapResp struct {
+	resp
+	lastIndex uint64 // last index in the snapshot being sent
+	size      int64  // size of the snapshot being sent
+}
+
+func (resp *sendSnapResp) decode(r io.Reader) error {
+	var err error
+	if err = resp.resp.decode(r); err != nil {
+		return err
+	}
+	if resp.lastIndex, err = readUint64(r); err != nil {
+		return err
+	}
+	size, err := readUint64(r)
+	resp.size = int64(size)
+	return err
+}
+
+func (resp *sendSnapResp) encode(w io.Writer) error {
+	if err := resp.resp.encode(w); err != nil {
+		return err
+	}
+	if err := writeUint64(w, resp.lastIndex); err != nil {
+		return err
+	}
+	return writeUint64(w, uint64(resp.size))
+}
+
+// ------------------------------------------------------
+
+// relayReq asks a follower to replicate to nonvoter target, on behalf
+// of leader. Leader sends it periodically, to learn the progress of
+// target. The follower stops relaying, if it is not polled for a while.
+type relayReq struct {
+	req           // term and id of leader
+	target uint64 // nonvoter to which entries are relayed
+}
+
+func (req *relayReq) rpcType() rpcType { return rpcRelay }
+
+func (req *relayReq) decode(r io.Reader) error {
+	var err error
+	if err = req.req.decode(r); err != nil {
+		return err
+	}
+	req.target, err = readUint64(r)
+	return err
+}
+
+func (req *relayReq) encode(w io.Writer) error {
+	if err := req.req.encode(w); err != nil {
+		return err
+	}
+	return writeUint64(w, req.target)
+}
+
+// ------------------------------------------------------
+
+type relayResp struct {
+	resp
+	matchIndex  uint64 // matchIndex of target, as seen by follower
+	unreachable bool   // true if follower is unable to reach target
+}
+
+func (resp *relayResp) decode(r io.Reader) error {
+	var err error
+	if err = resp.resp.decode(r); err != nil {
+		return err
+	}
+	if resp.matchIndex, err = readUint64(r); err != nil {
+		return err
+	}
+	resp.unreachable, err = readBool(r)
+	return err
+}
+
+func (resp *relayResp) encode(w io.Writer) error {
+	if err := resp.resp.encode(w); err != nil {
+		return err
+	}
+	if err := writeUint64(w, resp.matchIndex); err != nil {
+		return err
+	}
+	return writeBool(w, resp.unreachable)
+}
@@ -49,13 +49,19 @@ func TestMessage(t *testing.T) {
 			lastConfig: Config{
 				Nodes: nodes,
 				Index: 1, Term: 2,
-			}, size: int64(len(snapshot)),
+			}, size: int64(len(snapshot)), sessions: []byte("sessions"),
 		},
 		&installSnapResp{resp{term: 5, result: success}},
 		&installSnapResp{resp{term: 5, result: unexpectedErr, err: errors.New("notOpErr")}},
 		&installSnapResp{resp{term: 5, result: unexpectedErr, err: OpError{"myop", errors.New("notOpErr")}}},
 		&timeoutNowReq{req{term: 5, src: 3}},
 		&timeoutNowResp{resp{term: 5, result: success}},
+		&sendSnapReq{req: req{term: 5, src: 1}, target: 4, minIndex: 30},
+		&sendSnapResp{resp: resp{term: 5, result: success}, lastIndex: 35, size: 1024},
+		&sendSnapResp{resp: resp{term: 5, result: staleSnapshot}},
+		&relayReq{req: req{term: 5, src: 1}, target: 4},
+		&relayResp{resp: resp{term: 5, result: success}, matchIndex: 40, unreachable: true},
+		&relayResp{resp: resp{term: 5, result: cannotRelay}},
 	}
 	for _, test := range tests {
 		name := fmt.Sprintf("%T", test)
@@ -107,3 +113,88 @@ func TestMessage(t *testing.T) {
 		})
 	}
 }
+
+// new fields of Info must be appended, so that
+// older decoders read the preceding fields unchanged
+func TestInfo_appendedFields(t *testing.T) {
+	info := Info{CID: 1, NID: 2, Addr: "localhost:7000", Term: 5, State: Leader, Leader: 2, Committed: 10}
+	old := new(bytes.Buffer)
+	if err := info.encode(old); err != nil {
+		t.Fatal(err)
+	}
+	info.CommitReady, info.PendingEntries, info.PendingBytes = true, 3, 300
+	b := new(bytes.Buffer)
+	if err := info.encode(b); err != nil {
+		t.Fatal(err)
+	}
+	if n := old.Len() - 17; !bytes.Equal(old.Bytes()[:n], b.Bytes()[:n]) {
+		t.Fatal("new fields are not appended")
+	}
+	got := Info{}
+	if err := got.decode(b); err != nil {
+		t.Fatal(err)
+	}
+	if !got.CommitReady || got.Committed != 10 || got.PendingEntries != 3 || got.PendingBytes != 300 {
+		t.Fatalf("got %#v", got)
+	}
+
+	// older servers do not send appended fields
+	got = Info{}
+	if err := got.decode(bytes.NewReader(old.Bytes()[:old.Len()-17])); err != nil {
+		t.Fatal(err)
+	}
+	if got.CommitReady || got.Committed != 10 || got.PendingEntries != 0 {
+		t.Fatalf("got %#v", got)
+	}
+}
+
+// older nodes decode installSnapReq, without sessions
+func TestInstallSnapReq_olderNodes(t *testing.T) {
+	nodes := map[uint64]Node{1: {ID: 1, Addr: "localhost:7000", Voter: true}}
+	decodeOld := func(r io.Reader) *installSnapReq {
+		t.Helper()
+		req := &installSnapReq{}
+		if err := req.req.decode(r); err != nil {
+			t.Fatal(err)
+		}
+		var err error
+		if req.lastIndex, err = readUint64(r); err != nil {
+			t.Fatal(err)
+		}
+		if req.lastTerm, err = readUint64(r); err != nil {
+			t.Fatal(err)
+		}
+		e := &entry{}
+		if err = e.decode(r); err != nil {
+			t.Fatal(err)
+		}
+		if err = req.lastConfig.decode(e); err != nil {
+			t.Fatal(err)
+		}
+		size, err := readUint64(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.size = int64(size)
+		return req
+	}
+	for _, sessions := range [][]byte{nil, []byte("sessions")} {
+		req := &installSnapReq{
+			req: req{term: 5, src: 1}, lastIndex: 3, lastTerm: 5,
+			lastConfig: Config{Nodes: nodes, Index: 1, Term: 2},
+			size:       100, sessions: sessions,
+		}
+		b := new(bytes.Buffer)
+		if err := req.encode(b); err != nil {
+			t.Fatal(err)
+		}
+		got := decodeOld(b)
+		if b.Len() != 0 {
+			t.Fatalf("sessions=%q: bytes left %d", sessions, b.Len())
+		}
+		req.sessions = nil
+		if !reflect.DeepEqual(got, req) {
+			t.Fatalf("sessions=%q: got %#v, want %#v", sessions, got, req)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/santhosh-tekuri/raft/log"
+	"github.com/santhosh-tekuri/raft/vfs"
+)
+
+// The functions in this file work on storage directory of a node
+// which is not running. They never modify the storage directory.
+// Of the given Options, only FS and Keys are used. Keys is required
+// to read encrypted log entries and snapshots.
+
+// StorageInfo captures the state persisted in storage directory.
+type StorageInfo struct {
+	CID       uint64            `json:"cid"`
+	NID       uint64            `json:"nid"`
+	Term      uint64            `json:"term"`
+	VotedFor  uint64            `json:"votedFor"`
+	Locked    bool              `json:"locked,omitempty"`
+	Segments  []log.SegmentInfo `json:"segments"`
+	Snapshots []SnapshotInfo    `json:"snapshots"` // latest first
+}
+
+// SnapshotInfo captures metadata of a snapshot. The file fields
+// are set only when read from storage directory.
+type SnapshotInfo struct {
+	Index    uint64 `json:"index"`
+	Term     uint64 `json:"term"`
+	Config   Config `json:"config"`
+	Size     int64  `json:"size"`
+	KeyID    uint32 `json:"keyID,omitempty"`
+	MetaFile string `json:"metaFile,omitempty"`
+	SnapFile string `json:"snapFile,omitempty"`
+}
+
+// Entry is a log entry read from storage directory.
+type Entry struct {
+	Index  uint64  `json:"index"`
+	Term   uint64  `json:"term"`
+	Type   string  `json:"type"`
+	Size   int     `json:"size"`
+	Data   []byte  `json:"-"`
+	Config *Config `json:"config,omitempty"`
+}
+
+// ReadStorage reads identity, term, log segments and snapshots
+// from given storage directory.
+func ReadStorage(opt Options, storageDir string) (StorageInfo, error) {
+	if opt.FS == nil {
+		opt.FS = vfs.OS
+	}
+	info := StorageInfo{}
+	if err := assertDir(opt.FS, storageDir); err != nil {
+		return info, err
+	}
+	val, err := readValue(opt.FS, storageDir, ".id")
+	if err != nil {
+		return info, err
+	}
+	info.CID, info.NID = val.get()
+	if val, err = readValue(opt.FS, storageDir, ".term"); err != nil {
+		return info, err
+	}
+	info.Term, info.VotedFor = val.get()
+	if _, err = opt.FS.Stat(filepath.Join(storageDir, "lock")); err == nil {
+		info.Locked = true
+	}
+	if info.Segments, err = log.Segments(opt.FS, filepath.Join(storageDir, "log")); err != nil {
+		return info, err
+	}
+	info.Snapshots, err = readSnapshots(opt.FS, filepath.Join(storageDir, "snapshots"))
+	return info, err
+}
+
+// ReadEntries calls fn for each entry in log of given storage
+// directory, in order of index. The Entry.Data is valid only
+// during the call. Dangling segments are skipped, as raft
+// removes them on startup.
+func ReadEntries(opt Options, storageDir string, fn func(e Entry) error) error {
+	if opt.FS == nil {
+		opt.FS = vfs.OS
+	}
+	segs, err := log.Segments(opt.FS, filepath.Join(storageDir, "log"))
+	if err != nil {
+		return err
+	}
+	for _, seg := range segs {
+		if seg.Dangling {
+			continue
+		}
+		err := log.ReadSegment(opt.FS, seg, opt.Keys, func(index uint64, b []byte) error {
+			e, err := decodeEntry(index, b)
+			if err != nil {
+				return err
+			}
+			return fn(e)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VerifyStorage checks that the contents of given storage directory
+// are consistent with each other. It returns the list of problems
+// found. The returned error is non-nil, only if verification could
+// not be performed.
+func VerifyStorage(opt Options, storageDir string) ([]error, error) {
+	if opt.FS == nil {
+		opt.FS = vfs.OS
+	}
+	info, err := ReadStorage(opt, storageDir)
+	if err != nil {
+		return nil, err
+	}
+	var problems []error
+	problem := func(format string, v ...interface{}) {
+		problems = append(problems, fmt.Errorf(format, v...))
+	}
+	if info.Locked {
+		problem("lock file exists: node is running or was not shutdown cleanly")
+	}
+	if info.CID == 0 || info.NID == 0 {
+		problem("identity is not set")
+	}
+
+	// snapshots
+	var snap SnapshotInfo
+	for i, s := range info.Snapshots {
+		if s.Config.Index > s.Index {
+			problem("snapshot %d: config index %d is beyond snapshot index", s.Index, s.Config.Index)
+		}
+		size := s.Size
+		if s.KeyID != 0 {
+			size = sealedSize(s.Size)
+			if _, err := log.AEAD(opt.Keys, s.KeyID); err != nil {
+				problem("snapshot %d: %v", s.Index, err)
+			}
+		}
+		fi, err := opt.FS.Stat(s.SnapFile)
+		if err != nil {
+			problem("snapshot %d: %v", s.Index, err)
+		} else if fi.Size() != size {
+			problem("snapshot %d: size of %s is %d, want %d", s.Index, s.SnapFile, fi.Size(), size)
+		}
+		if i == 0 {
+			snap = s
+		}
+	}
+	if info.Term < snap.Term {
+		problem("term %d is less than snapshot term %d", info.Term, snap.Term)
+	}
+
+	// log segments, except dangling ones which raft removes on startup
+	var segs []log.SegmentInfo
+	for _, seg := range info.Segments {
+		if !seg.Dangling {
+			segs = append(segs, seg)
+		}
+	}
+	if len(segs) > 0 {
+		if prevIndex := segs[0].PrevIndex; prevIndex > snap.Index {
+			problem("log starts after index %d, but latest snapshot is at index %d", prevIndex, snap.Index)
+		}
+	}
+
+	// log entries
+	var last Entry
+	for _, seg := range segs {
+		err := log.ReadSegment(opt.FS, seg, opt.Keys, func(index uint64, b []byte) error {
+			e, err := decodeEntry(index, b)
+			if err != nil {
+				problem("%v", err)
+				return nil
+			}
+			if e.Index != index {
+				problem("entry %d: decoded index is %d", index, e.Index)
+			}
+			if e.Term < last.Term {
+				problem("entry %d: term %d is less than term %d of entry %d", index, e.Term, last.Term, last.Index)
+			}
+			if e.Term > info.Term {
+				problem("entry %d: term %d is beyond current term %d", index, e.Term, info.Term)
+			}
+			if index == snap.Index && e.Term != snap.Term {
+				problem("entry %d: term %d does not match snapshot term %d", index, e.Term, snap.Term)
+			}
+			last = e
+			return nil
+		})
+		if err != nil {
+			problem("%v", err)
+		}
+	}
+	return problems, nil
+}
+
+func readSnapshots(fs vfs.FS, dir string) ([]SnapshotInfo, error) {
+	if _, err := fs.Stat(dir); os.IsNotExist(err) {
+		return nil, nil
+	}
+	indexes, err := findSnapshots(fs, dir)
+	if err != nil {
+		return nil, err
+	}
+	var snaps []SnapshotInfo
+	for _, index := range indexes {
+		meta, err := readMeta(fs, metaFile(dir, index))
+		if err != nil {
+			return nil, fmt.Errorf("raft: %s: %v", metaFile(dir, index), err)
+		}
+		if meta.index != index {
+			return nil, fmt.Errorf("raft: %s has index %d", metaFile(dir, index), meta.index)
+		}
+		snaps = append(snaps, SnapshotInfo{
+			Index:    meta.index,
+			Term:     meta.term,
+			Config:   meta.config,
+			Size:     meta.size,
+			KeyID:    meta.keyID,
+			MetaFile: metaFile(dir, index),
+			SnapFile: snapFile(dir, index),
+		})
+	}
+	return snaps, nil
+}
+
+func decodeEntry(index uint64, b []byte) (Entry, error) {
+	ne := &entry{}
+	if err := ne.decode(bytes.NewReader(b)); err != nil {
+		return Entry{}, fmt.Errorf("raft: entry %d: %v", index, err)
+	}
+	e := Entry{
+		Index: ne.index,
+		Term:  ne.term,
+		Type:  ne.typ.String(),
+		Size:  len(ne.data),
+		Data:  ne.data,
+	}
+	if ne.typ == entryConfig {
+		config := Config{}
+		if err := config.decode(ne); err != nil {
+			return e, fmt.Errorf("raft: entry %d: %v", index, err)
+		}
+		e.Config = &config
+	}
+	return e, nil
+}
+
+func assertDir(fs vfs.FS, dir string) error {
+	d, err := fs.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !d.IsDir() {
+		return fmt.Errorf("raft: %q is not a directory", dir)
+	}
+	return nil
+}
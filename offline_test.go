@@ -0,0 +1,126 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadStorage(t *testing.T) {
+	c := newCluster(t)
+	c.opt.LogSegmentSize = 1024
+	c.opt.SnapshotsRetain = 2
+	ldr, _ := c.ensureLaunch(1)
+	c.waitCommitReady(ldr)
+	<-c.sendUpdates(ldr, 1, 20).Done()
+	c.takeSnapshot(ldr, 1, nil)
+	<-c.sendUpdates(ldr, 21, 40).Done()
+	c.takeSnapshot(ldr, 1, nil)
+	<-c.sendUpdates(ldr, 41, 60).Done()
+	c.waitFSMLen(60, ldr)
+	info := c.info(ldr)
+	c.shutdown()
+	dir := c.storage[ldr.nid]
+
+	// dangling segment, which raft removes on startup
+	dangling := filepath.Join(dir, "log", fmt.Sprintf("%d.log", info.LastLogIndex+10))
+	if err := ioutil.WriteFile(dangling, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := ReadStorage(Options{}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.CID != ldr.cid || s.NID != ldr.nid {
+		t.Fatalf("identity: got %d-%d, want %d-%d", s.CID, s.NID, ldr.cid, ldr.nid)
+	}
+	if s.Term != info.Term || s.VotedFor != ldr.nid {
+		t.Fatalf("term: got %d-%d, want %d-%d", s.Term, s.VotedFor, info.Term, ldr.nid)
+	}
+	if s.Locked {
+		t.Fatal("storage is locked after shutdown")
+	}
+	if len(s.Snapshots) != 2 || s.Snapshots[0].Index != info.SnapshotIndex {
+		t.Fatalf("snapshots: got %v, want latest %d", s.Snapshots, info.SnapshotIndex)
+	}
+	if len(s.Segments) < 3 {
+		t.Fatalf("numSegments: got %d, want >=3", len(s.Segments))
+	}
+	if got := s.Segments[len(s.Segments)-1]; !got.Dangling || got.File != dangling {
+		t.Fatalf("last segment: got %v, want dangling %s", got, dangling)
+	}
+	if got := s.Segments[0].PrevIndex; got != info.FirstLogIndex-1 {
+		t.Fatalf("prevIndex: got %d, want %d", got, info.FirstLogIndex-1)
+	}
+	if got := s.Segments[len(s.Segments)-2].LastIndex(); got != info.LastLogIndex {
+		t.Fatalf("lastIndex: got %d, want %d", got, info.LastLogIndex)
+	}
+
+	// check entries
+	want := info.FirstLogIndex
+	updates := 0
+	err = ReadEntries(Options{}, dir, func(e Entry) error {
+		if e.Index != want {
+			t.Fatalf("entry.index: got %d, want %d", e.Index, want)
+		}
+		switch e.Type {
+		case "update":
+			updates++
+		case "config":
+			if e.Config == nil {
+				t.Fatalf("entry %d: config not decoded", e.Index)
+			}
+		}
+		want++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want-1 != info.LastLogIndex || updates == 0 {
+		t.Fatalf("entries: lastIndex=%d updates=%d", want-1, updates)
+	}
+
+	// verify
+	problems, err := VerifyStorage(Options{}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("problems: %v", problems)
+	}
+
+	// corrupt latest snapshot
+	f, err := os.OpenFile(s.Snapshots[0].SnapFile, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteString("garbage"); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+	if problems, err = VerifyStorage(Options{}, dir); err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || !strings.Contains(problems[0].Error(), "size of") {
+		t.Fatalf("problems: got %v", problems)
+	}
+}
@@ -17,8 +17,12 @@ package raft
 import (
 	"errors"
 	"fmt"
-	"sync"
+	"net"
+	"os"
 	"time"
+
+	"github.com/santhosh-tekuri/raft/log"
+	"github.com/santhosh-tekuri/raft/vfs"
 )
 
 // todo: add roundThreshold & promoteThreshold, minRoundDuration
@@ -46,6 +50,62 @@ type Options struct {
 	// This is to avoid taking snapshot, for just few additional entries.
 	SnapshotThreshold uint64
 
+	// SnapshotBytes is the size of log entries since recent snapshot, beyond
+	// which snapshot is taken without waiting for SnapshotInterval. It is
+	// still subject to SnapshotThreshold. Zero means no such trigger.
+	SnapshotBytes int64
+
+	// SnapshotFreeBytes is the free space in filesystem containing storage,
+	// below which snapshot is taken without waiting for SnapshotInterval, so
+	// that log can be compacted. It is still subject to SnapshotThreshold.
+	// Zero means no such trigger.
+	SnapshotFreeBytes int64
+
+	// MinFreeBytes is the free space in filesystem containing storage, below
+	// which leader refuses new updates with ErrDiskFull, before the disk
+	// actually fills. Config changes are still accepted, so that nodes can
+	// be added or removed. It should be less than SnapshotFreeBytes.
+	// Zero means no such limit.
+	//
+	// It is enforced only on leader, against its own storage. Followers
+	// append whatever leader sends, so give all nodes similar disks.
+	// Free space is not measured on every update, so updates may resume
+	// up to a second after space is freed.
+	MinFreeBytes int64
+
+	// TrailingLogs is the number of log entries preceding the snapshot
+	// index, retained after log compaction. This allows slightly lagging
+	// followers and restarted nodes to catch up using AppendEntries,
+	// instead of InstallSnapshot. Log is compacted at segment granularity,
+	// so slightly more entries might be retained.
+	TrailingLogs uint64
+
+	// TrailingBytes is the minimum size of log entries preceding the
+	// snapshot index, retained after log compaction, in addition to
+	// TrailingLogs. Zero means no such minimum.
+	TrailingBytes int64
+
+	// DelegateSnapshots allows leader to delegate sending snapshot to
+	// a follower that is reachable and up-to-date, instead of sending it
+	// by itself. This reduces the load on leader, when several nodes need
+	// snapshot at once. If the follower cannot send its snapshot, leader
+	// sends snapshot by itself.
+	DelegateSnapshots bool
+
+	// ChainNonvoters allows leader to replicate to nonvoters through voter
+	// followers, instead of sending every entry to every node by itself.
+	// Each nonvoter receives committed entries from a follower, which is
+	// polled by leader for the progress of nonvoter. This bounds leader's
+	// egress, when there are many nonvoters. If no follower is reachable,
+	// leader replicates to nonvoter by itself.
+	ChainNonvoters bool
+
+	// FailureDomain returns the failure domain of node, such as availability
+	// zone. When sending snapshot is delegated, or when nonvoters are chained,
+	// follower in the same failure domain as the target is preferred. If nil,
+	// all nodes are treated as in the same failure domain.
+	FailureDomain func(n Node) string
+
 	// If ShutdownOnRemove is true, server will shutdown
 	// when it is removed from the cluster.
 	ShutdownOnRemove bool
@@ -60,12 +120,42 @@ type Options struct {
 	// new segment file is created. Value must be >=1024.
 	LogSegmentSize int
 
+	// MaxPendingEntries is the maximum number of FSMTasks that are submitted,
+	// but not yet completed. This bounds the memory used by queued and
+	// uncommitted entries, when the leader cannot keep up with submissions.
+	// Zero means no limit.
+	MaxPendingEntries int
+
+	// MaxPendingBytes is the maximum total size of data, of FSMTasks that are
+	// submitted, but not yet completed. Zero means no limit.
+	MaxPendingBytes int64
+
+	// FailWhenBusy determines how FSMTasks are handled, after the above limits
+	// are reached. If true, the task fails with ErrBusy. Otherwise, submission
+	// to Raft.FSMTasks() blocks until some pending tasks are completed.
+	FailWhenBusy bool
+
+	// MaxBatchEntries is the maximum number of FSMTasks, handed over to
+	// leader as a single batch. Leader appends a batch to log, and makes it
+	// durable with single fsync. Zero means no limit.
+	MaxBatchEntries int
+
+	// MaxBatchBytes is the maximum total size of data, of FSMTasks handed
+	// over to leader as a single batch. Zero means no limit.
+	MaxBatchBytes int64
+
+	// BatchLinger is the duration to wait for more FSMTasks, before handing
+	// over a batch that is not full. This trades latency for throughput,
+	// when there are few concurrent submitters. Zero means no waiting.
+	BatchLinger time.Duration
+
 	// SnapshotsRetain is the number of snapshots to be retained locally.
 	// When new snapshot is taken, older snapshots are removed accordingly.
 	// Value must be >=1.
 	SnapshotsRetain int
 
 	// Logger used for logging messages. If nil, nothing is logged.
+	// Use FromPrintLogger, if you have implementation of PrintLogger.
 	Logger Logger
 
 	// Alerts used to consume alerts that are raised. If nil, no alerts
@@ -75,6 +165,34 @@ type Options struct {
 	// Resolver used to resolved node id to transport address. If nill,
 	// Node.Address is used.
 	Resolver Resolver
+
+	// Codec used to decode read queries and encode FSM results, for
+	// the FSM tasks submitted using Client. If nil, queries are passed
+	// to FSM.Read as []byte, and FSM results must be []byte or string.
+	Codec Codec
+
+	// Clock provides time to raft. If nil, system clock is used.
+	// Use simulated clock from package sim, to run raft in virtual time.
+	Clock Clock
+
+	// Dial is used to connect to other nodes. If nil, net.DialTimeout
+	// is used. Use in-memory network from package sim, to simulate
+	// network failures.
+	Dial func(network, address string, timeout time.Duration) (net.Conn, error)
+
+	// RandSeed seeds the randomization of timeouts. If zero, a random
+	// seed is used. Use fixed seed, to get same timeouts in simulation.
+	RandSeed int64
+
+	// FS is the filesystem used for storage. If nil, vfs.OS is used.
+	// Use vfs.Mem to test how raft behaves on storage failures.
+	FS vfs.FS
+
+	// Keys, if not nil, is used to encrypt log entries and snapshots
+	// at rest. The id of key used is stored with each log segment and
+	// snapshot, so that keys can be rotated. Data is always transferred
+	// to other nodes and exported in plaintext.
+	Keys KeyProvider
 }
 
 func (o Options) validate() error {
@@ -87,9 +205,21 @@ func (o Options) validate() error {
 	if o.Bandwidth <= 0 {
 		return errors.New("raft.options: PromoteThreshold is zero")
 	}
+	if o.SnapshotBytes < 0 || o.SnapshotFreeBytes < 0 || o.MinFreeBytes < 0 {
+		return errors.New("raft.options: SnapshotBytes, SnapshotFreeBytes or MinFreeBytes is negative")
+	}
+	if o.TrailingBytes < 0 {
+		return errors.New("raft.options: TrailingBytes is negative")
+	}
 	if o.SnapshotsRetain < 1 {
 		return errors.New("raft.options: must retain at least one snapshot")
 	}
+	if o.MaxPendingEntries < 0 || o.MaxPendingBytes < 0 {
+		return errors.New("raft.options: MaxPendingEntries or MaxPendingBytes is negative")
+	}
+	if o.MaxBatchEntries < 0 || o.MaxBatchBytes < 0 || o.BatchLinger < 0 {
+		return errors.New("raft.options: MaxBatchEntries, MaxBatchBytes or BatchLinger is negative")
+	}
 	if o.LogSegmentSize < 1024 {
 		return fmt.Errorf("raft.options: LogSegmentSize is too smal")
 	}
@@ -108,7 +238,7 @@ func DefaultOptions() Options {
 		Bandwidth:         256 * 1024,
 		LogSegmentSize:    16 * 1024 * 1024,
 		SnapshotsRetain:   1,
-		Logger:            new(defaultLogger),
+		Logger:            NewTextLogger(os.Stdout, LevelInfo),
 	}
 }
 
@@ -122,38 +252,9 @@ type Resolver interface {
 	LookupID(id uint64, timeout time.Duration) (addr string, err error)
 }
 
-// Logger is the interface to be implemented for
-// consuming logs.
-type Logger interface {
-	// Info consumes information message.
-	Info(v ...interface{})
-
-	// Warn consumes warning message.
-	Warn(v ...interface{})
-}
-
-type nopLogger struct{}
-
-func (nopLogger) Info(v ...interface{}) {}
-func (nopLogger) Warn(v ...interface{}) {}
-
-type defaultLogger struct {
-	mu sync.Mutex
-}
-
-func (l *defaultLogger) Info(v ...interface{}) {
-	l.mu.Lock()
-	fmt.Print("[INFO] raft: ")
-	fmt.Println(v...)
-	l.mu.Unlock()
-}
-
-func (l *defaultLogger) Warn(v ...interface{}) {
-	l.mu.Lock()
-	fmt.Print("[WARN] raft: ")
-	fmt.Println(v...)
-	l.mu.Unlock()
-}
+// KeyProvider provides the keys used to encrypt storage. The keys
+// of log segments and snapshots that are retained, must be available.
+type KeyProvider = log.KeyProvider
 
 // Alerts allows to consume any alerts raised by raft.
 // This is useful in raising/resolving tickets to devops
@@ -219,6 +320,8 @@ var tracer struct {
 	configReverted      func(r *Raft)
 	roundCompleted      func(r *Raft, id uint64, round round)
 	logCompacted        func(r *Raft)
+	snapshotDelegated   func(r *Raft, target uint64)
+	logCommitted        func(r *Raft)
 	configActionStarted func(r *Raft, id uint64, action Action)
 	unreachable         func(r *Raft, id uint64, since time.Time, err error)
 	quorumUnreachable   func(r *Raft, since time.Time)
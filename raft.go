@@ -27,18 +27,30 @@ var testMode bool
 
 // Raft implements raft node.
 type Raft struct {
+	clock Clock
 	rtime randTime
 	timer *safeTimer
 
 	rpcCh        chan *rpc
 	disconnected chan uint64 // nid
 
-	fsm           *stateMachine
-	fsmRestoredCh chan error // fsm reports any errors during restore on this channel
-	snapTimer     *safeTimer
-	snapInterval  time.Duration
-	snapThreshold uint64
-	snapTakenCh   chan snapTaken // non nil only when snapshot task is in progress
+	fsm            *stateMachine
+	fsmRestoredCh  chan error // fsm reports any errors during restore on this channel
+	restoring      bool       // fsm restore is in progress
+	restoreAgain   bool       // snapshot installed during restore, restore it next
+	snapTimer      *safeTimer
+	snapInterval   time.Duration
+	snapThreshold  uint64
+	snapBytes      int64
+	snapFreeBytes  int64
+	minFreeBytes   int64
+	diskFull       bool
+	trailingLogs   uint64
+	trailingBytes  int64
+	delegateSnaps  bool
+	chainNonvoters bool
+	failureDomain  func(n Node) string
+	snapTakenCh    chan snapTaken // non nil only when snapshot task is in progress
 
 	// persistent state
 	*storage
@@ -56,6 +68,7 @@ type Raft struct {
 	logger           Logger
 	alerts           Alerts
 	bandwidth        int64
+	codec            Codec
 
 	// dialing
 	resolver  *resolver
@@ -64,10 +77,17 @@ type Raft struct {
 
 	ldr *leader
 	cnd *candidate
+	flr *follower
 
 	taskCh     chan Task
 	fsmTaskCh  chan FSMTask
 	newEntryCh chan *newEntry
+	quota      *quota
+
+	// batching
+	maxBatchEntries int
+	maxBatchBytes   int64
+	batchLinger     time.Duration
 
 	closeOnce   sync.Once
 	closeReason error
@@ -88,6 +108,15 @@ func New(opt Options, fsm FSM, storageDir string) (*Raft, error) {
 	if opt.Alerts == nil {
 		opt.Alerts = nopAlerts{}
 	}
+	if opt.Codec == nil {
+		opt.Codec = bytesCodec{}
+	}
+	if opt.Clock == nil {
+		opt.Clock = systemClock{}
+	}
+	if opt.Dial == nil {
+		opt.Dial = net.DialTimeout
+	}
 	store, err := openStorage(storageDir, opt)
 	if err != nil {
 		return nil, err
@@ -96,34 +125,49 @@ func New(opt Options, fsm FSM, storageDir string) (*Raft, error) {
 		return nil, ErrIdentityNotSet
 	}
 	sm := &stateMachine{
-		FSM:   fsm,
-		id:    store.nid,
-		ch:    make(chan interface{}, 1024), // todo configurable capacity
-		snaps: store.snaps,
+		FSM:      fsm,
+		id:       store.nid,
+		ch:       make(chan interface{}, 1024), // todo configurable capacity
+		snaps:    store.snaps,
+		sessions: newSessions(opt.Codec),
 	}
 	r := &Raft{
-		rtime:            newRandTime(),
-		timer:            newSafeTimer(),
+		clock:            opt.Clock,
+		rtime:            newRandTime(opt.Clock, opt.RandSeed),
+		timer:            newSafeTimer(opt.Clock),
 		rpcCh:            make(chan *rpc),
 		disconnected:     make(chan uint64, 20),
 		fsm:              sm,
-		fsmRestoredCh:    make(chan error, 5),
-		snapTimer:        newSafeTimer(),
+		fsmRestoredCh:    make(chan error, 1),
+		snapTimer:        newSafeTimer(opt.Clock),
 		snapInterval:     opt.SnapshotInterval,
 		snapThreshold:    opt.SnapshotThreshold,
+		snapBytes:        opt.SnapshotBytes,
+		snapFreeBytes:    opt.SnapshotFreeBytes,
+		minFreeBytes:     opt.MinFreeBytes,
+		trailingLogs:     opt.TrailingLogs,
+		trailingBytes:    opt.TrailingBytes,
+		delegateSnaps:    opt.DelegateSnapshots,
+		chainNonvoters:   opt.ChainNonvoters,
+		failureDomain:    opt.FailureDomain,
 		storage:          store,
 		state:            Follower,
 		hbTimeout:        opt.HeartbeatTimeout,
 		promoteThreshold: opt.PromoteThreshold,
 		shutdownOnRemove: opt.ShutdownOnRemove,
-		logger:           opt.Logger,
+		logger:           withFields(opt.Logger, "nid", store.nid),
 		alerts:           opt.Alerts,
 		bandwidth:        opt.Bandwidth,
-		dialFn:           net.DialTimeout,
+		codec:            opt.Codec,
+		dialFn:           opt.Dial,
 		connPools:        make(map[uint64]*connPool),
 		taskCh:           make(chan Task),
 		fsmTaskCh:        make(chan FSMTask),
 		newEntryCh:       make(chan *newEntry),
+		quota:            newQuota(opt),
+		maxBatchEntries:  opt.MaxBatchEntries,
+		maxBatchBytes:    opt.MaxBatchBytes,
+		batchLinger:      opt.BatchLinger,
 		close:            make(chan struct{}),
 		closed:           make(chan struct{}),
 	}
@@ -180,18 +224,30 @@ func (r *Raft) Serve(l net.Listener) error {
 		return ErrServerClosed
 	}
 	storageDir := filepath.Dir(r.snaps.dir)
-	if err := lockDir(storageDir); err != nil {
+	if err := lockDir(r.snaps.fs, storageDir); err != nil {
 		return err
 	}
-	defer unlockDir(storageDir)
+	defer unlockDir(r.snaps.fs, storageDir)
 	if trace {
 		println(r, "serving at", l.Addr())
 		defer println(r, "<< shutdown()")
 	}
-	r.logger.Info("storage:", filepath.Dir(r.snaps.dir))
-	r.logger.Info("cid:", r.cid, "nid:", r.nid)
-	r.logger.Info(r.configs.Latest)
-	r.logger.Info("listening at", l.Addr())
+	r.logger.Info("serving", "storage", storageDir, "cid", r.cid, "addr", l.Addr())
+	r.logger.Info("current config", "term", r.term, "config", r.configs.Latest)
+
+	// persistent fsm need not be restored, if it is up to date
+	index, term, skipRestore, err := r.persistentApplied()
+	if err != nil {
+		return err
+	}
+	if skipRestore {
+		if err = r.fsm.restoreSessions(r.log, index); err != nil {
+			return err
+		}
+		r.fsm.setIndex(index, term)
+		r.commitIndex = index
+		r.logger.Info("skipping fsm restore", "lastApplied", index)
+	}
 
 	var wg sync.WaitGroup
 	defer wg.Wait()
@@ -207,7 +263,7 @@ func (r *Raft) Serve(l net.Listener) error {
 	defer close(r.fsm.ch)
 
 	// restore fsm from last snapshot, if present
-	if r.snaps.index > 0 {
+	if r.snaps.index > 0 && !skipRestore {
 		r.fsm.ch <- fsmRestoreReq{r.fsmRestoredCh}
 		if err := <-r.fsmRestoredCh; err != nil {
 			return err
@@ -230,7 +286,11 @@ func (r *Raft) Serve(l net.Listener) error {
 	r.stateLoop()
 	for ne := range r.newEntryCh {
 		for ne != nil {
-			ne.reply(ErrServerClosed)
+			if ne.accept() {
+				ne.reply(ErrServerClosed)
+			} else {
+				ne.release()
+			}
 			ne = ne.next
 		}
 	}
@@ -245,12 +305,12 @@ func (r *Raft) stateLoop() {
 			Raft:  r,
 			repls: make(map[uint64]*replication),
 			transfer: transfer{
-				timer:        newSafeTimer(),
-				newTermTimer: newSafeTimer(),
+				timer:        newSafeTimer(r.clock),
+				newTermTimer: newSafeTimer(r.clock),
 			},
 		}
 	)
-	r.ldr, r.cnd = l, c
+	r.ldr, r.cnd, r.flr = l, c, f
 
 	states := map[State]interface {
 		init()
@@ -294,6 +354,18 @@ func (r *Raft) stateLoop() {
 				if err != nil {
 					panic(err)
 				}
+				if r.restoreAgain {
+					r.restoreAgain = false
+					r.fsm.ch <- fsmRestoreReq{r.fsmRestoredCh}
+				} else {
+					r.restoring = false
+					// apply entries committed during restore
+					if r.state == Leader {
+						l.applyCommitted()
+					} else {
+						r.applyCommitted(nil)
+					}
+				}
 
 			case <-r.snapTimer.C:
 				r.snapTimer.active = false
@@ -301,10 +373,13 @@ func (r *Raft) stateLoop() {
 
 			case rpc := <-r.rpcCh:
 				resetTimer := r.replyRPC(rpc)
-				// on receiving AppendEntries from current leader or
-				// granting vote to candidate reset timer
-				if r.state == Follower && resetTimer {
-					f.resetTimer()
+				if r.state == Follower {
+					// on receiving AppendEntries from current leader or
+					// granting vote to candidate reset timer
+					if resetTimer {
+						f.resetTimer()
+					}
+					f.checkRelays()
 				}
 
 			case nid := <-r.disconnected:
@@ -325,12 +400,15 @@ func (r *Raft) stateLoop() {
 						l.storeEntry(ne)
 					} else {
 						for ne != nil {
-							if ne.typ == entryDirtyRead {
+							next := ne.next
+							if !ne.accept() {
+								ne.release() // dropped, skip it
+							} else if ne.typ == entryDirtyRead {
 								r.fsm.ch <- fsmDirtyRead{ne}
 							} else {
 								ne.reply(notLeaderError(r, false))
 							}
-							ne = ne.next
+							ne = next
 						}
 					}
 				} else {
@@ -350,6 +428,10 @@ func (r *Raft) stateLoop() {
 					r.snapTimer.reset(r.rtime.duration(r.snapInterval))
 				}
 
+			// follower --------------
+			case u := <-f.relayUpdateCh:
+				f.onRelayUpdate(u)
+
 			// candidate --------------
 			case v := <-c.respCh:
 				c.onVoteResult(v)
@@ -387,6 +469,9 @@ func (r *Raft) release() {
 	if r.snapTakenCh != nil {
 		r.onSnapshotTaken(<-r.snapTakenCh)
 	}
+
+	// wait for stopped relays, before log is closed
+	r.flr.waitStopped()
 }
 
 func (r *Raft) doClose(reason error) {
@@ -400,7 +485,7 @@ func (r *Raft) doClose(reason error) {
 		} else if reason == ErrNodeRemoved {
 			r.logger.Info("node removed, shutting down")
 		} else {
-			r.logger.Warn(trimPrefix(reason), "shutting down")
+			r.logger.Error("shutting down", "reason", trimPrefix(reason))
 		}
 		r.alerts.ShuttingDown(reason)
 		if tracer.shuttingDown != nil {
@@ -447,7 +532,7 @@ func (r *Raft) setState(s State) {
 		if trace {
 			println(r, r.state, "->", s)
 		}
-		r.logger.Info("changing state", r.state, "->", s)
+		r.logger.Info("changing state", "term", r.term, "from", r.state, "to", s)
 		r.state = s
 		if tracer.stateChanged != nil {
 			tracer.stateChanged(r)
@@ -462,11 +547,11 @@ func (r *Raft) setLeader(id uint64) {
 		}
 		r.leader = id
 		if r.leader == 0 {
-			r.logger.Info("no known leader")
+			r.logger.Info("no known leader", "term", r.term)
 		} else if r.leader == r.nid {
-			r.logger.Info("cluster leadership acquired")
+			r.logger.Info("cluster leadership acquired", "term", r.term)
 		} else {
-			r.logger.Info("following leader node", r.leader)
+			r.logger.Info("following leader", "term", r.term, "leader", r.leader)
 		}
 		if tracer.leaderChanged != nil {
 			tracer.leaderChanged(r)
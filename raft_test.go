@@ -22,15 +22,18 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"reflect"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/fortytw2/leaktest"
 	"github.com/santhosh-tekuri/fnet"
+	"github.com/santhosh-tekuri/raft/vfs"
 )
 
 func TestRaft_shutdown_once(t *testing.T) {
@@ -119,6 +122,175 @@ func TestRaft_tripleNode(t *testing.T) {
 	c.waitFSMLen(1)
 }
 
+func TestRaft_Execute(t *testing.T) {
+	c, ldr, _ := launchCluster(t, 3)
+	defer c.shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ldr.Execute(ctx, GetInfo()); err != (ContextError{Err: context.Canceled}) {
+		t.Fatalf("got %v, want %v", err, ContextError{Err: context.Canceled})
+	}
+
+	// block raft loop, so that entry stays queued
+	started, block := make(chan struct{}), make(chan struct{})
+	go func() {
+		_ = ldr.inspect(func(*Raft) {
+			close(started)
+			<-block
+		})
+	}()
+	<-started
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	want := ContextError{Err: context.DeadlineExceeded}
+	if _, err := ldr.Execute(ctx, UpdateFSM([]byte("dropped"))); err != want {
+		t.Fatalf("got %v, want %v", err, want)
+	}
+	close(block)
+
+	// dropped entry must not be applied
+	result, err := ldr.Execute(context.Background(), UpdateFSM([]byte("test")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := result.(fsmReply); resp.msg != "test" || resp.index != 1 {
+		t.Fatalf("got %v, want {test 1}", resp)
+	}
+	c.waitFSMLen(1)
+}
+
+func TestRaft_backPressure(t *testing.T) {
+	for _, failWhenBusy := range []bool{true, false} {
+		t.Run(fmt.Sprintf("failWhenBusy=%v", failWhenBusy), func(t *testing.T) {
+			c := newCluster(t)
+			c.opt.MaxPendingEntries = 2
+			c.opt.FailWhenBusy = failWhenBusy
+			ldr, _ := c.ensureLaunch(1)
+			defer c.shutdown()
+
+			// block raft loop, so that entries stay pending
+			started, block := make(chan struct{}), make(chan struct{})
+			go func() {
+				_ = ldr.inspect(func(*Raft) {
+					close(started)
+					<-block
+				})
+			}()
+			<-started
+			var tasks []FSMTask
+			for i := 1; i <= 2; i++ {
+				t := UpdateFSM([]byte(fmt.Sprintf("update:%d", i)))
+				ldr.FSMTasks() <- t
+				tasks = append(tasks, t)
+			}
+			busy := UpdateFSM([]byte("busy"))
+			if failWhenBusy {
+				ldr.FSMTasks() <- busy
+				<-busy.Done()
+				if busy.Err() != ErrBusy {
+					t.Fatalf("got %v, want %v", busy.Err(), ErrBusy)
+				}
+			} else {
+				select {
+				case ldr.FSMTasks() <- busy:
+					t.Fatal("submission must block")
+				case <-time.After(100 * time.Millisecond):
+				}
+			}
+			close(block)
+			for _, task := range tasks {
+				<-task.Done()
+				if task.Err() != nil {
+					t.Fatal(task.Err())
+				}
+			}
+			if _, err := waitUpdate(ldr, "last", c.longTimeout); err != nil {
+				t.Fatal(err)
+			}
+			if info := c.info(ldr); info.PendingEntries != 0 || info.PendingBytes != 0 {
+				t.Fatalf("pending: entries=%d bytes=%d", info.PendingEntries, info.PendingBytes)
+			}
+		})
+	}
+}
+
+// run with -race: busy entries must not be replied twice,
+// when Execute drops them on context done.
+func TestRaft_busyWithContextDone(t *testing.T) {
+	c := newCluster(t)
+	c.opt.MaxPendingEntries = 1
+	c.opt.FailWhenBusy = true
+	ldr, _ := c.ensureLaunch(1)
+	defer c.shutdown()
+
+	// block raft loop, so that entries stay pending
+	started, block := make(chan struct{}), make(chan struct{})
+	go func() {
+		_ = ldr.inspect(func(*Raft) {
+			close(started)
+			<-block
+		})
+	}()
+	<-started
+	pending := UpdateFSM([]byte("pending"))
+	ldr.FSMTasks() <- pending
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithCancel(context.Background())
+			go cancel()
+			_, err := ldr.Execute(ctx, UpdateFSM([]byte("busy")))
+			if _, ok := err.(ContextError); !ok && err != ErrBusy {
+				t.Errorf("got %v, want ErrBusy or ContextError", err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(block)
+	<-pending.Done()
+	if pending.Err() != nil {
+		t.Fatal(pending.Err())
+	}
+}
+
+func TestRaft_batchLimits(t *testing.T) {
+	c := newCluster(t)
+	c.opt.MaxBatchEntries = 4
+	ldr, _ := c.ensureLaunch(1)
+	defer c.shutdown()
+	c.waitCommitReady(ldr)
+
+	var commits int32
+	tracer.logCommitted = func(*Raft) {
+		atomic.AddInt32(&commits, 1)
+	}
+	defer func() { tracer.logCommitted = nil }()
+
+	// block raft loop, so that entries are batched
+	started, block := make(chan struct{}), make(chan struct{})
+	go func() {
+		_ = ldr.inspect(func(*Raft) {
+			close(started)
+			<-block
+		})
+	}()
+	<-started
+	last := c.sendUpdates(ldr, 1, 10)
+	close(block)
+	<-last.Done()
+	if last.Err() != nil {
+		t.Fatal(last.Err())
+	}
+	// batches of 4, 4 and 2 entries
+	if got := atomic.LoadInt32(&commits); got != 3 {
+		t.Fatalf("commits=%d, want %d", got, 3)
+	}
+}
+
 // todo: test that non voter does not start election
 //        * if he started as voter and hasn't got any requests from leader
 //        * if leader contact lost for more than heartbeat timeout
@@ -243,6 +415,7 @@ type cluster struct {
 	commitTimeout    time.Duration
 	opt              Options
 	quorumWait       time.Duration
+	blockRestore     chan struct{} // used by fsm of nodes launched
 	resolverMu       sync.RWMutex
 }
 
@@ -314,7 +487,7 @@ func (c *cluster) launch(n int, bootstrap bool) map[uint64]*Raft {
 				c.Fatalf("Storage.bootstrap failed: %v", err)
 			}
 		}
-		fsm := &fsmMock{id: identity{c.id, node.ID}, changed: ee.onFMSChanged}
+		fsm := &fsmMock{id: identity{c.id, node.ID}, changed: ee.onFMSChanged, blockRestore: c.blockRestore}
 		c.alerts[node.ID] = new(alerts)
 		opt := c.opt
 		opt.Alerts = c.alerts[node.ID]
@@ -440,6 +613,27 @@ func (c *cluster) restart(r *Raft) *Raft {
 	return newr
 }
 
+// launchStorage launches node with given existing storageDir
+func (c *cluster) launchStorage(nid uint64, storageDir string) *Raft {
+	c.Helper()
+	fsm := &fsmMock{id: identity{c.id, nid}, changed: ee.onFMSChanged}
+	c.alerts[nid] = new(alerts)
+	opt := c.opt
+	opt.Alerts = c.alerts[nid]
+	r, err := New(opt, fsm, storageDir)
+	if err != nil {
+		c.Fatal(err)
+	}
+	r.quorumWait = c.quorumWait
+	c.rr[nid] = r
+	c.storage[nid] = storageDir
+	c.serverErrMu.Lock()
+	c.serveErr[nid] = make(chan error, 1)
+	c.serverErrMu.Unlock()
+	c.serve(r)
+	return r
+}
+
 func (c *cluster) info(r *Raft) Info {
 	res, err := waitTask(r, GetInfo(), 0)
 	if err != nil {
@@ -856,7 +1050,7 @@ func (c *cluster) connect() {
 
 func (c *cluster) snaps(r *Raft) []uint64 {
 	c.Helper()
-	snaps, err := findSnapshots(r.snaps.dir)
+	snaps, err := findSnapshots(r.snaps.fs, r.snaps.dir)
 	if err != nil {
 		c.Fatal(err)
 	}
@@ -999,6 +1193,55 @@ func bootstrapStorage(storageDir string, opt Options, nodes map[uint64]Node) err
 	return store.log.Close()
 }
 
+// launchNode launches single node cluster with given fsm, listening
+// on loopback address, and waits until it is ready to commit. If
+// storageDir is empty, new storage is bootstrapped, in "/storage"
+// if opt.FS is not vfs.OS.
+func launchNode(tb testing.TB, opt Options, fsm FSM, storageDir string) *Raft {
+	tb.Helper()
+	lr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if storageDir == "" {
+		if opt.FS == nil || opt.FS == vfs.OS {
+			storageDir, err = ioutil.TempDir(tempDir, "storage")
+		} else {
+			storageDir = "/storage"
+			err = opt.FS.MkdirAll(storageDir, 0700)
+		}
+		if err != nil {
+			tb.Fatal(err)
+		}
+		fs := opt.FS
+		if fs == nil {
+			fs = vfs.OS
+		}
+		if err = setIdentity(fs, storageDir, 1, 1); err != nil {
+			tb.Fatal(err)
+		}
+		nodes := map[uint64]Node{1: {ID: 1, Addr: lr.Addr().String(), Voter: true}}
+		if err = bootstrapStorage(storageDir, opt, nodes); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	r, err := New(opt, fsm, storageDir)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	go func() { _ = r.Serve(lr) }()
+	for {
+		info, err := r.Execute(context.Background(), GetInfo())
+		if err != nil {
+			tb.Fatal(err)
+		}
+		if info.(Info).CommitReady {
+			return r
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 // events ---------------------------------------------
 
 type eventType int
@@ -1391,6 +1634,9 @@ type fsmMock struct {
 	mu      sync.RWMutex
 	cmds    []string
 	changed func(id identity, len uint64)
+
+	// if not nil, Restore waits till it is closed
+	blockRestore chan struct{}
 }
 
 var _ FSM = (*fsmMock)(nil)
@@ -1470,6 +1716,9 @@ func (fsm *fsmMock) Restore(r io.Reader) error {
 	if err := gob.NewDecoder(r).Decode(&cmds); err != nil {
 		return err
 	}
+	if fsm.blockRestore != nil {
+		<-fsm.blockRestore
+	}
 	fsm.mu.Lock()
 	defer fsm.mu.Unlock()
 	fsm.cmds = cmds
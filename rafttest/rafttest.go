@@ -0,0 +1,530 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package rafttest runs a cluster of in-process raft nodes, to test
+applications built on raft.
+
+Nodes communicate through sim.Network and use sim.Clock, so that
+partitions are simulated without real sockets, and timeouts do not
+depend on how fast the machine is:
+
+	func TestKVStore(t *testing.T) {
+		c := rafttest.Launch(t, rafttest.Config{
+			Size:   3,
+			NewFSM: func(id uint64) raft.FSM { return newKVStore() },
+		})
+		defer c.Shutdown()
+		ldr := c.Leader()
+		if _, err := c.Execute(ldr, raft.UpdateFSM(cmd)); err != nil {
+			t.Fatal(err)
+		}
+
+		c.Partition([]*rafttest.Node{ldr})
+		newLdr := c.WaitForLeader(ldr)
+		...
+		c.Heal()
+		c.WaitCatchup()
+	}
+
+Storage directories are created in temporary directory, and are removed
+by Cluster.Shutdown. If Config.FS is set, they are created in the
+filesystems it returns instead. With vfs.Mem, Cluster.Crash simulates
+crash of a node, which loses the data that it has not synced.
+
+The clock is advanced in the background, one timer at a time, only when
+all goroutines are blocked (see sim.WaitIdle). Wait helpers poll on
+virtual time. So a run depends only on Config.Seed, and a failing seed
+replays the same run, provided the test goroutine and the FSMs also wait
+only on the cluster or its clock.
+*/
+package rafttest
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/santhosh-tekuri/raft"
+	"github.com/santhosh-tekuri/raft/sim"
+	"github.com/santhosh-tekuri/raft/vfs"
+)
+
+// Config describes the cluster to be launched.
+type Config struct {
+	// Size is the number of voters in cluster.
+	Size int
+
+	// NewFSM returns the FSM for node with given id. It is called
+	// each time the node is started, including restarts.
+	NewFSM func(id uint64) raft.FSM
+
+	// Options is optional. It is called to customize the options
+	// of node, each time it is started. Clock, Dial, RandSeed and FS
+	// are set by cluster, and must not be changed.
+	Options func(id uint64, opt *raft.Options)
+
+	// FS is optional. It returns the filesystem for storage of node
+	// with given id, and is called once for each node. If nil, vfs.OS
+	// is used. Return separate vfs.Mem for each node, to use Crash.
+	FS func(id uint64) vfs.FS
+
+	// Link is the network link used between nodes.
+	// If zero, a link with 1ms delay and 2ms jitter is used.
+	Link sim.Link
+
+	// Seed is used for all random decisions. If zero, a random seed
+	// is used, which is logged so that failing test can be rerun with
+	// same seed.
+	Seed int64
+
+	// WaitTimeout is the virtual time, after which wait helpers
+	// fail the test. Default is one minute.
+	WaitTimeout time.Duration
+}
+
+// Node represents a member of cluster.
+type Node struct {
+	ID   uint64
+	Addr string
+	Host string
+	Dir  string // storage dir
+	FS   vfs.FS // filesystem of Dir
+
+	// Raft and FSM of the node. Raft is nil, if node is killed.
+	Raft *raft.Raft
+	FSM  raft.FSM
+
+	starts   int
+	listener net.Listener
+	served   chan struct{}
+}
+
+// Alive tells whether the node is running.
+func (n *Node) Alive() bool {
+	return n.Raft != nil
+}
+
+// Cluster is a set of nodes, running in simulated environment.
+// Its methods must be called only from the test goroutine.
+type Cluster struct {
+	tb    testing.TB
+	cfg   Config
+	nodes []*Node
+
+	// Clock and Network are shared by all nodes. Use them for
+	// finer control, such as to configure lossy links.
+	Clock   *sim.Clock
+	Network *sim.Network
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// Launch starts a cluster of cfg.Size voters, and waits for a leader
+// to be elected. Use Shutdown, to stop the cluster when test finishes.
+func Launch(tb testing.TB, cfg Config) *Cluster {
+	tb.Helper()
+	if cfg.Size <= 0 {
+		tb.Fatal("rafttest: Config.Size must be positive")
+	}
+	if cfg.NewFSM == nil {
+		tb.Fatal("rafttest: Config.NewFSM is nil")
+	}
+	if cfg.Seed == 0 {
+		cfg.Seed = rand.Int63()
+	}
+	if cfg.Link == (sim.Link{}) {
+		cfg.Link = sim.Link{Delay: time.Millisecond, Jitter: 2 * time.Millisecond}
+	}
+	if cfg.WaitTimeout == 0 {
+		cfg.WaitTimeout = time.Minute
+	}
+	tb.Logf("rafttest: seed %d", cfg.Seed)
+
+	clock := sim.NewClock()
+	c := &Cluster{
+		tb:      tb,
+		cfg:     cfg,
+		Clock:   clock,
+		Network: sim.NewNetwork(clock, cfg.Seed),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	c.Network.SetDefaultLink(cfg.Link)
+	go c.run()
+	launched := false
+	defer func() {
+		if !launched {
+			c.Shutdown()
+		}
+	}()
+
+	config := raft.Config{Nodes: make(map[uint64]raft.Node)}
+	for id := uint64(1); id <= uint64(cfg.Size); id++ {
+		n := &Node{ID: id, Host: fmt.Sprintf("M%d", id), FS: vfs.OS}
+		n.Addr = n.Host + ":7000"
+		c.nodes = append(c.nodes, n)
+		var err error
+		if cfg.FS != nil {
+			n.FS, n.Dir = cfg.FS(id), "/"+n.Host
+			err = n.FS.MkdirAll(n.Dir, 0700)
+		} else {
+			n.Dir, err = ioutil.TempDir("", "rafttest")
+		}
+		if err != nil {
+			tb.Fatal(err)
+		}
+		if err = raft.SetIdentityFS(n.FS, n.Dir, 1, id); err != nil {
+			tb.Fatal(err)
+		}
+		if err = config.AddVoter(id, n.Addr); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	for _, n := range c.nodes {
+		c.start(n)
+	}
+	c.settle()
+	if _, err := c.Execute(c.nodes[0], raft.ChangeConfig(config)); err != nil {
+		tb.Fatalf("rafttest: bootstrap: %v", err)
+	}
+	c.WaitForLeader()
+	launched = true
+	return c
+}
+
+func (c *Cluster) start(n *Node) {
+	c.tb.Helper()
+	opt := raft.DefaultOptions()
+	opt.Logger = nil
+	opt.HeartbeatTimeout = 100 * time.Millisecond
+	opt.PromoteThreshold = opt.HeartbeatTimeout
+	opt.Clock = c.Clock
+	opt.FS = n.FS
+	opt.Dial = c.Network.Dialer(n.Host)
+	opt.RandSeed = c.cfg.Seed*100 + int64(n.ID)*10 + int64(n.starts)
+	n.starts++
+	if c.cfg.Options != nil {
+		c.cfg.Options(n.ID, &opt)
+	}
+
+	fsm := c.cfg.NewFSM(n.ID)
+	r, err := raft.New(opt, fsm, n.Dir)
+	if err != nil {
+		c.tb.Fatalf("rafttest: start M%d: %v", n.ID, err)
+	}
+	l, err := c.Network.Listen(n.Addr)
+	if err != nil {
+		c.tb.Fatalf("rafttest: start M%d: %v", n.ID, err)
+	}
+	n.Raft, n.FSM, n.listener = r, fsm, l
+	n.served = make(chan struct{})
+	go func(served chan struct{}) {
+		defer close(served)
+		_ = r.Serve(l)
+	}(n.served)
+	c.Network.SetDown(n.Host, false)
+}
+
+// run fires the timers one at a time, each after all goroutines
+// have finished reacting to the previous one.
+func (c *Cluster) run() {
+	defer close(c.stopped)
+	warned := false
+	for {
+		select {
+		case <-c.stop:
+			return
+		default:
+		}
+		if !sim.WaitIdle(time.Second) && !warned {
+			// better not to hang, if some goroutine is always busy
+			c.tb.Logf("rafttest: seed %d: goroutines busy for 1s, advancing clock anyway; run may not replay", c.cfg.Seed)
+			warned = true
+		}
+		if !c.Clock.Step() {
+			// nothing to fire, until test goroutine does something
+			time.Sleep(50 * time.Microsecond)
+		}
+	}
+}
+
+// settle returns after 1ns of virtual time, so that the caller
+// resumes only after nodes have reacted to the changes it made.
+func (c *Cluster) settle() {
+	c.Sleep(time.Nanosecond)
+}
+
+// Shutdown stops all alive nodes and the clock, and removes
+// storage dirs of all nodes.
+func (c *Cluster) Shutdown() {
+	for _, n := range c.nodes {
+		if n.Alive() {
+			c.stopNode(n)
+		}
+	}
+	close(c.stop)
+	<-c.stopped
+	for _, n := range c.nodes {
+		if n.FS == vfs.OS {
+			_ = os.RemoveAll(n.Dir)
+		}
+	}
+}
+
+// Nodes returns all nodes in cluster, including killed nodes.
+func (c *Cluster) Nodes() []*Node {
+	return append([]*Node(nil), c.nodes...)
+}
+
+// Node returns the node with given id.
+func (c *Cluster) Node(id uint64) *Node {
+	c.tb.Helper()
+	if id == 0 || id > uint64(len(c.nodes)) {
+		c.tb.Fatalf("rafttest: no node with id %d", id)
+	}
+	return c.nodes[id-1]
+}
+
+// Execute executes task on given node, waiting at most 10 seconds
+// of virtual time.
+//
+// It returns 1ns of virtual time after the task is completed, so that
+// caller resumes only after the node has finished reacting to whatever
+// completed the task. Otherwise the caller's next action would race
+// with the node, and the run would not replay.
+func (c *Cluster) Execute(n *Node, t raft.Task) (interface{}, error) {
+	if !n.Alive() {
+		return nil, raft.ErrServerClosed
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	timer := c.Clock.NewTimer(10 * time.Second)
+	defer timer.Stop()
+	go func() {
+		select {
+		case <-timer.C():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	result, err := n.Raft.Execute(ctx, t)
+	c.settle()
+	return result, err
+}
+
+// Sleep blocks the caller for d of virtual time. Unlike other
+// methods, it can be called from any goroutine.
+func (c *Cluster) Sleep(d time.Duration) {
+	timer := c.Clock.NewTimer(d)
+	<-timer.C()
+}
+
+// Info returns the info of given node. It fails
+// the test, if node is killed.
+func (c *Cluster) Info(n *Node) raft.Info {
+	c.tb.Helper()
+	info, err := c.Execute(n, raft.GetInfo())
+	if err != nil {
+		c.tb.Fatalf("rafttest: info of M%d: %v", n.ID, err)
+	}
+	return info.(raft.Info)
+}
+
+func (c *Cluster) info(n *Node) (raft.Info, bool) {
+	info, err := c.Execute(n, raft.GetInfo())
+	if err != nil {
+		return raft.Info{}, false
+	}
+	return info.(raft.Info), true
+}
+
+// WaitFor waits until cond returns true, failing the test
+// if it does not happen within Config.WaitTimeout of virtual time.
+func (c *Cluster) WaitFor(what string, cond func() bool) {
+	c.tb.Helper()
+	deadline := c.Clock.Now().Add(c.cfg.WaitTimeout)
+	for !cond() {
+		if c.Clock.Now().After(deadline) {
+			c.tb.Fatalf("rafttest: seed %d: waitFor %s: timeout", c.cfg.Seed, what)
+		}
+		c.Sleep(time.Millisecond)
+	}
+}
+
+// leader returns the commit ready leader with highest term,
+// among alive nodes except the given nodes.
+func (c *Cluster) leader(except []*Node) *Node {
+	var ldr *Node
+	var term uint64
+outer:
+	for _, n := range c.nodes {
+		for _, e := range except {
+			if n == e {
+				continue outer
+			}
+		}
+		info, ok := c.info(n)
+		if ok && info.State == raft.Leader && info.CommitReady && info.Term > term {
+			ldr, term = n, info.Term
+		}
+	}
+	return ldr
+}
+
+// Leader waits for a leader that is ready to commit, and returns it.
+func (c *Cluster) Leader() *Node {
+	c.tb.Helper()
+	return c.WaitForLeader()
+}
+
+// WaitForLeader waits for a leader that is ready to commit, other than
+// the given nodes. This is useful, to wait for new leader to be elected
+// after old leader is partitioned or killed.
+func (c *Cluster) WaitForLeader(except ...*Node) *Node {
+	c.tb.Helper()
+	var ldr *Node
+	c.WaitFor("leader", func() bool {
+		ldr = c.leader(except)
+		return ldr != nil
+	})
+	return ldr
+}
+
+// WaitCatchup waits until all alive nodes have applied
+// all entries in log of leader.
+func (c *Cluster) WaitCatchup() {
+	c.tb.Helper()
+	c.WaitFor("catchup", func() bool {
+		ldr := c.leader(nil)
+		if ldr == nil {
+			return false
+		}
+		linfo, ok := c.info(ldr)
+		if !ok || linfo.Committed != linfo.LastLogIndex {
+			return false
+		}
+		for _, n := range c.nodes {
+			if !n.Alive() {
+				continue
+			}
+			info, ok := c.info(n)
+			if !ok || info.LastApplied < linfo.LastLogIndex {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func hosts(nodes []*Node) []string {
+	h := make([]string, len(nodes))
+	for i, n := range nodes {
+		h[i] = n.Host
+	}
+	return h
+}
+
+// Partition splits the network into given groups of nodes.
+// Nodes in different groups cannot communicate. Nodes not
+// listed in any group, form a separate group.
+func (c *Cluster) Partition(groups ...[]*Node) {
+	defer c.settle()
+	g := make([][]string, len(groups))
+	for i, nodes := range groups {
+		g[i] = hosts(nodes)
+	}
+	c.Network.Partition(g...)
+}
+
+// Heal removes all partitions.
+func (c *Cluster) Heal() {
+	defer c.settle()
+	c.Network.Heal()
+}
+
+// Disconnect cuts given nodes from network, without stopping them.
+func (c *Cluster) Disconnect(nodes ...*Node) {
+	defer c.settle()
+	for _, n := range nodes {
+		c.Network.SetDown(n.Host, true)
+	}
+}
+
+// Reconnect undoes Disconnect.
+func (c *Cluster) Reconnect(nodes ...*Node) {
+	defer c.settle()
+	for _, n := range nodes {
+		c.Network.SetDown(n.Host, false)
+	}
+}
+
+// Kill disconnects the node from network, and shuts it down. Its
+// storage is retained, so that it can be started using Restart.
+//
+// This is not a crash: shutdown is graceful, so in-flight work is
+// completed and no written data is lost. Use Crash for that.
+func (c *Cluster) Kill(n *Node) {
+	c.tb.Helper()
+	if !n.Alive() {
+		c.tb.Fatalf("rafttest: M%d is already killed", n.ID)
+	}
+	defer c.settle()
+	c.Network.SetDown(n.Host, true)
+	c.stopNode(n)
+}
+
+// Crash disconnects the node from network, and crashes its filesystem,
+// which must be vfs.Mem, so that the data it has not synced is lost.
+// Then the node, which sees its files failing, is shut down. Use
+// Restart, to start it from what survived the crash.
+func (c *Cluster) Crash(n *Node) {
+	c.tb.Helper()
+	if !n.Alive() {
+		c.tb.Fatalf("rafttest: M%d is already killed", n.ID)
+	}
+	mem, ok := n.FS.(*vfs.Mem)
+	if !ok {
+		c.tb.Fatalf("rafttest: crash M%d: FS is %T, want *vfs.Mem", n.ID, n.FS)
+	}
+	defer c.settle()
+	c.Network.SetDown(n.Host, true)
+	mem.Crash()
+	c.stopNode(n)
+}
+
+func (c *Cluster) stopNode(n *Node) {
+	_ = n.Raft.Shutdown(context.Background())
+	<-n.served
+	_ = n.listener.Close()
+	n.Raft, n.listener = nil, nil
+}
+
+// Restart starts the node from its storage with new FSM
+// created by Config.NewFSM. The node is killed first, if
+// it is alive.
+func (c *Cluster) Restart(n *Node) {
+	c.tb.Helper()
+	defer c.settle()
+	if n.Alive() {
+		c.Kill(n)
+	}
+	c.start(n)
+}
@@ -0,0 +1,345 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rafttest
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/santhosh-tekuri/raft"
+	"github.com/santhosh-tekuri/raft/sim"
+	"github.com/santhosh-tekuri/raft/vfs"
+)
+
+func TestCluster(t *testing.T) {
+	var dirs []string
+	t.Run("run", func(t *testing.T) {
+		c := Launch(t, Config{
+			Size:   3,
+			NewFSM: func(id uint64) raft.FSM { return &fsmMock{} },
+			Seed:   1,
+		})
+		defer c.Shutdown()
+		for _, n := range c.Nodes() {
+			dirs = append(dirs, n.Dir)
+		}
+		update := func(ldr *Node, from, to int) {
+			t.Helper()
+			for i := from; i <= to; i++ {
+				cmd := []byte(fmt.Sprintf("update:%d", i))
+				if _, err := c.Execute(ldr, raft.UpdateFSM(cmd)); err != nil {
+					t.Fatalf("update:%d: %v", i, err)
+				}
+			}
+		}
+		checkFSMs := func(n int) {
+			t.Helper()
+			c.WaitCatchup()
+			for _, node := range c.Nodes() {
+				if !node.Alive() {
+					continue
+				}
+				if got := len(node.FSM.(*fsmMock).commands()); got != n {
+					t.Fatalf("M%d: fsmLen=%d, want %d", node.ID, got, n)
+				}
+			}
+		}
+
+		ldr := c.Leader()
+		update(ldr, 1, 10)
+
+		// isolate leader, remaining nodes must elect new leader
+		c.Partition([]*Node{ldr})
+		ldr = c.WaitForLeader(ldr)
+		update(ldr, 11, 20)
+		c.Heal()
+		checkFSMs(20)
+
+		// kill a follower, cluster must still commit
+		var follower *Node
+		for _, n := range c.Nodes() {
+			if n != ldr {
+				follower = n
+				break
+			}
+		}
+		c.Kill(follower)
+		update(ldr, 21, 30)
+
+		// restarted node must catch up with new fsm
+		c.Restart(follower)
+		checkFSMs(30)
+		want := ldr.FSM.(*fsmMock).commands()
+		if got := follower.FSM.(*fsmMock).commands(); !reflect.DeepEqual(got, want) {
+			t.Fatalf("cmds=%v, want %v", got, want)
+		}
+	})
+
+	// storage dirs must be removed after test
+	if len(dirs) != 3 {
+		t.Fatalf("dirs=%v", dirs)
+	}
+	for _, dir := range dirs {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Fatalf("%s not removed: %v", dir, err)
+		}
+	}
+}
+
+func TestCluster_lossyPartition(t *testing.T) {
+	for seed := int64(1); seed <= 5; seed++ {
+		t.Run(fmt.Sprintf("seed=%d", seed), func(t *testing.T) {
+			c := Launch(t, Config{
+				Size:   3,
+				NewFSM: func(id uint64) raft.FSM { return &fsmMock{} },
+				Link: sim.Link{
+					Delay:  time.Millisecond,
+					Jitter: time.Duration(seed%5+1) * time.Millisecond,
+					Loss:   0.001,
+				},
+				Seed: seed,
+			})
+			defer c.Shutdown()
+			update := func(ldr *Node, from, to int) {
+				t.Helper()
+				for i := from; i <= to; i++ {
+					cmd := []byte(fmt.Sprintf("update:%d", i))
+					if _, err := c.Execute(ldr, raft.UpdateFSM(cmd)); err != nil {
+						t.Fatalf("update:%d: %v", i, err)
+					}
+				}
+			}
+
+			ldr := c.Leader()
+			update(ldr, 1, 10)
+
+			// isolate leader, remaining nodes must elect new leader
+			c.Partition([]*Node{ldr})
+			update(c.WaitForLeader(ldr), 11, 20)
+
+			// after heal, old leader must catch up
+			c.Heal()
+			c.WaitCatchup()
+			want := c.Node(1).FSM.(*fsmMock).commands()
+			if len(want) != 20 {
+				t.Fatalf("fsmLen=%d, want 20", len(want))
+			}
+			for _, n := range c.Nodes()[1:] {
+				if got := n.FSM.(*fsmMock).commands(); !reflect.DeepEqual(got, want) {
+					t.Fatalf("M%d cmds=%v, want %v", n.ID, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCluster_crash(t *testing.T) {
+	for seed := int64(1); seed <= 3; seed++ {
+		t.Run(fmt.Sprintf("seed=%d", seed), func(t *testing.T) {
+			c := Launch(t, Config{
+				Size:   3,
+				NewFSM: func(id uint64) raft.FSM { return &fsmMock{} },
+				FS:     func(id uint64) vfs.FS { return vfs.NewMem(seed*10 + int64(id)) },
+				Seed:   seed,
+			})
+			defer c.Shutdown()
+			update := func(ldr *Node, from, to int) {
+				t.Helper()
+				for i := from; i <= to; i++ {
+					cmd := []byte(fmt.Sprintf("update:%d", i))
+					if _, err := c.Execute(ldr, raft.UpdateFSM(cmd)); err != nil {
+						t.Fatalf("update:%d: %v", i, err)
+					}
+				}
+			}
+
+			// committed entries must survive crash of leader
+			ldr := c.Leader()
+			update(ldr, 1, 10)
+			c.Crash(ldr)
+			update(c.WaitForLeader(ldr), 11, 20)
+			c.Restart(ldr)
+			c.WaitCatchup()
+			for _, n := range c.Nodes() {
+				if got := n.FSM.(*fsmMock).commands(); len(got) != 20 {
+					t.Fatalf("M%d: fsmLen=%d, want 20", n.ID, len(got))
+				}
+			}
+		})
+	}
+}
+
+// same seed must replay the same run
+func TestCluster_replay(t *testing.T) {
+	run := func() []string {
+		var mu sync.Mutex
+		var trace []string
+		var clock raft.Clock
+		record := func(id uint64, format string, v ...interface{}) {
+			mu.Lock()
+			defer mu.Unlock()
+			at := clock.Now().Format("15:04:05.000000000")
+			trace = append(trace, fmt.Sprintf("%s M%d ", at, id)+fmt.Sprintf(format, v...))
+		}
+		c := Launch(t, Config{
+			Size: 3,
+			NewFSM: func(id uint64) raft.FSM {
+				return &traceFSM{fsmMock: &fsmMock{}, id: id, record: record}
+			},
+			Options: func(id uint64, opt *raft.Options) {
+				clock = opt.Clock
+				opt.Logger = traceLogger{id, record}
+			},
+			Link: sim.Link{Delay: time.Millisecond, Jitter: 2 * time.Millisecond, Loss: 0.001},
+			Seed: 7,
+		})
+		defer c.Shutdown()
+		update := func(ldr *Node, from, to int) {
+			t.Helper()
+			for i := from; i <= to; i++ {
+				cmd := []byte(fmt.Sprintf("update:%d", i))
+				if _, err := c.Execute(ldr, raft.UpdateFSM(cmd)); err != nil {
+					t.Fatalf("update:%d: %v", i, err)
+				}
+			}
+		}
+		ldr := c.Leader()
+		update(ldr, 1, 10)
+		c.Partition([]*Node{ldr})
+		update(c.WaitForLeader(ldr), 11, 20)
+		c.Heal()
+		c.Restart(ldr)
+		c.WaitCatchup()
+
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), trace...)
+	}
+
+	// events of different goroutines at same virtual time are
+	// concurrent, so their order of recording is not compared
+	trace1, trace2 := run(), run()
+	sort.Strings(trace1)
+	sort.Strings(trace2)
+	if len(trace1) == 0 {
+		t.Fatal("empty trace")
+	}
+	for i := 0; i < len(trace1) && i < len(trace2); i++ {
+		if trace1[i] != trace2[i] {
+			t.Fatalf("trace differs at %d:\n%s\n%s", i, trace1[i], trace2[i])
+		}
+	}
+	if len(trace1) != len(trace2) {
+		t.Fatalf("trace lengths differ: %d, %d", len(trace1), len(trace2))
+	}
+}
+
+type traceFSM struct {
+	*fsmMock
+	id     uint64
+	record func(id uint64, format string, v ...interface{})
+}
+
+func (fsm *traceFSM) Update(cmd []byte) interface{} {
+	fsm.record(fsm.id, "applied %s", cmd)
+	return fsm.fsmMock.Update(cmd)
+}
+
+// traceLogger records messages, except storage dir which differs
+// in each run. Config.String is not used, as its order of nodes
+// is random.
+type traceLogger struct {
+	id     uint64
+	record func(id uint64, format string, v ...interface{})
+}
+
+func (l traceLogger) log(level, msg string, keyvals []interface{}) {
+	var kv []interface{}
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		k, v := keyvals[i], keyvals[i+1]
+		if k == "storage" {
+			continue
+		}
+		if config, ok := v.(raft.Config); ok {
+			var nodes []string
+			for _, n := range config.Nodes {
+				nodes = append(nodes, fmt.Sprintf("%+v", n))
+			}
+			sort.Strings(nodes)
+			v = fmt.Sprintf("%d %v", config.Index, nodes)
+		}
+		kv = append(kv, k, v)
+	}
+	l.record(l.id, "%s %s %v", level, msg, kv)
+}
+
+func (l traceLogger) Debug(msg string, keyvals ...interface{}) {}
+func (l traceLogger) Info(msg string, keyvals ...interface{})  { l.log("info", msg, keyvals) }
+func (l traceLogger) Warn(msg string, keyvals ...interface{})  { l.log("warn", msg, keyvals) }
+func (l traceLogger) Error(msg string, keyvals ...interface{}) { l.log("error", msg, keyvals) }
+
+// fsmMock ---------------------------------------------------------
+
+type fsmMock struct {
+	mu   sync.Mutex
+	cmds []string
+}
+
+func (fsm *fsmMock) Update(cmd []byte) interface{} {
+	fsm.mu.Lock()
+	defer fsm.mu.Unlock()
+	fsm.cmds = append(fsm.cmds, string(cmd))
+	return nil
+}
+
+func (fsm *fsmMock) Read(cmd interface{}) interface{} {
+	return nil
+}
+
+func (fsm *fsmMock) commands() []string {
+	fsm.mu.Lock()
+	defer fsm.mu.Unlock()
+	return append([]string(nil), fsm.cmds...)
+}
+
+func (fsm *fsmMock) Snapshot() (raft.FSMState, error) {
+	return stateMock(fsm.commands()), nil
+}
+
+func (fsm *fsmMock) Restore(r io.Reader) error {
+	var cmds []string
+	if err := gob.NewDecoder(r).Decode(&cmds); err != nil {
+		return err
+	}
+	fsm.mu.Lock()
+	defer fsm.mu.Unlock()
+	fsm.cmds = cmds
+	return nil
+}
+
+type stateMock []string
+
+func (state stateMock) Persist(w io.Writer) error {
+	return gob.NewEncoder(w).Encode([]string(state))
+}
+
+func (state stateMock) Release() {}
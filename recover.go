@@ -0,0 +1,161 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/santhosh-tekuri/raft/vfs"
+)
+
+// RecoverConfig forcibly replaces the configuration of the node whose
+// storage is in storageDir. It is meant for disaster recovery, when a
+// quorum of voters is permanently lost, and the cluster can no longer
+// elect a leader or commit entries.
+//
+// WARNING: This operation bypasses raft's safety guarantees. Use it
+// only if the lost voters are never coming back. If they come back
+// with their old storage, the cluster may end up with two leaders
+// and committed entries may be lost. Entries which were committed
+// only on the lost voters are lost.
+//
+// The node must not be running. The log and snapshots are retained.
+// A config entry with given nodes is appended to the log at given term,
+// so that it becomes the latest config. The index and term of the given
+// config are ignored.
+//
+// Run RecoverConfig only on the surviving node with most up-to-date log,
+// i.e. the one whose last entry has the highest term, and among them the
+// highest index (see ReadEntries). The term must be greater than the term
+// and last entry's term of every surviving node, so that no other node
+// can have a more up-to-date log. The storage of every other surviving
+// node must be wiped, retaining only its identity (see SetIdentity),
+// before starting it. Once a majority of voters of the new config are
+// started, the recovered node is elected as leader, and the others
+// catch up from it.
+//
+// Each recovery is appended, as a json line, to the audit file
+// "recovery.log" in storageDir, along with given reason. The returned
+// Config is the config written to the log.
+func RecoverConfig(opt Options, storageDir string, config Config, term uint64, reason string) (Config, error) {
+	if opt.FS == nil {
+		opt.FS = vfs.OS
+	}
+	if err := assertDir(opt.FS, storageDir); err != nil {
+		return config, err
+	}
+	if err := lockDir(opt.FS, storageDir); err != nil {
+		return config, err
+	}
+	defer unlockDir(opt.FS, storageDir)
+
+	store, err := openStorage(storageDir, opt)
+	if err != nil {
+		return config, err
+	}
+	prev := store.configs.Latest
+	config, err = store.recoverConfig(config, term)
+	if e := store.log.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return config, err
+	}
+	if err = auditRecovery(opt.FS, storageDir, store, prev, config, reason); err != nil {
+		return config, fmt.Errorf("raft.RecoverConfig: config recovered, but audit failed: %v", err)
+	}
+	if opt.Logger != nil {
+		withFields(opt.Logger, "nid", store.nid).Warn("config recovered", "term", config.Term, "from", prev, "to", config)
+	}
+	return config, nil
+}
+
+func (s *storage) recoverConfig(config Config, term uint64) (_ Config, err error) {
+	if s.cid == 0 || s.nid == 0 {
+		return config, ErrIdentityNotSet
+	}
+	if !s.configs.Latest.isBootstrapped() {
+		return config, fmt.Errorf("raft.RecoverConfig: storage is not bootstrapped")
+	}
+
+	// fix node.ID, and clear actions
+	config = config.clone()
+	for id, n := range config.Nodes {
+		n.ID, n.Action = id, None
+		config.Nodes[id] = n
+	}
+	if err := config.validate(); err != nil {
+		return config, err
+	}
+	if !config.isVoter(s.nid) {
+		return config, fmt.Errorf("raft.RecoverConfig: node %d is not voter in given config", s.nid)
+	}
+
+	if term <= s.term || term <= s.lastLogTerm {
+		max := s.term
+		if s.lastLogTerm > max {
+			max = s.lastLogTerm
+		}
+		return config, fmt.Errorf("raft.RecoverConfig: term must be greater than %d", max)
+	}
+	config.Index, config.Term = s.lastLogIndex+1, term
+
+	defer func() {
+		if v := recover(); v != nil {
+			err = recoverErr(v)
+		}
+	}()
+	s.setTerm(term)
+	s.appendEntry(config.encode())
+	s.commitLog(config.Index) // flush to disk; the leader commits it later
+
+	return config, nil
+}
+
+func auditRecovery(fs vfs.FS, dir string, store *storage, prev, config Config, reason string) error {
+	hostname, _ := os.Hostname()
+	b, err := json.Marshal(struct {
+		Time     time.Time `json:"time"`
+		Host     string    `json:"host,omitempty"`
+		CID      uint64    `json:"cid"`
+		NID      uint64    `json:"nid"`
+		Reason   string    `json:"reason,omitempty"`
+		Previous Config    `json:"previous"`
+		Config   Config    `json:"config"`
+	}{time.Now().UTC(), hostname, store.cid, store.nid, reason, prev, config})
+	if err != nil {
+		return err
+	}
+	f, err := fs.OpenFile(filepath.Join(dir, "recovery.log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(b, '\n')); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return fs.SyncDir(dir) // in case audit file is created
+}
@@ -0,0 +1,168 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/santhosh-tekuri/raft/vfs"
+)
+
+func TestRecoverConfig(t *testing.T) {
+	c, ldr, flrs := launchCluster(t, 3)
+	defer c.shutdown()
+	c.sendUpdates(ldr, 1, 10)
+	c.waitFSMLen(10)
+	config := c.info(ldr).Configs.Latest
+
+	// lose quorum permanently, M1 and M2 survive
+	c.shutdown(flrs...)
+	c.shutdown(ldr)
+	survivor := flrs[0]
+	dir := c.storage[ldr.nid]
+	before, err := ReadStorage(c.opt, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ReadStorage(c.opt, c.storage[survivor.nid])
+	if err != nil {
+		t.Fatal(err)
+	}
+	term := before.Term
+	if other.Term > term {
+		term = other.Term
+	}
+	term++
+
+	// node must be voter in new config
+	config.Nodes = map[uint64]Node{survivor.nid: config.Nodes[survivor.nid]}
+	if _, err = RecoverConfig(c.opt, dir, config, term, "test"); err == nil {
+		t.Fatal("error expected, when node is not voter in config")
+	}
+
+	// term must be greater than any seen
+	config.Nodes = map[uint64]Node{
+		ldr.nid:      {Addr: c.id2Addr(ldr.nid), Voter: true},
+		survivor.nid: {Addr: c.id2Addr(survivor.nid), Voter: true},
+	}
+	if _, err = RecoverConfig(c.opt, dir, config, before.Term, "test"); err == nil {
+		t.Fatal("error expected, when term is not greater than any seen")
+	}
+
+	// recover ldr, which has most up-to-date log
+	recovered, err := RecoverConfig(c.opt, dir, config, term, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recovered.Term != term {
+		t.Fatalf("recovered.term: got %d, want %d", recovered.Term, term)
+	}
+	if recovered.Nodes[ldr.nid].ID != ldr.nid {
+		t.Fatalf("recovered.nodes: got %v", recovered.Nodes)
+	}
+	if problems, err := VerifyStorage(c.opt, dir); err != nil || len(problems) > 0 {
+		t.Fatalf("verifyStorage: %v %v", problems, err)
+	}
+
+	// check audit record
+	b, err := ioutil.ReadFile(filepath.Join(dir, "recovery.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var audit struct {
+		NID      uint64
+		Reason   string
+		Previous Config
+		Config   Config
+	}
+	if err = json.Unmarshal(b, &audit); err != nil {
+		t.Fatal(err)
+	}
+	if audit.NID != ldr.nid || audit.Reason != "test" || len(audit.Previous.Nodes) != 3 || audit.Config.Index != recovered.Index {
+		t.Fatalf("audit: got %+v", audit)
+	}
+
+	// wipe other survivor, retaining identity
+	sdir := c.storage[survivor.nid]
+	if err = os.RemoveAll(sdir); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Mkdir(sdir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = SetIdentity(sdir, other.CID, other.NID); err != nil {
+		t.Fatal(err)
+	}
+
+	// recovered node should be elected, and other survivor catches up
+	r := c.restart(ldr)
+	s := c.restart(survivor)
+	if got := c.waitForLeader(r, s); got != r {
+		t.Fatalf("leader: got M%d, want M%d", got.nid, r.nid)
+	}
+	c.waitFSMLen(10, r, s)
+	if _, err = waitUpdate(r, "recovered", c.longTimeout); err != nil {
+		t.Fatal(err)
+	}
+	c.waitFSMLen(11, r, s)
+	info := c.info(r)
+	if !info.Configs.IsCommitted() || info.Configs.Latest.Index != recovered.Index {
+		t.Fatalf("configs: got %v", info.Configs)
+	}
+}
+
+func TestRecoverConfig_memFS(t *testing.T) {
+	fs := vfs.NewMem(1)
+	opt := DefaultOptions()
+	opt.Logger = nil
+	opt.FS = fs
+	r := launchNode(t, opt, &fsmMock{id: identity{1, 1}}, "")
+	if _, err := r.Execute(context.Background(), UpdateFSM([]byte("update"))); err != nil {
+		t.Fatal(err)
+	}
+	res, err := r.Execute(context.Background(), GetInfo())
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := res.(Info)
+	_ = r.Shutdown(context.Background())
+
+	config := Config{Nodes: map[uint64]Node{1: info.Configs.Latest.Nodes[1]}}
+	if _, err = RecoverConfig(opt, "/storage", config, info.Term+1, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.Stat("/storage/recovery.log"); err != nil {
+		t.Fatal(err)
+	}
+
+	// audit must survive crash
+	fs.Crash()
+	if _, err = fs.Stat("/storage/recovery.log"); err != nil {
+		t.Fatal(err)
+	}
+	r = launchNode(t, opt, &fsmMock{id: identity{1, 1}}, "/storage")
+	defer func() { _ = r.Shutdown(context.Background()) }()
+	if res, err = r.Execute(context.Background(), GetInfo()); err != nil {
+		t.Fatal(err)
+	}
+	if got := res.(Info).Configs.Latest; got.Term <= info.Term {
+		t.Fatalf("config.term=%d, want >%d", got.Term, info.Term)
+	}
+}
@@ -0,0 +1,325 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// relay is a replication to nonvoter, run by follower on behalf of
+// leader. It sends only committed entries, so that nonvoter never
+// receives entries that are later truncated. Leader learns the progress
+// of nonvoter by polling the follower. see Options.ChainNonvoters.
+type relay struct {
+	*replication
+	term   uint64    // term of leader, on whose behalf we relay
+	leader uint64    // id of leader
+	polled time.Time // when leader polled recently
+	dialFn dialFn
+	done   chan struct{} // closed when relay goroutine ends
+
+	mu    sync.Mutex
+	conns map[*relayConn]struct{} // open conns, nil once stopped
+}
+
+// startRelay starts relaying to nonvoter n, if not running already.
+func (f *follower) startRelay(n Node) *relay {
+	if rl, ok := f.relays[n.ID]; ok {
+		return rl
+	}
+	if f.removeLTE < f.log.PrevIndex() {
+		f.removeLTE = f.log.PrevIndex()
+	}
+	rl := &relay{
+		replication: &replication{
+			node:           n,
+			rtime:          f.rtime.fork(),
+			status:         replicationStatus{id: n.ID, node: n, removeLTE: f.removeLTE},
+			ldrLastIndex:   f.commitIndex,
+			matchIndex:     0,
+			nextIndex:      f.commitIndex + 1,
+			hbTimeout:      f.hbTimeout,
+			timer:          newSafeTimer(f.clock),
+			clock:          f.clock,
+			bandwidth:      f.bandwidth,
+			log:            f.storage.log.ViewAt(f.removeLTE, f.commitIndex),
+			snaps:          f.storage.snaps,
+			stopCh:         make(chan struct{}),
+			replUpdateCh:   f.relayUpdateCh,
+			leaderUpdateCh: make(chan leaderUpdate, 1),
+		},
+		term:   f.term,
+		leader: f.leader,
+		dialFn: f.dialFn,
+		done:   make(chan struct{}),
+		conns:  make(map[*relayConn]struct{}),
+	}
+	// own connPool, so that its conns can be closed on stop
+	rl.connPool = &connPool{
+		src:      f.nid,
+		cid:      f.cid,
+		nid:      n.ID,
+		resolver: f.resolver,
+		dialFn:   rl.dial,
+		clock:    f.clock,
+		max:      1,
+	}
+	f.relays[n.ID] = rl
+	f.relayIndex = f.commitIndex
+	if trace {
+		println(f, "relay.start", n.ID)
+	}
+	f.logger.Info("relaying to nonvoter", "node", n.ID, "leader", f.leader)
+
+	// target sees this as AppendEntries from leader
+	req := &appendReq{
+		req:            req{f.term, f.leader},
+		ldrCommitIndex: f.commitIndex,
+		prevLogIndex:   f.commitIndex,
+	}
+
+	go func() {
+		defer close(rl.done)
+		rl.runLoop(req)
+		if trace {
+			println(rl, "relay.End")
+		}
+	}()
+	return rl
+}
+
+func (f *follower) stopRelay(id uint64) {
+	if rl, ok := f.relays[id]; ok {
+		if trace {
+			println(f, "relay.stop", id)
+		}
+		f.logger.Info("stopped relaying to nonvoter", "node", id)
+		rl.status.removed = true
+		close(rl.stopCh)
+		rl.closeConns()
+		delete(f.relays, id)
+		f.stoppedRunning()
+		f.stopped = append(f.stopped, rl)
+	}
+}
+
+// stoppedRunning tells whether any stopped relay has not finished yet.
+// It forgets stopped relays that have finished.
+func (f *follower) stoppedRunning() bool {
+	stopped := f.stopped[:0]
+	for _, rl := range f.stopped {
+		select {
+		case <-rl.done:
+		default:
+			stopped = append(stopped, rl)
+		}
+	}
+	f.stopped = stopped
+	return len(stopped) > 0
+}
+
+// stopRelays stops all relays, without waiting for them to finish.
+func (f *follower) stopRelays() {
+	for id := range f.relays {
+		f.stopRelay(id)
+	}
+}
+
+// waitStopped waits for stopped relays to finish. It must be called
+// before discarding log, which they might be reading. This usually
+// does not take long, because their conns are closed on stop.
+func (f *follower) waitStopped() {
+	for _, rl := range f.stopped {
+		<-rl.done
+	}
+	f.stopped = nil
+}
+
+// checkRelays stops relays which are no longer required, and notifies
+// the rest about new commitIndex. A relay is not required, if leader
+// has changed or stopped polling, or if its target is no longer nonvoter.
+func (f *follower) checkRelays() {
+	if f.deferredLTE > f.log.PrevIndex() && !f.stoppedRunning() {
+		_ = f.compactLog(f.deferredLTE)
+	}
+	if len(f.relays) == 0 {
+		return
+	}
+	now := f.clock.Now()
+	for id, rl := range f.relays {
+		n, ok := f.configs.Latest.Nodes[id]
+		switch {
+		case !ok, n.Voter, rl.term != f.term, rl.leader != f.leader, now.Sub(rl.polled) > 2*f.hbTimeout:
+			f.stopRelay(id)
+		}
+	}
+	if f.commitIndex != f.relayIndex {
+		f.notifyRelays()
+	}
+}
+
+func (f *follower) notifyRelays() {
+	if f.removeLTE < f.log.PrevIndex() {
+		f.removeLTE = f.log.PrevIndex()
+	}
+	update := leaderUpdate{
+		log:         f.log.ViewAt(f.removeLTE, f.commitIndex),
+		commitIndex: f.commitIndex,
+	}
+	for _, rl := range f.relays {
+		select {
+		case rl.leaderUpdateCh <- update:
+		case <-rl.leaderUpdateCh:
+			rl.leaderUpdateCh <- update
+		}
+		if trace {
+			println(f, update, rl.status.id)
+		}
+	}
+	f.relayIndex = f.commitIndex
+}
+
+func (f *follower) onRelayUpdate(u replUpdate) {
+	if trace {
+		println(f, "<<", u)
+	}
+	status := u.status
+	if status.removed {
+		return
+	}
+	switch u := u.update.(type) {
+	case error:
+		// relay is best effort. refuse to relay to this nonvoter
+		// in current term, so that leader falls back to other
+		// helper or replicates by itself
+		f.logger.Warn("relay failed", "node", status.id, "err", trimPrefix(u))
+		f.stopRelay(status.id)
+		f.relayFailed[status.id] = f.term
+	case matchIndex:
+		status.matchIndex = u.val
+	case noContact:
+		status.noContact, status.err = u.time, u.err
+	case removeLTE:
+		status.removeLTE = u.val
+		if f.removeLTE > f.log.PrevIndex() {
+			f.checkLogCompact()
+		}
+	case newTerm:
+		// nonvoter has seen newer term. adopt it, so that
+		// leader learns about it on next poll
+		if u.val > f.term {
+			f.setTerm(u.val)
+			f.setLeader(0)
+			f.checkRelays()
+		}
+	}
+}
+
+// checkLogCompact compacts log, once all relays acknowledged removeLTE.
+func (f *follower) checkLogCompact() {
+	for _, rl := range f.relays {
+		if rl.status.removeLTE < f.removeLTE {
+			return
+		}
+	}
+	_ = f.compactLog(f.removeLTE)
+}
+
+// dial dials using dialFn of raft, and tracks the conn, so that it is
+// closed on stop. It does not wait for dialFn, once relay is stopped.
+func (rl *relay) dial(network, address string, timeout time.Duration) (net.Conn, error) {
+	type result struct {
+		rwc net.Conn
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		rwc, err := rl.dialFn(network, address, timeout)
+		ch <- result{rwc, err}
+	}()
+	var res result
+	select {
+	case <-rl.stopCh:
+		go func() {
+			if res := <-ch; res.rwc != nil {
+				_ = res.rwc.Close()
+			}
+		}()
+		return nil, errStop
+	case res = <-ch:
+	}
+	if res.err != nil {
+		return nil, res.err
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if rl.conns == nil {
+		_ = res.rwc.Close()
+		return nil, errStop
+	}
+	c := &relayConn{Conn: res.rwc, rl: rl}
+	rl.conns[c] = struct{}{}
+	return c, nil
+}
+
+// closeConns closes all conns of relay, interrupting any io
+// in progress. Conns dialed later are closed immediately.
+func (rl *relay) closeConns() {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for c := range rl.conns {
+		_ = c.Conn.Close()
+	}
+	rl.conns = nil
+}
+
+type relayConn struct {
+	net.Conn
+	rl *relay
+}
+
+func (c *relayConn) Close() error {
+	c.rl.mu.Lock()
+	delete(c.rl.conns, c)
+	c.rl.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// onRelayRequest -------------------------------------------------
+
+func (r *Raft) onRelayRequest(req *relayReq) (rpcResult, error) {
+	if req.term < r.term {
+		return staleTerm, nil
+	}
+	if r.state != Follower || req.term != r.term || req.src != r.leader || !r.configs.Latest.isVoter(r.nid) {
+		return cannotRelay, nil
+	}
+	n, ok := r.configs.Latest.Nodes[req.target]
+	if !ok || n.Voter || r.flr.relayFailed[req.target] == r.term {
+		return cannotRelay, nil
+	}
+	r.flr.startRelay(n).polled = r.clock.Now()
+	return success, nil
+}
+
+// relayStatus fills resp with the progress of relay to target.
+func (r *Raft) relayStatus(target uint64, resp *relayResp) {
+	if rl, ok := r.flr.relays[target]; ok {
+		resp.matchIndex = rl.status.matchIndex
+		resp.unreachable = !rl.status.noContact.IsZero()
+	}
+}
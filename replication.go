@@ -25,9 +25,13 @@ import (
 )
 
 type replication struct {
+	clock  Clock
 	rtime  randTime
 	status replicationStatus // owned by ldr goroutine
 
+	delegateSnaps  bool
+	chainNonvoters bool
+
 	connPool  *connPool
 	log       *log.Log
 	snaps     *snapshots
@@ -66,6 +70,7 @@ func (r *replication) runLoop(req *appendReq) {
 	}()
 
 	failures, err := uint64(0), error(nil)
+	relayFailures, failedHelper := 0, uint64(0)
 	for {
 		if failures > 0 {
 			if failures == 1 {
@@ -83,6 +88,28 @@ func (r *replication) runLoop(req *appendReq) {
 			}
 		}
 
+		if c == nil && r.chainNonvoters && !r.node.Voter {
+			if pool := r.getRelayHelper(failedHelper); pool != nil {
+				failedHelper = 0
+				contacted := false
+				contacted, err = r.relay(pool, req)
+				if err == errStop {
+					return
+				} else if contacted {
+					failures, relayFailures = 0, 0
+				}
+				if err != nil {
+					failures++
+					relayFailures++
+					if relayFailures >= maxRelayFailures {
+						// try other helper, or replicate directly
+						relayFailures, failedHelper = 0, pool.nid
+					}
+				}
+				continue
+			}
+		}
+
 		if c == nil {
 			if c, err = r.connPool.getConn(r.deadline()); err != nil {
 				failures++
@@ -217,6 +244,8 @@ func (r *replication) replicate(c *conn, req *appendReq) error {
 			go func() {
 				drained <- drainResps()
 			}()
+			timer := r.clock.NewTimer(timeout)
+			defer timer.Stop()
 			select {
 			case err := <-drained:
 				if trace {
@@ -226,7 +255,7 @@ func (r *replication) replicate(c *conn, req *appendReq) error {
 					_ = c.rwc.Close()
 					c.rwc = nil // to signal runLoop that we closed the conn
 				}
-			case <-time.After(timeout):
+			case <-timer.C():
 				if trace {
 					println(r, "drain timeout, closing conn")
 				}
@@ -378,6 +407,21 @@ func (r *replication) onAppendEntriesResp(resp *appendResp, reqLastIndex uint64)
 }
 
 func (r *replication) sendInstallSnapReq(c *conn, appReq *appendReq) error {
+	if r.delegateSnaps {
+		if pool := r.getSnapHelper(); pool != nil {
+			lastIndex, resp, err := r.delegateInstallSnap(pool, appReq)
+			if err == nil {
+				return r.onInstallSnapResp(resp, lastIndex, appReq)
+			}
+			if err == errStop {
+				return err
+			}
+			if trace {
+				println(r, "delegateInstallSnap failed", err)
+			}
+		}
+	}
+
 	snap, err := r.snaps.open()
 	if err != nil {
 		return opError(err, "snapshots.open")
@@ -390,24 +434,39 @@ func (r *replication) sendInstallSnapReq(c *conn, appReq *appendReq) error {
 		lastTerm:   snap.meta.term,
 		lastConfig: snap.meta.config,
 		size:       snap.meta.size,
+		sessions:   snap.meta.sessions,
 	}
+	resp, err := r.installSnap(c, req, snap.r)
+	if err != nil {
+		return err
+	}
+	return r.onInstallSnapResp(resp, req.lastIndex, appReq)
+}
+
+// installSnap sends snapshot to the node connected by c,
+// and returns its response.
+func (r *replication) installSnap(c *conn, req *installSnapReq, snap io.Reader) (*installSnapResp, error) {
 	if trace {
 		println(r, ">>", req)
 	}
-	if err = c.writeReq(req, r.deadline()); err != nil {
-		return err
+	if err := c.writeReq(req, r.deadline()); err != nil {
+		return nil, err
 	}
 	if err := c.rwc.SetWriteDeadline(r.deadlineSize(req.size)); err != nil {
-		return err
+		return nil, err
 	}
-	if _, err = io.Copy(c.rwc, snap.file); err != nil { // will use sendFile
-		return err
+	if _, err := io.Copy(c.rwc, snap); err != nil { // will use sendFile, if not encrypted
+		return nil, err
 	}
 
 	resp := &installSnapResp{}
-	if err = c.readResp(resp, time.Now().Add(4*r.hbTimeout)); err != nil { // todo: is 2*hbTimeout enough for saving snap
-		return err
+	if err := c.readResp(resp, r.clock.Now().Add(4*r.hbTimeout)); err != nil { // todo: is 2*hbTimeout enough for saving snap
+		return nil, err
 	}
+	return resp, nil
+}
+
+func (r *replication) onInstallSnapResp(resp *installSnapResp, lastIndex uint64, appReq *appendReq) error {
 	switch resp.result {
 	case staleTerm:
 		r.notifyLdr(newTerm{resp.getTerm()})
@@ -415,12 +474,12 @@ func (r *replication) sendInstallSnapReq(c *conn, appReq *appendReq) error {
 	case success:
 		// case: snapshot was taken before we got leaderUpdate about lastLogIndex
 		// we should wait until we get our logview gets updated
-		for req.lastIndex > r.ldrLastIndex {
+		for lastIndex > r.ldrLastIndex {
 			if _, err := r.checkLeaderUpdate(r.stopCh, appReq, false); err != nil {
 				return err
 			}
 		}
-		r.matchIndex = req.lastIndex
+		r.matchIndex = lastIndex
 		r.nextIndex = r.matchIndex + 1
 		if trace {
 			println(r, "matchIndex:", r.matchIndex, "nextIndex:", r.nextIndex)
@@ -434,6 +493,147 @@ func (r *replication) sendInstallSnapReq(c *conn, appReq *appendReq) error {
 	}
 }
 
+// getSnapHelper asks leader for the follower, to which sending
+// snapshot can be delegated. It returns nil, if there is none.
+func (r *replication) getSnapHelper() *connPool {
+	ch := make(chan *connPool, 1)
+	r.notifyLdr(snapHelper{ch})
+	select {
+	case <-r.stopCh:
+		return nil
+	case pool := <-ch:
+		return pool
+	}
+}
+
+// delegateInstallSnap asks the follower connected by pool, to send its
+// snapshot to this node. It returns the lastIndex of snapshot sent, along
+// with response of this node.
+func (r *replication) delegateInstallSnap(pool *connPool, appReq *appendReq) (uint64, *installSnapResp, error) {
+	c, err := pool.getConn(r.deadline())
+	if err != nil {
+		return 0, nil, err
+	}
+	req := &sendSnapReq{
+		req:      appReq.req,
+		target:   r.node.ID,
+		minIndex: r.log.PrevIndex(),
+	}
+	if trace {
+		println(r, ">>", req, "to", pool.nid)
+	}
+	resp := &sendSnapResp{}
+	if err = c.doRPC(req, resp, r.deadline()); err != nil {
+		_ = c.rwc.Close()
+		return 0, nil, err
+	}
+	switch resp.result {
+	case success:
+	case staleTerm:
+		pool.returnConn(c)
+		r.notifyLdr(newTerm{resp.getTerm()})
+		return 0, nil, errStop
+	case staleSnapshot:
+		pool.returnConn(c)
+		return 0, nil, fmt.Errorf("raft: M%d has no snapshot at or after %d", pool.nid, req.minIndex)
+	case unexpectedErr:
+		pool.returnConn(c)
+		return 0, nil, resp.err
+	default:
+		pool.returnConn(c)
+		return 0, nil, fmt.Errorf("raft: M%d cannot send snapshot to M%d", pool.nid, req.target)
+	}
+	installResp := &installSnapResp{}
+	deadline := r.deadlineSize(resp.size).Add(4 * r.hbTimeout)
+	if err = c.readResp(installResp, deadline); err != nil {
+		_ = c.rwc.Close()
+		return 0, nil, err
+	}
+	pool.returnConn(c)
+	return resp.lastIndex, installResp, nil
+}
+
+// getRelayHelper asks leader for the follower, through which
+// entries can be relayed to nonvoter. failed is the follower which
+// failed to relay, zero if none. It returns nil, if there is none.
+func (r *replication) getRelayHelper(failed uint64) *connPool {
+	ch := make(chan *connPool, 1)
+	r.notifyLdr(relayHelper{ch, failed})
+	select {
+	case <-r.stopCh:
+		return nil
+	case pool := <-ch:
+		return pool
+	}
+}
+
+// relay replicates to nonvoter through the follower connected by pool.
+// It polls the follower for the progress of nonvoter, until an error
+// occurs, the follower cannot reach nonvoter or the node becomes voter.
+// contacted tells whether nonvoter was reached at least once.
+func (r *replication) relay(pool *connPool, appReq *appendReq) (contacted bool, err error) {
+	c, err := pool.getConn(r.deadline())
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err == nil || err == errStop {
+			pool.returnConn(c)
+		} else {
+			_ = c.rwc.Close()
+		}
+	}()
+
+	req, resp := &relayReq{req: appReq.req, target: r.status.id}, &relayResp{}
+	for !r.node.Voter {
+		if trace {
+			println(r, ">>", req, "to", pool.nid)
+		}
+		if err = c.doRPC(req, resp, r.deadline()); err != nil {
+			return contacted, err
+		}
+		if trace {
+			println(r, "<<", resp)
+		}
+		switch resp.result {
+		case success:
+		case staleTerm:
+			r.notifyLdr(newTerm{resp.getTerm()})
+			return contacted, errStop
+		case unexpectedErr:
+			return contacted, resp.err
+		default:
+			return contacted, fmt.Errorf("raft: M%d cannot relay to M%d", pool.nid, req.target)
+		}
+		if resp.unreachable {
+			return contacted, fmt.Errorf("raft: M%d cannot reach M%d", pool.nid, req.target)
+		}
+		contacted = true
+		if !r.noContact.IsZero() {
+			r.notifyNoContact(nil)
+		}
+		if resp.matchIndex > r.matchIndex {
+			r.matchIndex, r.nextIndex = resp.matchIndex, resp.matchIndex+1
+			if trace {
+				println(r, "matchIndex:", r.matchIndex)
+			}
+			r.notifyLdr(matchIndex{r.matchIndex})
+		}
+
+		// wait before polling again
+		r.timer.reset(r.hbTimeout / 2)
+		select {
+		case <-r.stopCh:
+			return contacted, errStop
+		case update := <-r.leaderUpdateCh:
+			r.onLeaderUpdate(update, appReq)
+		case <-r.timer.C:
+			r.timer.active = false
+		}
+	}
+	return contacted, nil
+}
+
 func (r *replication) checkLeaderUpdate(stopCh <-chan struct{}, req *appendReq, sendEntries bool) (ldrUpdate bool, err error) {
 	if sendEntries && r.nextIndex > r.ldrLastIndex {
 		// for nonvoter, dont send heartbeats
@@ -491,7 +691,7 @@ func (r *replication) notifyLdr(u interface{}) {
 
 func (r *replication) notifyNoContact(err error) {
 	if err != nil {
-		r.noContact = time.Now()
+		r.noContact = r.clock.Now()
 		if trace {
 			println(r, "noContact", err)
 		}
@@ -533,7 +733,7 @@ func (r *replication) writeEntriesTo(c *conn, from uint64, n uint64) error {
 }
 
 func (r *replication) deadline() time.Time {
-	return time.Now().Add(2 * r.hbTimeout)
+	return r.clock.Now().Add(2 * r.hbTimeout)
 }
 
 func (r *replication) deadlineSize(size int64) time.Time {
@@ -541,7 +741,7 @@ func (r *replication) deadlineSize(size int64) time.Time {
 	if timeout < 2*r.hbTimeout {
 		timeout = 2 * r.hbTimeout
 	}
-	return time.Now().Add(timeout)
+	return r.clock.Now().Add(timeout)
 }
 
 // ------------------------------------------------
@@ -574,6 +774,23 @@ type newTerm struct {
 	val uint64
 }
 
+// snapHelper asks leader for the follower, to which
+// sending snapshot can be delegated.
+type snapHelper struct {
+	ch chan<- *connPool
+}
+
+// relayHelper asks leader for the follower, through
+// which entries can be relayed to nonvoter.
+type relayHelper struct {
+	ch     chan<- *connPool
+	failed uint64 // follower which failed to relay, zero if none
+}
+
+// maxRelayFailures is the number of consecutive failed polls,
+// after which the follower relaying to nonvoter is skipped.
+const maxRelayFailures = 3
+
 type replicationStatus struct {
 	id uint64
 
@@ -595,5 +812,12 @@ type replicationStatus struct {
 
 	round *round // nil if no promotion required
 
+	// follower relaying entries to this nonvoter
+	// zero value means leader replicates by itself
+	relayedBy uint64
+
+	// followers which failed to relay to this nonvoter
+	relaySkip map[uint64]bool
+
 	removeLTE uint64
 }
@@ -15,7 +15,10 @@
 package raft
 
 import (
+	"errors"
+	"fmt"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 )
@@ -159,6 +162,371 @@ func TestReplication_installSnap(t *testing.T) {
 	})
 }
 
+// lagging follower must catch up using AppendEntries,
+// if leader retained trailing logs after compaction.
+func TestReplication_trailingLogs(t *testing.T) {
+	c := newCluster(t)
+	c.opt.LogSegmentSize = 1024
+	c.opt.TrailingLogs = 60
+	ldr, flrs := c.ensureLaunch(3)
+	defer c.shutdown()
+
+	updates := uint64(50)
+	<-c.sendUpdates(ldr, 1, 50).Done()
+	c.waitFSMLen(updates)
+
+	// disconnect follower and let it lag behind
+	c.disconnect(flrs[0])
+	c.waitUnreachableDetected(ldr, flrs[0])
+	updates += 50
+	<-c.sendUpdates(ldr, 1, 50).Done()
+	c.waitFSMLen(updates, ldr, flrs[1])
+
+	// take snapshot, must retain trailing logs
+	logCompacted := c.registerFor(eventLogCompacted, ldr)
+	defer c.unregister(logCompacted)
+	c.takeSnapshot(ldr, 1, nil)
+	c.ensure(logCompacted.waitForEvent(c.longTimeout))
+	snapIndex, _ := ldr.snaps.latest()
+	if prevIndex := ldr.log.PrevIndex(); prevIndex == 0 || prevIndex > snapIndex-60 {
+		t.Fatalf("prevIndex=%d, want in range (0, %d]", prevIndex, snapIndex-60)
+	}
+
+	// wait till offline follower acknowledges the compaction
+	compacted := func() (done bool) {
+		_ = ldr.inspect(func(r *Raft) {
+			done = r.log.PrevIndex() >= r.ldr.removeLTE
+		})
+		return
+	}
+	for deadline := time.Now().Add(c.longTimeout); !compacted(); {
+		if time.Now().After(deadline) {
+			t.Fatal("log compaction is not acknowledged")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// follower must catch up without snapshot
+	c.connect()
+	c.waitFSMLen(updates, flrs[0])
+	if index, _ := flrs[0].snaps.latest(); index != 0 {
+		t.Fatalf("follower installed snapshot at %d", index)
+	}
+}
+
+func TestReplication_asyncRestore(t *testing.T) {
+	// launch 3 node cluster
+	c := newCluster(t)
+	c.opt.LogSegmentSize = 1024
+	ldr, _ := c.ensureLaunch(3)
+	defer c.shutdown()
+
+	// send 30 updates, add nonVoter M4, take snapshot
+	updates := uint64(30)
+	<-c.sendUpdates(ldr, 1, 30).Done()
+	c.ensure(c.waitAddNonvoter(ldr, 4, c.id2Addr(4), false))
+	c.waitCatchup()
+	logCompacted := c.registerFor(eventLogCompacted, ldr)
+	defer c.unregister(logCompacted)
+	c.takeSnapshot(ldr, 1, nil)
+	c.ensure(logCompacted.waitForEvent(c.longTimeout))
+
+	// launch M4, whose fsm restore blocks
+	c.blockRestore = make(chan struct{})
+	m4 := c.launch(1, false)[4]
+	restoring := func() (b bool) {
+		_ = m4.inspect(func(r *Raft) { b = r.restoring })
+		return
+	}
+	if !waitForCondition(restoring, c.commitTimeout, c.longTimeout) {
+		t.Fatal("M4 must restore fsm from snapshot")
+	}
+
+	// during restore, GetInfo must not wait for fsm
+	res, err := waitTask(m4, GetInfo(), c.commitTimeout)
+	if err != nil {
+		close(c.blockRestore) // unblock raft loop to shutdown
+		t.Fatal(err)
+	}
+	if got := res.(Info).LastApplied; got != 0 {
+		t.Fatalf("M4.lastApplied=%d, want 0", got)
+	}
+
+	// during restore, M4 must store entries but not apply them
+	updates += 10
+	<-c.sendUpdates(ldr, 1, 10).Done()
+	c.waitCatchup(m4)
+	if got := fsm(m4).len(); got != 0 {
+		t.Fatalf("M4.fsmLen=%d, want 0", got)
+	}
+	c.takeSnapshot(m4, 0, InProgressError("restoreFSM"))
+
+	// after restore, M4 must apply entries
+	close(c.blockRestore)
+	c.waitFSMLen(updates, m4)
+	if restoring() {
+		t.Fatal("M4 must not be restoring")
+	}
+}
+
+func TestReplication_delegateSnapshot(t *testing.T) {
+	var mu sync.Mutex
+	sentBy := make(map[uint64]uint64) // target -> follower
+	tracer.snapshotDelegated = func(r *Raft, target uint64) {
+		mu.Lock()
+		defer mu.Unlock()
+		sentBy[target] = r.nid
+	}
+	defer func() { tracer.snapshotDelegated = nil }()
+
+	// launch 3 node cluster, with odd and even failure domains
+	c := newCluster(t)
+	c.opt.LogSegmentSize = 1024
+	c.opt.DelegateSnapshots = true
+	c.opt.FailureDomain = func(n Node) string { return fmt.Sprint(n.ID % 2) }
+	ldr, flrs := c.ensureLaunch(3)
+	defer c.shutdown()
+
+	// send 30 updates, add nonVoters M4, M5
+	updates := uint64(30)
+	<-c.sendUpdates(ldr, 1, 30).Done()
+	c.ensure(c.waitAddNonvoter(ldr, 4, c.id2Addr(4), false))
+	c.ensure(c.waitAddNonvoter(ldr, 5, c.id2Addr(5), false))
+	updates += 10
+	<-c.sendUpdates(ldr, 1, 10).Done()
+	c.waitFSMLen(updates)
+
+	// take snapshot in all nodes
+	logCompacted := c.registerFor(eventLogCompacted, ldr)
+	defer c.unregister(logCompacted)
+	for _, r := range flrs {
+		c.takeSnapshot(r, 1, nil)
+	}
+	c.takeSnapshot(ldr, 1, nil)
+	c.ensure(logCompacted.waitForEvent(c.longTimeout))
+
+	// launch M4, M5; they must get snapshot from followers
+	launched := c.launch(2, false)
+	c.waitFSMLen(updates, launched[4], launched[5])
+	delegated := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(sentBy) == 2
+	}
+	if !waitForCondition(delegated, 5*time.Millisecond, c.longTimeout) {
+		t.Fatalf("snapshot not delegated: %v", sentBy)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for target := uint64(4); target <= 5; target++ {
+		helper := sentBy[target]
+		if helper == 0 || helper == ldr.nid {
+			t.Fatalf("M%d: snapshot must be sent by follower, but sent by M%d", target, helper)
+		}
+		for _, flr := range flrs {
+			if flr.nid%2 == target%2 && helper%2 != target%2 {
+				t.Fatalf("M%d: snapshot must be sent by M%d in same failure domain, but sent by M%d", target, flr.nid, helper)
+			}
+		}
+	}
+
+	// send 10 more updates, ensure all alive get them
+	updates += 10
+	c.sendUpdates(ldr, 1, 10)
+	c.waitFSMLen(updates)
+
+	// follower sends snapshot, only on behalf of current leader
+	var got [3]rpcResult
+	_ = flrs[0].inspect(func(r *Raft) {
+		got[0], _ = r.onSendSnapRequest(&sendSnapReq{req: req{r.term, r.leader}, target: 4})
+		got[1], _ = r.onSendSnapRequest(&sendSnapReq{req: req{r.term - 1, r.leader}, target: 4})
+		got[2], _ = r.onSendSnapRequest(&sendSnapReq{req: req{r.term, r.nid}, target: 4})
+	})
+	if want := [3]rpcResult{success, staleTerm, cannotRelay}; got != want {
+		t.Fatalf("sendSnap results: got %v, want %v", got, want)
+	}
+}
+
+func TestReplication_chainNonvoters(t *testing.T) {
+	// launch 3 node cluster, with odd and even failure domains
+	c := newCluster(t)
+	c.opt.ChainNonvoters = true
+	c.opt.FailureDomain = func(n Node) string { return fmt.Sprint(n.ID % 2) }
+	ldr, flrs := c.ensureLaunch(3)
+	defer c.shutdown()
+
+	// send 10 updates, add nonVoters M4, M5
+	updates := uint64(10)
+	<-c.sendUpdates(ldr, 1, 10).Done()
+	c.ensure(c.waitAddNonvoter(ldr, 4, c.id2Addr(4), false))
+	c.ensure(c.waitAddNonvoter(ldr, 5, c.id2Addr(5), false))
+	c.launch(2, false)
+
+	// send 10 more updates, ensure all get them
+	updates += 10
+	<-c.sendUpdates(ldr, 1, 10).Done()
+	c.waitFSMLen(updates)
+
+	// leader must learn matchIndex of nonvoters through followers
+	relayedBy := func(target uint64) (relay uint64) {
+		ldr.inspect(func(r *Raft) {
+			if status := r.ldr.repls[target].status; status.matchIndex == r.lastLogIndex {
+				relay = status.relayedBy
+			}
+		})
+		return
+	}
+	for target := uint64(4); target <= 5; target++ {
+		if !waitForCondition(func() bool { return relayedBy(target) != 0 }, 5*time.Millisecond, c.longTimeout) {
+			t.Fatalf("M%d: leader did not learn matchIndex through follower", target)
+		}
+		relay := relayedBy(target)
+		for _, flr := range flrs {
+			if flr.nid%2 == target%2 && relay%2 != target%2 {
+				t.Fatalf("M%d: must be relayed by M%d in same failure domain, but relayed by M%d", target, flr.nid, relay)
+			}
+		}
+		var relaying bool
+		c.rr[relay].inspect(func(r *Raft) {
+			_, relaying = r.flr.relays[target]
+		})
+		if !relaying {
+			t.Fatalf("M%d: M%d is not relaying", target, relay)
+		}
+	}
+
+	// shutdown follower relaying to M4
+	relay := c.rr[relayedBy(4)]
+	c.shutdown(relay)
+
+	// send 10 more updates, ensure M4 gets them through other follower
+	updates += 10
+	<-c.sendUpdates(ldr, 1, 10).Done()
+	c.waitFSMLen(updates, c.exclude(relay)...)
+	if !waitForCondition(func() bool { r := relayedBy(4); return r != 0 && r != relay.nid }, 5*time.Millisecond, c.longTimeout) {
+		t.Fatal("M4: not relayed by other follower")
+	}
+}
+
+func TestReplication_chainNonvoters_fallback(t *testing.T) {
+	// launch 2 node cluster
+	c := newCluster(t)
+	c.opt.ChainNonvoters = true
+	ldr, flrs := c.ensureLaunch(2)
+	defer c.shutdown()
+	c.waitForStableConfig(ldr)
+
+	// add nonvoter M3, which follower cannot reach
+	c.ensure(c.waitAddNonvoter(ldr, 3, c.id2Addr(3), false))
+	network.SetFirewall(blockLink{id2Host(flrs[0].nid), id2Host(3)})
+	defer c.connect()
+	c.launch(1, false)
+
+	// leader must give up on follower, and replicate by itself
+	updates := uint64(10)
+	<-c.sendUpdates(ldr, 1, 10).Done()
+	c.waitFSMLen(updates)
+	var relayedBy uint64
+	ldr.inspect(func(r *Raft) {
+		relayedBy = r.ldr.repls[3].status.relayedBy
+	})
+	if relayedBy != 0 {
+		t.Fatalf("M3: relayedBy got M%d, want 0", relayedBy)
+	}
+}
+
+func TestReplication_chainNonvoters_relayError(t *testing.T) {
+	// launch 2 node cluster
+	c := newCluster(t)
+	c.opt.ChainNonvoters = true
+	ldr, flrs := c.ensureLaunch(2)
+	defer c.shutdown()
+	c.waitForStableConfig(ldr)
+
+	// add nonvoter M3, wait till follower relays to it
+	c.ensure(c.waitAddNonvoter(ldr, 3, c.id2Addr(3), false))
+	c.launch(1, false)
+	updates := uint64(10)
+	<-c.sendUpdates(ldr, 1, 10).Done()
+	c.waitFSMLen(updates)
+	relaying := func() (b bool) {
+		_ = flrs[0].inspect(func(r *Raft) {
+			_, b = r.flr.relays[3]
+		})
+		return
+	}
+	if !waitForCondition(relaying, c.commitTimeout, c.longTimeout) {
+		t.Fatal("M3 must be relayed by follower")
+	}
+
+	// make relay report error
+	_ = flrs[0].inspect(func(r *Raft) {
+		rl := r.flr.relays[3]
+		r.flr.relayUpdateCh <- replUpdate{&rl.status, errors.New("relay failed")}
+	})
+
+	// follower must stay up, and leader must replicate by itself
+	updates += 10
+	<-c.sendUpdates(ldr, 1, 10).Done()
+	c.waitFSMLen(updates)
+	select {
+	case <-flrs[0].Closed():
+		t.Fatal("follower must not shutdown")
+	default:
+	}
+	var relayedBy uint64
+	_ = ldr.inspect(func(r *Raft) {
+		relayedBy = r.ldr.repls[3].status.relayedBy
+	})
+	if relayedBy != 0 {
+		t.Fatalf("M3: relayedBy got M%d, want 0", relayedBy)
+	}
+}
+
+func TestReplication_relayStopped_compactDeferred(t *testing.T) {
+	// launch 2 node cluster
+	c := newCluster(t)
+	c.opt.LogSegmentSize = 1024
+	ldr, flrs := c.ensureLaunch(2)
+	defer c.shutdown()
+	flr := flrs[0]
+
+	// pretend that a stopped relay is still running
+	rl := &relay{done: make(chan struct{})}
+	_ = flr.inspect(func(r *Raft) {
+		r.flr.stopped = append(r.flr.stopped, rl)
+	})
+	prevIndex := func() (i uint64) {
+		_ = flr.inspect(func(r *Raft) {
+			i = r.log.PrevIndex()
+		})
+		return
+	}
+
+	// log compaction must be deferred, without blocking raft loop
+	<-c.sendUpdates(ldr, 1, 30).Done()
+	c.waitFSMLen(30)
+	c.takeSnapshot(flr, 1, nil)
+	if got := prevIndex(); got != 0 {
+		close(rl.done)
+		t.Fatalf("M%d.prevIndex=%d, want 0", flr.nid, got)
+	}
+
+	// once relay finishes, log must be compacted
+	close(rl.done)
+	compacted := func() bool { return prevIndex() > 0 }
+	if !waitForCondition(compacted, c.commitTimeout, c.longTimeout) {
+		t.Fatalf("M%d: log must be compacted", flr.nid)
+	}
+}
+
+// blockLink is firewall that blocks traffic between two hosts.
+type blockLink [2]string
+
+func (b blockLink) Allow(host1, host2 string) bool {
+	return !(host1 == b[0] && host2 == b[1] || host1 == b[1] && host2 == b[0])
+}
+
 func testInstallSnapCase(t *testing.T, updateFSMAfterSnap bool) {
 	// launch 3 node cluster
 	c := newCluster(t)
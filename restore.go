@@ -0,0 +1,109 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/santhosh-tekuri/raft/vfs"
+)
+
+// RestoreSnapshot initializes a fresh storageDir from the snapshot read
+// from r, as written by Client.DownloadSnapshot. The identity cid and nid
+// are stored in storageDir, as SetIdentity does. Use new cid, to restore
+// into a new cluster.
+//
+// If config has no nodes, the config stored in snapshot is used. Otherwise
+// the given config is used, and its index and term are ignored. Node nid
+// must be in the config.
+//
+// To bootstrap a new cluster with the snapshot, restore same snapshot with
+// same config on each node of the new cluster, before starting them. Such
+// nodes are already bootstrapped and need no ChangeConfig.
+//
+// Returns error if storageDir already contains log entries or snapshots,
+// or if the snapshot data does not match its checksum.
+// Returns the config stored along with restored snapshot.
+func RestoreSnapshot(opt Options, storageDir string, cid, nid uint64, config Config, r io.Reader) (Config, error) {
+	if opt.FS == nil {
+		opt.FS = vfs.OS
+	}
+	if err := setIdentity(opt.FS, storageDir, cid, nid); err != nil {
+		return config, err
+	}
+	if err := lockDir(opt.FS, storageDir); err != nil {
+		return config, err
+	}
+	defer unlockDir(opt.FS, storageDir)
+
+	store, err := openStorage(storageDir, opt)
+	if err != nil {
+		return config, err
+	}
+	config, err = store.restoreSnapshot(config, r)
+	if e := store.log.Close(); err == nil {
+		err = e
+	}
+	return config, err
+}
+
+func (s *storage) restoreSnapshot(config Config, r io.Reader) (_ Config, err error) {
+	if s.term != 0 || s.lastLogIndex != 0 || s.snaps.index != 0 {
+		return config, errors.New("raft.RestoreSnapshot: storage is not empty")
+	}
+	meta, err := readSnapshotHeader(r)
+	if err != nil {
+		return config, err
+	}
+	if meta.index == 0 || meta.term == 0 {
+		return config, fmt.Errorf("raft.RestoreSnapshot: invalid snapshot index %d, term %d", meta.index, meta.term)
+	}
+	if len(config.Nodes) == 0 {
+		config = meta.config
+	} else {
+		// fix node.ID, and clear actions
+		config = config.clone()
+		for id, n := range config.Nodes {
+			n.ID, n.Action = id, None
+			config.Nodes[id] = n
+		}
+		config.Index, config.Term = meta.index, meta.term
+	}
+	if err := config.validate(); err != nil {
+		return config, err
+	}
+	if _, ok := config.Nodes[s.nid]; !ok {
+		return config, fmt.Errorf("raft.RestoreSnapshot: node %d is not in config", s.nid)
+	}
+
+	sink, err := s.snaps.new(meta.index, meta.term, config, meta.sessions)
+	if err != nil {
+		return config, err
+	}
+	_, err = readSnapshotData(r, sink.w, meta.size)
+	if _, err = sink.done(err); err != nil {
+		return config, err
+	}
+
+	defer func() {
+		if v := recover(); v != nil {
+			err = recoverErr(v)
+		}
+	}()
+	s.setTerm(meta.term)
+	return config, s.clearLog()
+}
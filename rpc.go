@@ -55,6 +55,9 @@ func (r *Raft) replyRPC(rpc *rpc) (resetTimer bool) {
 	}
 	result, err := r.onRequest(rpc.req, rpc.conn)
 	rpc.resp = rpc.req.rpcType().createResp(r, result, err)
+	if req, ok := rpc.req.(*relayReq); ok && result == success {
+		r.relayStatus(req.target, rpc.resp.(*relayResp))
+	}
 	if result == readErr {
 		rpc.readErr = err
 	}
@@ -85,6 +88,10 @@ func (r *Raft) onRequest(req request, c *conn) (result rpcResult, err error) {
 		return r.onInstallSnapRequest(req, c)
 	case *timeoutNowReq:
 		return r.onTimeoutNowRequest()
+	case *relayReq:
+		return r.onRelayRequest(req)
+	case *sendSnapReq:
+		return r.onSendSnapRequest(req)
 	default:
 		panic(fmt.Errorf("[BUG] raft.onRequest(%T)", req))
 	}
@@ -184,6 +191,7 @@ func (r *Raft) onAppendEntriesRequest(req *appendReq, c *conn) (rpcResult, error
 		if r.canCommit(req, req.prevLogIndex, req.prevLogTerm) {
 			r.setCommitIndex(req.prevLogIndex)
 			r.applyCommitted(prevEntry)
+			r.checkSnapshotTriggers()
 		}
 	}
 
@@ -199,6 +207,7 @@ func (r *Raft) onAppendEntriesRequest(req *appendReq, c *conn) (rpcResult, error
 				if r.canCommit(req, index, term) {
 					r.setCommitIndex(index)
 					r.applyCommitted(nil)
+					r.checkSnapshotTriggers()
 				}
 			}
 		}()
@@ -262,6 +271,9 @@ func (r *Raft) canCommit(req *appendReq, index, term uint64) bool {
 // if commitIndex > lastApplied: increment lastApplied, apply
 // log[lastApplied] to state machine
 func (r *Raft) applyCommitted(ne *entry) {
+	if r.restoring {
+		return
+	}
 	apply := fsmApply{log: r.log.ViewAt(r.log.PrevIndex(), r.commitIndex)}
 	if trace {
 		println(r, apply)
@@ -289,12 +301,16 @@ func (r *Raft) onInstallSnapRequest(req *installSnapReq, c *conn) (rpcResult, er
 	r.setState(Follower)
 	r.setLeader(req.src)
 
+	// relays read log, which might be discarded below.
+	// they are waited for, just before removing entries
+	r.flr.stopRelays()
+
 	// store snapshot
-	sink, err := r.snaps.new(req.lastIndex, req.lastTerm, req.lastConfig)
+	sink, err := r.snaps.new(req.lastIndex, req.lastTerm, req.lastConfig, req.sessions)
 	if err != nil {
 		return unexpectedErr, opError(err, "snapshots.new")
 	}
-	n, err := io.CopyN(sink.file, c.bufr, req.size)
+	n, err := io.CopyN(sink.w, c.bufr, req.size)
 	req.size -= n
 	meta, doneErr := sink.done(err)
 	if err != nil {
@@ -304,8 +320,11 @@ func (r *Raft) onInstallSnapRequest(req *installSnapReq, c *conn) (rpcResult, er
 		return unexpectedErr, opError(doneErr, "snapshotSink.done")
 	}
 
+	// if fsm restore is in progress, fsm needs the entries following
+	// the snapshot being restored, which compaction would remove. so
+	// log is discarded, and fsm is restored again from this snapshot
 	discardLog := true
-	if r.storage.log.Contains(meta.index) {
+	if !r.restoring && r.storage.log.Contains(meta.index) {
 		metaTerm, err := r.storage.getEntryTerm(meta.index)
 		if err != nil {
 			return unexpectedErr, err
@@ -320,16 +339,21 @@ func (r *Raft) onInstallSnapRequest(req *installSnapReq, c *conn) (rpcResult, er
 		}
 	}
 	if discardLog {
+		r.flr.waitStopped()
 		if err = r.storage.clearLog(); err != nil {
 			return unexpectedErr, err
 		}
 
-		// todo: dont wait for restoreFSM to complete
-		//       if restoreFSM fails panic and exit
-		//       if takeSnap req came meanwhile, reply inProgress(restoreFSM)
-
-		// restore fsm from this snapshot
-		r.fsm.ch <- fsmRestoreReq{r.fsmRestoredCh}
+		// restore fsm from this snapshot, without waiting for it.
+		// entries committed meanwhile are applied after restore.
+		// at most one restore is outstanding; if one is in progress,
+		// latest snapshot is restored again once it finishes
+		if r.restoring {
+			r.restoreAgain = true
+		} else {
+			r.fsm.ch <- fsmRestoreReq{r.fsmRestoredCh}
+			r.restoring = true
+		}
 		r.commitIndex = r.snaps.index
 
 		// load snapshot config as cluster configuration
@@ -340,6 +364,23 @@ func (r *Raft) onInstallSnapRequest(req *installSnapReq, c *conn) (rpcResult, er
 	return success, nil
 }
 
+// onSendSnapRequest -------------------------------------------------
+
+// onSendSnapRequest validates that req is from current leader. The snapshot
+// is sent by server, see server.sendSnapshot.
+func (r *Raft) onSendSnapRequest(req *sendSnapReq) (rpcResult, error) {
+	if req.term < r.term {
+		return staleTerm, nil
+	}
+	if r.state != Follower || req.term != r.term || req.src != r.leader {
+		return cannotRelay, nil
+	}
+	if index, _ := r.snaps.latest(); index == 0 || index < req.minIndex {
+		return staleSnapshot, nil
+	}
+	return success, nil
+}
+
 // onTimeoutNowRequest -------------------------------------------------
 
 func (r *Raft) onTimeoutNowRequest() (rpcResult, error) {
@@ -153,6 +153,12 @@ func (s *server) handleConn(rwc net.Conn) error {
 		if rpc.req.rpcType() == rpcIdentity && rpc.resp.getResult() == success {
 			nid = rpc.req.from()
 		}
+		if req, ok := rpc.req.(*sendSnapReq); ok {
+			if err = s.sendSnapshot(c, req, rpc.resp.(*sendSnapResp)); err != nil {
+				return err
+			}
+			continue
+		}
 		// todo: set write deadline
 		if err = rpc.resp.encode(c.bufw); err != nil {
 			return err
@@ -170,6 +176,10 @@ func (s *server) handleConn(rwc net.Conn) error {
 func (s *server) handleTask(typ taskType, c *conn) error {
 	var t Task
 	switch typ {
+	case taskDownloadSnapshot:
+		return s.downloadSnapshot(c)
+	case taskUpdateFSM, taskReadFSM, taskBarrierFSM, taskOpenSession, taskUpdateSession:
+		return s.handleFSMTask(typ, c)
 	case taskInfo:
 		t = GetInfo()
 	case taskChangeConfig:
@@ -210,6 +220,184 @@ func (s *server) handleTask(typ taskType, c *conn) error {
 	return c.bufw.Flush()
 }
 
+// downloadSnapshot streams latest snapshot. It does not go through
+// raft, because snapshots can be read concurrently.
+func (s *server) downloadSnapshot(c *conn) error {
+	snap, err := func() (*snapshot, error) {
+		if index, _ := s.r.snaps.latest(); index == 0 {
+			return nil, ErrNoSnapshot
+		}
+		return s.r.snaps.open()
+	}()
+	if err != nil {
+		return s.replyErr(err, c)
+	}
+	defer snap.release()
+	if err = writeString(c.bufw, ""); err != nil {
+		return err
+	}
+	if err = snap.export(c.bufw); err != nil {
+		return err
+	}
+	return c.bufw.Flush()
+}
+
+// sendSnapshot replies to req, which is validated by raft, and sends
+// latest snapshot to the target, on behalf of leader. Sending is done
+// outside raft, because snapshots can be read concurrently.
+func (s *server) sendSnapshot(c *conn, req *sendSnapReq, resp *sendSnapResp) error {
+	var snap *snapshot
+	if resp.result == success {
+		var err error
+		if snap, err = s.r.snaps.open(); err != nil {
+			resp.result, resp.err = unexpectedErr, opError(err, "snapshots.open")
+		} else if snap.meta.index < req.minIndex {
+			snap.release()
+			snap, resp.result = nil, staleSnapshot
+		} else {
+			defer snap.release()
+			resp.lastIndex, resp.size = snap.meta.index, snap.meta.size
+		}
+	}
+	if trace {
+		println(s.r, ">>", resp)
+	}
+	if err := resp.encode(c.bufw); err != nil {
+		return err
+	}
+	if err := c.bufw.Flush(); err != nil {
+		return err
+	}
+	if snap == nil {
+		return nil
+	}
+
+	// connect to target, as if we are leader
+	repl := &replication{
+		clock:     s.r.clock,
+		hbTimeout: s.r.hbTimeout,
+		bandwidth: s.r.bandwidth,
+	}
+	pool := &connPool{
+		src:      s.r.nid,
+		cid:      s.r.cid,
+		nid:      req.target,
+		resolver: s.r.resolver,
+		dialFn:   s.r.dialFn,
+		clock:    s.r.clock,
+	}
+	tc, err := pool.getConn(repl.deadline())
+	if err != nil {
+		return err
+	}
+	defer tc.rwc.Close()
+	installResp, err := repl.installSnap(tc, &installSnapReq{
+		req:        req.req,
+		lastIndex:  snap.meta.index,
+		lastTerm:   snap.meta.term,
+		lastConfig: snap.meta.config,
+		size:       snap.meta.size,
+		sessions:   snap.meta.sessions,
+	}, snap.r)
+	if err != nil {
+		return err
+	}
+	if tracer.snapshotDelegated != nil {
+		tracer.snapshotDelegated(s.r, req.target)
+	}
+	if err = installResp.encode(c.bufw); err != nil {
+		return err
+	}
+	return c.bufw.Flush()
+}
+
+// handleFSMTask submits FSMTask to raft. The read command and the
+// result are converted from/to bytes using Options.Codec. The result
+// of UpdateSession is already encoded.
+func (s *server) handleFSMTask(typ taskType, c *conn) error {
+	var t FSMTask
+	switch typ {
+	case taskUpdateFSM:
+		cmd, err := readBytes(c.bufr)
+		if err != nil {
+			return err
+		}
+		t = UpdateFSM(cmd)
+	case taskReadFSM:
+		b, err := readBytes(c.bufr)
+		if err != nil {
+			return err
+		}
+		cmd, err := s.r.codec.DecodeRead(b)
+		if err != nil {
+			return s.replyErr(err, c)
+		}
+		t = ReadFSM(cmd)
+	case taskBarrierFSM:
+		t = BarrierFSM()
+	case taskOpenSession:
+		timeout, err := readUint64(c.bufr)
+		if err != nil {
+			return err
+		}
+		t = OpenSession(time.Duration(timeout))
+	case taskUpdateSession:
+		id, err := readUint64(c.bufr)
+		if err != nil {
+			return err
+		}
+		seq, err := readUint64(c.bufr)
+		if err != nil {
+			return err
+		}
+		cmd, err := readBytes(c.bufr)
+		if err != nil {
+			return err
+		}
+		t = UpdateSession(id, seq, cmd)
+	default:
+		panic(unreachable())
+	}
+	select {
+	case <-s.r.Closed():
+		t.reply(ErrServerClosed)
+	case s.r.FSMTasks() <- t:
+	}
+	<-t.Done()
+	if t.Err() != nil {
+		return s.replyErr(t.Err(), c)
+	}
+
+	result := newTask()
+	switch typ {
+	case taskBarrierFSM:
+		result.reply(nil)
+	case taskOpenSession, taskUpdateSession:
+		result.reply(t.Result())
+	default:
+		b, err := s.r.codec.EncodeResult(t.Result())
+		if err != nil {
+			s.r.logger.Error("encoding result failed", "err", trimPrefix(err))
+			return s.replyErr(ErrResultNotEncoded, c)
+		}
+		result.reply(b)
+	}
+	if err := encodeTaskResp(result, c.bufw); err != nil {
+		return err
+	}
+	return c.bufw.Flush()
+}
+
+// replyErr sends err as the response of task.
+func (s *server) replyErr(err error, c *conn) error {
+	t := newTask()
+	t.reply(err)
+	if err = encodeTaskResp(t, c.bufw); err != nil {
+		return err
+	}
+	return c.bufw.Flush()
+}
+
 func (s *server) executeTask(t Task) {
 	select {
 	case <-s.r.Closed():
@@ -0,0 +1,301 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+// OpenSession task registers a new client session, that expires if no
+// update is applied within the given timeout. This task returns the
+// session id as uint64, which is used with UpdateSession task.
+//
+// Expiry is decided using the time recorded by leader in the log
+// entries, so that all nodes expire sessions at same log index.
+func OpenSession(timeout time.Duration) FSMTask {
+	data := make([]byte, 16)
+	byteOrder.PutUint64(data[8:], uint64(timeout))
+	return fsmTask(entryOpenSession, nil, data)
+}
+
+// UpdateSession task is similar to UpdateFSM, but it is applied
+// at most once for given session and seq. The seq of first update
+// in a session is 1, and it must be incremented for each update.
+// Each session must have at most one update outstanding.
+//
+// If an update with same seq is already applied, its result is
+// returned without applying again. This allows the update to be
+// safely retried if its outcome is unknown, for example when the
+// leader crashes before replying.
+//
+// The result of this task is the value returned by FSM, encoded
+// using Options.Codec, because results are included in snapshot.
+// For the same reason, if FSM returns an error, only its message is
+// kept, and the task fails with errors.New of that message on every node.
+//
+// ErrSessionExpired: the session is not open, or it is expired.
+// ErrDuplicateRequest: the seq is older than the last applied seq,
+// or the result of last applied seq is no longer available.
+func UpdateSession(id, seq uint64, data []byte) FSMTask {
+	b := make([]byte, sessionHeaderLen+len(data))
+	byteOrder.PutUint64(b[8:], id)
+	byteOrder.PutUint64(b[16:], seq)
+	copy(b[sessionHeaderLen:], data)
+	return fsmTask(entryUpdateSession, nil, b)
+}
+
+// sessionHeaderLen is the length of time+id+seq, which
+// precedes the command in data of entryUpdateSession.
+const sessionHeaderLen = 24
+
+// isSession tells whether the entry data starts with time.
+func (e *entry) isSession() bool {
+	return e.typ == entryOpenSession || e.typ == entryUpdateSession
+}
+
+// stampTime records the leader time in the entry. Must be called
+// by leader, before entry is appended to log.
+func (e *entry) stampTime(now time.Time) {
+	byteOrder.PutUint64(e.data, uint64(now.UnixNano()))
+}
+
+type session struct {
+	seq        uint64        // seq of last applied update
+	result     interface{}   // result of last applied update, []byte or error
+	pending    bool          // last applied update is in batch, not yet flushed
+	timeout    time.Duration // expire if inactive for this duration
+	lastActive int64         // log time of last activity
+}
+
+// sessions tracks client sessions. It is driven only by log entries,
+// so that it is same on all nodes, at given log index.
+type sessions struct {
+	codec      Codec
+	m          map[uint64]*session
+	now        int64 // latest time recorded by leader in log
+	nextExpiry int64 // no session expires before this time
+}
+
+func newSessions(codec Codec) *sessions {
+	return &sessions{codec: codec, m: make(map[uint64]*session)}
+}
+
+// advance moves the log time to time recorded in entry e,
+// and removes expired sessions.
+func (s *sessions) advance(e *entry) {
+	if t := int64(byteOrder.Uint64(e.data)); t > s.now {
+		s.now = t
+	}
+	if s.now < s.nextExpiry {
+		return
+	}
+	s.nextExpiry = math.MaxInt64
+	for id, sess := range s.m {
+		expiry := sess.lastActive + int64(sess.timeout)
+		if expiry < s.now {
+			delete(s.m, id)
+		} else if expiry < s.nextExpiry {
+			s.nextExpiry = expiry
+		}
+	}
+}
+
+// open applies entryOpenSession. The session id is the entry index.
+func (s *sessions) open(e *entry) uint64 {
+	s.advance(e)
+	sess := &session{
+		timeout:    time.Duration(byteOrder.Uint64(e.data[8:])),
+		lastActive: s.now,
+	}
+	if expiry := sess.lastActive + int64(sess.timeout); expiry < s.nextExpiry {
+		s.nextExpiry = expiry
+	}
+	s.m[e.index] = sess
+	return e.index
+}
+
+// lookup returns the session of entryUpdateSession e, and its seq.
+// The session is nil if it is expired.
+func (s *sessions) lookup(e *entry) (*session, uint64) {
+	s.advance(e)
+	sess := s.m[byteOrder.Uint64(e.data[8:])]
+	if sess != nil {
+		sess.lastActive = s.now
+	}
+	return sess, byteOrder.Uint64(e.data[16:])
+}
+
+// record saves v as the result of last applied update in session,
+// and returns the saved result. Errors other than sessionErrs are
+// saved by message, as that is all that survives snapshot.
+func (s *sessions) record(sess *session, v interface{}) interface{} {
+	sess.pending = false
+	if err, ok := v.(error); ok {
+		if sessionErrIndex(err) < 0 {
+			err = errors.New(err.Error())
+		}
+		sess.result = err
+	} else if b, err := s.codec.EncodeResult(v); err != nil {
+		sess.result = ErrResultNotEncoded
+	} else {
+		sess.result = b
+	}
+	return sess.result
+}
+
+func (s *sessions) encode(w io.Writer) error {
+	ids := make([]uint64, 0, len(s.m))
+	for id := range s.m {
+		ids = append(ids, id)
+	}
+	sort.Sort(decrUint64Slice(ids))
+	if err := writeUint64(w, uint64(s.now)); err != nil {
+		return err
+	}
+	if err := writeUint64(w, uint64(len(ids))); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		sess := s.m[id]
+		for _, v := range []uint64{id, sess.seq, uint64(sess.timeout), uint64(sess.lastActive)} {
+			if err := writeUint64(w, v); err != nil {
+				return err
+			}
+		}
+		if err, ok := sess.result.(error); ok {
+			if i := sessionErrIndex(err); i >= 0 {
+				if err := writeUint8(w, resultSessionErr); err != nil {
+					return err
+				}
+				if err := writeUint8(w, uint8(i)); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := writeUint8(w, resultErr); err != nil {
+				return err
+			}
+			if err := writeString(w, err.Error()); err != nil {
+				return err
+			}
+		} else {
+			if err := writeUint8(w, resultBytes); err != nil {
+				return err
+			}
+			b, _ := sess.result.([]byte)
+			if err := writeBytes(w, b); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// types of session result, in encoded sessions
+const (
+	resultBytes      uint8 = iota // encoded result of FSM
+	resultErr                     // error returned by FSM, as message
+	resultSessionErr              // error in sessionErrs, as index
+)
+
+// sessionErrs are the errors which are encoded by identity, so that
+// duplicate requests get the same error on every node. The index
+// is encoded, so new errors must be appended.
+var sessionErrs = []error{ErrDuplicateRequest, ErrResultNotEncoded}
+
+// sessionErrIndex returns index of err in sessionErrs, or -1 if absent.
+func sessionErrIndex(err error) int {
+	for i, e := range sessionErrs {
+		if e == err {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *sessions) decode(r io.Reader) error {
+	now, err := readUint64(r)
+	if err != nil {
+		return err
+	}
+	n, err := readUint64(r)
+	if err != nil {
+		return err
+	}
+	m := make(map[uint64]*session, n)
+	for ; n > 0; n-- {
+		var v [4]uint64
+		for i := range v {
+			if v[i], err = readUint64(r); err != nil {
+				return err
+			}
+		}
+		sess := &session{seq: v[1], timeout: time.Duration(v[2]), lastActive: int64(v[3])}
+		typ, err := readUint8(r)
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case resultBytes:
+			if sess.result, err = readBytes(r); err != nil {
+				return err
+			}
+		case resultErr:
+			msg, err := readString(r)
+			if err != nil {
+				return err
+			}
+			sess.result = errors.New(msg)
+		case resultSessionErr:
+			i, err := readUint8(r)
+			if err != nil {
+				return err
+			}
+			if int(i) >= len(sessionErrs) {
+				return fmt.Errorf("raft: invalid session error %d", i)
+			}
+			sess.result = sessionErrs[i]
+		default:
+			return fmt.Errorf("raft: invalid session result type %d", typ)
+		}
+		m[v[0]] = sess
+	}
+	s.m, s.now, s.nextExpiry = m, int64(now), 0
+	return nil
+}
+
+func (s *sessions) bytes() []byte {
+	if len(s.m) == 0 && s.now == 0 {
+		return nil
+	}
+	buf := new(bytes.Buffer)
+	_ = s.encode(buf) // never fails on bytes.Buffer
+	return buf.Bytes()
+}
+
+// restore replaces sessions with those encoded in b.
+func (s *sessions) restore(b []byte) error {
+	if len(b) == 0 {
+		s.m, s.now, s.nextExpiry = make(map[uint64]*session), 0, 0
+		return nil
+	}
+	return s.decode(bytes.NewReader(b))
+}
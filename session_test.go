@@ -0,0 +1,223 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSession_exactlyOnce(t *testing.T) {
+	c := newCluster(t)
+	c.opt.Codec = fsmMockCodec{}
+	ldr, flrs := c.ensureLaunch(3)
+	defer c.shutdown()
+
+	// submitted to follower, must be redirected to leader
+	client := NewClient(c.id2Addr(flrs[0].nid))
+	client.dial = flrs[0].dialFn
+	id, err := client.OpenSession(context.Background(), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for seq := uint64(1); seq <= 3; seq++ {
+		result, err := client.UpdateSession(context.Background(), id, seq, []byte(fmt.Sprintf("update:%d", seq)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("update:%d:%d", seq, seq); string(result) != want {
+			t.Fatalf("result=%q, want %q", result, want)
+		}
+	}
+
+	// retry of last update, must return cached result without applying
+	result, err := client.UpdateSession(context.Background(), id, 3, []byte("update:3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "update:3:3"; string(result) != want {
+		t.Fatalf("result=%q, want %q", result, want)
+	}
+	if _, err := client.UpdateSession(context.Background(), id, 2, []byte("update:2")); err != ErrDuplicateRequest {
+		t.Fatalf("got %v, want %v", err, ErrDuplicateRequest)
+	}
+	if _, err := client.UpdateSession(context.Background(), id+1, 1, []byte("update")); err != ErrSessionExpired {
+		t.Fatalf("got %v, want %v", err, ErrSessionExpired)
+	}
+
+	// followers must have same sessions, and must not apply duplicates
+	c.waitFSMLen(3)
+	for _, r := range c.rr {
+		if got := fsm(r).len(); got != 3 {
+			t.Fatalf("M%d fsm.len=%d, want %d", r.nid, got, 3)
+		}
+	}
+
+	// new leader must detect duplicates
+	c.shutdown(ldr)
+	c.waitForLeader(flrs...)
+	result, err = client.UpdateSession(context.Background(), id, 3, []byte("update:3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "update:3:3"; string(result) != want {
+		t.Fatalf("result=%q, want %q", result, want)
+	}
+	if got := fsm(flrs[0]).len(); got != 3 {
+		t.Fatalf("fsm.len=%d, want %d", got, 3)
+	}
+}
+
+func TestSession_expiry(t *testing.T) {
+	opt := DefaultOptions()
+	opt.Logger = nil
+	opt.Codec = fsmMockCodec{}
+	r := launchNode(t, opt, &fsmMock{id: identity{1, 1}}, "")
+	defer func() { _ = r.Shutdown(context.Background()) }()
+	execute := func(task Task) (interface{}, error) {
+		return r.Execute(context.Background(), task)
+	}
+
+	id1, err := execute(OpenSession(200 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, err := execute(OpenSession(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if _, err := execute(UpdateSession(id1.(uint64), uint64(i+1), []byte("update"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// inactive for more than timeout, must expire
+	time.Sleep(300 * time.Millisecond)
+	if _, err := execute(UpdateSession(id1.(uint64), 4, []byte("update"))); err != ErrSessionExpired {
+		t.Fatalf("got %v, want %v", err, ErrSessionExpired)
+	}
+	if _, err := execute(UpdateSession(id2.(uint64), 1, []byte("update"))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSession_snapshot(t *testing.T) {
+	opt := DefaultOptions()
+	opt.Logger = nil
+	opt.SnapshotInterval = 0
+	opt.Codec = fsmMockCodec{}
+	r := launchNode(t, opt, &fsmMock{id: identity{1, 1}}, "")
+	storageDir := filepath.Dir(r.snaps.dir)
+	execute := func(task Task) interface{} {
+		t.Helper()
+		result, err := r.Execute(context.Background(), task)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	id := execute(OpenSession(time.Minute)).(uint64)
+	execute(UpdateSession(id, 1, []byte("update:1")))
+	id2 := execute(OpenSession(time.Minute)).(uint64)
+	if _, err := r.Execute(context.Background(), UpdateSession(id2, 1, []byte("noencode"))); err != ErrResultNotEncoded {
+		t.Fatalf("got %v, want %v", err, ErrResultNotEncoded)
+	}
+	execute(TakeSnapshot(0))
+	execute(UpdateSession(id, 2, []byte("update:2")))
+	_ = r.Shutdown(context.Background())
+
+	// restart with empty fsm, sessions must be restored from snapshot and log
+	fsm := &fsmMock{id: identity{1, 1}}
+	r = launchNode(t, opt, fsm, storageDir)
+	defer func() { _ = r.Shutdown(context.Background()) }()
+	if got, want := string(execute(UpdateSession(id, 2, []byte("update:2"))).([]byte)), "update:2:3"; got != want {
+		t.Fatalf("result=%q, want %q", got, want)
+	}
+	execute(BarrierFSM())
+	if got := fsm.len(); got != 3 {
+		t.Fatalf("fsm.len=%d, want %d", got, 3)
+	}
+
+	// cached error must be restored with its identity
+	if _, err := r.Execute(context.Background(), UpdateSession(id2, 1, []byte("noencode"))); err != ErrResultNotEncoded {
+		t.Fatalf("got %v, want %v", err, ErrResultNotEncoded)
+	}
+	execute(TakeSnapshot(0))
+	if _, err := r.Execute(context.Background(), UpdateSession(id, 1, []byte("update:1"))); err != ErrDuplicateRequest {
+		t.Fatalf("got %v, want %v", err, ErrDuplicateRequest)
+	}
+	if got, want := string(execute(UpdateSession(id, 3, []byte("update:3"))).([]byte)), "update:3:4"; got != want {
+		t.Fatalf("result=%q, want %q", got, want)
+	}
+}
+
+func TestSession_snapshot_fsmError(t *testing.T) {
+	opt := DefaultOptions()
+	opt.Logger = nil
+	opt.SnapshotInterval = 0
+	opt.Codec = fsmMockCodec{}
+	r := launchNode(t, opt, failingFSM{&fsmMock{id: identity{1, 1}}}, "")
+	storageDir := filepath.Dir(r.snaps.dir)
+	id, err := r.Execute(context.Background(), OpenSession(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, want := r.Execute(context.Background(), UpdateSession(id.(uint64), 1, []byte("fail")))
+	if want == nil || want.Error() != string(errUpdateFailed) {
+		t.Fatalf("got %v, want %v", want, errUpdateFailed)
+	}
+	if _, err := r.Execute(context.Background(), TakeSnapshot(0)); err != nil {
+		t.Fatal(err)
+	}
+	_ = r.Shutdown(context.Background())
+
+	// retry after restoring from snapshot, must get same error
+	fsm := &fsmMock{id: identity{1, 1}}
+	r = launchNode(t, opt, failingFSM{fsm}, storageDir)
+	defer func() { _ = r.Shutdown(context.Background()) }()
+	_, err = r.Execute(context.Background(), UpdateSession(id.(uint64), 1, []byte("fail")))
+	if !reflect.DeepEqual(err, want) {
+		t.Fatalf("got %#v, want %#v", err, want)
+	}
+	if got := fsm.len(); got != 1 {
+		t.Fatalf("fsm.len=%d, want %d", got, 1)
+	}
+}
+
+type updateError string
+
+func (e updateError) Error() string { return string(e) }
+
+const errUpdateFailed = updateError("update failed")
+
+// failingFSM fails the updates with command "fail".
+type failingFSM struct {
+	*fsmMock
+}
+
+func (fsm failingFSM) Update(cmd []byte) interface{} {
+	v := fsm.fsmMock.Update(cmd)
+	if string(cmd) == "fail" {
+		return errUpdateFailed
+	}
+	return v
+}
@@ -0,0 +1,211 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sim
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	"github.com/santhosh-tekuri/raft"
+)
+
+// epoch is the initial time of Clock.
+var epoch = time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Clock is a virtual clock, which implements raft.Clock.
+// Its time moves only when Advance or Step is called.
+type Clock struct {
+	mu     sync.Mutex
+	now    time.Time
+	seq    uint64 // to fire timers with same expiry in creation order
+	timers timerHeap
+}
+
+var _ raft.Clock = (*Clock)(nil)
+
+// NewClock creates new Clock, whose time is set to a fixed epoch.
+func NewClock() *Clock {
+	return &Clock{now: epoch}
+}
+
+// Now returns the current virtual time.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTimer creates a timer, which fires when the clock
+// is advanced by at least d.
+func (c *Clock) NewTimer(d time.Duration) raft.Timer {
+	t := &timer{clock: c, ch: make(chan time.Time, 1), index: -1}
+	t.Reset(d)
+	return t
+}
+
+// afterFunc calls f, when the clock is advanced by at least d.
+// f is called synchronously by Advance, so it must not block.
+func (c *Clock) afterFunc(d time.Duration, f func()) {
+	t := &timer{clock: c, f: f, index: -1}
+	t.Reset(d)
+}
+
+// Advance moves the clock forward by d, firing the timers
+// in the order of their expiry.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	target := c.now.Add(d)
+	c.mu.Unlock()
+	for {
+		c.mu.Lock()
+		if len(c.timers) == 0 || c.timers[0].when.After(target) {
+			c.now = target
+			c.mu.Unlock()
+			return
+		}
+		t := heap.Pop(&c.timers).(*timer)
+		if t.when.After(c.now) {
+			c.now = t.when
+		}
+		now := c.now
+		c.mu.Unlock()
+		t.fire(now)
+	}
+}
+
+// Step moves the clock to the expiry of earliest timer, and fires
+// only that timer, unlike Advance(Next()) which fires all timers with
+// that expiry. Timers with same expiry are fired by successive
+// calls, in the order of their creation. It returns false, if there
+// are no active timers.
+func (c *Clock) Step() bool {
+	c.mu.Lock()
+	if len(c.timers) == 0 {
+		c.mu.Unlock()
+		return false
+	}
+	t := heap.Pop(&c.timers).(*timer)
+	if t.when.After(c.now) {
+		c.now = t.when
+	}
+	now := c.now
+	c.mu.Unlock()
+	t.fire(now)
+	return true
+}
+
+// Next returns the duration after which the earliest timer fires.
+// ok is false, if there are no active timers.
+func (c *Clock) Next() (d time.Duration, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.timers) == 0 {
+		return 0, false
+	}
+	return c.timers[0].when.Sub(c.now), true
+}
+
+// timer ---------------------------------------------------------------
+
+type timer struct {
+	clock *Clock
+	ch    chan time.Time // nil for afterFunc
+	f     func()
+	when  time.Time
+	seq   uint64
+	index int // index in timerHeap, -1 if not active
+}
+
+func (t *timer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *timer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	return t.remove()
+}
+
+func (t *timer) Reset(d time.Duration) bool {
+	c := t.clock
+	c.mu.Lock()
+	active := t.remove()
+	if d <= 0 {
+		now := c.now
+		c.mu.Unlock()
+		t.fire(now)
+		return active
+	}
+	c.seq++
+	t.when, t.seq = c.now.Add(d), c.seq
+	heap.Push(&c.timers, t)
+	c.mu.Unlock()
+	return active
+}
+
+// remove removes timer from heap, and tells whether it was active.
+// must be called with clock.mu held.
+func (t *timer) remove() bool {
+	if t.index < 0 {
+		return false
+	}
+	heap.Remove(&t.clock.timers, t.index)
+	return true
+}
+
+func (t *timer) fire(now time.Time) {
+	if t.f != nil {
+		t.f()
+		return
+	}
+	select {
+	case t.ch <- now:
+	default:
+	}
+}
+
+// timerHeap -----------------------------------------------------------
+
+type timerHeap []*timer
+
+func (h timerHeap) Len() int { return len(h) }
+
+func (h timerHeap) Less(i, j int) bool {
+	if h[i].when.Equal(h[j].when) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].when.Before(h[j].when)
+}
+
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *timerHeap) Push(x interface{}) {
+	t := x.(*timer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	t.index = -1
+	return t
+}
@@ -0,0 +1,63 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package sim provides a virtual clock and an in-memory network, to run
+raft clusters in simulation.
+
+Clock implements raft.Clock. Time moves only when the clock is advanced,
+so that timeouts are independent of how fast the machine is:
+
+	clock := sim.NewClock()
+	network := sim.NewNetwork(clock, seed)
+	opt := raft.DefaultOptions()
+	opt.Clock = clock
+	opt.Dial = network.Dialer("M1")
+	opt.RandSeed = seed
+
+	r, _ := raft.New(opt, fsm, storageDir)
+	l, _ := network.Listen("M1:7000")
+	go r.Serve(l)
+
+	for !done {
+		sim.WaitIdle(time.Second)
+		clock.Step()
+	}
+
+Network delivers the data written to a connection after the delay
+configured for the link between the hosts, with random jitter. Data
+written to a connection is always delivered in order, but data written
+to different connections may be reordered. Lost messages, partitions
+and crashed hosts are simulated the way they are seen with TCP: a lost
+message resets the connection, and the data sent across partition is
+never delivered, causing reads to time out.
+
+All random decisions of network, and of raft if Options.RandSeed is set,
+are derived from the seed. Clock.Step fires one timer at a time, and
+WaitIdle waits until the goroutines have finished reacting to it. So the
+virtual time at which each event happens, and the order in which random
+numbers are drawn, depend only on the seed, and rerunning a seed replays
+the same run.
+
+The replay is exact only if the goroutines being simulated wait for
+nothing but the virtual clock, network and each other. Wall clock
+timers, real sockets, or goroutines that are always busy break it.
+Goroutines woken by the same timer still run concurrently, and their
+interleaving is up to the Go scheduler. This does not matter as long as
+they do not share random streams or timers of same expiry: each network
+connection has its own random stream, and raft forks its streams in the
+order of node ids. The code driving the simulation must also act only
+when the goroutines are idle, as package rafttest does.
+*/
+package sim
@@ -0,0 +1,109 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sim
+
+import (
+	"bytes"
+	"runtime"
+	"time"
+)
+
+// WaitIdle waits until all goroutines of the process, other than the
+// caller, are blocked. A goroutine is blocked, if it waits on channels,
+// select, package sync or time.Sleep. Goroutines that are running, in
+// system call, or waiting for the runtime, such as garbage collector,
+// are busy. It returns false, if that does not happen within given
+// timeout of wall time.
+//
+// So, if the goroutines being simulated wait only for each other,
+// Clock and Network, calling WaitIdle before each Clock.Step makes
+// the run depend only on the seed.
+func WaitIdle(timeout time.Duration) bool {
+	var buf []byte
+	deadline := time.Now().Add(timeout)
+	for wait := 10 * time.Microsecond; ; {
+		runtime.Gosched()
+		buf = stacks(buf)
+		if idle(buf) {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		// stacks stops the world, so check less often if busy for long
+		time.Sleep(wait)
+		if wait < time.Millisecond {
+			wait *= 2
+		}
+	}
+}
+
+// stacks returns the stacks of all goroutines, reusing buf.
+func stacks(buf []byte) []byte {
+	if buf == nil {
+		buf = make([]byte, 64*1024)
+	}
+	for {
+		n := runtime.Stack(buf[:cap(buf)], true)
+		if n < cap(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*cap(buf))
+	}
+}
+
+// idle tells whether all goroutines in given stacks, other than first
+// one, are blocked. The first one is always the caller.
+func idle(stacks []byte) bool {
+	// goroutines are separated by blank line
+	for i, g := range bytes.Split(stacks, []byte("\n\n")) {
+		if i == 0 {
+			continue
+		}
+		// goroutine 18 [chan receive, 2 minutes]:
+		// main.worker(...)
+		lines := bytes.SplitN(g, []byte("\n"), 3)
+		header, frame := lines[0], []byte(nil)
+		if len(lines) > 1 {
+			frame = lines[1]
+		}
+		i, j := bytes.IndexByte(header, '['), bytes.IndexAny(header, ",]")
+		if i < 0 || j < i {
+			continue
+		}
+		switch string(header[i+1 : j]) {
+		case "chan receive", "chan send", "select", "sleep",
+			"chan receive (nil chan)", "chan send (nil chan)", "select (no cases)",
+			"sync.Cond.Wait", "sync.Mutex.Lock", "sync.RWMutex.RLock",
+			"sync.RWMutex.Lock", "sync.WaitGroup.Wait", "IO wait", "finalizer wait":
+		case "semacquire":
+			// semaphores of package sync are released by other goroutines.
+			// otherwise it is waiting inside runtime, for example to start
+			// garbage collection while WaitIdle has stopped the world.
+			if !bytes.HasPrefix(frame, []byte("sync.")) && !bytes.HasPrefix(frame, []byte("internal/")) {
+				return false
+			}
+		case "syscall":
+			// these wait for events from runtime, for ever
+			if !bytes.HasPrefix(frame, []byte("os/signal.signal_recv")) && !bytes.HasPrefix(frame, []byte("runtime/pprof.readProfile")) {
+				return false
+			}
+		default:
+			// running, or waiting for runtime, such as garbage collector
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,475 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sim
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	errClosed      = errors.New("sim: use of closed connection")
+	errReset       = errors.New("sim: connection reset by peer")
+	errRefused     = errors.New("sim: connection refused")
+	errUnreachable = errors.New("sim: host unreachable")
+)
+
+// timeoutError is returned on deadline exceeded.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "sim: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// Link describes the behavior of network between two hosts.
+type Link struct {
+	// Delay is the minimum time taken to deliver data.
+	Delay time.Duration
+
+	// Jitter is the maximum random delay, added to Delay.
+	Jitter time.Duration
+
+	// Loss is the probability that a write is lost,
+	// which resets the connection.
+	Loss float64
+}
+
+// Network is an in-memory network, whose hosts are identified by the
+// host part of the address. It must be created using NewNetwork.
+type Network struct {
+	clock *Clock
+	seed  int64
+
+	mu        sync.Mutex
+	dials     map[[2]string]int // number of dials, map[{from,to}]
+	listeners map[string]*listener
+	links     map[[2]string]Link // map[{from,to}]
+	link      Link               // default link
+	groups    map[string]int     // partition group of hosts
+	down      map[string]bool    // crashed hosts
+}
+
+// NewNetwork creates a network, whose random decisions
+// are derived from seed.
+//
+// Each direction of a connection has its own random stream, derived
+// from seed, the hosts and the number of connections dialed earlier
+// between them. So the random decisions do not depend on the order in
+// which goroutines write to different connections.
+func NewNetwork(clock *Clock, seed int64) *Network {
+	return &Network{
+		clock:     clock,
+		seed:      seed,
+		dials:     make(map[[2]string]int),
+		listeners: make(map[string]*listener),
+		links:     make(map[[2]string]Link),
+		groups:    make(map[string]int),
+		down:      make(map[string]bool),
+	}
+}
+
+// SetDefaultLink sets the link used between hosts, for which
+// no link is set using SetLink.
+func (n *Network) SetDefaultLink(l Link) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.link = l
+}
+
+// SetLink sets the link for data sent from host to another host.
+func (n *Network) SetLink(from, to string, l Link) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.links[[2]string{from, to}] = l
+}
+
+// Partition splits the network into given groups of hosts. Hosts in
+// different groups cannot communicate. Hosts not listed in any group,
+// form a separate group.
+func (n *Network) Partition(groups ...[]string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.groups = make(map[string]int)
+	for i, g := range groups {
+		for _, host := range g {
+			n.groups[host] = i + 1
+		}
+	}
+}
+
+// Heal removes all partitions.
+func (n *Network) Heal() {
+	n.Partition()
+}
+
+// SetDown simulates a crashed host, if down is true. A crashed host
+// cannot communicate with any other host, but it can still accept
+// connections from itself.
+func (n *Network) SetDown(host string, down bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.down[host] = down
+}
+
+// reachable tells whether data can be sent from host to another.
+// must be called with n.mu held.
+func (n *Network) reachable(from, to string) bool {
+	if from == to {
+		return true
+	}
+	return !n.down[from] && !n.down[to] && n.groups[from] == n.groups[to]
+}
+
+// getLink must be called with n.mu held.
+func (n *Network) getLink(from, to string) Link {
+	if l, ok := n.links[[2]string{from, to}]; ok {
+		return l
+	}
+	return n.link
+}
+
+// Listen announces on the local network address.
+func (n *Network) Listen(address string) (net.Listener, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.listeners[address]; ok {
+		return nil, fmt.Errorf("sim: address %s already in use", address)
+	}
+	l := &listener{
+		n:      n,
+		addr:   addr(address),
+		connCh: make(chan net.Conn, 64),
+		closed: make(chan struct{}),
+	}
+	n.listeners[address] = l
+	return l, nil
+}
+
+// Dialer returns a function to be used as raft Options.Dial,
+// which connects from the given host.
+func (n *Network) Dialer(host string) func(network, address string, timeout time.Duration) (net.Conn, error) {
+	return func(network, address string, timeout time.Duration) (net.Conn, error) {
+		return n.dial(host, address)
+	}
+}
+
+func (n *Network) dial(from, address string) (net.Conn, error) {
+	opErr := func(err error) error {
+		return &net.OpError{Op: "dial", Net: "sim", Addr: addr(address), Err: err}
+	}
+	n.mu.Lock()
+	l, ok := n.listeners[address]
+	if !ok {
+		n.mu.Unlock()
+		return nil, opErr(errRefused)
+	}
+	to := hostOf(address)
+	if !n.reachable(from, to) {
+		n.mu.Unlock()
+		return nil, opErr(errUnreachable)
+	}
+	n.dials[[2]string{from, to}]++
+	dials := n.dials[[2]string{from, to}]
+	n.mu.Unlock()
+
+	p1, p2 := newPipe(), newPipe()
+	local := &conn{n: n, from: from, to: to, local: addr(from), remote: l.addr, rd: p1, wr: p2,
+		rand: n.connRand(from, to, dials)}
+	remote := &conn{n: n, from: to, to: from, local: l.addr, remote: addr(from), rd: p2, wr: p1,
+		rand: n.connRand(to, from, dials)}
+	select {
+	case <-l.closed:
+		return nil, opErr(errRefused)
+	case l.connCh <- remote:
+		return local, nil
+	default:
+		return nil, opErr(errRefused)
+	}
+}
+
+// connRand returns random stream for data sent from host to another,
+// on connection dialed after given number of dials between them.
+func (n *Network) connRand(from, to string, dials int) *rand.Rand {
+	h := fnv.New64a()
+	_, _ = fmt.Fprintf(h, "%d %s %s %d", n.seed, from, to, dials)
+	return rand.New(rand.NewSource(int64(h.Sum64())))
+}
+
+// listener -----------------------------------------------------------
+
+type listener struct {
+	n      *Network
+	addr   addr
+	connCh chan net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case <-l.closed:
+		return nil, &net.OpError{Op: "accept", Net: "sim", Addr: l.addr, Err: errClosed}
+	case c := <-l.connCh:
+		return c, nil
+	}
+}
+
+func (l *listener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+		l.n.mu.Lock()
+		delete(l.n.listeners, string(l.addr))
+		l.n.mu.Unlock()
+	})
+	return nil
+}
+
+func (l *listener) Addr() net.Addr {
+	return l.addr
+}
+
+// conn -----------------------------------------------------------
+
+type conn struct {
+	n             *Network
+	from, to      string
+	local, remote addr
+	rd, wr        *pipe
+
+	mu           sync.Mutex
+	rand         *rand.Rand
+	lastDelivery time.Time // data is delivered in order
+	blackHole    bool      // data is no longer delivered
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	return c.rd.read(c.n.clock, b)
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	if err := c.wr.writable(c.n.clock); err != nil {
+		return 0, err
+	}
+	n := c.n
+	n.mu.Lock()
+	reachable := n.reachable(c.from, c.to)
+	link := n.getLink(c.from, c.to)
+	n.mu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	lost := link.Loss > 0 && c.rand.Float64() < link.Loss
+	delay := link.Delay
+	if link.Jitter > 0 {
+		delay += time.Duration(c.rand.Int63n(int64(link.Jitter)))
+	}
+	if lost {
+		c.rd.reset(errReset)
+		c.wr.reset(errReset)
+		return len(b), nil
+	}
+	if c.blackHole || !reachable {
+		// with TCP, write succeeds, but data never reaches peer
+		c.blackHole = true
+		return len(b), nil
+	}
+	data := append([]byte(nil), b...)
+	c.schedule(delay, func() { c.wr.deliver(data) })
+	return len(b), nil
+}
+
+// schedule calls f after delay, but not before previously scheduled.
+// must be called with c.mu held.
+func (c *conn) schedule(delay time.Duration, f func()) {
+	now := c.n.clock.Now()
+	at := now.Add(delay)
+	if at.Before(c.lastDelivery) {
+		at = c.lastDelivery
+	}
+	c.lastDelivery = at
+	c.n.clock.afterFunc(at.Sub(now), f)
+}
+
+func (c *conn) Close() error {
+	c.rd.reset(errClosed)
+	c.wr.closeWrite()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.blackHole {
+		// peer sees EOF, after pending data is delivered
+		c.schedule(0, func() { c.wr.deliverEOF() })
+	}
+	return nil
+}
+
+func (c *conn) LocalAddr() net.Addr  { return c.local }
+func (c *conn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *conn) SetDeadline(t time.Time) error {
+	c.rd.setReadDeadline(t)
+	c.wr.setWriteDeadline(t)
+	return nil
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.rd.setReadDeadline(t)
+	return nil
+}
+
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	c.wr.setWriteDeadline(t)
+	return nil
+}
+
+// pipe -----------------------------------------------------------
+
+// pipe is one direction of conn. Reader waits for data delivered to buf.
+// deadline is set by reader, and wrDeadline is set by writer.
+type pipe struct {
+	mu         sync.Mutex
+	buf        bytes.Buffer
+	eof        bool  // writer closed, and all data delivered
+	wrClosed   bool  // writer closed
+	err        error // reader gets this error
+	deadline   time.Time
+	wrDeadline time.Time
+	notify     chan struct{}
+}
+
+func newPipe() *pipe {
+	return &pipe{notify: make(chan struct{}, 1)}
+}
+
+func (p *pipe) signal() {
+	select {
+	case p.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (p *pipe) read(clock *Clock, b []byte) (int, error) {
+	for {
+		p.mu.Lock()
+		switch {
+		case p.err != nil:
+			p.mu.Unlock()
+			return 0, p.err
+		case p.buf.Len() > 0:
+			n, _ := p.buf.Read(b)
+			p.mu.Unlock()
+			return n, nil
+		case p.eof:
+			p.mu.Unlock()
+			return 0, io.EOF
+		}
+		deadline := p.deadline
+		p.mu.Unlock()
+
+		if deadline.IsZero() {
+			<-p.notify
+			continue
+		}
+		d := deadline.Sub(clock.Now())
+		if d <= 0 {
+			return 0, timeoutError{}
+		}
+		t := clock.NewTimer(d)
+		select {
+		case <-p.notify:
+		case <-t.C():
+		}
+		t.Stop()
+	}
+}
+
+func (p *pipe) writable(clock *Clock) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case p.wrClosed:
+		return errClosed
+	case p.err == errReset:
+		return errReset
+	case !p.wrDeadline.IsZero() && !clock.Now().Before(p.wrDeadline):
+		return timeoutError{}
+	}
+	return nil
+}
+
+func (p *pipe) deliver(b []byte) {
+	p.mu.Lock()
+	if p.err == nil {
+		p.buf.Write(b)
+	}
+	p.mu.Unlock()
+	p.signal()
+}
+
+func (p *pipe) deliverEOF() {
+	p.mu.Lock()
+	p.eof = true
+	p.mu.Unlock()
+	p.signal()
+}
+
+func (p *pipe) closeWrite() {
+	p.mu.Lock()
+	p.wrClosed = true
+	p.mu.Unlock()
+}
+
+func (p *pipe) reset(err error) {
+	p.mu.Lock()
+	if p.err == nil {
+		p.err = err
+		p.buf.Reset()
+	}
+	p.mu.Unlock()
+	p.signal()
+}
+
+func (p *pipe) setReadDeadline(t time.Time) {
+	p.mu.Lock()
+	p.deadline = t
+	p.mu.Unlock()
+	p.signal()
+}
+
+func (p *pipe) setWriteDeadline(t time.Time) {
+	p.mu.Lock()
+	p.wrDeadline = t
+	p.mu.Unlock()
+}
+
+// addr -----------------------------------------------------------
+
+type addr string
+
+func (a addr) Network() string { return "sim" }
+func (a addr) String() string  { return string(a) }
+
+func hostOf(address string) string {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return address
+}
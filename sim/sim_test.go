@@ -0,0 +1,170 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sim
+
+import (
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestClock(t *testing.T) {
+	c := NewClock()
+	t1, t2 := c.NewTimer(20*time.Millisecond), c.NewTimer(10*time.Millisecond)
+	var fired []time.Duration
+	c.afterFunc(15*time.Millisecond, func() { fired = append(fired, c.Now().Sub(epoch)) })
+	c.Advance(12 * time.Millisecond)
+	select {
+	case <-t1.C():
+		t.Fatal("t1 fired early")
+	case now := <-t2.C():
+		if got := now.Sub(epoch); got != 10*time.Millisecond {
+			t.Fatalf("t2 fired at %v", got)
+		}
+	}
+	if t2.Stop() {
+		t.Fatal("t2.Stop must return false after firing")
+	}
+	if !t1.Reset(time.Millisecond) {
+		t.Fatal("t1.Reset must return true for active timer")
+	}
+	c.Advance(10 * time.Millisecond)
+	if now := <-t1.C(); now.Sub(epoch) != 13*time.Millisecond {
+		t.Fatalf("t1 fired at %v", now.Sub(epoch))
+	}
+	if want := []time.Duration{15 * time.Millisecond}; !reflect.DeepEqual(fired, want) {
+		t.Fatalf("fired=%v, want %v", fired, want)
+	}
+	if got := c.Now().Sub(epoch); got != 22*time.Millisecond {
+		t.Fatalf("now=%v", got)
+	}
+}
+
+func TestClock_Step(t *testing.T) {
+	c := NewClock()
+	var fired []string
+	c.afterFunc(10*time.Millisecond, func() { fired = append(fired, "a") })
+	c.afterFunc(5*time.Millisecond, func() { fired = append(fired, "b") })
+	c.afterFunc(10*time.Millisecond, func() { fired = append(fired, "c") })
+	for i := 0; c.Step(); i++ {
+		if len(fired) != i+1 {
+			t.Fatalf("step %d fired %v", i, fired)
+		}
+	}
+	if want := []string{"b", "a", "c"}; !reflect.DeepEqual(fired, want) {
+		t.Fatalf("fired=%v, want %v", fired, want)
+	}
+	if got := c.Now().Sub(epoch); got != 10*time.Millisecond {
+		t.Fatalf("now=%v", got)
+	}
+}
+
+func TestIdle(t *testing.T) {
+	caller := "goroutine 1 [running]:\nmain.main()\n"
+	tests := []struct {
+		g    string
+		idle bool
+	}{
+		{"goroutine 7 [chan receive, 2 minutes]:\nmain.worker()", true},
+		{"goroutine 7 [select]:\nmain.worker()", true},
+		{"goroutine 7 [sync.Mutex.Lock]:\nsync.runtime_SemacquireMutex()", true},
+		{"goroutine 7 [semacquire]:\nsync.runtime_Semacquire()", true},
+		{"goroutine 7 [semacquire]:\nmain.newTask(...)", false},
+		{"goroutine 7 [runnable]:\nmain.worker()", false},
+		{"goroutine 7 [syscall]:\nsyscall.Syscall()", false},
+		{"goroutine 7 [syscall]:\nos/signal.signal_recv()", true},
+		{"goroutine 7 [GC assist wait]:\nmain.worker()", false},
+	}
+	for _, test := range tests {
+		if got := idle([]byte(caller + "\n" + test.g + "\n")); got != test.idle {
+			t.Errorf("idle(%q)=%v, want %v", test.g, got, test.idle)
+		}
+	}
+	if !idle([]byte(caller)) {
+		t.Error("caller must be ignored")
+	}
+}
+
+func TestNetwork(t *testing.T) {
+	clock := NewClock()
+	n := NewNetwork(clock, 1)
+	n.SetDefaultLink(Link{Delay: 5 * time.Millisecond})
+	l, err := n.Listen("B:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if _, err := n.dial("A", "C:1"); err == nil {
+		t.Fatal("dial to unknown address must fail")
+	}
+	c1, err := n.dial("A", "B:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// delivered only after delay
+	if _, err = c1.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	_ = c2.SetReadDeadline(clock.Now().Add(3 * time.Millisecond))
+	go clock.Advance(3 * time.Millisecond)
+	if _, err = c2.Read(make([]byte, 5)); err == nil || !err.(timeoutError).Timeout() {
+		t.Fatalf("got %v, want timeout", err)
+	}
+	clock.Advance(2 * time.Millisecond)
+	_ = c2.SetReadDeadline(time.Time{})
+	b := make([]byte, 5)
+	if _, err = io.ReadFull(c2, b); err != nil || string(b) != "hello" {
+		t.Fatalf("read %q %v", b, err)
+	}
+
+	// partitioned, data never delivered
+	n.Partition([]string{"A"}, []string{"B"})
+	if _, err = c1.Write([]byte("lost")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = n.dial("A", "B:1"); err == nil {
+		t.Fatal("dial across partition must fail")
+	}
+	clock.Advance(10 * time.Millisecond)
+	_ = c2.SetReadDeadline(clock.Now())
+	if _, err = c2.Read(b); err == nil || !err.(timeoutError).Timeout() {
+		t.Fatalf("got %v, want timeout", err)
+	}
+
+	// after heal, new connection works, and peer sees EOF on close
+	n.Heal()
+	c1, err = n.dial("A", "B:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c2, err = l.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c1.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	_ = c1.Close()
+	clock.Advance(10 * time.Millisecond)
+	if b, err = ioutil.ReadAll(c2); err != nil || string(b) != "hello" {
+		t.Fatalf("read %q %v", b, err)
+	}
+}
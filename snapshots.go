@@ -15,6 +15,10 @@
 package raft
 
 import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/md5"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -23,13 +27,16 @@ import (
 	"strconv"
 	"strings"
 	"sync"
-)
 
-// todo: add md5 check
+	"github.com/santhosh-tekuri/raft/log"
+	"github.com/santhosh-tekuri/raft/vfs"
+)
 
 type snapshots struct {
+	fs     vfs.FS
 	dir    string
 	retain int
+	keys   KeyProvider
 
 	mu    sync.RWMutex
 	index uint64
@@ -40,16 +47,18 @@ type snapshots struct {
 }
 
 func openSnapshots(dir string, opt Options) (*snapshots, error) {
-	if err := os.MkdirAll(dir, 0700); err != nil {
+	if err := opt.FS.MkdirAll(dir, 0700); err != nil {
 		return nil, err
 	}
-	snaps, err := findSnapshots(dir)
+	snaps, err := findSnapshots(opt.FS, dir)
 	if err != nil {
 		return nil, err
 	}
 	s := &snapshots{
+		fs:     opt.FS,
 		dir:    dir,
 		retain: opt.SnapshotsRetain,
+		keys:   opt.Keys,
 		used:   make(map[uint64]int),
 	}
 	if len(snaps) > 0 {
@@ -73,17 +82,11 @@ func (s *snapshots) meta() (snapshotMeta, error) {
 	if s.index == 0 {
 		return snapshotMeta{index: 0, term: 0}, nil
 	}
-	f, err := os.Open(metaFile(s.dir, s.index))
-	if err != nil {
-		return snapshotMeta{}, err
-	}
-	defer f.Close()
-	meta := snapshotMeta{}
-	return meta, meta.decode(f)
+	return readMeta(s.fs, metaFile(s.dir, s.index))
 }
 
 func (s *snapshots) applyRetain() error {
-	snaps, err := findSnapshots(s.dir)
+	snaps, err := findSnapshots(s.fs, s.dir)
 	if err != nil {
 		return err
 	}
@@ -91,8 +94,8 @@ func (s *snapshots) applyRetain() error {
 	defer s.usedMu.RUnlock()
 	for i, index := range snaps {
 		if i >= s.retain && s.used[index] == 0 {
-			if e := os.Remove(metaFile(s.dir, index)); e == nil {
-				if e := os.Remove(snapFile(s.dir, index)); err == nil {
+			if e := s.fs.Remove(metaFile(s.dir, index)); e == nil {
+				if e := s.fs.Remove(snapFile(s.dir, index)); err == nil {
 					err = e
 				}
 			} else if err == nil {
@@ -105,113 +108,206 @@ func (s *snapshots) applyRetain() error {
 
 // snapshot ----------------------------------------------------
 
-func (s *snapshots) open() (*snapshot, error) {
+func (s *snapshots) open() (snap *snapshot, err error) {
+	// count the use along with reading latest index, so that
+	// applyRetain cannot remove its files while we are opening them
+	s.mu.RLock()
+	index := s.index
+	s.usedMu.Lock()
+	s.used[index]++
+	s.usedMu.Unlock()
 	meta, err := s.meta()
+	s.mu.RUnlock()
+	defer func() {
+		if err != nil {
+			s.release(index)
+		}
+	}()
 	if err != nil {
 		return nil, err
 	}
 	file := snapFile(s.dir, meta.index)
+	var aead cipher.AEAD
+	if meta.keyID != 0 {
+		if aead, err = log.AEAD(s.keys, meta.keyID); err != nil {
+			return nil, err
+		}
+	}
 
 	// validate file size
-	info, err := os.Stat(file)
+	info, err := s.fs.Stat(file)
 	if err != nil {
 		return nil, err
 	}
-	if info.Size() != meta.size {
-		return nil, fmt.Errorf("raft: size of %q is %d, want %d", file, info.Size(), meta.size)
+	size := meta.size
+	if aead != nil {
+		size = sealedSize(meta.size)
+	}
+	if info.Size() != size {
+		return nil, fmt.Errorf("raft: size of %q is %d, want %d", file, info.Size(), size)
 	}
 
-	f, err := os.Open(file)
+	f, err := s.fs.OpenFile(file, os.O_RDONLY, 0)
 	if err != nil {
 		return nil, err
 	}
-	s.used[meta.index]++
+	var r io.Reader = f
+	if aead != nil {
+		if r, err = newOpenReader(f, aead, meta.size); err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+	}
 	return &snapshot{
 		snaps: s,
 		meta:  meta,
 		file:  f,
+		r:     r,
 	}, nil
 }
 
 type snapshot struct {
 	snaps *snapshots
 	meta  snapshotMeta
-	file  *os.File
+	file  vfs.File
+	r     io.Reader // reads decrypted data from file
 }
 
 func (s *snapshot) release() {
 	_ = s.file.Close()
-	s.snaps.usedMu.Lock()
-	defer s.snaps.usedMu.Unlock()
-	if s.snaps.used[s.meta.index] == 1 {
-		delete(s.snaps.used, s.meta.index)
+	s.snaps.release(s.meta.index)
+}
+
+func (s *snapshots) release(index uint64) {
+	s.usedMu.Lock()
+	defer s.usedMu.Unlock()
+	if s.used[index] == 1 {
+		delete(s.used, index)
 	} else {
-		s.snaps.used[s.meta.index]--
+		s.used[index]--
 	}
 }
 
+// export writes snapshot in the format read by readSnapshotHeader
+// and readSnapshotData.
+func (s *snapshot) export(w io.Writer) error {
+	if err := writeSnapshotHeader(w, s.meta); err != nil {
+		return err
+	}
+	return writeSnapshotData(w, s.r, s.meta.size)
+}
+
 // snapshotSink ----------------------------------------------------
 
-func (s *snapshots) new(index, term uint64, config Config) (*snapshotSink, error) {
-	f, err := os.Create(snapFile(s.dir, index))
+func (s *snapshots) new(index, term uint64, config Config, sessions []byte) (*snapshotSink, error) {
+	var keyID uint32
+	var aead cipher.AEAD
+	if s.keys != nil {
+		var err error
+		if keyID, aead, err = log.CurrentAEAD(s.keys); err != nil {
+			return nil, err
+		}
+	}
+	f, err := s.fs.OpenFile(snapFile(s.dir, index), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return nil, err
 	}
-	return &snapshotSink{
+	sink := &snapshotSink{
 		snaps: s,
-		meta:  snapshotMeta{index: index, term: term, config: config},
+		meta:  snapshotMeta{index: index, term: term, config: config, sessions: sessions, keyID: keyID},
 		file:  f,
-	}, nil
+		w:     f,
+	}
+	if aead != nil {
+		if sink.sw, err = newSealWriter(f, aead); err != nil {
+			_ = f.Close()
+			_ = s.fs.Remove(f.Name())
+			return nil, err
+		}
+		sink.w = sink.sw
+	}
+	return sink, nil
 }
 
 type snapshotSink struct {
 	snaps *snapshots
 	meta  snapshotMeta
-	file  *os.File
+	file  vfs.File
+	w     io.Writer   // writes encrypted data to file
+	sw    *sealWriter // nil if not encrypted
 }
 
+// done commits the snapshot, if err is nil. The snapshot file and meta
+// file are synced before meta file is renamed, and the dir is synced
+// after rename. Otherwise crash might leave meta file pointing to torn
+// snapshot file.
 func (s *snapshotSink) done(err error) (snapshotMeta, error) {
+	fs := s.snaps.fs
 	if err != nil {
 		_ = s.file.Close()
-		_ = os.Remove(s.file.Name())
+		_ = fs.Remove(s.file.Name())
 		return s.meta, err
 	}
 	defer func() {
 		if err != nil {
-			_ = os.Remove(s.file.Name())
+			_ = fs.Remove(s.file.Name())
 		}
 	}()
-	if err = s.file.Close(); err != nil {
+	if s.sw != nil {
+		if err = s.sw.Close(); err != nil {
+			_ = s.file.Close()
+			return s.meta, err
+		}
+	}
+	if err = s.file.Sync(); err != nil {
+		_ = s.file.Close()
 		return s.meta, err
 	}
-	info, err := os.Stat(s.file.Name())
-	if err != nil {
+	if err = s.file.Close(); err != nil {
 		return s.meta, err
 	}
-	s.meta.size = info.Size()
+	if s.sw != nil {
+		s.meta.size = s.sw.n
+	} else {
+		info, err := fs.Stat(s.file.Name())
+		if err != nil {
+			return s.meta, err
+		}
+		s.meta.size = info.Size()
+	}
 
 	file := filepath.Join(s.snaps.dir, "meta.tmp")
-	temp, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	temp, err := fs.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return s.meta, err
 	}
 	defer func() {
 		if temp != nil {
 			_ = temp.Close()
-			_ = os.RemoveAll(temp.Name())
+			_ = fs.Remove(temp.Name())
 		}
 	}()
 	if err = s.meta.encode(temp); err != nil {
 		return s.meta, err
 	}
+	if err = writeUint32(temp, s.meta.keyID); err != nil {
+		return s.meta, err
+	}
+	if err = temp.Sync(); err != nil {
+		return s.meta, err
+	}
 	if err = temp.Close(); err != nil {
 		return s.meta, err
 	}
 	file = metaFile(s.snaps.dir, s.meta.index)
-	if err = os.Rename(temp.Name(), file); err != nil {
+	if err = fs.Rename(temp.Name(), file); err != nil {
 		return s.meta, err
 	}
 	temp = nil
+	if err = fs.SyncDir(s.snaps.dir); err != nil {
+		_ = fs.Remove(file)
+		return s.meta, err
+	}
 	s.snaps.mu.Lock()
 	s.snaps.index, s.snaps.term = s.meta.index, s.meta.term
 	s.snaps.mu.Unlock()
@@ -222,10 +318,12 @@ func (s *snapshotSink) done(err error) (snapshotMeta, error) {
 // snapshotMeta ----------------------------------------------------
 
 type snapshotMeta struct {
-	index  uint64
-	term   uint64
-	config Config
-	size   int64
+	index    uint64
+	term     uint64
+	config   Config
+	size     int64  // size of data, before encryption
+	sessions []byte // encoded client sessions
+	keyID    uint32 // id of encryption key, 0 if not encrypted
 }
 
 func (m *snapshotMeta) encode(w io.Writer) error {
@@ -238,7 +336,10 @@ func (m *snapshotMeta) encode(w io.Writer) error {
 	if err := m.config.encode().encode(w); err != nil {
 		return err
 	}
-	return writeUint64(w, uint64(m.size))
+	if err := writeUint64(w, uint64(m.size)); err != nil {
+		return err
+	}
+	return writeBytes(w, m.sessions)
 }
 
 func (m *snapshotMeta) decode(r io.Reader) (err error) {
@@ -260,7 +361,90 @@ func (m *snapshotMeta) decode(r io.Reader) (err error) {
 		return err
 	}
 	m.size = int64(size)
-	return nil
+	m.sessions, err = readBytes(r)
+	if err == io.EOF {
+		err = nil // meta written before sessions were introduced
+	}
+	return err
+}
+
+// readMeta reads meta file. The keyID is stored only in meta file,
+// after the fields that are exchanged with other nodes.
+func readMeta(fs vfs.FS, file string) (snapshotMeta, error) {
+	meta := snapshotMeta{}
+	f, err := fs.OpenFile(file, os.O_RDONLY, 0)
+	if err != nil {
+		return meta, err
+	}
+	defer f.Close()
+	if err = meta.decode(f); err != nil {
+		return meta, err
+	}
+	meta.keyID, err = readUint32(f)
+	if err == io.EOF {
+		err = nil // meta written before encryption was introduced
+	}
+	return meta, err
+}
+
+// exported snapshot ----------------------------------------------------
+
+// snapshotMagic is the header of exported snapshot. It is followed
+// by snapshotMeta and snapshot data of size snapshotMeta.size
+const snapshotMagic = "raftsnap"
+
+func writeSnapshotHeader(w io.Writer, meta snapshotMeta) error {
+	if _, err := io.WriteString(w, snapshotMagic); err != nil {
+		return err
+	}
+	return meta.encode(w)
+}
+
+func readSnapshotHeader(r io.Reader) (snapshotMeta, error) {
+	meta := snapshotMeta{}
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return meta, err
+	}
+	if string(magic) != snapshotMagic {
+		return meta, errors.New("raft: not a snapshot file")
+	}
+	err := meta.decode(r)
+	return meta, err
+}
+
+// writeSnapshotData copies size bytes of snapshot data from r to w,
+// followed by their md5 checksum.
+func writeSnapshotData(w io.Writer, r io.Reader, size int64) error {
+	h := md5.New()
+	if _, err := io.CopyN(io.MultiWriter(w, h), r, size); err != nil {
+		return err
+	}
+	_, err := w.Write(h.Sum(nil))
+	return err
+}
+
+// readSnapshotData copies size bytes of snapshot data from r to w, and
+// verifies them against the md5 checksum that follows. Returns the checksum.
+func readSnapshotData(r io.Reader, w io.Writer, size int64) ([]byte, error) {
+	h := md5.New()
+	if _, err := io.CopyN(io.MultiWriter(w, h), r, size); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	sum := make([]byte, md5.Size)
+	if _, err := io.ReadFull(r, sum); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if !bytes.Equal(sum, h.Sum(nil)) {
+		return nil, errors.New("raft: snapshot checksum mismatch")
+	}
+	return sum, nil
 }
 
 // helpers ----------------------------------------------------
@@ -273,8 +457,8 @@ func snapFile(dir string, index uint64) string {
 }
 
 // findSnapshots returns list of snapshots from latest to oldest
-func findSnapshots(dir string) ([]uint64, error) {
-	matches, err := filepath.Glob(filepath.Join(dir, "*.meta"))
+func findSnapshots(fs vfs.FS, dir string) ([]uint64, error) {
+	matches, err := fs.Glob(filepath.Join(dir, "*.meta"))
 	if err != nil {
 		return nil, err
 	}
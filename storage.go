@@ -18,10 +18,11 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
-	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/santhosh-tekuri/raft/log"
+	"github.com/santhosh-tekuri/raft/vfs"
 )
 
 // SetIdentity stores the identity in storageDir.
@@ -31,27 +32,39 @@ import (
 //
 // If the storageDir is already in use, returns ErrLockExists.
 // If the stored identity does not match given identity, returns ErrIdentityAlreadySet.
-func SetIdentity(storageDir string, cid, nid uint64) (err error) {
+func SetIdentity(storageDir string, cid, nid uint64) error {
+	return setIdentity(vfs.OS, storageDir, cid, nid)
+}
+
+// SetIdentityFS is same as SetIdentity, but storageDir is in
+// given filesystem, which should be same as Options.FS.
+func SetIdentityFS(fs vfs.FS, storageDir string, cid, nid uint64) error {
+	return setIdentity(fs, storageDir, cid, nid)
+}
+
+func setIdentity(fs vfs.FS, storageDir string, cid, nid uint64) (err error) {
 	if cid == 0 {
 		return errors.New("raft: cid is zero")
 	}
 	if nid == 0 {
 		return errors.New("raft: nid is zero")
 	}
-	d, err := os.Stat(storageDir)
+	d, err := fs.Stat(storageDir)
 	if err != nil {
 		return err
 	}
 	if !d.IsDir() {
 		return fmt.Errorf("raft: %q is not a diretory", storageDir)
 	}
-	if err := lockDir(storageDir); err != nil {
+	if err := lockDir(fs, storageDir); err != nil {
 		return err
 	}
 	defer func() {
-		err = unlockDir(storageDir)
+		if e := unlockDir(fs, storageDir); err == nil {
+			err = e
+		}
 	}()
-	val, err := openValue(storageDir, ".id")
+	val, err := openValue(fs, storageDir, ".id")
 	if err != nil {
 		return err
 	}
@@ -65,6 +78,9 @@ func SetIdentity(storageDir string, cid, nid uint64) (err error) {
 }
 
 type storage struct {
+	fs  vfs.FS
+	dir string
+
 	idVal *value
 	cid   uint64
 	nid   uint64
@@ -76,13 +92,22 @@ type storage struct {
 	log          *log.Log
 	lastLogIndex uint64
 	lastLogTerm  uint64
+	appended     int64 // bytes appended to log, since open
 
 	snaps   *snapshots
 	configs Configs
+
+	// recent measurement of free space, see Raft.freeBytes
+	free         int64
+	freeAt       time.Time
+	freeAppended int64 // appended, when free was measured
 }
 
 func openStorage(dir string, opt Options) (*storage, error) {
-	s, err := &storage{}, error(nil)
+	if opt.FS == nil {
+		opt.FS = vfs.OS
+	}
+	s, err := &storage{fs: opt.FS, dir: dir}, error(nil)
 	defer func() {
 		if err != nil {
 			if s.log != nil {
@@ -92,13 +117,20 @@ func openStorage(dir string, opt Options) (*storage, error) {
 	}()
 
 	// open identity value ----------------
-	if s.idVal, err = openValue(dir, ".id"); err != nil {
+	if s.idVal, err = openValue(opt.FS, dir, ".id"); err != nil {
 		return nil, err
 	}
 	s.cid, s.nid = s.idVal.get()
 
+	// check free space can be measured ----------------
+	if opt.SnapshotFreeBytes > 0 || opt.MinFreeBytes > 0 {
+		if _, err = opt.FS.Free(dir); err != nil {
+			return nil, err
+		}
+	}
+
 	// open term value ----------------
-	if s.termVal, err = openValue(dir, ".term"); err != nil {
+	if s.termVal, err = openValue(opt.FS, dir, ".term"); err != nil {
 		return nil, err
 	}
 	s.term, s.votedFor = s.termVal.get()
@@ -117,6 +149,8 @@ func openStorage(dir string, opt Options) (*storage, error) {
 	logOpt := log.Options{
 		FileMode:    0600,
 		SegmentSize: opt.LogSegmentSize,
+		FS:          opt.FS,
+		Keys:        opt.Keys,
 	}
 	if s.log, err = log.Open(filepath.Join(dir, "log"), 0700, logOpt); err != nil {
 		return nil, err
@@ -193,6 +227,42 @@ func (s *storage) setVotedFor(term, candidate uint64) {
 	}
 }
 
+// freeInterval is the maximum interval between measurements of
+// free space in storage.
+const freeInterval = time.Second
+
+// freeBytes returns free space in the filesystem containing storage.
+// Measuring it is costly, so it is measured again only after freeInterval,
+// after snapshot or log compaction, or after appending an eighth of the
+// larger of snapFreeBytes and minFreeBytes to log. In between, the bytes
+// appended since recent measurement are deducted from it. If measurement
+// fails, the error is logged and recent measurement is used.
+func (r *Raft) freeBytes() int64 {
+	step := r.snapFreeBytes
+	if r.minFreeBytes > step {
+		step = r.minFreeBytes
+	}
+	step /= 8
+	now := r.clock.Now()
+	if r.freeAt.IsZero() || now.Sub(r.freeAt) >= freeInterval || r.appended-r.freeAppended >= step {
+		if free, err := r.fs.Free(r.dir); err != nil {
+			r.logger.Warn("measuring free space failed", "err", trimPrefix(err))
+		} else {
+			r.free = free
+		}
+		r.freeAt, r.freeAppended = now, r.appended
+	}
+	return r.free - (r.appended - r.freeAppended)
+}
+
+// logBytes returns the size of log entries after snapshot.
+func (s *storage) logBytes() int64 {
+	if s.lastLogIndex <= s.snaps.index {
+		return 0
+	}
+	return s.log.DataSize(s.lastLogIndex) - s.log.DataSize(s.snaps.index)
+}
+
 // NOTE: this should not be called with snapIndex
 func (s *storage) getEntryTerm(index uint64) (uint64, error) {
 	e := &entry{}
@@ -234,6 +304,7 @@ func (s *storage) appendEntry(e *entry) {
 	if err := s.log.Append(w.Bytes()); err != nil {
 		panic(opError(err, "Log.Append"))
 	}
+	s.appended += int64(w.Len())
 	s.lastLogIndex, s.lastLogTerm = e.index, e.term
 }
 
@@ -256,12 +327,24 @@ func (r *Raft) compactLog(lte uint64) error {
 	if trace {
 		println(r, "compactLog", lte)
 	}
+	// stopped relays might still be reading the entries. rather than
+	// waiting for them, compact later. see follower.checkRelays
+	if r.flr.stoppedRunning() {
+		if trace {
+			println(r, "compactLog deferred")
+		}
+		if lte > r.flr.deferredLTE {
+			r.flr.deferredLTE = lte
+		}
+		return nil
+	}
 	if err := r.storage.removeLTE(lte); err != nil {
-		r.logger.Warn(trimPrefix(err))
+		r.logger.Error("log compaction failed", "err", trimPrefix(err))
 		r.alerts.Error(err)
 		return err
 	}
-	r.logger.Info("log upto index ", r.log.PrevIndex(), "is discarded")
+	r.freeAt = time.Time{} // compaction freed space, measure again
+	r.logger.Debug("log compacted", "prevIndex", r.log.PrevIndex())
 	if tracer.logCompacted != nil {
 		tracer.logCompacted(r)
 	}
@@ -15,8 +15,10 @@
 package raft
 
 import (
+	"context"
 	"errors"
 	"io"
+	"sync/atomic"
 	"time"
 )
 
@@ -94,13 +96,48 @@ type newEntry struct {
 	cmd interface{}
 	*task
 	*entry
-	next *newEntry
+	next     *newEntry
+	state    int32 // one of neQueued, neAccepted, neDropped
+	acquired int32 // 1, if it holds pending quota
+	quota    *quota
 }
 
+const (
+	neQueued   int32 = iota // not yet seen by raft
+	neAccepted              // raft took ownership
+	neDropped               // dropped by Raft.Execute, on context done
+)
+
 func (ne *newEntry) newEntry() *newEntry {
 	return ne
 }
 
+// accept is called by raft before processing ne.
+// returns false, if ne is already dropped.
+func (ne *newEntry) accept() bool {
+	return atomic.CompareAndSwapInt32(&ne.state, neQueued, neAccepted)
+}
+
+// drop returns false, if raft has already accepted ne.
+func (ne *newEntry) drop() bool {
+	return atomic.CompareAndSwapInt32(&ne.state, neQueued, neDropped)
+}
+
+// reply completes the task, and releases its pending quota.
+func (ne *newEntry) reply(result interface{}) {
+	ne.task.reply(result)
+	ne.release()
+}
+
+// release releases pending quota, if held. raft must call this
+// for dropped entries, because they might have acquired quota
+// after they were dropped.
+func (ne *newEntry) release() {
+	if atomic.CompareAndSwapInt32(&ne.acquired, 1, 0) {
+		ne.quota.release(int64(len(ne.data)))
+	}
+}
+
 // FSMTasks returns a channel to which FSMTasks
 // has to be submitted. Should be used as below:
 // 	 select {
@@ -111,38 +148,196 @@ func (r *Raft) FSMTasks() chan<- FSMTask {
 	return r.fsmTaskCh
 }
 
+// Execute submits t to raft, and waits for its completion. If t is
+// FSMTask, it is submitted to FSMTasks(), otherwise to Tasks().
+//
+// If ctx is done before t is completed, it returns ContextError.
+// FSMTask that is not yet appended to log is dropped, and
+// ContextError.Unknown is false in that case.
+func (r *Raft) Execute(ctx context.Context, t Task) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, ContextError{Err: err}
+	}
+	fsmTask, isFSMTask := t.(FSMTask)
+	if isFSMTask {
+		select {
+		case <-ctx.Done():
+			return nil, ContextError{Err: ctx.Err()}
+		case <-r.Closed():
+			return nil, ErrServerClosed
+		case r.FSMTasks() <- fsmTask:
+		}
+	} else {
+		select {
+		case <-ctx.Done():
+			return nil, ContextError{Err: ctx.Err()}
+		case <-r.Closed():
+			return nil, ErrServerClosed
+		case r.Tasks() <- t:
+		}
+	}
+	select {
+	case <-t.Done():
+		return t.Result(), t.Err()
+	case <-ctx.Done():
+	}
+	if isFSMTask && fsmTask.newEntry().drop() {
+		err := ContextError{Err: ctx.Err()}
+		t.reply(err)
+		return nil, err
+	}
+	select {
+	case <-t.Done():
+		return t.Result(), t.Err()
+	default:
+		return nil, ContextError{Err: ctx.Err(), Unknown: true}
+	}
+}
+
 func (r *Raft) runBatch() {
-	var neHead, neTail *newEntry
-	var newEntryCh chan *newEntry
-	i := 0
+	var batches []*batch // only last batch can accept more entries
+	linger := newSafeTimer(r.clock)
 	for {
+		// hand over first batch, if it is full or lingered enough
+		var newEntryCh chan *newEntry
+		var head *newEntry
+		if len(batches) > 0 && (len(batches) > 1 || r.isBatchFull(batches[0]) || !linger.active) {
+			newEntryCh, head = r.newEntryCh, batches[0].head
+		}
+		fsmTaskCh := r.fsmTaskCh
+		if !r.quota.failFast && r.quota.exceeds(1) {
+			fsmTaskCh = nil // block submitters, until quota is released
+		}
 		select {
 		case <-r.close:
-			if neHead != nil {
-				r.newEntryCh <- neHead
+			linger.stop()
+			for _, b := range batches {
+				r.newEntryCh <- b.head
 			}
 			close(r.newEntryCh)
 			return
-		case t := <-r.fsmTaskCh:
-			i++
+		case <-r.quota.released:
+		case <-linger.C:
+			linger.active = false
+		case t := <-fsmTaskCh:
 			ne := t.newEntry()
-			if neTail != nil {
-				neTail.next, neTail = ne, ne
-			} else {
-				neHead, neTail = ne, ne
-				newEntryCh = r.newEntryCh
+			size := int64(len(ne.data))
+			if r.quota.failFast && r.quota.exceeds(size) {
+				if ne.accept() { // Execute might have dropped it
+					ne.reply(ErrBusy)
+				}
+				continue
 			}
-		case newEntryCh <- neHead:
+			r.quota.acquire(ne)
+			if len(batches) == 0 || !r.canAddToBatch(batches[len(batches)-1], size) {
+				batches = append(batches, &batch{start: r.clock.Now()})
+				if len(batches) == 1 && r.batchLinger > 0 {
+					linger.reset(r.batchLinger)
+				}
+			}
+			batches[len(batches)-1].add(ne)
+		case newEntryCh <- head:
 			if trace {
-				println(r, "got batch of", i, "entries")
+				println(r, "got batch of", batches[0].entries, "entries")
+			}
+			batches[0] = nil
+			batches = batches[1:]
+			linger.stop()
+			if len(batches) > 0 && r.batchLinger > 0 {
+				if d := r.batchLinger - r.clock.Now().Sub(batches[0].start); d > 0 {
+					linger.reset(d)
+				}
 			}
-			i = 0
-			neHead, neTail = nil, nil
-			newEntryCh = nil
 		}
 	}
 }
 
+// batch is a list of newEntries, that are handed over
+// to raft together.
+type batch struct {
+	head, tail *newEntry
+	entries    int
+	bytes      int64
+	start      time.Time // when the batch is created
+}
+
+func (b *batch) add(ne *newEntry) {
+	if b.tail != nil {
+		b.tail.next, b.tail = ne, ne
+	} else {
+		b.head, b.tail = ne, ne
+	}
+	b.entries++
+	b.bytes += int64(len(ne.data))
+}
+
+func (r *Raft) isBatchFull(b *batch) bool {
+	if r.maxBatchEntries > 0 && b.entries >= r.maxBatchEntries {
+		return true
+	}
+	return r.maxBatchBytes > 0 && b.bytes >= r.maxBatchBytes
+}
+
+// canAddToBatch tells whether entry of given size can be added to b.
+// An entry larger than maxBatchBytes, is added to empty batch.
+func (r *Raft) canAddToBatch(b *batch, size int64) bool {
+	if r.isBatchFull(b) {
+		return false
+	}
+	return r.maxBatchBytes == 0 || b.entries == 0 || b.bytes+size <= r.maxBatchBytes
+}
+
+// quota tracks FSMTasks that are submitted, but not yet completed.
+type quota struct {
+	// accessed atomically, kept first for 64-bit alignment
+	entries int64
+	bytes   int64
+
+	maxEntries int64
+	maxBytes   int64
+	failFast   bool
+	released   chan struct{} // signaled when quota is released
+}
+
+func newQuota(opt Options) *quota {
+	return &quota{
+		maxEntries: int64(opt.MaxPendingEntries),
+		maxBytes:   opt.MaxPendingBytes,
+		failFast:   opt.FailWhenBusy,
+		released:   make(chan struct{}, 1),
+	}
+}
+
+// exceeds tells whether admitting an entry of given size exceeds limits.
+// It never exceeds if nothing is pending, so that an entry larger than
+// maxBytes can still be submitted.
+func (q *quota) exceeds(size int64) bool {
+	entries := atomic.LoadInt64(&q.entries)
+	if entries == 0 {
+		return false
+	}
+	if q.maxEntries > 0 && entries+1 > q.maxEntries {
+		return true
+	}
+	return q.maxBytes > 0 && atomic.LoadInt64(&q.bytes)+size > q.maxBytes
+}
+
+func (q *quota) acquire(ne *newEntry) {
+	atomic.AddInt64(&q.entries, 1)
+	atomic.AddInt64(&q.bytes, int64(len(ne.data)))
+	ne.quota = q
+	atomic.StoreInt32(&ne.acquired, 1)
+}
+
+func (q *quota) release(size int64) {
+	atomic.AddInt64(&q.entries, -1)
+	atomic.AddInt64(&q.bytes, -size)
+	select {
+	case q.released <- struct{}{}:
+	default:
+	}
+}
+
 func fsmTask(typ entryType, cmd interface{}, data []byte) FSMTask {
 	return &newEntry{
 		task:  newTask(),
@@ -191,7 +386,9 @@ func GetInfo() Task {
 
 func (r *Raft) info() Info {
 	var flrs map[uint64]Replication
+	commitReady := false
 	if r.state == Leader {
+		commitReady = r.commitIndex >= r.ldr.startIndex
 		flrs = make(map[uint64]Replication)
 		for id, repl := range r.ldr.repls {
 			errMessage := ""
@@ -217,20 +414,23 @@ func (r *Raft) info() Info {
 		}
 	}
 	return Info{
-		CID:           r.cid,
-		NID:           r.nid,
-		Addr:          r.addr(),
-		Term:          r.term,
-		State:         r.state,
-		Leader:        r.leader,
-		SnapshotIndex: r.snaps.index,
-		FirstLogIndex: r.log.PrevIndex() + 1,
-		LastLogIndex:  r.lastLogIndex,
-		LastLogTerm:   r.lastLogTerm,
-		Committed:     r.commitIndex,
-		LastApplied:   r.lastApplied(),
-		Configs:       r.configs.clone(),
-		Followers:     flrs,
+		CID:            r.cid,
+		NID:            r.nid,
+		Addr:           r.addr(),
+		Term:           r.term,
+		State:          r.state,
+		Leader:         r.leader,
+		SnapshotIndex:  r.snaps.index,
+		FirstLogIndex:  r.log.PrevIndex() + 1,
+		LastLogIndex:   r.lastLogIndex,
+		LastLogTerm:    r.lastLogTerm,
+		Committed:      r.commitIndex,
+		CommitReady:    commitReady,
+		LastApplied:    r.lastApplied(),
+		PendingEntries: uint64(atomic.LoadInt64(&r.quota.entries)),
+		PendingBytes:   uint64(atomic.LoadInt64(&r.quota.bytes)),
+		Configs:        r.configs.clone(),
+		Followers:      flrs,
 	}
 }
 
@@ -292,20 +492,23 @@ func (repl *Replication) encode(w io.Writer) error {
 
 // Info captures state of a node.
 type Info struct {
-	CID           uint64                 `json:"cid"`
-	NID           uint64                 `json:"nid"`
-	Addr          string                 `json:"addr"`
-	Term          uint64                 `json:"term"`
-	State         State                  `json:"state"`
-	Leader        uint64                 `json:"leader,omitempty"`
-	SnapshotIndex uint64                 `json:"snapshotIndex"`
-	FirstLogIndex uint64                 `json:"firstLogIndex"`
-	LastLogIndex  uint64                 `json:"lastLogIndex"`
-	LastLogTerm   uint64                 `json:"lastLogTerm"`
-	Committed     uint64                 `json:"committed"`
-	LastApplied   uint64                 `json:"lastApplied"`
-	Configs       Configs                `json:"configs"`
-	Followers     map[uint64]Replication `json:"followers,omitempty"`
+	CID            uint64                 `json:"cid"`
+	NID            uint64                 `json:"nid"`
+	Addr           string                 `json:"addr"`
+	Term           uint64                 `json:"term"`
+	State          State                  `json:"state"`
+	Leader         uint64                 `json:"leader,omitempty"`
+	SnapshotIndex  uint64                 `json:"snapshotIndex"`
+	FirstLogIndex  uint64                 `json:"firstLogIndex"`
+	LastLogIndex   uint64                 `json:"lastLogIndex"`
+	LastLogTerm    uint64                 `json:"lastLogTerm"`
+	Committed      uint64                 `json:"committed"`
+	CommitReady    bool                   `json:"commitReady,omitempty"`
+	LastApplied    uint64                 `json:"lastApplied"`
+	PendingEntries uint64                 `json:"pendingEntries"`
+	PendingBytes   uint64                 `json:"pendingBytes"`
+	Configs        Configs                `json:"configs"`
+	Followers      map[uint64]Replication `json:"followers,omitempty"`
 }
 
 func (info *Info) decode(r io.Reader) error {
@@ -376,7 +579,19 @@ func (info *Info) decode(r io.Reader) error {
 			info.Followers[repl.ID] = repl
 		}
 	}
-	return nil
+	// fields added later are appended below. older
+	// servers do not send them, so EOF means absent
+	if info.CommitReady, err = readBool(r); err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	if info.PendingEntries, err = readUint64(r); err != nil {
+		return err
+	}
+	info.PendingBytes, err = readUint64(r)
+	return err
 }
 
 func (info Info) encode(w io.Writer) error {
@@ -431,7 +646,15 @@ func (info Info) encode(w io.Writer) error {
 			return err
 		}
 	}
-	return nil
+	// fields added later are appended below, so that
+	// older decoders read the preceding fields unchanged
+	if err := writeBool(w, info.CommitReady); err != nil {
+		return err
+	}
+	if err := writeUint64(w, info.PendingEntries); err != nil {
+		return err
+	}
+	return writeUint64(w, info.PendingBytes)
 }
 
 // ------------------------------------------------------------------------
@@ -73,24 +73,6 @@ func println(args ...interface{}) {
 
 // Stringers ----------------------------------------------------------
 
-func (t entryType) String() string {
-	switch t {
-	case entryBarrier:
-		return "barrier"
-	case entryUpdate:
-		return "update"
-	case entryRead:
-		return "read"
-	case entryDirtyRead:
-		return "dirtyRead"
-	case entryNop:
-		return "nop"
-	case entryConfig:
-		return "config"
-	}
-	return fmt.Sprintf("entryType(%d)", uint8(t))
-}
-
 func (r rpcResult) String() string {
 	switch r {
 	case success:
@@ -113,6 +95,10 @@ func (r rpcResult) String() string {
 		return "readErr"
 	case unexpectedErr:
 		return "unexpectedErr"
+	case staleSnapshot:
+		return "staleSnapshot"
+	case cannotRelay:
+		return "cannotRelay"
 	}
 	return fmt.Sprintf("rpcResult(%d)", r)
 }
@@ -169,6 +155,22 @@ func (resp *timeoutNowResp) String() string {
 	return fmt.Sprintf("timeoutNowResp{%v}", resp.resp)
 }
 
+func (req *sendSnapReq) String() string {
+	return fmt.Sprintf("sendSnapReq{T%d M%d target:M%d min:%d}", req.term, req.src, req.target, req.minIndex)
+}
+
+func (resp *sendSnapResp) String() string {
+	return fmt.Sprintf("sendSnapResp{%v last:%d, size:%d}", resp.resp, resp.lastIndex, resp.size)
+}
+
+func (req *relayReq) String() string {
+	return fmt.Sprintf("relayReq{T%d M%d target:M%d}", req.term, req.src, req.target)
+}
+
+func (resp *relayResp) String() string {
+	return fmt.Sprintf("relayResp{%v match:%d, unreachable:%v}", resp.resp, resp.matchIndex, resp.unreachable)
+}
+
 func (n Node) String() string {
 	return fmt.Sprintf("M%d", n.ID)
 }
@@ -290,6 +292,10 @@ func (t rpcType) String() string {
 		return "installSnap"
 	case rpcTimeoutNow:
 		return "timeoutNow"
+	case rpcSendSnap:
+		return "sendSnap"
+	case rpcRelay:
+		return "relay"
 	}
 	return fmt.Sprintf("rpcType(%d)", int(t))
 }
@@ -84,7 +84,7 @@ func (l *leader) onTransfer(t transferLdr) {
 		t.timeout = 2 * l.hbTimeout
 	}
 	l.transfer.timer.reset(t.timeout)
-	l.transfer.deadline = time.Now().Add(t.timeout)
+	l.transfer.deadline = l.clock.Now().Add(t.timeout)
 	l.tryTransfer()
 }
 
@@ -164,7 +164,7 @@ func (l *leader) onTimeoutNowResult(rpc rpcResponse) {
 	if rpc.err != nil {
 		repl := l.repls[rpc.from]
 		if repl.status.noContact.IsZero() {
-			repl.status.noContact = time.Now()
+			repl.status.noContact = l.clock.Now()
 			repl.status.err = rpc.err
 		}
 		if l.transfer.target == 0 {
@@ -17,17 +17,14 @@ package raft
 import (
 	crand "crypto/rand"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"math"
 	"math/big"
 	"math/rand"
 	"net"
-	"os"
-	"path/filepath"
-	"runtime"
 	"strings"
 	"time"
+
+	"github.com/santhosh-tekuri/raft/vfs"
 )
 
 func min(a, b uint64) uint64 {
@@ -54,22 +51,6 @@ func isClosed(ch <-chan struct{}) bool {
 	}
 }
 
-func syncDir(dir string) error {
-	if runtime.GOOS == "windows" {
-		return nil
-	}
-	d, err := os.Open(dir)
-	if err != nil {
-		return err
-	}
-	err = d.Sync()
-	e := d.Close()
-	if err != nil {
-		return err
-	}
-	return e
-}
-
 func size(buffs net.Buffers) int64 {
 	var size int64
 	for _, buff := range buffs {
@@ -81,7 +62,7 @@ func size(buffs net.Buffers) int64 {
 // safeTimer ------------------------------------------------------
 
 type safeTimer struct {
-	timer *time.Timer
+	timer Timer
 	C     <-chan time.Time
 
 	// active is true if timer is started, but not yet received from channel.
@@ -90,12 +71,12 @@ type safeTimer struct {
 }
 
 // newSafeTimer creates stopped timer
-func newSafeTimer() *safeTimer {
-	t := time.NewTimer(0)
+func newSafeTimer(clock Clock) *safeTimer {
+	t := clock.NewTimer(0)
 	if !t.Stop() {
-		<-t.C
+		<-t.C()
 	}
-	return &safeTimer{t, t.C, false}
+	return &safeTimer{t, t.C(), false}
 }
 
 func (t *safeTimer) stop() {
@@ -140,17 +121,26 @@ func backOff(round uint64, max time.Duration) time.Duration {
 // randTime -----------------------------------------------------------------
 
 type randTime struct {
-	r *rand.Rand
+	r     *rand.Rand
+	clock Clock
+}
+
+// newRandTime creates randTime with given seed.
+// If seed is zero, random seed is used.
+func newRandTime(clock Clock, seed int64) randTime {
+	if seed == 0 {
+		if r, err := crand.Int(crand.Reader, big.NewInt(math.MaxInt64)); err != nil {
+			seed = time.Now().UnixNano()
+		} else {
+			seed = r.Int64()
+		}
+	}
+	return randTime{rand.New(rand.NewSource(seed)), clock}
 }
 
-func newRandTime() randTime {
-	var seed int64
-	if r, err := crand.Int(crand.Reader, big.NewInt(math.MaxInt64)); err != nil {
-		seed = time.Now().UnixNano()
-	} else {
-		seed = r.Int64()
-	}
-	return randTime{rand.New(rand.NewSource(seed))}
+// fork creates new randTime, whose seed is derived from rt.
+func (rt randTime) fork() randTime {
+	return newRandTime(rt.clock, rt.r.Int63()|1)
 }
 
 func (rt randTime) duration(min time.Duration) time.Duration {
@@ -158,54 +148,26 @@ func (rt randTime) duration(min time.Duration) time.Duration {
 }
 
 func (rt randTime) deadline(min time.Duration) time.Time {
-	return time.Now().Add(rt.duration(min))
+	return rt.clock.Now().Add(rt.duration(min))
 }
 
 func (rt randTime) after(min time.Duration) <-chan time.Time {
-	return time.After(rt.duration(min))
+	return rt.clock.NewTimer(rt.duration(min)).C()
 }
 
 // -------------------------------------------------------------------------
 
-func lockDir(dir string) error {
-	dir, err := filepath.Abs(dir)
-	if err != nil {
-		return fmt.Errorf("raft.lockDir: %v", err)
-	}
-	tempFile, err := ioutil.TempFile(dir, "lock*.tmp")
-	if err != nil {
-		return fmt.Errorf("raft.lockDir: %v", err)
-	}
-	defer func() {
-		_ = tempFile.Close()
-		_ = os.Remove(tempFile.Name())
-	}()
-	if _, err := io.WriteString(tempFile, fmt.Sprintf("%d\n", os.Getpid())); err != nil {
-		return fmt.Errorf("raft.lockDir: %v", err)
-	}
-	lockFile := filepath.Join(dir, "lock")
-	if err := os.Link(tempFile.Name(), lockFile); err != nil {
-		if os.IsExist(err) {
-			return ErrLockExists
-		}
-		return fmt.Errorf("raft.lockDir: %v", err)
-	}
-	tempInfo, err := os.Lstat(tempFile.Name())
-	if err != nil {
-		return fmt.Errorf("raft.lockDir: %v", err)
-	}
-	lockInfo, err := os.Lstat(lockFile)
-	if err != nil {
-		return fmt.Errorf("raft.lockDir: %v", err)
-	}
-	if !os.SameFile(tempInfo, lockInfo) {
+func lockDir(fs vfs.FS, dir string) error {
+	if err := fs.Lock(dir); err == vfs.ErrLocked {
 		return ErrLockExists
+	} else if err != nil {
+		return fmt.Errorf("raft.lockDir: %v", err)
 	}
 	return nil
 }
 
-func unlockDir(dir string) error {
-	return os.RemoveAll(filepath.Join(dir, "lock"))
+func unlockDir(fs vfs.FS, dir string) error {
+	return fs.Unlock(dir)
 }
 
 // -------------------------------------------------------------------------
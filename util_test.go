@@ -20,7 +20,7 @@ import (
 )
 
 func TestRandTime_duration(t *testing.T) {
-	rt1, rt2 := newRandTime(), newRandTime()
+	rt1, rt2 := newRandTime(systemClock{}, 0), newRandTime(systemClock{}, 0)
 	same := true
 	for i := 0; i < 10; i++ {
 		d1, d2 := rt1.duration(time.Second), rt2.duration(time.Second)
@@ -32,3 +32,16 @@ func TestRandTime_duration(t *testing.T) {
 		t.Fatal("got same values for 10 times")
 	}
 }
+
+func TestRandTime_seed(t *testing.T) {
+	rt1, rt2 := newRandTime(systemClock{}, 7), newRandTime(systemClock{}, 7)
+	f1, f2 := rt1.fork(), rt2.fork()
+	for i := 0; i < 10; i++ {
+		if d1, d2 := rt1.duration(time.Second), rt2.duration(time.Second); d1 != d2 {
+			t.Fatalf("got %v and %v for same seed", d1, d2)
+		}
+		if d1, d2 := f1.duration(time.Second), f2.duration(time.Second); d1 != d2 {
+			t.Fatalf("got %v and %v for forks of same seed", d1, d2)
+		}
+	}
+}
@@ -20,55 +20,111 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+
+	"github.com/santhosh-tekuri/raft/vfs"
 )
 
 type value struct {
+	fs  vfs.FS
 	dir string
 	ext string
 	v1  uint64
 	v2  uint64
 }
 
-func openValue(dir, ext string) (*value, error) {
-	matches, err := filepath.Glob(filepath.Join(dir, "*"+ext))
+func openValue(fs vfs.FS, dir, ext string) (*value, error) {
+	matches, err := fs.Glob(filepath.Join(dir, "*"+ext))
 	if err != nil {
 		return nil, err
 	}
 	if len(matches) == 0 {
-		f, err := os.OpenFile(valueFile(dir, ext, 0, 0), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+		f, err := fs.OpenFile(valueFile(dir, ext, 0, 0), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
 		if err != nil {
 			return nil, err
 		}
 		if err := f.Close(); err != nil {
 			return nil, err
 		}
-		if err := syncDir(dir); err != nil {
+		if err := fs.SyncDir(dir); err != nil {
 			return nil, err
 		}
 		matches = []string{f.Name()}
 	}
-	if len(matches) != 1 {
-		return nil, fmt.Errorf("raft: more than one file with ext %s in dir %s", ext, dir)
+	v, err := parseValue(fs, dir, ext, matches)
+	if err != nil {
+		return nil, err
 	}
-	s := strings.TrimSuffix(filepath.Base(matches[0]), ext)
-	i := strings.IndexByte(s, '-')
-	if i == -1 {
-		return nil, fmt.Errorf("raft: invalid value file %s", matches[0])
+	if err = v.removeStale(); err != nil {
+		return nil, err
 	}
-	v1, err := strconv.ParseInt(s[:i], 10, 64)
+	return v, nil
+}
+
+// readValue is same as openValue, but it never creates
+// value file. If value file does not exist, zero values
+// are returned.
+func readValue(fs vfs.FS, dir, ext string) (*value, error) {
+	matches, err := fs.Glob(filepath.Join(dir, "*"+ext))
 	if err != nil {
-		return nil, fmt.Errorf("raft: invalid value file %s", matches[0])
+		return nil, err
 	}
-	v2, err := strconv.ParseInt(s[i+1:], 10, 64)
-	if err != nil {
-		return nil, fmt.Errorf("raft: invalid value file %s", matches[0])
+	if len(matches) == 0 {
+		return &value{fs: fs, dir: dir, ext: ext}, nil
+	}
+	return parseValue(fs, dir, ext, matches)
+}
+
+// parseValue parses the value from matched files. If crash happened
+// during set, on filesystems where rename is not atomic, both old and
+// new files might exist. The values only grow, so larger one is picked.
+func parseValue(fs vfs.FS, dir, ext string, matches []string) (*value, error) {
+	if len(matches) > 2 {
+		return nil, fmt.Errorf("raft: more than two files with ext %s in dir %s", ext, dir)
+	}
+	var v *value
+	for _, m := range matches {
+		s := strings.TrimSuffix(filepath.Base(m), ext)
+		i := strings.IndexByte(s, '-')
+		if i == -1 {
+			return nil, fmt.Errorf("raft: invalid value file %s", m)
+		}
+		v1, err := strconv.ParseInt(s[:i], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("raft: invalid value file %s", m)
+		}
+		v2, err := strconv.ParseInt(s[i+1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("raft: invalid value file %s", m)
+		}
+		if v == nil || uint64(v1) > v.v1 || (uint64(v1) == v.v1 && uint64(v2) > v.v2) {
+			v = &value{
+				fs:  fs,
+				dir: dir,
+				ext: ext,
+				v1:  uint64(v1),
+				v2:  uint64(v2),
+			}
+		}
+	}
+	return v, nil
+}
+
+// removeStale removes the files other than current value, left
+// by crash during set.
+func (v *value) removeStale() error {
+	matches, err := v.fs.Glob(filepath.Join(v.dir, "*"+v.ext))
+	if err != nil || len(matches) == 1 {
+		return err
+	}
+	cur := valueFile(v.dir, v.ext, v.v1, v.v2)
+	for _, m := range matches {
+		if m != cur {
+			if err := v.fs.Remove(m); err != nil {
+				return err
+			}
+		}
 	}
-	return &value{
-		dir: dir,
-		ext: ext,
-		v1:  uint64(v1),
-		v2:  uint64(v2),
-	}, nil
+	return v.fs.SyncDir(v.dir)
 }
 
 func (v *value) get() (uint64, uint64) {
@@ -81,10 +137,10 @@ func (v *value) set(v1, v2 uint64) error {
 	}
 	curPath := valueFile(v.dir, v.ext, v.v1, v.v2)
 	newPath := valueFile(v.dir, v.ext, v1, v2)
-	if err := os.Rename(curPath, newPath); err != nil {
+	if err := v.fs.Rename(curPath, newPath); err != nil {
 		return err
 	}
-	if err := syncDir(v.dir); err != nil {
+	if err := v.fs.SyncDir(v.dir); err != nil {
 		return err
 	}
 	v.v1, v.v2 = v1, v2
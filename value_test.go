@@ -17,7 +17,10 @@ package raft
 import (
 	"fmt"
 	"io/ioutil"
+	"syscall"
 	"testing"
+
+	"github.com/santhosh-tekuri/raft/vfs"
 )
 
 // todo: test openValue errors
@@ -27,7 +30,7 @@ func TestValue(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	v, err := openValue(dir, ".val")
+	v, err := openValue(vfs.OS, dir, ".val")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -41,7 +44,7 @@ func TestValue(t *testing.T) {
 		if err = ensureValue(v, i*2, i*2+1); err != nil {
 			t.Fatal(err)
 		}
-		if v, err = openValue(dir, ".val"); err != nil {
+		if v, err = openValue(vfs.OS, dir, ".val"); err != nil {
 			t.Fatal(err)
 		}
 		if err = ensureValue(v, i*2, i*2+1); err != nil {
@@ -55,7 +58,7 @@ func BenchmarkValue_set(b *testing.B) {
 	if err != nil {
 		b.Fatal(err)
 	}
-	v, err := openValue(dir, ".val")
+	v, err := openValue(vfs.OS, dir, ".val")
 	if err != nil {
 		b.Fatal(err)
 	}
@@ -78,3 +81,47 @@ func ensureValue(v *value, w1, w2 uint64) error {
 	}
 	return nil
 }
+
+func TestValue_crash(t *testing.T) {
+	for seed := int64(1); seed <= 10; seed++ {
+		fs := vfs.NewMem(seed)
+		if err := fs.MkdirAll("/val", 0700); err != nil {
+			t.Fatal(err)
+		}
+		v, err := openValue(fs, "/val", ".val")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = v.set(1, 2); err != nil {
+			t.Fatal(err)
+		}
+
+		// crash before rename is synced
+		fs.SetFaults(vfs.Faults{SyncErr: syscall.EIO, NonAtomicRename: true})
+		if err = v.set(3, 0); err == nil {
+			t.Fatal("set must fail")
+		}
+		fs.Crash()
+		fs.SetFaults(vfs.Faults{})
+		matches, err := fs.Glob("/val/*.val")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, err = openValue(fs, "/val", ".val"); err != nil {
+			t.Fatalf("seed %d: %v", seed, err)
+		}
+		if len(matches) == 2 {
+			err = ensureValue(v, 3, 0)
+		} else if g1, _ := v.get(); g1 == 1 {
+			err = ensureValue(v, 1, 2)
+		} else {
+			err = ensureValue(v, 3, 0)
+		}
+		if err != nil {
+			t.Fatalf("seed %d: %v", seed, err)
+		}
+		if matches, _ = fs.Glob("/val/*.val"); len(matches) != 1 {
+			t.Fatalf("seed %d: stale value files: %v", seed, matches)
+		}
+	}
+}
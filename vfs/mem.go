@@ -0,0 +1,617 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// sectorSize is the unit of torn writes.
+const sectorSize = 512
+
+// Faults describes the faults injected by Mem.
+type Faults struct {
+	// SyncErr, if not nil, is returned by Sync of files and SyncDir.
+	// The data is not synced in that case.
+	SyncErr error
+
+	// Capacity is the maximum total size of files. Writes beyond
+	// capacity fail with ENOSPC. Zero means unlimited.
+	Capacity int64
+
+	// TornWrites makes Crash retain random sectors of data written
+	// since last sync, instead of losing all of it.
+	TornWrites bool
+
+	// NonAtomicRename makes Crash possibly retain both old and new
+	// names of a file, renamed since last SyncDir.
+	NonAtomicRename bool
+}
+
+// Mem is an in-memory filesystem, which simulates crashes.
+//
+// Data written to a file survives crash, only after the file is
+// synced. Files created, removed or renamed survive crash, only after
+// their directory is synced. Changes to directory since last sync
+// may partially survive crash, but always in the order they are made.
+// Directories survive crash, once they are created.
+type Mem struct {
+	mu     sync.Mutex
+	rand   *rand.Rand
+	faults Faults
+	gen    int // incremented on crash, to invalidate open files
+	dirs   map[string]*memDir
+	locked map[string]bool
+}
+
+type memDir struct {
+	entries map[string]*inode
+	durable map[string]*inode
+	journal [][]dirChange // changes since last sync
+}
+
+// dirChange sets entry name to ino. nil ino means removal.
+type dirChange struct {
+	name string
+	ino  *inode
+}
+
+type inode struct {
+	data    []byte
+	durable []byte
+	perm    os.FileMode
+}
+
+// NewMem creates an empty filesystem, whose random decisions
+// during crash are derived from seed.
+func NewMem(seed int64) *Mem {
+	return &Mem{
+		rand:   rand.New(rand.NewSource(seed)),
+		dirs:   make(map[string]*memDir),
+		locked: make(map[string]bool),
+	}
+}
+
+var _ FS = (*Mem)(nil)
+
+// SetFaults sets the faults to be injected from now on.
+func (m *Mem) SetFaults(f Faults) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.faults = f
+}
+
+// Crash simulates a crash, followed by reboot. The changes that are
+// not synced are lost, subject to faults. Files opened before crash
+// can no longer be used, and all locks are released.
+func (m *Mem) Crash() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gen++
+	m.locked = make(map[string]bool)
+	for _, name := range sortedKeys(m.dirs) {
+		d := m.dirs[name]
+		n := m.rand.Intn(len(d.journal) + 1)
+		for _, changes := range d.journal[:n] {
+			for _, c := range changes {
+				setEntry(d.durable, c)
+			}
+		}
+		d.journal = nil
+		d.entries = copyEntries(d.durable)
+	}
+	recovered := make(map[*inode]bool)
+	for _, name := range sortedKeys(m.dirs) {
+		entries := m.dirs[name].entries
+		for _, base := range sortedNames(entries) {
+			if ino := entries[base]; !recovered[ino] {
+				m.recover(ino)
+				recovered[ino] = true
+			}
+		}
+	}
+}
+
+// recover replaces the data of inode with what survives crash.
+func (m *Mem) recover(ino *inode) {
+	data := append([]byte(nil), ino.durable...)
+	if m.faults.TornWrites {
+		if len(ino.data) != len(data) && m.rand.Intn(2) == 0 {
+			resized := make([]byte, len(ino.data))
+			copy(resized, data)
+			data = resized
+		}
+		for off := 0; off < len(data) && off < len(ino.data); off += sectorSize {
+			end := off + sectorSize
+			if end > len(data) {
+				end = len(data)
+			}
+			if end > len(ino.data) {
+				end = len(ino.data)
+			}
+			if !bytes.Equal(data[off:end], ino.data[off:end]) && m.rand.Intn(2) == 0 {
+				copy(data[off:end], ino.data[off:end])
+			}
+		}
+	}
+	ino.data, ino.durable = data, append([]byte(nil), data...)
+}
+
+// Usage returns the total size of files, which is
+// compared against Faults.Capacity.
+func (m *Mem) Usage() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.usage()
+}
+
+// must be called with m.mu held.
+func (m *Mem) usage() int64 {
+	var n int64
+	seen := make(map[*inode]bool)
+	for _, d := range m.dirs {
+		for _, ino := range d.entries {
+			if !seen[ino] {
+				n += int64(len(ino.data))
+				seen[ino] = true
+			}
+		}
+	}
+	return n
+}
+
+// grow checks whether ino can be grown to size, without
+// exceeding capacity. must be called with m.mu held.
+func (m *Mem) grow(ino *inode, size int64) bool {
+	if m.faults.Capacity == 0 || size <= int64(len(ino.data)) {
+		return true
+	}
+	return m.usage()+size-int64(len(ino.data)) <= m.faults.Capacity
+}
+
+// lookup returns the parent directory of name.
+// must be called with m.mu held.
+func (m *Mem) lookup(op, name string) (*memDir, string, error) {
+	name = filepath.Clean(name)
+	d := m.dirs[filepath.Dir(name)]
+	if d == nil {
+		return nil, "", &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	return d, filepath.Base(name), nil
+}
+
+// change applies the changes to directory, which are journaled
+// as single unit for crash. must be called with m.mu held.
+func (d *memDir) change(changes ...dirChange) {
+	for _, c := range changes {
+		setEntry(d.entries, c)
+	}
+	d.journal = append(d.journal, changes)
+}
+
+// OpenFile is same as os.OpenFile.
+func (m *Mem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.dirs[filepath.Clean(name)]; ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	}
+	d, base, err := m.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	ino := d.entries[base]
+	switch {
+	case ino == nil && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	case ino == nil:
+		ino = &inode{perm: perm}
+		d.change(dirChange{base, ino})
+	case flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case flag&os.O_TRUNC != 0:
+		ino.data = nil
+	}
+	return &memFile{m: m, ino: ino, name: name, flag: flag, gen: m.gen}, nil
+}
+
+// Map opens the named file and maps its contents into memory.
+func (m *Mem) Map(name string, flag int, perm os.FileMode) (MappedFile, error) {
+	f, err := m.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	mf := f.(*memFile)
+	return &memMapped{mf, mf.ino.data}, nil
+}
+
+// Stat is same as os.Stat.
+func (m *Mem) Stat(name string) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.dirs[filepath.Clean(name)]; ok {
+		return fileInfo{name: filepath.Base(name), mode: os.ModeDir | 0700}, nil
+	}
+	d, base, err := m.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	ino := d.entries[base]
+	if ino == nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return fileInfo{name: base, size: int64(len(ino.data)), mode: ino.perm}, nil
+}
+
+// Rename is same as os.Rename, but only files can be renamed.
+func (m *Mem) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	od, ob, err := m.lookup("rename", oldpath)
+	if err != nil {
+		return err
+	}
+	nd, nb, err := m.lookup("rename", newpath)
+	if err != nil {
+		return err
+	}
+	ino := od.entries[ob]
+	if ino == nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	if od == nd && ob == nb {
+		return nil
+	}
+	if od == nd && !m.faults.NonAtomicRename {
+		od.change(dirChange{nb, ino}, dirChange{ob, nil})
+	} else {
+		nd.change(dirChange{nb, ino})
+		od.change(dirChange{ob, nil})
+	}
+	return nil
+}
+
+// Remove is same as os.Remove.
+func (m *Mem) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	if d, ok := m.dirs[name]; ok {
+		if len(d.entries) > 0 {
+			return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+		}
+		for dir := range m.dirs {
+			if dir != name && filepath.Dir(dir) == name {
+				return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+			}
+		}
+		delete(m.dirs, name)
+		return nil
+	}
+	d, base, err := m.lookup("remove", name)
+	if err != nil {
+		return err
+	}
+	if d.entries[base] == nil {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	d.change(dirChange{base, nil})
+	return nil
+}
+
+// MkdirAll is same as os.MkdirAll.
+func (m *Mem) MkdirAll(path string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for p := filepath.Clean(path); ; p = filepath.Dir(p) {
+		if _, ok := m.dirs[p]; !ok {
+			m.dirs[p] = &memDir{
+				entries: make(map[string]*inode),
+				durable: make(map[string]*inode),
+			}
+		}
+		if filepath.Dir(p) == p {
+			return nil
+		}
+	}
+}
+
+// Glob is same as filepath.Glob, but pattern is
+// allowed to have meta characters only in last element.
+func (m *Mem) Glob(pattern string) ([]string, error) {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dir := filepath.Dir(pattern)
+	var names []string
+	if d, ok := m.dirs[dir]; ok {
+		names = sortedNames(d.entries)
+	}
+	for p := range m.dirs {
+		if p != dir && filepath.Dir(p) == dir {
+			names = append(names, filepath.Base(p))
+		}
+	}
+	sort.Strings(names)
+	var matches []string
+	for _, name := range names {
+		if ok, _ := filepath.Match(filepath.Base(pattern), name); ok {
+			matches = append(matches, filepath.Join(dir, name))
+		}
+	}
+	return matches, nil
+}
+
+// SyncDir commits the entries of directory to stable storage.
+func (m *Mem) SyncDir(dir string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.faults.SyncErr != nil {
+		return &os.PathError{Op: "sync", Path: dir, Err: m.faults.SyncErr}
+	}
+	d, ok := m.dirs[filepath.Clean(dir)]
+	if !ok {
+		return &os.PathError{Op: "sync", Path: dir, Err: os.ErrNotExist}
+	}
+	d.durable, d.journal = copyEntries(d.entries), nil
+	return nil
+}
+
+// Lock prevents the directory from being used by others. Locks
+// are not persisted, and they are released on crash.
+func (m *Mem) Lock(dir string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dir = filepath.Clean(dir)
+	if _, ok := m.dirs[dir]; !ok {
+		return &os.PathError{Op: "lock", Path: dir, Err: os.ErrNotExist}
+	}
+	if m.locked[dir] {
+		return ErrLocked
+	}
+	m.locked[dir] = true
+	return nil
+}
+
+// Unlock releases the lock acquired by Lock.
+func (m *Mem) Unlock(dir string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.locked, filepath.Clean(dir))
+	return nil
+}
+
+// Free returns the space left before reaching Faults.Capacity.
+// If capacity is unlimited, it returns math.MaxInt64.
+func (m *Mem) Free(dir string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.dirs[filepath.Clean(dir)]; !ok {
+		return 0, &os.PathError{Op: "statfs", Path: dir, Err: os.ErrNotExist}
+	}
+	if m.faults.Capacity == 0 {
+		return math.MaxInt64, nil
+	}
+	if free := m.faults.Capacity - m.usage(); free > 0 {
+		return free, nil
+	}
+	return 0, nil
+}
+
+// memFile -----------------------------------------------------
+
+type memFile struct {
+	m      *Mem
+	ino    *inode
+	name   string
+	flag   int
+	gen    int
+	off    int64
+	closed bool
+}
+
+// check returns error, if the file is closed or crashed.
+// must be called with m.mu held.
+func (f *memFile) check(op string) error {
+	if f.closed || f.gen != f.m.gen {
+		return &os.PathError{Op: op, Path: f.name, Err: os.ErrClosed}
+	}
+	return nil
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Read(b []byte) (int, error) {
+	n, err := f.ReadAt(b, f.off)
+	f.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *memFile) ReadAt(b []byte, off int64) (int, error) {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+	if err := f.check("read"); err != nil {
+		return 0, err
+	}
+	if off >= int64(len(f.ino.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, f.ino.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(b []byte) (int, error) {
+	if f.flag&os.O_APPEND != 0 {
+		f.m.mu.Lock()
+		f.off = int64(len(f.ino.data))
+		f.m.mu.Unlock()
+	}
+	n, err := f.WriteAt(b, f.off)
+	f.off += int64(n)
+	return n, err
+}
+
+func (f *memFile) WriteAt(b []byte, off int64) (int, error) {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+	if err := f.check("write"); err != nil {
+		return 0, err
+	}
+	end := off + int64(len(b))
+	if !f.m.grow(f.ino, end) {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: syscall.ENOSPC}
+	}
+	if end > int64(len(f.ino.data)) {
+		data := make([]byte, end)
+		copy(data, f.ino.data)
+		f.ino.data = data
+	}
+	return copy(f.ino.data[off:], b), nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+	if err := f.check("truncate"); err != nil {
+		return err
+	}
+	if !f.m.grow(f.ino, size) {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: syscall.ENOSPC}
+	}
+	data := make([]byte, size)
+	copy(data, f.ino.data)
+	f.ino.data = data
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+	if err := f.check("stat"); err != nil {
+		return nil, err
+	}
+	return fileInfo{name: filepath.Base(f.name), size: int64(len(f.ino.data)), mode: f.ino.perm}, nil
+}
+
+func (f *memFile) Sync() error {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+	if err := f.check("sync"); err != nil {
+		return err
+	}
+	if f.m.faults.SyncErr != nil {
+		return &os.PathError{Op: "sync", Path: f.name, Err: f.m.faults.SyncErr}
+	}
+	f.ino.durable = append(f.ino.durable[:0], f.ino.data...)
+	return nil
+}
+
+func (f *memFile) Close() error {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+	if err := f.check("close"); err != nil {
+		return err
+	}
+	f.closed = true
+	return nil
+}
+
+// memMapped -----------------------------------------------------
+
+type memMapped struct {
+	*memFile
+	data []byte
+}
+
+func (f *memMapped) Data() []byte {
+	return f.data
+}
+
+// Close unmaps the file. Unlike memFile, it never fails,
+// so that crashed segments can be closed.
+func (f *memMapped) Close() error {
+	_ = f.memFile.Close()
+	return nil
+}
+
+// fileInfo -----------------------------------------------------
+
+type fileInfo struct {
+	name string
+	size int64
+	mode os.FileMode
+}
+
+func (fi fileInfo) Name() string       { return fi.name }
+func (fi fileInfo) Size() int64        { return fi.size }
+func (fi fileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi fileInfo) ModTime() time.Time { return time.Time{} }
+func (fi fileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi fileInfo) Sys() interface{}   { return nil }
+
+// helpers -----------------------------------------------------
+
+func setEntry(entries map[string]*inode, c dirChange) {
+	if c.ino == nil {
+		delete(entries, c.name)
+	} else {
+		entries[c.name] = c.ino
+	}
+}
+
+func copyEntries(entries map[string]*inode) map[string]*inode {
+	m := make(map[string]*inode, len(entries))
+	for name, ino := range entries {
+		m[name] = ino
+	}
+	return m
+}
+
+func sortedNames(entries map[string]*inode) []string {
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedKeys(dirs map[string]*memDir) []string {
+	keys := make([]string, 0, len(dirs))
+	for k := range dirs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,303 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestMem_crash(t *testing.T) {
+	m := NewMem(1)
+	mkdir(t, m, "/d")
+	writeFile(t, m, "/d/synced", "hello", true)
+	if err := m.SyncDir("/d"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := m.OpenFile("/d/synced", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Write([]byte(" world")); err != nil {
+		t.Fatal(err)
+	}
+
+	m.Crash()
+	if got := readFile(t, m, "/d/synced"); got != "hello" {
+		t.Fatalf("synced=%q, want %q", got, "hello")
+	}
+	if _, err := f.Write([]byte("!")); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("write after crash: got %v, want %v", err, os.ErrClosed)
+	}
+	if err := m.Lock("/d"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Lock("/d"); err != ErrLocked {
+		t.Fatalf("got %v, want %v", err, ErrLocked)
+	}
+	m.Crash()
+	if err := m.Lock("/d"); err != nil {
+		t.Fatalf("lock after crash: %v", err)
+	}
+}
+
+func TestMem_syncDir(t *testing.T) {
+	// new file might not survive crash, unless dir is synced
+	lost, kept := false, false
+	for seed := int64(1); seed <= 20; seed++ {
+		m := NewMem(seed)
+		mkdir(t, m, "/d")
+		writeFile(t, m, "/d/f1", "f1", true)
+		if err := m.SyncDir("/d"); err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, m, "/d/f2", "f2", true)
+		m.Crash()
+		if got := readFile(t, m, "/d/f1"); got != "f1" {
+			t.Fatalf("seed %d: f1=%q", seed, got)
+		}
+		if _, err := m.Stat("/d/f2"); err == nil {
+			kept = true
+		} else if os.IsNotExist(err) {
+			lost = true
+		} else {
+			t.Fatal(err)
+		}
+	}
+	if !lost || !kept {
+		t.Fatalf("lost=%v kept=%v, want both", lost, kept)
+	}
+}
+
+func TestMem_syncErr(t *testing.T) {
+	m := NewMem(1)
+	mkdir(t, m, "/d")
+	writeFile(t, m, "/d/f", "v1", true)
+	if err := m.SyncDir("/d"); err != nil {
+		t.Fatal(err)
+	}
+	m.SetFaults(Faults{SyncErr: syscall.EIO})
+	f, err := m.OpenFile("/d/f", os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Write([]byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Sync(); !errors.Is(err, syscall.EIO) {
+		t.Fatalf("sync: got %v, want %v", err, syscall.EIO)
+	}
+	if err = m.SyncDir("/d"); !errors.Is(err, syscall.EIO) {
+		t.Fatalf("syncDir: got %v, want %v", err, syscall.EIO)
+	}
+	m.Crash()
+	if got := readFile(t, m, "/d/f"); got != "v1" {
+		t.Fatalf("got %q, want %q", got, "v1")
+	}
+}
+
+func TestMem_capacity(t *testing.T) {
+	m := NewMem(1)
+	mkdir(t, m, "/d")
+	m.SetFaults(Faults{Capacity: 10})
+	writeFile(t, m, "/d/f1", "12345", false)
+	if free, err := m.Free("/d"); err != nil || free != 5 {
+		t.Fatalf("free: got %d %v, want 5", free, err)
+	}
+	f, err := m.OpenFile("/d/f2", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Write([]byte("123456")); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("write: got %v, want %v", err, syscall.ENOSPC)
+	}
+	if err = f.Truncate(6); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("truncate: got %v, want %v", err, syscall.ENOSPC)
+	}
+	if _, err = f.Write([]byte("12345")); err != nil {
+		t.Fatal(err)
+	}
+
+	if free, err := m.Free("/d"); err != nil || free != 0 {
+		t.Fatalf("free: got %d %v, want 0", free, err)
+	}
+
+	// removing file frees space
+	if err = m.Remove("/d/f1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Write([]byte("12345")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMem_tornWrites(t *testing.T) {
+	old := bytes.Repeat([]byte{'o'}, 4*sectorSize)
+	new := bytes.Repeat([]byte{'n'}, 4*sectorSize)
+	torn := false
+	for seed := int64(1); seed <= 20; seed++ {
+		m := NewMem(seed)
+		mkdir(t, m, "/d")
+		writeFile(t, m, "/d/f", string(old), true)
+		if err := m.SyncDir("/d"); err != nil {
+			t.Fatal(err)
+		}
+		m.SetFaults(Faults{TornWrites: true})
+		f, err := m.OpenFile("/d/f", os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = f.Write(new); err != nil {
+			t.Fatal(err)
+		}
+		m.Crash()
+		got := []byte(readFile(t, m, "/d/f"))
+		if len(got) != len(old) {
+			t.Fatalf("seed %d: len=%d, want %d", seed, len(got), len(old))
+		}
+		for off := 0; off < len(got); off += sectorSize {
+			sector := got[off : off+sectorSize]
+			if !bytes.Equal(sector, old[:sectorSize]) && !bytes.Equal(sector, new[:sectorSize]) {
+				t.Fatalf("seed %d: sector at %d is neither old nor new", seed, off)
+			}
+		}
+		if !bytes.Equal(got, old) && !bytes.Equal(got, new) {
+			torn = true
+		}
+	}
+	if !torn {
+		t.Fatal("no torn write seen")
+	}
+}
+
+func TestMem_rename(t *testing.T) {
+	test := func(faults Faults) (seen map[string]bool) {
+		seen = make(map[string]bool)
+		for seed := int64(1); seed <= 20; seed++ {
+			m := NewMem(seed)
+			mkdir(t, m, "/d")
+			writeFile(t, m, "/d/old", "v", true)
+			if err := m.SyncDir("/d"); err != nil {
+				t.Fatal(err)
+			}
+			m.SetFaults(faults)
+			if err := m.Rename("/d/old", "/d/new"); err != nil {
+				t.Fatal(err)
+			}
+			if matches, _ := m.Glob("/d/*"); !reflect.DeepEqual(matches, []string{"/d/new"}) {
+				t.Fatalf("before crash: got %v", matches)
+			}
+			m.Crash()
+			matches, err := m.Glob("/d/*")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range matches {
+				if got := readFile(t, m, name); got != "v" {
+					t.Fatalf("seed %d: %s=%q", seed, name, got)
+				}
+			}
+			seen[fmt.Sprint(matches)] = true
+		}
+		return seen
+	}
+
+	want := map[string]bool{"[/d/old]": true, "[/d/new]": true}
+	if got := test(Faults{}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("atomic: got %v, want %v", got, want)
+	}
+	want["[/d/new /d/old]"] = true
+	if got := test(Faults{NonAtomicRename: true}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("nonAtomic: got %v, want %v", got, want)
+	}
+}
+
+func TestMem_map(t *testing.T) {
+	m := NewMem(1)
+	mkdir(t, m, "/d")
+	f, err := m.OpenFile("/d/f", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Truncate(5); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	mf, err := m.Map("/d/f", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(mf.Data(), "hello")
+	if got := readFile(t, m, "/d/f"); got != "hello" {
+		t.Fatalf("got %q, want %q", got, "hello")
+	}
+	m.Crash()
+	if err = mf.Sync(); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("sync after crash: got %v, want %v", err, os.ErrClosed)
+	}
+	if err = mf.Close(); err != nil {
+		t.Fatalf("close after crash: %v", err)
+	}
+}
+
+// helpers -----------------------------------------------------
+
+func mkdir(t *testing.T, fs FS, dir string) {
+	t.Helper()
+	if err := fs.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeFile(t *testing.T, fs FS, name, data string, sync bool) {
+	t.Helper()
+	f, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if sync {
+		if err = f.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, fs FS, name string) string {
+	t.Helper()
+	f, err := fs.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
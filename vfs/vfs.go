@@ -0,0 +1,190 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package vfs abstracts the filesystem used by raft storage.
+//
+// OS is the filesystem of operating system. Mem is an in-memory
+// filesystem, which can simulate crashes and inject faults such as
+// fsync failure, disk full, torn writes and non-atomic renames.
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/santhosh-tekuri/raft/mmap"
+)
+
+// ErrLocked is returned by FS.Lock, if the directory is already locked.
+var ErrLocked = errors.New("vfs: directory is locked")
+
+// FS is the interface to filesystem.
+type FS interface {
+	// OpenFile is same as os.OpenFile.
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+
+	// Map opens the named file and maps its contents into memory.
+	// flag must be os.O_RDONLY or os.O_RDWR. The mapping does not
+	// change, if the file is resized.
+	Map(name string, flag int, perm os.FileMode) (MappedFile, error)
+
+	Stat(name string) (os.FileInfo, error)
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+	MkdirAll(path string, perm os.FileMode) error
+	Glob(pattern string) ([]string, error)
+
+	// SyncDir commits the entries of directory to stable storage,
+	// so that files created, removed or renamed survive crash.
+	SyncDir(dir string) error
+
+	// Lock prevents the directory from being used by others,
+	// until Unlock is called. It returns ErrLocked, if the
+	// directory is already locked.
+	Lock(dir string) error
+	Unlock(dir string) error
+
+	// Free returns the number of bytes available to unprivileged
+	// user, in the filesystem containing dir.
+	Free(dir string) (int64, error)
+}
+
+// File is an open file.
+type File interface {
+	io.Reader
+	io.Writer
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// MappedFile is a file mapped into memory.
+type MappedFile interface {
+	Name() string
+
+	// Data returns the mapped contents. Changes made
+	// to it are written to file.
+	Data() []byte
+
+	// Sync commits the changes made to Data to stable storage.
+	Sync() error
+
+	// Close unmaps the file. Data must not be used after Close.
+	Close() error
+}
+
+// OS is the filesystem of operating system.
+var OS FS = osFS{}
+
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err // avoid non-nil interface holding nil *os.File
+	}
+	return f, nil
+}
+
+func (osFS) Map(name string, flag int, perm os.FileMode) (MappedFile, error) {
+	f, err := mmap.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return mappedFile{f}, nil
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error)        { return os.Stat(name) }
+func (osFS) Rename(oldpath, newpath string) error         { return os.Rename(oldpath, newpath) }
+func (osFS) Remove(name string) error                     { return os.Remove(name) }
+func (osFS) MkdirAll(path string, perm os.FileMode) error { return os.MkdirAll(path, perm) }
+func (osFS) Glob(pattern string) ([]string, error)        { return filepath.Glob(pattern) }
+func (osFS) Free(dir string) (int64, error)               { return free(dir) }
+
+func (osFS) SyncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	e := d.Close()
+	if err != nil {
+		return err
+	}
+	return e
+}
+
+// Lock creates "lock" file in dir, using hard link of temporary
+// file, which works even on nfs.
+func (osFS) Lock(dir string) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	tempFile, err := ioutil.TempFile(dir, "lock*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tempFile.Close()
+		_ = os.Remove(tempFile.Name())
+	}()
+	if _, err := io.WriteString(tempFile, fmt.Sprintf("%d\n", os.Getpid())); err != nil {
+		return err
+	}
+	lockFile := filepath.Join(dir, "lock")
+	if err := os.Link(tempFile.Name(), lockFile); err != nil {
+		if os.IsExist(err) {
+			return ErrLocked
+		}
+		return err
+	}
+	tempInfo, err := os.Lstat(tempFile.Name())
+	if err != nil {
+		return err
+	}
+	lockInfo, err := os.Lstat(lockFile)
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(tempInfo, lockInfo) {
+		return ErrLocked
+	}
+	return nil
+}
+
+func (osFS) Unlock(dir string) error {
+	return os.RemoveAll(filepath.Join(dir, "lock"))
+}
+
+type mappedFile struct {
+	f *mmap.File
+}
+
+func (m mappedFile) Name() string { return m.f.Name() }
+func (m mappedFile) Data() []byte { return m.f.Data }
+func (m mappedFile) Sync() error  { return m.f.Sync() }
+func (m mappedFile) Close() error { return m.f.Close() }